@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	flagAccessLog          = flag.String("access-log", "", "append a line per request to this file, in Common Log Format")
+	flagAccessLogIP        = flag.String("access-log-ip", "full", "how client IPs are logged: full, truncate (drop the host part, /24 for IPv4 and /48 for IPv6) or hash (keyed per process run)")
+	flagAccessLogSample    = flag.Int("access-log-sample", 1, "log only 1 in this many successful reads (GET, HEAD, PROPFIND, OPTIONS); errors and writes are always logged")
+	flagAccessLogRetention = flag.Duration("access-log-retention", 0, "after this long, drop usernames from access log lines and truncate their IPs (0 to keep them)")
+)
+
+const clfTime = "02/Jan/2006:15:04:05 -0700"
+
+// accessLogger writes the access log and scrubs its old lines.
+type accessLogger struct {
+	path      string
+	ipMode    string
+	hashKey   []byte
+	retention time.Duration
+	sample    int
+
+	mu    sync.Mutex
+	f     *os.File
+	reads int // successful reads seen, for sampling
+}
+
+var accessLog *accessLogger
+
+func startAccessLog() error {
+	switch *flagAccessLogIP {
+	case "full", "truncate", "hash":
+	default:
+		return fmt.Errorf("unknown -access-log-ip %q", *flagAccessLogIP)
+	}
+	if *flagAccessLogSample < 1 {
+		return fmt.Errorf("-access-log-sample must be at least 1")
+	}
+	l := &accessLogger{path: *flagAccessLog, ipMode: *flagAccessLogIP, retention: *flagAccessLogRetention, sample: *flagAccessLogSample}
+	if l.ipMode == "hash" {
+		// A key that never leaves the process keeps the hashes from being
+		// reversed by hashing every possible address.
+		l.hashKey = make([]byte, 32)
+		rand.Read(l.hashKey)
+	}
+	if err := l.open(); err != nil {
+		return err
+	}
+	accessLog = l
+	onShutdown(l.close)
+	if l.sample > 1 {
+		log.Printf("Access log: logging 1 in %d successful reads", l.sample)
+	}
+	if l.retention > 0 {
+		go func() {
+			for {
+				if err := l.scrub(time.Now().Add(-l.retention)); err != nil {
+					log.Printf("Failed to scrub access log: %v", err)
+				}
+				time.Sleep(time.Hour)
+			}
+		}()
+	}
+	return nil
+}
+
+func (l *accessLogger) open() error {
+	f, err := os.OpenFile(l.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	l.f = f
+	return nil
+}
+
+func (l *accessLogger) close() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.f.Close()
+}
+
+// wrap logs each request served by h.
+func (l *accessLogger) wrap(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		lw := &statusWriter{ResponseWriter: w}
+		start := time.Now()
+		defer func() {
+			if lw.status == 0 {
+				lw.status = http.StatusOK
+			}
+			if l.sampled(req.Method, lw.status) {
+				l.write(req, start, lw.status, lw.size)
+			}
+		}()
+		h.ServeHTTP(lw, req)
+	})
+}
+
+// sampled reports whether a request is logged. Every error and every
+// write is; of the successful reads, one in l.sample.
+func (l *accessLogger) sampled(method string, status int) bool {
+	if l.sample <= 1 || status >= 400 {
+		return true
+	}
+	switch method {
+	case "GET", "HEAD", "PROPFIND", "OPTIONS":
+	default:
+		return true
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.reads++
+	return l.reads%l.sample == 1
+}
+
+func (l *accessLogger) write(req *http.Request, t time.Time, status int, size int64) {
+	host := clientIP(req)
+	user := "-"
+	if name, _, ok := req.BasicAuth(); ok && name != "" {
+		user = url.PathEscape(name)
+	}
+	line := fmt.Sprintf("%s - %s [%s] %q %d %d\n", l.anonymize(host), user, t.Format(clfTime),
+		req.Method+" "+req.RequestURI+" "+req.Proto, status, size)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, err := l.f.WriteString(line); err != nil {
+		log.Printf("Failed to write access log: %v", err)
+	}
+}
+
+func (l *accessLogger) anonymize(host string) string {
+	switch l.ipMode {
+	case "truncate":
+		return truncateIP(host)
+	case "hash":
+		m := hmac.New(sha256.New, l.hashKey)
+		m.Write([]byte(host))
+		return hex.EncodeToString(m.Sum(nil)[:8])
+	}
+	return host
+}
+
+// truncateIP zeroes the host part of an address, keeping its /24 for IPv4
+// and /48 for IPv6. Anything that is not an address is returned as is.
+func truncateIP(host string) string {
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return host
+	}
+	if v4 := ip.To4(); v4 != nil {
+		return v4.Mask(net.CIDRMask(24, 32)).String()
+	}
+	return ip.Mask(net.CIDRMask(48, 128)).String()
+}
+
+// scrub rewrites the lines logged before cutoff without their usernames and
+// with truncated IPs. Newer lines keep every detail.
+func (l *accessLogger) scrub(cutoff time.Time) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	in, err := os.Open(l.path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	var out strings.Builder
+	changed := false
+	sc := bufio.NewScanner(in)
+	sc.Buffer(nil, 1<<20)
+	for sc.Scan() {
+		line := sc.Text()
+		if s, ok := scrubLine(line, cutoff); ok && s != line {
+			line, changed = s, true
+		}
+		out.WriteString(line + "\n")
+	}
+	if err := sc.Err(); err != nil || !changed {
+		return err
+	}
+	tmp := l.path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(out.String()), 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, l.path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	// Keep appending to the new file, not the replaced one.
+	l.f.Close()
+	return l.open()
+}
+
+// scrubLine anonymizes one Common Log Format line if it was logged before
+// cutoff. It reports false for lines it cannot parse.
+func scrubLine(line string, cutoff time.Time) (string, bool) {
+	fields := strings.SplitN(line, " ", 4)
+	if len(fields) < 4 || !strings.HasPrefix(fields[3], "[") {
+		return line, false
+	}
+	end := strings.IndexByte(fields[3], ']')
+	if end < 0 {
+		return line, false
+	}
+	t, err := time.Parse(clfTime, fields[3][1:end])
+	if err != nil {
+		return line, false
+	}
+	if !t.Before(cutoff) {
+		return line, true
+	}
+	return truncateIP(fields[0]) + " - - " + fields[3], true
+}
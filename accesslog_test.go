@@ -0,0 +1,129 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTruncateIP(t *testing.T) {
+	tests := map[string]string{
+		"192.0.2.77":           "192.0.2.0",
+		"2001:db8:1:2:3:4:5:6": "2001:db8:1::",
+		"192.0.2.0":            "192.0.2.0",
+		"3f2a9c01d4e5b6a7":     "3f2a9c01d4e5b6a7",
+	}
+	for in, want := range tests {
+		if got := truncateIP(in); got != want {
+			t.Errorf("truncateIP(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestAccessLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	for _, mode := range []string{"full", "truncate", "hash"} {
+		os.Remove(path)
+		l := &accessLogger{path: path, ipMode: mode, hashKey: []byte("key")}
+		if err := l.open(); err != nil {
+			t.Fatal(err)
+		}
+		h := l.wrap(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			w.WriteHeader(http.StatusCreated)
+			w.Write([]byte("done"))
+		}))
+		req := httptest.NewRequest("PUT", "/a%20b.txt", nil)
+		req.RemoteAddr = "192.0.2.77:4711"
+		req.SetBasicAuth("alice", "secret")
+		h.ServeHTTP(httptest.NewRecorder(), req)
+		l.close()
+
+		data, _ := os.ReadFile(path)
+		line := string(data)
+		if !strings.Contains(line, ` - alice [`) || !strings.HasSuffix(line, `] "PUT /a%20b.txt HTTP/1.1" 201 4`+"\n") {
+			t.Errorf("%s: unexpected line %q", mode, line)
+		}
+		switch host := strings.Fields(line)[0]; mode {
+		case "full":
+			if host != "192.0.2.77" {
+				t.Errorf("full: host %q", host)
+			}
+		case "truncate":
+			if host != "192.0.2.0" {
+				t.Errorf("truncate: host %q", host)
+			}
+		case "hash":
+			if strings.Contains(host, "192.0.2") || len(host) != 16 {
+				t.Errorf("hash: host %q", host)
+			}
+		}
+	}
+}
+
+func TestAccessLogScrub(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	now := time.Now()
+	old := now.Add(-48 * time.Hour).Format(clfTime)
+	recent := now.Add(-time.Hour).Format(clfTime)
+	os.WriteFile(path, []byte(
+		"192.0.2.77 - alice ["+old+`] "GET / HTTP/1.1" 200 12`+"\n"+
+			"192.0.2.78 - bob ["+recent+`] "GET / HTTP/1.1" 200 12`+"\n"+
+			"not a log line\n"), 0600)
+	l := &accessLogger{path: path, ipMode: "full"}
+	if err := l.open(); err != nil {
+		t.Fatal(err)
+	}
+	defer l.close()
+	if err := l.scrub(now.Add(-24 * time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	want := "192.0.2.0 - - [" + old + `] "GET / HTTP/1.1" 200 12` + "\n" +
+		"192.0.2.78 - bob [" + recent + `] "GET / HTTP/1.1" 200 12` + "\n" +
+		"not a log line\n"
+	if data, _ := os.ReadFile(path); string(data) != want {
+		t.Errorf("scrubbed log:\n%s\nwant:\n%s", data, want)
+	}
+
+	// Lines keep going to the rewritten file.
+	l.write(httptest.NewRequest("GET", "/x", nil), now, 200, 0)
+	if data, _ := os.ReadFile(path); !strings.Contains(string(data), `"GET /x HTTP/1.1"`) {
+		t.Errorf("line written after scrubbing is missing:\n%s", data)
+	}
+}
+
+func TestAccessLogSampling(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	l := &accessLogger{path: path, ipMode: "full", sample: 10}
+	if err := l.open(); err != nil {
+		t.Fatal(err)
+	}
+	h := l.wrap(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/missing" {
+			http.NotFound(w, req)
+		}
+	}))
+	for i := 0; i < 25; i++ {
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/file", nil))
+	}
+	for i := 0; i < 3; i++ {
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/missing", nil))
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("PUT", "/file", nil))
+	}
+	l.close()
+
+	data, _ := os.ReadFile(path)
+	text := string(data)
+	if n := strings.Count(text, `"GET /file `); n != 3 {
+		t.Errorf("%d of 25 reads logged, want 3", n)
+	}
+	if n := strings.Count(text, `"GET /missing `); n != 3 {
+		t.Errorf("%d of 3 errors logged", n)
+	}
+	if n := strings.Count(text, `"PUT /file `); n != 3 {
+		t.Errorf("%d of 3 writes logged", n)
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"net"
+	"net/http"
+	"strings"
+)
+
+var (
+	flagAdminPath     = flag.String("admin-path", "", "serve the admin API below this path, e.g. /.admin/ (disabled when empty); needs -user and -password, or -admin-trust-loopback")
+	flagAdminLoopback = flag.Bool("admin-trust-loopback", false, "without -user and -password, let clients on the loopback interface use the admin API; unsafe behind a reverse proxy on the same host, which makes every client look local")
+)
+
+var adminMux = http.NewServeMux()
+
+// handleAdmin registers an admin API endpoint, relative to -admin-path.
+func handleAdmin(pattern string, handler http.HandlerFunc) {
+	adminMux.HandleFunc("/"+strings.TrimPrefix(pattern, "/"), handler)
+}
+
+// adminAuthorized requires the configured credentials or, when the server
+// runs without authentication and -admin-trust-loopback is set, a loopback
+// client.
+func adminAuthorized(req *http.Request) bool {
+	if *flagUserName != "" && *flagPassword != "" {
+		return authorized(req)
+	}
+	if !*flagAdminLoopback {
+		return false
+	}
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+func serveAdmin(w http.ResponseWriter, req *http.Request) {
+	if !adminAuthorized(req) {
+		if *flagUserName != "" && *flagPassword != "" {
+			w.Header().Set("WWW-Authenticate", `Basic realm="Restricted"`)
+		}
+		http.Error(w, "WebDAV: need authorized!", http.StatusUnauthorized)
+		return
+	}
+	http.StripPrefix(strings.TrimSuffix(*flagAdminPath, "/"), adminMux).ServeHTTP(w, req)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
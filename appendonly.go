@@ -0,0 +1,157 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"time"
+
+	"golang.org/x/net/context"
+	"golang.org/x/net/webdav"
+)
+
+var (
+	flagAppendOnlyPaths = flag.String("append-only-paths", "", "comma-separated backup folders where files and folders may be added, files overwritten only within -append-only-grace of their last write, and nothing deleted except through the admin API's purge endpoint")
+	flagAppendOnlyGrace = flag.Duration("append-only-grace", time.Hour, "how long after its last write a file in -append-only-paths may still be overwritten or renamed, so interrupted uploads can be retried")
+)
+
+// appendOnlyPaths lists the append-only backup folders. They keep backups
+// safe from ransomware on the client, which can add files but not destroy
+// what is there.
+var appendOnlyPaths []string
+
+func startAppendOnly() {
+	appendOnlyPaths = parseFolders(*flagAppendOnlyPaths)
+}
+
+// appendReplace refuses writing over name unless it is a file in an
+// append-only folder last written within the grace window. Empty files, as
+// created by clients locking a new name, can always be replaced.
+func appendReplace(ctx context.Context, fs webdav.FileSystem, name string) error {
+	name = path.Clean("/" + name)
+	if !inFolders(name, appendOnlyPaths) && !holdsFolders(name, appendOnlyPaths) {
+		return nil
+	}
+	fi, err := fs.Stat(ctx, name)
+	if err != nil || !fi.IsDir() && (fi.Size() == 0 || time.Since(fi.ModTime()) < *flagAppendOnlyGrace) {
+		return nil
+	}
+	return permissionError("write", name)
+}
+
+// appendRemove refuses removing name from an append-only folder.
+func appendRemove(name string) error {
+	name = path.Clean("/" + name)
+	if inFolders(name, appendOnlyPaths) || holdsFolders(name, appendOnlyPaths) {
+		return permissionError("remove", name)
+	}
+	return nil
+}
+
+// appendRename refuses renaming name unless, like an upload put in place
+// under its final name, it is a file that may still be overwritten.
+func appendRename(ctx context.Context, fs webdav.FileSystem, name string) error {
+	name = path.Clean("/" + name)
+	if holdsFolders(name, appendOnlyPaths) {
+		return permissionError("rename", name)
+	}
+	if !inFolders(name, appendOnlyPaths) {
+		return nil
+	}
+	if fi, err := fs.Stat(ctx, name); err == nil && fi.IsDir() {
+		return permissionError("rename", name)
+	}
+	return appendReplace(ctx, fs, name)
+}
+
+// appendOnlyFS enforces -append-only-paths on every change made through the
+// file system, so FTP, SFTP and server-side copies obey it too.
+type appendOnlyFS struct {
+	webdav.FileSystem
+}
+
+func (fs appendOnlyFS) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	if flag&(os.O_WRONLY|os.O_RDWR) != 0 {
+		if err := appendReplace(ctx, fs.FileSystem, name); err != nil {
+			return nil, err
+		}
+	}
+	return fs.FileSystem.OpenFile(ctx, name, flag, perm)
+}
+
+func (fs appendOnlyFS) RemoveAll(ctx context.Context, name string) error {
+	if err := appendRemove(name); err != nil {
+		return err
+	}
+	return fs.FileSystem.RemoveAll(ctx, name)
+}
+
+func (fs appendOnlyFS) Rename(ctx context.Context, oldName, newName string) error {
+	if err := appendRename(ctx, fs.FileSystem, oldName); err != nil {
+		return err
+	}
+	if err := appendReplace(ctx, fs.FileSystem, newName); err != nil {
+		return err
+	}
+	return fs.FileSystem.Rename(ctx, oldName, newName)
+}
+
+// refuseAppendOnly answers 403 to WebDAV requests that would delete or
+// overwrite backups in an append-only folder.
+func refuseAppendOnly(fs webdav.FileSystem, w http.ResponseWriter, req *http.Request) bool {
+	if appendOnlyPaths == nil {
+		return false
+	}
+	ctx := req.Context()
+	var err error
+	switch req.Method {
+	case "PUT":
+		err = appendReplace(ctx, fs, req.URL.Path)
+	case "DELETE":
+		err = appendRemove(req.URL.Path)
+	case "MOVE", "COPY":
+		if req.Method == "MOVE" {
+			err = appendRename(ctx, fs, req.URL.Path)
+		}
+		if u, perr := url.Parse(req.Header.Get("Destination")); err == nil && perr == nil && u.Path != "" {
+			err = appendReplace(ctx, fs, u.Path)
+		}
+	}
+	if err == nil {
+		return false
+	}
+	http.Error(w, "WebDAV: backups in append-only folders may not be deleted or overwritten", http.StatusForbidden)
+	return true
+}
+
+// purgeAdmin deletes the file or folder named by ?path= from an append-only
+// folder on DELETE, bypassing its protection. The folders themselves stay.
+func purgeAdmin(fs appendOnlyFS) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != "DELETE" {
+			w.Header().Set("Allow", "DELETE")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		name := path.Clean("/" + req.URL.Query().Get("path"))
+		if !inFolders(name, appendOnlyPaths) {
+			http.Error(w, "path is not inside an append-only folder", http.StatusBadRequest)
+			return
+		}
+		ctx := req.Context()
+		if _, err := fs.FileSystem.Stat(ctx, name); err != nil {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		if err := fs.FileSystem.RemoveAll(ctx, name); err != nil {
+			log.Printf("Purging %s failed: %v", name, err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		log.Printf("Purged %s from the append-only folders, by admin request from %s", name, clientIP(req))
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+	"golang.org/x/net/webdav"
+)
+
+func TestAppendOnly(t *testing.T) {
+	root := t.TempDir()
+	os.MkdirAll(filepath.Join(root, "backups", "host"), 0755)
+	old := filepath.Join(root, "backups", "host", "2026-01.tar")
+	os.WriteFile(old, []byte("january"), 0644)
+	month := time.Now().Add(-30 * 24 * time.Hour)
+	os.Chtimes(old, month, month)
+	*flagAppendOnlyPaths = "/backups"
+	defer func() { *flagAppendOnlyPaths, appendOnlyPaths = "", nil }()
+	startAppendOnly()
+
+	fs := appendOnlyFS{webdav.Dir(root)}
+	h := &webdav.Handler{FileSystem: fs, LockSystem: webdav.NewMemLS()}
+	do := func(method, target, dest string) int {
+		var body string
+		if method == "PUT" {
+			body = "backup"
+		}
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		if dest != "" {
+			req.Header.Set("Destination", dest)
+		}
+		w := httptest.NewRecorder()
+		if !refuseAppendOnly(fs, w, req) {
+			h.ServeHTTP(w, req)
+		}
+		return w.Code
+	}
+	for _, tt := range []struct {
+		method, target, dest string
+		want                 int
+	}{
+		{"MKCOL", "/backups/host/daily", "", http.StatusCreated},
+		{"PUT", "/backups/host/2026-10.tar.part", "", http.StatusCreated},
+		// Within the grace window, uploads can be retried and put in place.
+		{"PUT", "/backups/host/2026-10.tar.part", "", http.StatusCreated},
+		{"MOVE", "/backups/host/2026-10.tar.part", "/backups/host/2026-10.tar", http.StatusCreated},
+		// Older backups are for keeps.
+		{"PUT", "/backups/host/2026-01.tar", "", http.StatusForbidden},
+		{"MOVE", "/backups/host/2026-01.tar", "/backups/host/x.tar", http.StatusForbidden},
+		{"COPY", "/backups/host/2026-10.tar", "/backups/host/2026-01.tar", http.StatusForbidden},
+		{"MOVE", "/backups/host/daily", "/daily", http.StatusForbidden},
+		{"DELETE", "/backups/host/2026-10.tar", "", http.StatusForbidden},
+		{"DELETE", "/backups", "", http.StatusForbidden},
+		{"COPY", "/backups/host/2026-01.tar", "/restore.tar", http.StatusCreated},
+		{"DELETE", "/restore.tar", "", http.StatusNoContent},
+	} {
+		if got := do(tt.method, tt.target, tt.dest); got != tt.want {
+			t.Errorf("%s %s %s answered %d, want %d", tt.method, tt.target, tt.dest, got, tt.want)
+		}
+	}
+	if data, _ := os.ReadFile(old); string(data) != "january" {
+		t.Errorf("old backup holds %q", data)
+	}
+	if _, err := fs.OpenFile(context.Background(), "/backups/host/2026-01.tar", os.O_WRONLY|os.O_APPEND, 0); !os.IsPermission(err) {
+		t.Errorf("appending to an old backup answered %v", err)
+	}
+
+	purge := purgeAdmin(fs)
+	for _, tt := range []struct {
+		target string
+		want   int
+	}{
+		{"/purge?path=/backups/host/2026-01.tar", http.StatusNoContent},
+		{"/purge?path=/backups/host/2026-01.tar", http.StatusNotFound},
+		{"/purge?path=/backups", http.StatusBadRequest},
+		{"/purge?path=/other", http.StatusBadRequest},
+	} {
+		w := httptest.NewRecorder()
+		purge(w, httptest.NewRequest("DELETE", tt.target, nil))
+		if w.Code != tt.want {
+			t.Errorf("DELETE %s answered %d, want %d", tt.target, w.Code, tt.want)
+		}
+	}
+	if _, err := os.Stat(old); !os.IsNotExist(err) {
+		t.Errorf("purged backup still there: %v", err)
+	}
+}
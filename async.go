@@ -0,0 +1,208 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// asyncKeep is how long the result of a finished operation can be fetched.
+const asyncKeep = time.Hour
+
+// asyncProgress counts the files and bytes an operation has gone through.
+type asyncProgress struct {
+	files int64
+	bytes int64
+}
+
+type asyncProgressKey struct{}
+
+// progressFrom returns the progress counters of the operation ctx belongs
+// to, or nil for ordinary requests.
+func progressFrom(ctx context.Context) *asyncProgress {
+	p, _ := ctx.Value(asyncProgressKey{}).(*asyncProgress)
+	return p
+}
+
+func (p *asyncProgress) add(files, bytes int64) {
+	if p != nil {
+		atomic.AddInt64(&p.files, files)
+		atomic.AddInt64(&p.bytes, bytes)
+	}
+}
+
+// asyncOp is a COPY, MOVE or DELETE running after its request was answered
+// with 202 Accepted. It runs as a task of the queue, which limits how many
+// run at once and lets the admin API cancel it.
+type asyncOp struct {
+	id          string
+	method      string
+	path        string
+	destination string
+	started     time.Time
+	progress    asyncProgress
+	task        *task
+
+	mu       sync.Mutex
+	status   int
+	finished time.Time
+}
+
+type asyncOpStatus struct {
+	ID          string     `json:"id"`
+	Method      string     `json:"method"`
+	Path        string     `json:"path"`
+	Destination string     `json:"destination,omitempty"`
+	Task        string     `json:"task"`
+	State       string     `json:"state"`
+	Done        bool       `json:"done"`
+	Status      int        `json:"status,omitempty"`
+	Files       int64      `json:"files"`
+	Bytes       int64      `json:"bytes"`
+	Started     time.Time  `json:"started"`
+	Finished    *time.Time `json:"finished,omitempty"`
+}
+
+func (op *asyncOp) state() asyncOpStatus {
+	task := op.task.state()
+	op.mu.Lock()
+	defer op.mu.Unlock()
+	s := asyncOpStatus{
+		ID:          op.id,
+		Task:        task.ID,
+		State:       task.State,
+		Method:      op.method,
+		Path:        op.path,
+		Destination: op.destination,
+		Status:      op.status,
+		Files:       atomic.LoadInt64(&op.progress.files),
+		Bytes:       atomic.LoadInt64(&op.progress.bytes),
+		Started:     op.started,
+	}
+	if !op.finished.IsZero() {
+		s.Done = true
+		s.Finished = &op.finished
+	}
+	return s
+}
+
+var asyncOps = struct {
+	sync.Mutex
+	m map[string]*asyncOp
+}{m: make(map[string]*asyncOp)}
+
+// statusResponse records the status code a handler answers with.
+type statusResponse struct {
+	header http.Header
+	status int
+}
+
+func (r *statusResponse) Header() http.Header         { return r.header }
+func (r *statusResponse) Write(p []byte) (int, error) { return len(p), nil }
+func (r *statusResponse) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+}
+
+// wantsAsync reports whether req is a COPY, MOVE or DELETE whose client
+// asked, with Prefer: respond-async, not to wait for it to finish.
+func wantsAsync(req *http.Request) bool {
+	switch req.Method {
+	case "COPY", "MOVE", "DELETE":
+	default:
+		return false
+	}
+	return prefersAsync(req)
+}
+
+// prefersAsync reports whether req carries Prefer: respond-async.
+func prefersAsync(req *http.Request) bool {
+	for _, v := range req.Header.Values("Prefer") {
+		for _, pref := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(pref), "respond-async") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// startAsync runs serve for req in the background, free of the request's
+// deadline, and answers 202 Accepted with a status URL for it.
+func startAsync(w http.ResponseWriter, req *http.Request, serve http.HandlerFunc) {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	op := &asyncOp{
+		id:          hex.EncodeToString(b[:]),
+		method:      req.Method,
+		path:        req.URL.Path,
+		destination: req.Header.Get("Destination"),
+		started:     time.Now(),
+	}
+	asyncOps.Lock()
+	for id, o := range asyncOps.m {
+		if s := o.state(); s.Done && time.Since(*s.Finished) > asyncKeep {
+			delete(asyncOps.m, id)
+		}
+	}
+	asyncOps.m[op.id] = op
+	asyncOps.Unlock()
+
+	ctx := context.WithValue(context.Background(), asyncProgressKey{}, &op.progress)
+	op.task = queue.add(ctx, strings.ToLower(req.Method), req.URL.Path)
+	bg := req.Clone(ctx)
+	bg.Body = http.NoBody
+	bg.Header.Del("Prefer")
+	go func() {
+		var status int
+		err := queue.do(op.task, func(ctx context.Context) error {
+			rec := &statusResponse{header: make(http.Header)}
+			recoverPanics(serve).ServeHTTP(rec, bg.WithContext(ctx))
+			if status = rec.status; status == 0 {
+				status = http.StatusOK
+			}
+			if status >= 400 {
+				return fmt.Errorf("answered %d", status)
+			}
+			return nil
+		})
+		op.mu.Lock()
+		op.status, op.finished = status, time.Now()
+		op.mu.Unlock()
+		if status == 0 {
+			log.Printf("Async %s %s did not run: %v", op.method, op.path, err)
+		} else {
+			log.Printf("Async %s %s finished with status %d", op.method, op.path, status)
+		}
+	}()
+
+	w.Header().Set("Location", (&url.URL{Path: req.URL.Path, RawQuery: "operation=" + op.id}).String())
+	w.Header().Set("Preference-Applied", "respond-async")
+	writeJSON(w, http.StatusAccepted, op.state())
+}
+
+// handleAsyncStatus reports the progress and, once done, the result of the
+// operation named by ?operation=.
+func handleAsyncStatus(w http.ResponseWriter, req *http.Request, id string) {
+	asyncOps.Lock()
+	op := asyncOps.m[id]
+	asyncOps.Unlock()
+	if op == nil {
+		http.Error(w, "Not Found", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, op.state())
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/webdav"
+)
+
+func TestWantsAsync(t *testing.T) {
+	tests := []struct {
+		method, prefer string
+		want           bool
+	}{
+		{"COPY", "respond-async", true},
+		{"DELETE", "return=minimal, Respond-Async", true},
+		{"MOVE", "", false},
+		{"PUT", "respond-async", false},
+		{"COPY", "wait=10", false},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(tt.method, "/x", nil)
+		if tt.prefer != "" {
+			req.Header.Set("Prefer", tt.prefer)
+		}
+		if got := wantsAsync(req); got != tt.want {
+			t.Errorf("wantsAsync(%s, %q) = %v, want %v", tt.method, tt.prefer, got, tt.want)
+		}
+	}
+}
+
+func TestAsyncOperation(t *testing.T) {
+	root := t.TempDir()
+	n := makeTree(t, filepath.Join(root, "src"))
+	h := &webdav.Handler{FileSystem: SkipBrokenLink{webdav.Dir(root)}, LockSystem: webdav.NewMemLS()}
+	serve := func(w http.ResponseWriter, req *http.Request) {
+		if !handleTreeCopy(h, w, req) {
+			h.ServeHTTP(w, req)
+		}
+	}
+
+	run := func(req *http.Request) asyncOpStatus {
+		t.Helper()
+		req.Header.Set("Prefer", "respond-async")
+		rec := httptest.NewRecorder()
+		startAsync(rec, req, serve)
+		if rec.Code != http.StatusAccepted || rec.Header().Get("Preference-Applied") != "respond-async" {
+			t.Fatalf("status = %d, headers %v", rec.Code, rec.Header())
+		}
+		loc := rec.Header().Get("Location")
+		if !strings.Contains(loc, "?operation=") {
+			t.Fatalf("Location = %q", loc)
+		}
+		id := loc[strings.Index(loc, "=")+1:]
+		for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+			rec := httptest.NewRecorder()
+			handleAsyncStatus(rec, httptest.NewRequest("GET", loc, nil), id)
+			var s asyncOpStatus
+			if err := json.Unmarshal(rec.Body.Bytes(), &s); err != nil {
+				t.Fatal(err)
+			}
+			if s.Done {
+				return s
+			}
+		}
+		t.Fatal("operation did not finish")
+		return asyncOpStatus{}
+	}
+
+	req := httptest.NewRequest("COPY", "/src", nil)
+	req.Header.Set("Destination", "/copy")
+	if s := run(req); s.Status != http.StatusCreated || s.Files != int64(n) || s.Bytes == 0 {
+		t.Errorf("copy: %+v, want status 201 and %d files", s, n)
+	} else if s.Task == "" || s.State != "done" {
+		t.Errorf("copy ran as task %q in state %q", s.Task, s.State)
+	}
+	if s := run(httptest.NewRequest("DELETE", "/copy", nil)); s.Status != http.StatusNoContent || s.Files != int64(n) {
+		t.Errorf("delete: %+v, want status 204 and %d files", s, n)
+	}
+	if _, err := os.Stat(filepath.Join(root, "copy")); !os.IsNotExist(err) {
+		t.Errorf("copy still exists: %v", err)
+	}
+	if s := run(httptest.NewRequest("DELETE", "/gone", nil)); s.Status < 400 || s.State != "failed" {
+		t.Errorf("delete of a missing folder finished with %d in state %q", s.Status, s.State)
+	}
+
+	rec := httptest.NewRecorder()
+	handleAsyncStatus(rec, httptest.NewRequest("GET", "/?operation=nope", nil), "nope")
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("unknown operation: status %d", rec.Code)
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+	"golang.org/x/net/webdav"
+)
+
+// backupFilter selects what goes into a snapshot. Patterns containing a
+// slash match the path relative to the snapshot root, others the base name.
+type backupFilter struct {
+	include, exclude []string
+}
+
+func newBackupFilter(include, exclude []string) (backupFilter, error) {
+	for _, p := range append(append([]string(nil), include...), exclude...) {
+		if _, err := path.Match(p, ""); err != nil {
+			return backupFilter{}, fmt.Errorf("bad pattern %q", p)
+		}
+	}
+	return backupFilter{include: include, exclude: exclude}, nil
+}
+
+func matchAny(patterns []string, rel string) bool {
+	for _, p := range patterns {
+		target := path.Base(rel)
+		if strings.Contains(p, "/") {
+			target = rel
+		}
+		if ok, _ := path.Match(strings.TrimPrefix(p, "/"), target); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// excluded reports whether rel, and for directories everything below it,
+// stays out of the snapshot.
+func (f backupFilter) excluded(rel string) bool {
+	return matchAny(f.exclude, rel)
+}
+
+// included reports whether the file at rel goes into the snapshot; with no
+// include patterns every file not excluded does.
+func (f backupFilter) included(rel string) bool {
+	return !f.excluded(rel) && (len(f.include) == 0 || matchAny(f.include, rel))
+}
+
+// writeSnapshot writes the tree below dir to w as a tar archive with paths
+// relative to dir. Unlike listings it keeps hidden files, since a backup
+// should restore what was there.
+func writeSnapshot(ctx context.Context, fs webdav.FileSystem, dir string, filter backupFilter, w io.Writer) error {
+	tw := tar.NewWriter(w)
+	if err := snapshotDir(ctx, fs, dir, "", filter, tw); err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+func snapshotDir(ctx context.Context, fs webdav.FileSystem, dir, rel string, filter backupFilter, tw *tar.Writer) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	keep := func(fi os.FileInfo) bool { return !filter.excluded(path.Join(rel, fi.Name())) }
+	return readdirSorted(ctx, fs, path.Join(dir, rel), os.FileInfo.Name, keep, func(fi os.FileInfo) error {
+		name := path.Join(rel, fi.Name())
+		if fi.IsDir() {
+			hdr := &tar.Header{Typeflag: tar.TypeDir, Name: name + "/", Mode: 0755, ModTime: fi.ModTime()}
+			if err := tw.WriteHeader(hdr); err != nil {
+				return err
+			}
+			return snapshotDir(ctx, fs, dir, name, filter, tw)
+		}
+		if !fi.Mode().IsRegular() || !filter.included(name) {
+			return nil
+		}
+		return snapshotFile(ctx, fs, path.Join(dir, name), name, fi, tw)
+	})
+}
+
+func snapshotFile(ctx context.Context, fs webdav.FileSystem, src, name string, fi os.FileInfo, tw *tar.Writer) error {
+	f, err := fs.OpenFile(ctx, src, os.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	hdr := &tar.Header{Typeflag: tar.TypeReg, Name: name, Mode: int64(fi.Mode().Perm()), Size: fi.Size(), ModTime: fi.ModTime()}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	// The header promised fi.Size() bytes; a file that grew since is cut
+	// short and one that shrank fails, rather than corrupting the archive.
+	_, err = io.CopyN(tw, ctxFile{f, ctx}, fi.Size())
+	return err
+}
+
+// backupHandler streams a tar.gz snapshot of ?path= (default the whole
+// share), filtered by repeatable ?include= and ?exclude= glob patterns.
+func backupHandler(fs webdav.FileSystem) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != "GET" {
+			w.Header().Set("Allow", "GET")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		q := req.URL.Query()
+		dir := path.Clean("/" + q.Get("path"))
+		filter, err := newBackupFilter(q["include"], q["exclude"])
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		fi, err := fs.Stat(req.Context(), dir)
+		if err != nil || !fi.IsDir() {
+			http.Error(w, "not a directory", http.StatusNotFound)
+			return
+		}
+
+		base := "share"
+		if dir != "/" {
+			base = path.Base(dir)
+		}
+		name := fmt.Sprintf("%s-%s.tar.gz", base, time.Now().Format("20060102-150405"))
+		w.Header().Set("Content-Type", "application/gzip")
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, name))
+		gz := gzip.NewWriter(w)
+		if err := writeSnapshot(req.Context(), fs, dir, filter, gz); err != nil {
+			if req.Context().Err() == nil {
+				log.Printf("Backup of %s failed: %v", dir, err)
+			}
+			// Drop the connection so the client sees a truncated download
+			// instead of a well-formed but incomplete archive.
+			panic(http.ErrAbortHandler)
+		}
+		gz.Close()
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"golang.org/x/net/webdav"
+)
+
+func TestBackupHandler(t *testing.T) {
+	root := t.TempDir()
+	for name, data := range map[string]string{
+		"a.txt":              "a",
+		".env":               "secret",
+		"docs/b.md":          "b",
+		"docs/c.txt":         "c",
+		"docs/tmp/scratch":   "x",
+		"photos/2024/d.jpg":  "d",
+		"photos/cache/e.jpg": "e",
+	} {
+		p := filepath.Join(root, filepath.FromSlash(name))
+		os.MkdirAll(filepath.Dir(p), 0755)
+		os.WriteFile(p, []byte(data), 0644)
+	}
+	h := backupHandler(webdav.Dir(root))
+
+	tests := []struct {
+		name   string
+		query  string
+		status int
+		want   []string
+	}{
+		{
+			name:   "everything",
+			status: http.StatusOK,
+			want: []string{".env", "a.txt", "docs/", "docs/b.md", "docs/c.txt", "docs/tmp/", "docs/tmp/scratch",
+				"photos/", "photos/2024/", "photos/2024/d.jpg", "photos/cache/", "photos/cache/e.jpg"},
+		},
+		{
+			name:   "subtree",
+			query:  "?path=/docs",
+			status: http.StatusOK,
+			want:   []string{"b.md", "c.txt", "tmp/", "tmp/scratch"},
+		},
+		{
+			name:   "include by name",
+			query:  "?path=/docs&include=*.txt",
+			status: http.StatusOK,
+			want:   []string{"c.txt", "tmp/"},
+		},
+		{
+			name:   "exclude dir and relative path",
+			query:  "?exclude=cache&exclude=docs/*.md&exclude=.*",
+			status: http.StatusOK,
+			want:   []string{"a.txt", "docs/", "docs/c.txt", "docs/tmp/", "docs/tmp/scratch", "photos/", "photos/2024/", "photos/2024/d.jpg"},
+		},
+		{name: "missing", query: "?path=/nope", status: http.StatusNotFound},
+		{name: "file", query: "?path=/a.txt", status: http.StatusNotFound},
+		{name: "bad pattern", query: "?include=[", status: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			h(rec, httptest.NewRequest("GET", "/backup"+tt.query, nil))
+			if rec.Code != tt.status {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.status, rec.Body)
+			}
+			if tt.status != http.StatusOK {
+				return
+			}
+			gz, err := gzip.NewReader(rec.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			tr := tar.NewReader(gz)
+			for {
+				hdr, err := tr.Next()
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				got = append(got, hdr.Name)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("entries = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
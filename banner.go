@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"html"
+	"log"
+	"mime"
+	"net/http"
+	"sync"
+	"time"
+)
+
+var flagBanner = flag.String("banner", "", "message shown at the top of listings and sent in the X-Server-Message header, e.g. to announce maintenance; the admin API can change it")
+
+const bannerState = "banner.json"
+
+// serverBanner is the message of the day. Expires, when set, clears it
+// automatically, so a maintenance notice doesn't outlive the maintenance.
+type serverBanner struct {
+	Message string     `json:"message"`
+	Expires *time.Time `json:"expires,omitempty"`
+}
+
+var banner struct {
+	sync.Mutex
+	serverBanner
+}
+
+// startBanner loads the banner and registers its admin endpoint.
+func startBanner() {
+	loadBanner()
+	handleAdmin("banner", serveBannerAdmin)
+}
+
+// loadBanner reads the banner set through the admin API, which takes
+// precedence over -banner.
+func loadBanner() {
+	banner.Lock()
+	defer banner.Unlock()
+	banner.serverBanner = serverBanner{Message: *flagBanner}
+	if data, err := readState(bannerState); err != nil {
+		log.Printf("Failed to read banner: %v", err)
+	} else if data != nil {
+		if err := json.Unmarshal(data, &banner.serverBanner); err != nil {
+			log.Printf("Failed to read banner: %v", err)
+		}
+	}
+}
+
+// bannerMessage returns the current message, or "" when there is none.
+func bannerMessage() string {
+	banner.Lock()
+	defer banner.Unlock()
+	if banner.Expires != nil && time.Now().After(*banner.Expires) {
+		return ""
+	}
+	return banner.Message
+}
+
+// setBannerHeader announces the banner on a response. Header values are
+// ASCII, so other text is sent RFC 2047 encoded.
+func setBannerHeader(w http.ResponseWriter) {
+	if m := bannerMessage(); m != "" {
+		w.Header().Set("X-Server-Message", mime.QEncoding.Encode("utf-8", m))
+	}
+}
+
+func bannerHTML() string {
+	m := bannerMessage()
+	if m == "" {
+		return ""
+	}
+	return fmt.Sprintf(`<div class="banner" role="status">%s</div>`, html.EscapeString(m))
+}
+
+// serveBannerAdmin shows the banner on GET, replaces it with the JSON body
+// of a PUT and removes it on DELETE.
+func serveBannerAdmin(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case "GET":
+	case "PUT":
+		var b serverBanner
+		if err := json.NewDecoder(http.MaxBytesReader(w, req.Body, 64<<10)).Decode(&b); err != nil {
+			http.Error(w, "invalid banner: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := saveBanner(b); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	case "DELETE":
+		if err := saveBanner(serverBanner{}); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	default:
+		w.Header().Set("Allow", "GET, PUT, DELETE")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	banner.Lock()
+	b := banner.serverBanner
+	banner.Unlock()
+	writeJSON(w, http.StatusOK, b)
+}
+
+func saveBanner(b serverBanner) error {
+	data, err := json.Marshal(b)
+	if err != nil {
+		return err
+	}
+	banner.Lock()
+	defer banner.Unlock()
+	if err := writeState(bannerState, data); err != nil {
+		return err
+	}
+	banner.serverBanner = b
+	return nil
+}
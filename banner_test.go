@@ -0,0 +1,65 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBanner(t *testing.T) {
+	*flagStateDir = t.TempDir()
+	defer func() { *flagStateDir = "" }()
+	*flagBanner = "Maintenance on Sunday"
+	defer func() { *flagBanner = "" }()
+	defer func() { banner.serverBanner = serverBanner{} }()
+	loadBanner()
+
+	w := httptest.NewRecorder()
+	setBannerHeader(w)
+	if got := w.Header().Get("X-Server-Message"); got != "Maintenance on Sunday" {
+		t.Errorf("header = %q", got)
+	}
+
+	admin := func(method, body string) serverBanner {
+		w := httptest.NewRecorder()
+		serveBannerAdmin(w, httptest.NewRequest(method, "/banner", strings.NewReader(body)))
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s answered %d: %s", method, w.Code, w.Body)
+		}
+		var b serverBanner
+		json.NewDecoder(w.Body).Decode(&b)
+		return b
+	}
+	if b := admin("PUT", `{"message": "Wartung <heute>"}`); b.Message != "Wartung <heute>" {
+		t.Errorf("PUT returned %+v", b)
+	}
+	if got := bannerHTML(); got != `<div class="banner" role="status">Wartung &lt;heute&gt;</div>` {
+		t.Errorf("HTML = %q", got)
+	}
+
+	// The banner set through the API survives a restart.
+	loadBanner()
+	if got := bannerMessage(); got != "Wartung <heute>" {
+		t.Errorf("after restart, message = %q", got)
+	}
+
+	past := time.Now().Add(-time.Minute).UTC().Format(time.RFC3339)
+	admin("PUT", `{"message": "over", "expires": "`+past+`"}`)
+	if got := bannerMessage(); got != "" {
+		t.Errorf("expired banner still shown: %q", got)
+	}
+
+	admin("PUT", `{"message": "Größe"}`)
+	w = httptest.NewRecorder()
+	setBannerHeader(w)
+	if got := w.Header().Get("X-Server-Message"); got != "=?utf-8?q?Gr=C3=B6=C3=9Fe?=" {
+		t.Errorf("header = %q", got)
+	}
+
+	if b := admin("DELETE", ""); b.Message != "" || bannerMessage() != "" {
+		t.Errorf("DELETE left %+v", b)
+	}
+}
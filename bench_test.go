@@ -0,0 +1,55 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/webdav"
+)
+
+func TestRunBench(t *testing.T) {
+	root := t.TempDir()
+	h := &webdav.Handler{FileSystem: webdav.Dir(root), LockSystem: webdav.NewMemLS()}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if u, p, _ := req.BasicAuth(); u != "bench" || p != "secret" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		h.ServeHTTP(w, req)
+	}))
+	defer srv.Close()
+
+	base, _ := url.Parse(strings.Replace(srv.URL, "http://", "http://bench:secret@", 1) + "/")
+	cfg := benchConfig{
+		base:        base,
+		client:      srv.Client(),
+		concurrency: 2,
+		duration:    100 * time.Millisecond,
+		workloads:   []string{"propfind", "get", "range", "put"},
+		fileSize:    64 << 10,
+		rangeSize:   4 << 10,
+	}
+	var out bytes.Buffer
+	if err := runBench(cfg, &out); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 5 {
+		t.Fatalf("output:\n%s", out.String())
+	}
+	for i, w := range cfg.workloads {
+		fields := strings.Fields(lines[i+1])
+		if fields[0] != w || fields[1] == "0" || fields[2] != "0" {
+			t.Errorf("workload %s: %s", w, lines[i+1])
+		}
+	}
+	if entries, _ := os.ReadDir(root); len(entries) != 0 {
+		t.Errorf("%d test files left behind", len(entries))
+	}
+}
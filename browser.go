@@ -0,0 +1,52 @@
+package main
+
+import (
+	"flag"
+	"net"
+	"os/exec"
+	"runtime"
+	"strings"
+)
+
+var flagOpenBrowser = flag.Bool("open", false, "open the default browser at the server url once listening")
+
+// serverURL builds the URL clients should use for a listener bound to addr,
+// substituting localhost for unspecified (all-interfaces) hosts.
+func serverURL(addr net.Addr, host string) string {
+	scheme := "http"
+	if *flagHttpsMode {
+		scheme = "https"
+	}
+	h, port, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return scheme + "://" + addr.String() + "/"
+	}
+	if host == "" {
+		host = h
+		ip := net.ParseIP(strings.SplitN(h, "%", 2)[0])
+		if ip == nil || ip.IsUnspecified() {
+			host = "localhost"
+		}
+	}
+	if strings.Contains(host, ":") {
+		host = "[" + strings.Replace(host, "%", "%25", 1) + "]"
+	}
+	return scheme + "://" + host + ":" + port + "/"
+}
+
+func openBrowser(url string) error {
+	var cmd *exec.Cmd
+	switch runtime.GOOS {
+	case "windows":
+		cmd = exec.Command("rundll32", "url.dll,FileProtocolHandler", url)
+	case "darwin":
+		cmd = exec.Command("open", url)
+	default:
+		cmd = exec.Command("xdg-open", url)
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	go cmd.Wait()
+	return nil
+}
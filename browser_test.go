@@ -0,0 +1,34 @@
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+func TestServerURL(t *testing.T) {
+	tests := []struct {
+		name  string
+		addr  net.Addr
+		host  string
+		https bool
+		want  string
+	}{
+		{"unspecified v4", &net.TCPAddr{IP: net.IPv4zero, Port: 6086}, "", false, "http://localhost:6086/"},
+		{"unspecified v6", &net.TCPAddr{IP: net.IPv6unspecified, Port: 6086}, "", false, "http://localhost:6086/"},
+		{"specific v4", &net.TCPAddr{IP: net.IPv4(192, 168, 1, 2), Port: 80}, "", false, "http://192.168.1.2:80/"},
+		{"https", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 443}, "", true, "https://127.0.0.1:443/"},
+		{"v6 bracketed", &net.TCPAddr{IP: net.ParseIP("::1"), Port: 5005}, "", false, "http://[::1]:5005/"},
+		{"v6 zone escaped", &net.TCPAddr{IP: net.ParseIP("fe80::1"), Port: 5005, Zone: "eth0"}, "", false, "http://[fe80::1%25eth0]:5005/"},
+		{"host override", &net.TCPAddr{IP: net.IPv4zero, Port: 6086}, "10.0.0.5", false, "http://10.0.0.5:6086/"},
+		{"v6 host override", &net.TCPAddr{IP: net.IPv4zero, Port: 6086}, "2001:db8::1", false, "http://[2001:db8::1]:6086/"},
+	}
+	defer func(v bool) { *flagHttpsMode = v }(*flagHttpsMode)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			*flagHttpsMode = tt.https
+			if got := serverURL(tt.addr, tt.host); got != tt.want {
+				t.Errorf("serverURL = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,480 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+	"golang.org/x/net/webdav"
+)
+
+var (
+	flagCalendars    = flag.String("calendars", "", "comma-separated folders to serve as CalDAV calendars of .ics files, e.g. /cal/home,/cal/work")
+	flagAddressbooks = flag.String("addressbooks", "", "comma-separated folders to serve as CardDAV address books of .vcf files")
+)
+
+const (
+	nsCalDAV  = "urn:ietf:params:xml:ns:caldav"
+	nsCardDAV = "urn:ietf:params:xml:ns:carddav"
+	nsCS      = "http://calendarserver.org/ns/"
+)
+
+type pimKind int
+
+const (
+	pimCalendar pimKind = iota + 1
+	pimAddressbook
+)
+
+// pimCollections maps the folders served as calendars and address books to
+// their kind. It is nil unless -calendars or -addressbooks is set.
+var pimCollections map[string]pimKind
+
+func startPIM() {
+	for _, c := range []struct {
+		list string
+		kind pimKind
+	}{{*flagCalendars, pimCalendar}, {*flagAddressbooks, pimAddressbook}} {
+		for _, dir := range strings.Split(c.list, ",") {
+			if dir = strings.TrimSpace(dir); dir == "" {
+				continue
+			}
+			if pimCollections == nil {
+				pimCollections = make(map[string]pimKind)
+			}
+			pimCollections[path.Clean("/"+dir)] = c.kind
+		}
+	}
+}
+
+// homeSets returns the hrefs of the folders holding collections of kind, as
+// advertised by calendar-home-set and addressbook-home-set.
+func homeSets(kind pimKind) string {
+	seen := make(map[string]bool)
+	var homes []string
+	for dir, k := range pimCollections {
+		if home := path.Dir(dir); k == kind && !seen[home] {
+			seen[home] = true
+			homes = append(homes, home)
+		}
+	}
+	sort.Strings(homes)
+	var b strings.Builder
+	for _, h := range homes {
+		fmt.Fprintf(&b, `<D:href xmlns:D="DAV:">%s</D:href>`, xmlEscape(dirHref(h)))
+	}
+	return b.String()
+}
+
+func dirHref(p string) string {
+	href := (&url.URL{Path: p}).EscapedPath()
+	if !strings.HasSuffix(href, "/") {
+		href += "/"
+	}
+	return href
+}
+
+func xmlEscape(s string) string {
+	var b bytes.Buffer
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
+
+// pimFile adds the properties CalDAV and CardDAV clients discover
+// collections by: the root stands in for the single user's principal, and
+// the configured folders get their collection types.
+type pimFile struct {
+	webdav.File
+	name string
+}
+
+func withPIM(name string, f webdav.File) webdav.File {
+	if pimCollections == nil {
+		return f
+	}
+	name = path.Clean("/" + name)
+	if _, ok := pimCollections[name]; !ok && name != "/" {
+		return f
+	}
+	return pimFile{File: f, name: name}
+}
+
+func prop(space, local, inner string) (xml.Name, webdav.Property) {
+	n := xml.Name{Space: space, Local: local}
+	return n, webdav.Property{XMLName: n, InnerXML: []byte(inner)}
+}
+
+func (f pimFile) DeadProps() (map[xml.Name]webdav.Property, error) {
+	props := make(map[xml.Name]webdav.Property)
+	if dph, ok := f.File.(webdav.DeadPropsHolder); ok {
+		inner, err := dph.DeadProps()
+		if err != nil {
+			return nil, err
+		}
+		for n, p := range inner {
+			props[n] = p
+		}
+	}
+	add := func(n xml.Name, p webdav.Property) { props[n] = p }
+
+	if f.name == "/" {
+		add(prop("DAV:", "current-user-principal", `<D:href xmlns:D="DAV:">/</D:href>`))
+		add(prop("DAV:", "principal-URL", `<D:href xmlns:D="DAV:">/</D:href>`))
+		add(prop(nsCalDAV, "calendar-home-set", homeSets(pimCalendar)))
+		add(prop(nsCardDAV, "addressbook-home-set", homeSets(pimAddressbook)))
+	}
+	kind, ok := pimCollections[f.name]
+	if !ok {
+		return props, nil
+	}
+	ctag, err := collectionTag(f.File)
+	if err != nil {
+		return nil, err
+	}
+	add(prop(nsCS, "getctag", ctag))
+	switch kind {
+	case pimCalendar:
+		add(prop("DAV:", "resourcetype", `<D:collection xmlns:D="DAV:"/><C:calendar xmlns:C="`+nsCalDAV+`"/>`))
+		add(prop(nsCalDAV, "supported-calendar-component-set",
+			`<C:comp xmlns:C="`+nsCalDAV+`" name="VEVENT"/><C:comp xmlns:C="`+nsCalDAV+`" name="VTODO"/>`))
+	case pimAddressbook:
+		add(prop("DAV:", "resourcetype", `<D:collection xmlns:D="DAV:"/><CR:addressbook xmlns:CR="`+nsCardDAV+`"/>`))
+	}
+	return props, nil
+}
+
+func (f pimFile) Patch(patches []webdav.Proppatch) ([]webdav.Propstat, error) {
+	if dph, ok := f.File.(webdav.DeadPropsHolder); ok {
+		return dph.Patch(patches)
+	}
+	pstat := webdav.Propstat{Status: http.StatusForbidden}
+	for _, patch := range patches {
+		for _, p := range patch.Props {
+			pstat.Props = append(pstat.Props, webdav.Property{XMLName: p.XMLName})
+		}
+	}
+	return []webdav.Propstat{pstat}, nil
+}
+
+// collectionTag changes whenever a member of the collection is added,
+// removed or modified, letting clients skip unchanged collections.
+func collectionTag(dir webdav.File) (string, error) {
+	if _, err := dir.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	// The members' hashes are XORed, which does not depend on the order
+	// they are read in, so the directory need not be held to sort it.
+	var tag [sha256.Size]byte
+	err := readdirBatches(dir, func(fis []os.FileInfo) error {
+		for _, fi := range fis {
+			sum := sha256.Sum256([]byte(fmt.Sprintf("%s\x00%d\x00%d", fi.Name(), fi.Size(), fi.ModTime().UnixNano())))
+			for i := range tag {
+				tag[i] ^= sum[i]
+			}
+		}
+		return nil
+	})
+	dir.Seek(0, io.SeekStart)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(tag[:12]), nil
+}
+
+// davETag matches the getetag property webdav.Handler reports for a file.
+func davETag(fi os.FileInfo) string {
+	return fmt.Sprintf(`"%x%x"`, fi.ModTime().UnixNano(), fi.Size())
+}
+
+// pimReport is the body of the calendar-query, calendar-multiget,
+// addressbook-query and addressbook-multiget REPORTs.
+type pimReport struct {
+	XMLName xml.Name
+	Props   propNames `xml:"DAV: prop"`
+	Hrefs   []string  `xml:"DAV: href"`
+	Filter  struct {
+		Comps []compFilter `xml:"comp-filter"`
+	} `xml:"filter"`
+}
+
+type compFilter struct {
+	Name      string       `xml:"name,attr"`
+	Comps     []compFilter `xml:"comp-filter"`
+	TimeRange *struct {
+		Start string `xml:"start,attr"`
+		End   string `xml:"end,attr"`
+	} `xml:"time-range"`
+}
+
+type propNames []xml.Name
+
+func (p *propNames) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
+	for {
+		t, err := d.Token()
+		if err != nil {
+			return err
+		}
+		switch t := t.(type) {
+		case xml.StartElement:
+			*p = append(*p, t.Name)
+			if err := d.Skip(); err != nil {
+				return err
+			}
+		case xml.EndElement:
+			return nil
+		}
+	}
+}
+
+// eventFilter is a flattened calendar-query filter: the component type
+// wanted and an optional time range it must overlap.
+type eventFilter struct {
+	comp       string
+	start, end time.Time
+}
+
+func (r *pimReport) eventFilter() eventFilter {
+	var f eventFilter
+	comps := r.Filter.Comps
+	for len(comps) > 0 {
+		c := comps[0]
+		f.comp = c.Name
+		if c.TimeRange != nil {
+			f.start, _ = parseICalTime(c.TimeRange.Start)
+			f.end, _ = parseICalTime(c.TimeRange.End)
+		}
+		comps = c.Comps
+	}
+	return f
+}
+
+func parseICalTime(s string) (time.Time, error) {
+	for _, layout := range []string{"20060102T150405Z", "20060102T150405", "20060102"} {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("bad time %q", s)
+}
+
+// icalLines unfolds an iCalendar or vCard body into logical lines.
+func icalLines(data []byte) []string {
+	var lines []string
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	sc.Buffer(nil, 1<<20)
+	for sc.Scan() {
+		line := strings.TrimRight(sc.Text(), "\r")
+		if len(lines) > 0 && (strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t")) {
+			lines[len(lines)-1] += line[1:]
+			continue
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+// matches reports whether an iCalendar object passes f. Recurring
+// components are always included since their instances aren't expanded.
+func (f eventFilter) matches(data []byte) bool {
+	if f.comp == "" || f.comp == "VCALENDAR" {
+		return true
+	}
+	var in bool
+	var start, end time.Time
+	var recurring, allDay bool
+	for _, line := range icalLines(data) {
+		name, value, _ := strings.Cut(line, ":")
+		params := ""
+		if i := strings.Index(name, ";"); i >= 0 {
+			name, params = name[:i], name[i:]
+		}
+		switch {
+		case strings.EqualFold(name, "BEGIN") && value == f.comp:
+			in = true
+			start, end, recurring, allDay = time.Time{}, time.Time{}, false, false
+		case !in:
+		case strings.EqualFold(name, "END") && value == f.comp:
+			if f.start.IsZero() && f.end.IsZero() {
+				return true
+			}
+			if recurring || start.IsZero() {
+				return true
+			}
+			if end.IsZero() {
+				end = start
+				if allDay {
+					end = start.AddDate(0, 0, 1)
+				}
+			}
+			if (f.end.IsZero() || start.Before(f.end)) && (f.start.IsZero() || end.After(f.start) || end.Equal(start) && !start.Before(f.start)) {
+				return true
+			}
+			in = false
+		case strings.EqualFold(name, "DTSTART"), strings.EqualFold(name, "DUE") && start.IsZero():
+			start, _ = parseICalTime(value)
+			allDay = strings.Contains(params, "VALUE=DATE") && !strings.Contains(params, "DATE-TIME")
+		case strings.EqualFold(name, "DTEND"):
+			end, _ = parseICalTime(value)
+		case strings.EqualFold(name, "RRULE"), strings.EqualFold(name, "RDATE"):
+			recurring = true
+		}
+	}
+	return false
+}
+
+type reportResponse struct {
+	XMLName   xml.Name         `xml:"D:multistatus"`
+	XMLNS     string           `xml:"xmlns:D,attr"`
+	XMLNSC    string           `xml:"xmlns:C,attr"`
+	XMLNSCR   string           `xml:"xmlns:CR,attr"`
+	Responses []reportResource `xml:"D:response"`
+}
+
+type reportResource struct {
+	Href      string           `xml:"D:href"`
+	Status    string           `xml:"D:status,omitempty"`
+	Propstats []reportPropstat `xml:"D:propstat"`
+}
+
+type reportPropstat struct {
+	Props  []reportProp `xml:"D:prop>any"`
+	Status string       `xml:"D:status"`
+}
+
+type reportProp struct {
+	XMLName xml.Name
+	Value   string `xml:",chardata"`
+}
+
+// handleReport answers the CalDAV and CardDAV REPORTs on the configured
+// collections.
+func handleReport(fs webdav.FileSystem, w http.ResponseWriter, req *http.Request) {
+	var r pimReport
+	if err := xml.NewDecoder(io.LimitReader(req.Body, 1<<20)).Decode(&r); err != nil {
+		http.Error(w, "WebDAV: invalid REPORT body", http.StatusBadRequest)
+		return
+	}
+	ctx := req.Context()
+	dir := path.Clean(req.URL.Path)
+	kind := pimCollections[dir]
+	var dataProp xml.Name
+	var ext string
+	switch {
+	case r.XMLName.Space == nsCalDAV && kind == pimCalendar:
+		dataProp, ext = xml.Name{Space: nsCalDAV, Local: "calendar-data"}, ".ics"
+	case r.XMLName.Space == nsCardDAV && kind == pimAddressbook:
+		dataProp, ext = xml.Name{Space: nsCardDAV, Local: "address-data"}, ".vcf"
+	default:
+		http.Error(w, "WebDAV: unsupported REPORT", http.StatusForbidden)
+		return
+	}
+
+	var names []string
+	multiget := strings.HasSuffix(r.XMLName.Local, "-multiget")
+	if multiget {
+		for _, href := range r.Hrefs {
+			if u, err := url.Parse(href); err == nil {
+				names = append(names, path.Clean("/"+u.Path))
+			}
+		}
+	} else {
+		if _, err := fs.Stat(ctx, dir); err != nil {
+			http.Error(w, "Not Found", http.StatusNotFound)
+			return
+		}
+		keep := func(fi os.FileInfo) bool { return !fi.IsDir() && strings.EqualFold(path.Ext(fi.Name()), ext) }
+		err := readdirSorted(ctx, fs, dir, os.FileInfo.Name, keep, func(fi os.FileInfo) error {
+			names = append(names, path.Join(dir, fi.Name()))
+			return nil
+		})
+		if err != nil {
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	filter := r.eventFilter()
+	resp := reportResponse{XMLNS: "DAV:", XMLNSC: nsCalDAV, XMLNSCR: nsCardDAV}
+	for _, name := range names {
+		href := (&url.URL{Path: name}).EscapedPath()
+		fi, data, err := readPIMObject(ctx, fs, name)
+		if err != nil {
+			if multiget {
+				resp.Responses = append(resp.Responses, reportResource{Href: href, Status: "HTTP/1.1 404 Not Found"})
+			}
+			continue
+		}
+		if !multiget && dataProp.Space == nsCalDAV && !filter.matches(data) {
+			continue
+		}
+		found := reportPropstat{Status: "HTTP/1.1 200 OK"}
+		missing := reportPropstat{Status: "HTTP/1.1 404 Not Found"}
+		for _, pn := range r.Props {
+			switch pn {
+			case xml.Name{Space: "DAV:", Local: "getetag"}:
+				found.Props = append(found.Props, reportProp{XMLName: xml.Name{Local: "D:getetag"}, Value: davETag(fi)})
+			case xml.Name{Space: "DAV:", Local: "getcontenttype"}:
+				ct := "text/calendar; charset=utf-8"
+				if ext == ".vcf" {
+					ct = "text/vcard; charset=utf-8"
+				}
+				found.Props = append(found.Props, reportProp{XMLName: xml.Name{Local: "D:getcontenttype"}, Value: ct})
+			case dataProp:
+				prefix := "C:"
+				if dataProp.Space == nsCardDAV {
+					prefix = "CR:"
+				}
+				found.Props = append(found.Props, reportProp{XMLName: xml.Name{Local: prefix + dataProp.Local}, Value: string(data)})
+			default:
+				missing.Props = append(missing.Props, reportProp{XMLName: pn})
+			}
+		}
+		res := reportResource{Href: href}
+		for _, ps := range []reportPropstat{found, missing} {
+			if len(ps.Props) > 0 {
+				res.Propstats = append(res.Propstats, ps)
+			}
+		}
+		resp.Responses = append(resp.Responses, res)
+	}
+	w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+	w.WriteHeader(http.StatusMultiStatus)
+	io.WriteString(w, xml.Header)
+	xml.NewEncoder(w).Encode(resp)
+}
+
+func readPIMObject(ctx context.Context, fs webdav.FileSystem, name string) (os.FileInfo, []byte, error) {
+	f, err := fs.OpenFile(ctx, name, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, nil, err
+	}
+	if fi.IsDir() {
+		return nil, nil, os.ErrNotExist
+	}
+	data, err := io.ReadAll(io.LimitReader(f, 4<<20))
+	return fi, data, err
+}
+
+// handleWellKnownPIM sends CalDAV and CardDAV clients looking for the
+// service to the root, where the principal properties live.
+func handleWellKnownPIM(w http.ResponseWriter, req *http.Request) {
+	http.Redirect(w, req, "/", http.StatusMovedPermanently)
+}
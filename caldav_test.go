@@ -0,0 +1,152 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/webdav"
+)
+
+const (
+	testEvent  = "BEGIN:VCALENDAR\r\nBEGIN:VEVENT\r\nUID:1\r\nDTSTART:20240310T090000Z\r\nDTEND:20240310T100000Z\r\nSUMMARY:Dentist\r\nEND:VEVENT\r\nEND:VCALENDAR\r\n"
+	testAllDay = "BEGIN:VCALENDAR\r\nBEGIN:VEVENT\r\nUID:2\r\nDTSTART;VALUE=DATE:20240401\r\nSUMMARY:Holiday\r\nEND:VEVENT\r\nEND:VCALENDAR\r\n"
+	testWeekly = "BEGIN:VCALENDAR\r\nBEGIN:VEVENT\r\nUID:3\r\nDTSTART:20230101T080000Z\r\nDTEND:20230101T090000Z\r\nRRULE:FREQ=WEEKLY\r\nSUMMARY:Stand\r\n up\r\nEND:VEVENT\r\nEND:VCALENDAR\r\n"
+	testTodo   = "BEGIN:VCALENDAR\r\nBEGIN:VTODO\r\nUID:4\r\nSUMMARY:Taxes\r\nEND:VTODO\r\nEND:VCALENDAR\r\n"
+	testCard   = "BEGIN:VCARD\r\nVERSION:3.0\r\nFN:Ada Lovelace\r\nEND:VCARD\r\n"
+)
+
+func date(y int, m time.Month, d int) time.Time {
+	return time.Date(y, m, d, 0, 0, 0, 0, time.UTC)
+}
+
+func TestEventFilter(t *testing.T) {
+	tests := []struct {
+		name   string
+		filter eventFilter
+		data   string
+		want   bool
+	}{
+		{"no filter", eventFilter{}, testTodo, true},
+		{"component only", eventFilter{comp: "VEVENT"}, testEvent, true},
+		{"other component", eventFilter{comp: "VEVENT"}, testTodo, false},
+		{"in range", eventFilter{comp: "VEVENT", start: date(2024, 3, 1), end: date(2024, 4, 1)}, testEvent, true},
+		{"before range", eventFilter{comp: "VEVENT", start: date(2024, 3, 11), end: date(2024, 4, 1)}, testEvent, false},
+		{"after range", eventFilter{comp: "VEVENT", start: date(2024, 2, 1), end: date(2024, 3, 10)}, testEvent, false},
+		{"all day lasts a day", eventFilter{comp: "VEVENT", start: date(2024, 4, 1).Add(12 * time.Hour), end: date(2024, 4, 3)}, testAllDay, true},
+		{"recurring always", eventFilter{comp: "VEVENT", start: date(2030, 1, 1), end: date(2030, 2, 1)}, testWeekly, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.filter.matches([]byte(tt.data)); got != tt.want {
+				t.Errorf("matches = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPIMCollections(t *testing.T) {
+	root := t.TempDir()
+	for name, data := range map[string]string{
+		"cal/home/dentist.ics": testEvent,
+		"cal/home/holiday.ics": testAllDay,
+		"cal/home/notes.txt":   "not an event",
+		"cal/work/weekly.ics":  testWeekly,
+		"contacts/ada.vcf":     testCard,
+	} {
+		p := filepath.Join(root, filepath.FromSlash(name))
+		os.MkdirAll(filepath.Dir(p), 0755)
+		os.WriteFile(p, []byte(data), 0644)
+	}
+	defer func(m map[string]pimKind) { pimCollections = m }(pimCollections)
+	pimCollections = map[string]pimKind{"/cal/home": pimCalendar, "/cal/work": pimCalendar, "/contacts": pimAddressbook}
+	fs := SkipBrokenLink{webdav.Dir(root)}
+	h := &webdav.Handler{FileSystem: fs, LockSystem: webdav.NewMemLS()}
+
+	tests := []struct {
+		name    string
+		method  string
+		target  string
+		body    string
+		want    []string
+		notWant []string
+	}{
+		{
+			name:   "principal",
+			method: "PROPFIND",
+			target: "/",
+			body:   `<propfind xmlns="DAV:" xmlns:C="urn:ietf:params:xml:ns:caldav" xmlns:CR="urn:ietf:params:xml:ns:carddav"><prop><current-user-principal/><C:calendar-home-set/><CR:addressbook-home-set/></prop></propfind>`,
+			want:   []string{"<D:href xmlns:D=\"DAV:\">/</D:href>", ">/cal/</D:href>", ">/</D:href></addressbook-home-set>"},
+		},
+		{
+			name:   "calendar collection",
+			method: "PROPFIND",
+			target: "/cal/home",
+			body:   `<propfind xmlns="DAV:" xmlns:CS="http://calendarserver.org/ns/"><prop><resourcetype/><CS:getctag/></prop></propfind>`,
+			want:   []string{`<C:calendar xmlns:C="urn:ietf:params:xml:ns:caldav"/>`, "getctag"},
+		},
+		{
+			name:    "calendar query",
+			method:  "REPORT",
+			target:  "/cal/home/",
+			body:    `<C:calendar-query xmlns:D="DAV:" xmlns:C="urn:ietf:params:xml:ns:caldav"><D:prop><D:getetag/><C:calendar-data/></D:prop><C:filter><C:comp-filter name="VCALENDAR"><C:comp-filter name="VEVENT"><C:time-range start="20240301T000000Z" end="20240315T000000Z"/></C:comp-filter></C:comp-filter></C:filter></C:calendar-query>`,
+			want:    []string{"/cal/home/dentist.ics", "SUMMARY:Dentist", "<D:getetag>"},
+			notWant: []string{"holiday.ics", "notes.txt"},
+		},
+		{
+			name:    "calendar multiget",
+			method:  "REPORT",
+			target:  "/cal/work",
+			body:    `<C:calendar-multiget xmlns:D="DAV:" xmlns:C="urn:ietf:params:xml:ns:caldav"><D:prop><C:calendar-data/><D:displayname/></D:prop><D:href>/cal/work/weekly.ics</D:href><D:href>/cal/work/gone.ics</D:href></C:calendar-multiget>`,
+			want:    []string{"RRULE:FREQ=WEEKLY", "<D:href>/cal/work/gone.ics</D:href><D:status>HTTP/1.1 404 Not Found</D:status>", "<displayname xmlns=\"DAV:\"></displayname>"},
+			notWant: []string{"Dentist"},
+		},
+		{
+			name:   "addressbook query",
+			method: "REPORT",
+			target: "/contacts/",
+			body:   `<CR:addressbook-query xmlns:D="DAV:" xmlns:CR="urn:ietf:params:xml:ns:carddav"><D:prop><D:getetag/><CR:address-data/></D:prop></CR:addressbook-query>`,
+			want:   []string{"/contacts/ada.vcf", "<CR:address-data>BEGIN:VCARD"},
+		},
+		{
+			name:   "calendar report on address book",
+			method: "REPORT",
+			target: "/contacts/",
+			body:   `<C:calendar-query xmlns:C="urn:ietf:params:xml:ns:caldav"/>`,
+			want:   []string{"unsupported REPORT"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, tt.target, strings.NewReader(tt.body))
+			req.Header.Set("Depth", "0")
+			rec := httptest.NewRecorder()
+			if tt.method == "REPORT" {
+				handleReport(fs, rec, req)
+			} else {
+				h.ServeHTTP(rec, req)
+			}
+			body := rec.Body.String()
+			for _, s := range tt.want {
+				if !strings.Contains(body, s) {
+					t.Errorf("response lacks %q:\n%s", s, body)
+				}
+			}
+			for _, s := range tt.notWant {
+				if strings.Contains(body, s) {
+					t.Errorf("response has %q:\n%s", s, body)
+				}
+			}
+		})
+	}
+
+	rec := httptest.NewRecorder()
+	handleReport(fs, rec, httptest.NewRequest("REPORT", "/cal/home", strings.NewReader("<nope")))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("bad body: status %d", rec.Code)
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"html"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+var (
+	flagNotifyWebhook       = flag.String("notify-webhook", "", "post notifications to this webhook URL; for matrix, the room's .../rooms/ROOM/send/m.room.message URL")
+	flagNotifyWebhookFormat = flag.String("notify-webhook-format", "json", "message format of -notify-webhook: slack, discord, matrix or json (the raw events)")
+	flagNotifyWebhookToken  = flag.String("notify-webhook-token", "", "access token for -notify-webhook-format matrix")
+)
+
+// chatNotifier posts each batch of events to a chat webhook.
+type chatNotifier struct {
+	format string
+	url    string
+	token  string
+	client *http.Client
+}
+
+func startChatNotifier() error {
+	u, err := url.Parse(*flagNotifyWebhook)
+	if err != nil || u.Host == "" {
+		return fmt.Errorf("invalid -notify-webhook %q", *flagNotifyWebhook)
+	}
+	switch *flagNotifyWebhookFormat {
+	case "slack", "discord", "json":
+	case "matrix":
+		if *flagNotifyWebhookToken == "" {
+			return fmt.Errorf("-notify-webhook-format matrix needs -notify-webhook-token")
+		}
+	default:
+		return fmt.Errorf("unknown -notify-webhook-format %q", *flagNotifyWebhookFormat)
+	}
+	addNotifier(&chatNotifier{
+		format: *flagNotifyWebhookFormat,
+		url:    strings.TrimSuffix(u.String(), "/"),
+		token:  *flagNotifyWebhookToken,
+		client: &http.Client{Timeout: 10 * time.Second},
+	})
+	return nil
+}
+
+func (c *chatNotifier) name() string { return c.format + " webhook" }
+
+var chatIcons = map[string]string{
+	"upload":        "\U0001F4E5",
+	"quota":         "\u26A0\uFE0F",
+	"auth-failures": "\U0001F512",
+}
+
+// chatMarkup writes the markup of a chat's format.
+type chatMarkup struct {
+	text, bold, code func(string) string
+}
+
+func chatLine(ev notifyEvent, m chatMarkup) string {
+	icon := chatIcons[ev.Kind]
+	switch ev.Kind {
+	case "upload":
+		line := icon + " " + m.code(ev.Path) + m.text(" uploaded")
+		if ev.User != "" {
+			line += m.text(" by ") + m.bold(ev.User)
+		}
+		return line
+	case "auth-failures":
+		return icon + " " + m.bold("Failed logins:") + " " + m.text(ev.Message)
+	}
+	if icon != "" {
+		return icon + " " + m.text(ev.Message)
+	}
+	return m.text(ev.Message)
+}
+
+// payload returns the JSON body the chat service expects for events.
+func (c *chatNotifier) payload(events []notifyEvent) interface{} {
+	lines := func(m chatMarkup, sep string) string {
+		var out []string
+		for _, ev := range events {
+			out = append(out, chatLine(ev, m))
+		}
+		return strings.Join(out, sep)
+	}
+	switch c.format {
+	case "slack":
+		esc := strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;").Replace
+		text := lines(chatMarkup{
+			text: esc,
+			bold: func(s string) string { return "*" + esc(s) + "*" },
+			code: func(s string) string { return "`" + esc(s) + "`" },
+		}, "\n")
+		return map[string]string{"text": text}
+	case "discord":
+		text := lines(chatMarkup{
+			text: func(s string) string { return s },
+			bold: func(s string) string { return "**" + s + "**" },
+			code: func(s string) string { return "`" + s + "`" },
+		}, "\n")
+		// Discord rejects messages over 2000 characters.
+		if r := []rune(text); len(r) > 2000 {
+			text = string(r[:1999]) + "…"
+		}
+		return map[string]string{"content": text, "username": "gowebdav"}
+	case "matrix":
+		plain := func(s string) string { return s }
+		return map[string]string{
+			"msgtype": "m.text",
+			"body":    lines(chatMarkup{plain, plain, plain}, "\n"),
+			"format":  "org.matrix.custom.html",
+			"formatted_body": lines(chatMarkup{
+				text: html.EscapeString,
+				bold: func(s string) string { return "<b>" + html.EscapeString(s) + "</b>" },
+				code: func(s string) string { return "<code>" + html.EscapeString(s) + "</code>" },
+			}, "<br>"),
+		}
+	}
+	return events
+}
+
+func (c *chatNotifier) send(events []notifyEvent) error {
+	body, err := json.Marshal(c.payload(events))
+	if err != nil {
+		return err
+	}
+	method, target := "POST", c.url
+	if c.format == "matrix" {
+		// Matrix wants a transaction ID per message so retries are not
+		// posted twice.
+		var txn [8]byte
+		rand.Read(txn[:])
+		method, target = "PUT", target+"/"+hex.EncodeToString(txn[:])
+	}
+	req, err := http.NewRequest(method, target, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook answered %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestChatNotifier(t *testing.T) {
+	type posted struct {
+		method, path, auth string
+		body               map[string]interface{}
+	}
+	got := make(chan posted, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var body map[string]interface{}
+		json.NewDecoder(req.Body).Decode(&body)
+		got <- posted{req.Method, req.URL.Path, req.Header.Get("Authorization"), body}
+	}))
+	defer srv.Close()
+
+	events := []notifyEvent{
+		{Kind: "upload", Path: "/inbox/a<b>.txt", User: "bob", Message: "/inbox/a<b>.txt uploaded by bob"},
+		{Kind: "auth-failures", Client: "192.0.2.9", Message: "5 failed logins from 192.0.2.9 within 10 minutes"},
+	}
+	tests := []struct {
+		format, field, want string
+	}{
+		{"slack", "text", "\U0001F4E5 `/inbox/a&lt;b&gt;.txt` uploaded by *bob*\n\U0001F512 *Failed logins:* 5 failed logins"},
+		{"discord", "content", "\U0001F4E5 `/inbox/a<b>.txt` uploaded by **bob**\n"},
+		{"matrix", "formatted_body", "\U0001F4E5 <code>/inbox/a&lt;b&gt;.txt</code> uploaded by <b>bob</b><br>"},
+		{"matrix", "body", "\U0001F4E5 /inbox/a<b>.txt uploaded by bob\n"},
+	}
+	for _, tt := range tests {
+		c := &chatNotifier{format: tt.format, url: srv.URL + "/hook", client: srv.Client()}
+		if tt.format == "matrix" {
+			c.token = "tok"
+		}
+		if err := c.send(events); err != nil {
+			t.Fatal(err)
+		}
+		p := <-got
+		text, _ := p.body[tt.field].(string)
+		if !strings.HasPrefix(text, tt.want) {
+			t.Errorf("%s %s = %q, want prefix %q", tt.format, tt.field, text, tt.want)
+		}
+		if tt.format == "matrix" {
+			if p.method != "PUT" || !strings.HasPrefix(p.path, "/hook/") || p.auth != "Bearer tok" {
+				t.Errorf("matrix request %s %s %q", p.method, p.path, p.auth)
+			}
+		} else if p.method != "POST" || p.path != "/hook" {
+			t.Errorf("%s request %s %s", tt.format, p.method, p.path)
+		}
+	}
+
+	long := make([]notifyEvent, 100)
+	for i := range long {
+		long[i] = notifyEvent{Kind: "upload", Path: "/" + strings.Repeat("x", 40)}
+	}
+	c := &chatNotifier{format: "discord"}
+	if text := c.payload(long).(map[string]string)["content"]; len([]rune(text)) > 2000 {
+		t.Errorf("discord message has %d characters", len([]rune(text)))
+	}
+}
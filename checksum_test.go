@@ -0,0 +1,180 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+	"golang.org/x/net/webdav"
+)
+
+func TestHashCacheSum(t *testing.T) {
+	root := t.TempDir()
+	file := filepath.Join(root, "a.txt")
+	os.WriteFile(file, []byte("hello\n"), 0644)
+	fs := webdav.Dir(root)
+	c := newHashCache(3)
+	ctx := context.Background()
+
+	tests := []struct {
+		name    string
+		algo    string
+		want    string
+		wantErr bool
+	}{
+		{"sha256", "sha256", "5891b5b522d5df086d0ff0b110fbd9d21bb4fc7163af34d08286a2e846f6be03", false},
+		{"md5 upper-case", "MD5", "b1946ac92492d2347c6235b4d2611184", false},
+		{"sha1", "sha1", "f572d396fae9206628714fb2ce00f72e94f2258f", false},
+		{"unknown", "crc32", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := c.sum(ctx, fs, "/a.txt", tt.algo)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("sum = %s, want %s", got, tt.want)
+			}
+		})
+	}
+
+	// A cached entry is reused while size and mtime match...
+	key := hashKey{"sha256", "/a.txt"}
+	c.entries[key].Value.(*hashEntry).sum = "cached"
+	if got, _ := c.sum(ctx, fs, "/a.txt", "sha256"); got != "cached" {
+		t.Errorf("sum = %s, want cached value", got)
+	}
+	// ...and recomputed once the file changes.
+	os.WriteFile(file, []byte("changed\n"), 0644)
+	os.Chtimes(file, time.Now(), time.Now().Add(time.Minute))
+	if got, _ := c.sum(ctx, fs, "/a.txt", "sha256"); got == "cached" {
+		t.Error("stale cached sum returned after modification")
+	}
+
+	if _, err := c.sum(ctx, fs, "/", "sha256"); err == nil {
+		t.Error("hashing a directory succeeded")
+	}
+
+	// Only the two most recently used digests are kept.
+	c = newHashCache(2)
+	c.sum(ctx, fs, "/a.txt", "sha256")
+	c.sum(ctx, fs, "/a.txt", "sha1")
+	c.sum(ctx, fs, "/a.txt", "sha256")
+	c.sum(ctx, fs, "/a.txt", "md5")
+	if len(c.entries) != 2 || c.lru.Len() != 2 {
+		t.Errorf("cache holds %d entries, want 2", len(c.entries))
+	}
+	if _, ok := c.entries[hashKey{"sha1", "/a.txt"}]; ok {
+		t.Error("least recently used digest kept")
+	}
+	c.forget("/")
+	if len(c.entries) != 0 || c.lru.Len() != 0 {
+		t.Errorf("cache holds %d entries after forgetting the root", len(c.entries))
+	}
+}
+
+func TestSkipBrokenLinkForgetsHashes(t *testing.T) {
+	root := t.TempDir()
+	os.Mkdir(filepath.Join(root, "d"), 0755)
+	os.WriteFile(filepath.Join(root, "d", "a.txt"), []byte("hello\n"), 0644)
+	os.WriteFile(filepath.Join(root, "b.txt"), []byte("hello\n"), 0644)
+	fs := SkipBrokenLink{webdav.Dir(root)}
+	ctx := context.Background()
+	for _, name := range []string{"/d/a.txt", "/b.txt"} {
+		if _, err := fileHashes.sum(ctx, fs, name, "sha256"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	defer fileHashes.forget("/")
+	if err := fs.Rename(ctx, "/d", "/e"); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.RemoveAll(ctx, "/b.txt"); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"/d/a.txt", "/b.txt"} {
+		if _, ok := fileHashes.entries[hashKey{"sha256", name}]; ok {
+			t.Errorf("digest of %s kept", name)
+		}
+	}
+}
+
+func TestHandleManifest(t *testing.T) {
+	root := t.TempDir()
+	os.MkdirAll(filepath.Join(root, "d", "sub"), 0755)
+	os.WriteFile(filepath.Join(root, "d", "b.txt"), []byte("hello\n"), 0644)
+	os.WriteFile(filepath.Join(root, "d", "sub", "a.txt"), []byte("hello\n"), 0644)
+	os.WriteFile(filepath.Join(root, "d", ".hidden"), []byte("x"), 0644)
+	fs := webdav.Dir(root)
+
+	tests := []struct {
+		name   string
+		algo   string
+		status int
+		body   string
+	}{
+		{"sha256", "sha256", http.StatusOK,
+			"5891b5b522d5df086d0ff0b110fbd9d21bb4fc7163af34d08286a2e846f6be03  b.txt\n" +
+				"5891b5b522d5df086d0ff0b110fbd9d21bb4fc7163af34d08286a2e846f6be03  sub/a.txt\n"},
+		{"md5", "md5", http.StatusOK,
+			"b1946ac92492d2347c6235b4d2611184  b.txt\n" +
+				"b1946ac92492d2347c6235b4d2611184  sub/a.txt\n"},
+		{"unsupported", "crc", http.StatusBadRequest, "unsupported hash \"crc\"\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			handleManifest(fs, rec, httptest.NewRequest("GET", "/d/?manifest="+tt.algo, nil), "/d/", tt.algo)
+			if rec.Code != tt.status {
+				t.Errorf("status = %d, want %d", rec.Code, tt.status)
+			}
+			if rec.Body.String() != tt.body {
+				t.Errorf("body = %q, want %q", rec.Body, tt.body)
+			}
+		})
+	}
+}
+
+func TestHandleFileHash(t *testing.T) {
+	root := t.TempDir()
+	os.MkdirAll(filepath.Join(root, "d"), 0755)
+	os.WriteFile(filepath.Join(root, "d", "a.txt"), []byte("hello\n"), 0644)
+	fs := webdav.Dir(root)
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		algo   string
+		status int
+		digest string
+		body   string
+	}{
+		{"sha256", "GET", "/d/a.txt", "sha256", http.StatusOK, "SHA-256=WJG1tSLV3whtD/CxEPvZ0hu0/HFjrzTQgoai6Eb2vgM=",
+			"5891b5b522d5df086d0ff0b110fbd9d21bb4fc7163af34d08286a2e846f6be03  a.txt\n"},
+		{"md5 head", "HEAD", "/d/a.txt", "MD5", http.StatusOK, "MD5=sZRqySSS0jR8YjW00mERhA==", ""},
+		{"directory", "GET", "/d", "sha256", http.StatusBadRequest, "", ""},
+		{"missing", "GET", "/nope", "sha256", http.StatusNotFound, "", ""},
+		{"bad algo", "GET", "/d/a.txt", "crc32", http.StatusBadRequest, "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			handleFileHash(fs, rec, httptest.NewRequest(tt.method, tt.path+"?hash="+tt.algo, nil), tt.algo)
+			if rec.Code != tt.status {
+				t.Fatalf("status = %d, want %d", rec.Code, tt.status)
+			}
+			if got := rec.Header().Get("Digest"); got != tt.digest {
+				t.Errorf("Digest = %q, want %q", got, tt.digest)
+			}
+			if tt.status == http.StatusOK && rec.Body.String() != tt.body {
+				t.Errorf("body = %q, want %q", rec.Body, tt.body)
+			}
+		})
+	}
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+	"golang.org/x/net/webdav"
+)
+
+var (
+	flagClamd           = flag.String("clamd", "", "clamd socket to scan uploads with, e.g. /run/clamav/clamd.ctl or tcp:127.0.0.1:3310")
+	flagClamdMode       = flag.String("clamd-mode", "inline", "scan uploads inline (before responding) or async")
+	flagClamdAction     = flag.String("clamd-action", "reject", "action on detection: reject, quarantine or alert")
+	flagClamdQuarantine = flag.String("clamd-quarantine", "", "directory infected uploads are moved to with -clamd-action quarantine")
+	flagClamdWebhook    = flag.String("clamd-webhook", "", "url to POST a JSON alert to on detection")
+)
+
+const clamdChunkSize = 64 << 10
+
+// clamdAddr splits a -clamd value into a network and address. Paths are
+// unix sockets; "tcp:host:port" and "unix:path" are explicit.
+func clamdAddr(s string) (network, addr string) {
+	switch {
+	case strings.HasPrefix(s, "tcp:"):
+		return "tcp", strings.TrimPrefix(s, "tcp:")
+	case strings.HasPrefix(s, "unix:"):
+		return "unix", strings.TrimPrefix(s, "unix:")
+	case strings.HasPrefix(s, "/"):
+		return "unix", s
+	default:
+		return "tcp", s
+	}
+}
+
+// clamdScan streams r to clamd with the INSTREAM command. It returns the
+// signature name when clamd finds something, and "" when the data is clean.
+func clamdScan(addr string, r io.Reader) (string, error) {
+	network, address := clamdAddr(addr)
+	conn, err := net.DialTimeout(network, address, 5*time.Second)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte("zINSTREAM\x00")); err != nil {
+		return "", err
+	}
+	buf := make([]byte, 4+clamdChunkSize)
+	for {
+		n, rerr := io.ReadFull(r, buf[4:])
+		if n > 0 {
+			binary.BigEndian.PutUint32(buf[:4], uint32(n))
+			if _, err := conn.Write(buf[:4+n]); err != nil {
+				return "", err
+			}
+		}
+		if rerr == io.EOF || rerr == io.ErrUnexpectedEOF {
+			break
+		}
+		if rerr != nil {
+			return "", rerr
+		}
+	}
+	if _, err := conn.Write([]byte{0, 0, 0, 0}); err != nil {
+		return "", err
+	}
+
+	reply, err := bufio.NewReader(conn).ReadString(0)
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+	reply = strings.TrimSpace(strings.TrimRight(reply, "\x00"))
+	reply = strings.TrimPrefix(reply, "stream: ")
+	switch {
+	case reply == "OK":
+		return "", nil
+	case strings.HasSuffix(reply, " FOUND"):
+		return strings.TrimSuffix(reply, " FOUND"), nil
+	default:
+		return "", fmt.Errorf("clamd: %s", reply)
+	}
+}
+
+// scanUpload scans name and applies -clamd-action to it when infected.
+func scanUpload(fs webdav.FileSystem, name, user string) (string, error) {
+	ctx := context.Background()
+	f, err := fs.OpenFile(ctx, name, os.O_RDONLY, 0)
+	if err != nil {
+		return "", err
+	}
+	virus, err := clamdScan(*flagClamd, f)
+	f.Close()
+	if err != nil || virus == "" {
+		return "", err
+	}
+
+	log.Printf("Virus %s found in %s uploaded by %q, action %s", virus, name, user, *flagClamdAction)
+	switch *flagClamdAction {
+	case "quarantine":
+		if err := quarantine(fs, name); err != nil {
+			log.Printf("Failed to quarantine %s: %v", name, err)
+			fs.RemoveAll(ctx, name)
+		}
+	case "alert":
+	default:
+		if err := fs.RemoveAll(ctx, name); err != nil {
+			log.Printf("Failed to remove %s: %v", name, err)
+		}
+	}
+	if *flagClamdWebhook != "" {
+		go postVirusAlert(name, virus, user)
+	}
+	return virus, nil
+}
+
+func quarantine(fs webdav.FileSystem, name string) error {
+	if *flagClamdQuarantine == "" {
+		return errors.New("-clamd-quarantine is not set")
+	}
+	ctx := context.Background()
+	src, err := fs.OpenFile(ctx, name, os.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	stamp := time.Now().UTC().Format("20060102T150405")
+	dst, err := os.OpenFile(filepath.Join(*flagClamdQuarantine, stamp+"-"+path.Base(name)), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(dst, src); err != nil {
+		dst.Close()
+		return err
+	}
+	if err := dst.Close(); err != nil {
+		return err
+	}
+	return fs.RemoveAll(ctx, name)
+}
+
+func postVirusAlert(name, virus, user string) {
+	body, _ := json.Marshal(map[string]string{
+		"event":  "virus_found",
+		"path":   name,
+		"virus":  virus,
+		"user":   user,
+		"action": *flagClamdAction,
+		"time":   time.Now().UTC().Format(time.RFC3339),
+	})
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Post(*flagClamdWebhook, "application/json", bytes.NewReader(body))
+	if err != nil {
+		log.Printf("Failed to post virus alert: %v", err)
+		return
+	}
+	resp.Body.Close()
+}
+
+// scanWriter holds back a successful PUT response until the upload has been
+// scanned, replacing it with 403 when the file was rejected.
+type scanWriter struct {
+	http.ResponseWriter
+	scan     func() (string, error)
+	rejected bool
+}
+
+func (w *scanWriter) WriteHeader(code int) {
+	if code == http.StatusCreated || code == http.StatusNoContent {
+		virus, err := w.scan()
+		if err != nil {
+			// Fail open: an unreachable clamd must not block all uploads.
+			log.Printf("Failed to scan upload: %v", err)
+		} else if virus != "" && *flagClamdAction != "alert" {
+			w.rejected = true
+			w.ResponseWriter.Header().Del("ETag")
+			http.Error(w.ResponseWriter, "WebDAV: upload rejected, virus found: "+virus, http.StatusForbidden)
+			return
+		}
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *scanWriter) Write(b []byte) (int, error) {
+	if w.rejected {
+		return len(b), nil
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// serveScannedPut serves a PUT through h and scans the stored file.
+func serveScannedPut(h *webdav.Handler, w http.ResponseWriter, req *http.Request) {
+	user, _, _ := req.BasicAuth()
+	name := req.URL.Path
+	scan := func() (string, error) { return scanUpload(h.FileSystem, name, user) }
+
+	if *flagClamdMode == "async" {
+		sw := &statusWriter{ResponseWriter: w}
+		h.ServeHTTP(sw, req)
+		if sw.status == http.StatusCreated || sw.status == http.StatusNoContent {
+			go func() {
+				if _, err := scan(); err != nil {
+					log.Printf("Failed to scan upload %s: %v", name, err)
+				}
+			}()
+		}
+		return
+	}
+	h.ServeHTTP(&scanWriter{ResponseWriter: w, scan: scan}, req)
+}
+
+func checkClamdFlags() error {
+	switch *flagClamdMode {
+	case "inline", "async":
+	default:
+		return fmt.Errorf("invalid -clamd-mode %q", *flagClamdMode)
+	}
+	switch *flagClamdAction {
+	case "reject", "alert":
+	case "quarantine":
+		if *flagClamdQuarantine == "" {
+			return errors.New("-clamd-action quarantine needs -clamd-quarantine")
+		}
+	default:
+		return fmt.Errorf("invalid -clamd-action %q", *flagClamdAction)
+	}
+	return nil
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/webdav"
+)
+
+// fakeClamd accepts INSTREAM scans and reports a virus when the stream
+// contains "EICAR".
+func fakeClamd(t *testing.T, reply string) string {
+	t.Helper()
+	sock := filepath.Join(t.TempDir(), "clamd.sock")
+	ln, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+				if cmd, err := r.ReadString(0); err != nil || cmd != "zINSTREAM\x00" {
+					return
+				}
+				var data []byte
+				for {
+					var size uint32
+					if err := binary.Read(r, binary.BigEndian, &size); err != nil {
+						return
+					}
+					if size == 0 {
+						break
+					}
+					chunk := make([]byte, size)
+					if _, err := io.ReadFull(r, chunk); err != nil {
+						return
+					}
+					data = append(data, chunk...)
+				}
+				switch {
+				case reply != "":
+					io.WriteString(conn, reply+"\x00")
+				case strings.Contains(string(data), "EICAR"):
+					io.WriteString(conn, "stream: Eicar-Test-Signature FOUND\x00")
+				default:
+					io.WriteString(conn, "stream: OK\x00")
+				}
+			}(conn)
+		}
+	}()
+	return sock
+}
+
+func TestClamdAddr(t *testing.T) {
+	tests := []struct {
+		in, network, addr string
+	}{
+		{"/run/clamav/clamd.ctl", "unix", "/run/clamav/clamd.ctl"},
+		{"unix:clamd.sock", "unix", "clamd.sock"},
+		{"tcp:127.0.0.1:3310", "tcp", "127.0.0.1:3310"},
+		{"localhost:3310", "tcp", "localhost:3310"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			network, addr := clamdAddr(tt.in)
+			if network != tt.network || addr != tt.addr {
+				t.Errorf("clamdAddr = %q %q, want %q %q", network, addr, tt.network, tt.addr)
+			}
+		})
+	}
+}
+
+func TestClamdScan(t *testing.T) {
+	clean := fakeClamd(t, "")
+	broken := fakeClamd(t, "INSTREAM size limit exceeded. ERROR")
+	tests := []struct {
+		name    string
+		sock    string
+		data    string
+		virus   string
+		wantErr bool
+	}{
+		{"clean", clean, "hello", "", false},
+		{"empty", clean, "", "", false},
+		{"large clean", clean, strings.Repeat("x", 3*clamdChunkSize+7), "", false},
+		{"infected", clean, "X5O!P%@AP EICAR test", "Eicar-Test-Signature", false},
+		{"clamd error", broken, "hello", "", true},
+		{"unreachable", filepath.Join(t.TempDir(), "missing.sock"), "hello", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			virus, err := clamdScan(tt.sock, strings.NewReader(tt.data))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if virus != tt.virus {
+				t.Errorf("virus = %q, want %q", virus, tt.virus)
+			}
+		})
+	}
+}
+
+func TestServeScannedPut(t *testing.T) {
+	sock := fakeClamd(t, "")
+	defer func(clamd, mode, action, q string) {
+		*flagClamd, *flagClamdMode, *flagClamdAction, *flagClamdQuarantine = clamd, mode, action, q
+	}(*flagClamd, *flagClamdMode, *flagClamdAction, *flagClamdQuarantine)
+
+	tests := []struct {
+		name        string
+		action      string
+		body        string
+		status      int
+		kept        bool
+		quarantined bool
+	}{
+		{"clean upload", "reject", "hello", http.StatusCreated, true, false},
+		{"reject", "reject", "EICAR", http.StatusForbidden, false, false},
+		{"quarantine", "quarantine", "EICAR", http.StatusForbidden, false, true},
+		{"alert only", "alert", "EICAR", http.StatusCreated, true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root, qdir := t.TempDir(), t.TempDir()
+			*flagClamd, *flagClamdMode, *flagClamdAction, *flagClamdQuarantine = sock, "inline", tt.action, qdir
+			h := &webdav.Handler{FileSystem: webdav.Dir(root), LockSystem: webdav.NewMemLS()}
+
+			req := httptest.NewRequest("PUT", "/file.txt", strings.NewReader(tt.body))
+			rec := httptest.NewRecorder()
+			serveScannedPut(h, rec, req)
+			if rec.Code != tt.status {
+				t.Errorf("status = %d, want %d (%s)", rec.Code, tt.status, rec.Body)
+			}
+			if _, err := os.Stat(filepath.Join(root, "file.txt")); (err == nil) != tt.kept {
+				t.Errorf("file kept = %v, want %v", err == nil, tt.kept)
+			}
+			entries, _ := os.ReadDir(qdir)
+			if (len(entries) == 1) != tt.quarantined {
+				t.Errorf("quarantine dir has %d entries", len(entries))
+			}
+		})
+	}
+}
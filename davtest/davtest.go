@@ -0,0 +1,162 @@
+// Package davtest runs an in-memory WebDAV server for integration tests.
+//
+// The server listens on a random loopback port, keeps its files in memory
+// and knows only the users a test adds, so tests need no fixtures on disk:
+//
+//	srv := davtest.NewServer()
+//	defer srv.Close()
+//	srv.AddUser(davtest.User{Name: "alice", Password: "secret"})
+//	srv.WriteFile("/docs/readme.txt", []byte("hello"))
+//	// Point the client under test at srv.URL.
+package davtest
+
+import (
+	"crypto/subtle"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"sync"
+
+	"golang.org/x/net/context"
+	"golang.org/x/net/webdav"
+)
+
+// User is an account the server accepts with basic authentication.
+type User struct {
+	Name     string
+	Password string
+	// ReadOnly users may read and list files but get 403 Forbidden on any
+	// request that would change them.
+	ReadOnly bool
+}
+
+// Server is a WebDAV server backed by memory. Until a user is added it
+// serves anyone, like gowebdav without -user and -password.
+type Server struct {
+	// URL is the base URL of the server, e.g. http://127.0.0.1:41234.
+	URL string
+	// FS is the file system the server serves, for tests that want to
+	// look at or change files directly.
+	FS webdav.FileSystem
+
+	srv     *httptest.Server
+	handler *webdav.Handler
+
+	mu    sync.Mutex
+	users map[string]User
+}
+
+// NewServer starts a server. Close it when the test is done.
+func NewServer() *Server {
+	return newServer(httptest.NewServer)
+}
+
+// NewTLSServer starts a server on HTTPS with a self-signed certificate,
+// which the client returned by Client trusts.
+func NewTLSServer() *Server {
+	return newServer(httptest.NewTLSServer)
+}
+
+func newServer(start func(http.Handler) *httptest.Server) *Server {
+	s := &Server{FS: webdav.NewMemFS(), users: make(map[string]User)}
+	s.handler = &webdav.Handler{FileSystem: s.FS, LockSystem: webdav.NewMemLS()}
+	s.srv = start(http.HandlerFunc(s.serveHTTP))
+	s.URL = s.srv.URL
+	return s
+}
+
+// Client returns an HTTP client set up to talk to the server.
+func (s *Server) Client() *http.Client {
+	return s.srv.Client()
+}
+
+// Close shuts the server down.
+func (s *Server) Close() {
+	s.srv.Close()
+}
+
+// AddUser adds or replaces an account. Once any account exists, requests
+// without valid credentials get 401 Unauthorized.
+func (s *Server) AddUser(u User) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.users[u.Name] = u
+}
+
+// RemoveUser deletes an account.
+func (s *Server) RemoveUser(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.users, name)
+}
+
+// Mkdir creates the folder name along with any missing parents.
+func (s *Server) Mkdir(name string) error {
+	ctx := context.Background()
+	dir := "/"
+	for _, part := range strings.Split(strings.Trim(path.Clean("/"+name), "/"), "/") {
+		if part == "" {
+			continue
+		}
+		dir = path.Join(dir, part)
+		if err := s.FS.Mkdir(ctx, dir, 0755); err != nil && !os.IsExist(err) {
+			if fi, serr := s.FS.Stat(ctx, dir); serr != nil || !fi.IsDir() {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// WriteFile stores data as name, creating its folders as needed.
+func (s *Server) WriteFile(name string, data []byte) error {
+	name = path.Clean("/" + name)
+	if err := s.Mkdir(path.Dir(name)); err != nil {
+		return err
+	}
+	f, err := s.FS.OpenFile(context.Background(), name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// ReadFile returns the content of name.
+func (s *Server) ReadFile(name string) ([]byte, error) {
+	f, err := s.FS.OpenFile(context.Background(), path.Clean("/"+name), os.O_RDONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return io.ReadAll(f)
+}
+
+func (s *Server) serveHTTP(w http.ResponseWriter, req *http.Request) {
+	s.mu.Lock()
+	anonymous := len(s.users) == 0
+	name, password, _ := req.BasicAuth()
+	u, known := s.users[name]
+	s.mu.Unlock()
+	if !anonymous {
+		if !known || subtle.ConstantTimeCompare([]byte(password), []byte(u.Password)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Basic realm="Restricted"`)
+			http.Error(w, "WebDAV: need authorized!", http.StatusUnauthorized)
+			return
+		}
+		if u.ReadOnly {
+			switch req.Method {
+			case "PUT", "DELETE", "PROPPATCH", "MKCOL", "COPY", "MOVE", "LOCK", "UNLOCK":
+				http.Error(w, "WebDAV: Read Only!!!", http.StatusForbidden)
+				return
+			}
+		}
+	}
+	s.handler.ServeHTTP(w, req)
+}
@@ -0,0 +1,100 @@
+package davtest_test
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/clgcn/gowebdav/davtest"
+)
+
+func TestServer(t *testing.T) {
+	srv := davtest.NewServer()
+	defer srv.Close()
+	if err := srv.WriteFile("/a/b/file.txt", []byte("content")); err != nil {
+		t.Fatal(err)
+	}
+
+	do := func(method, p, user, password, body string) *http.Response {
+		t.Helper()
+		req, _ := http.NewRequest(method, srv.URL+p, strings.NewReader(body))
+		if user != "" {
+			req.SetBasicAuth(user, password)
+		}
+		resp, err := srv.Client().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+
+	if resp := do("GET", "/a/b/file.txt", "", "", ""); resp.StatusCode != http.StatusOK {
+		t.Errorf("anonymous GET: %s", resp.Status)
+	}
+
+	srv.AddUser(davtest.User{Name: "alice", Password: "secret"})
+	srv.AddUser(davtest.User{Name: "bob", Password: "pw", ReadOnly: true})
+	tests := []struct {
+		method, path, user, password string
+		status                       int
+	}{
+		{"GET", "/a/b/file.txt", "", "", http.StatusUnauthorized},
+		{"GET", "/a/b/file.txt", "alice", "wrong", http.StatusUnauthorized},
+		{"PROPFIND", "/a/", "alice", "secret", http.StatusMultiStatus},
+		{"PUT", "/a/new.txt", "alice", "secret", http.StatusCreated},
+		{"GET", "/a/b/file.txt", "bob", "pw", http.StatusOK},
+		{"PUT", "/a/bob.txt", "bob", "pw", http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		body := ""
+		if tt.method == "PUT" {
+			body = "uploaded"
+		}
+		if resp := do(tt.method, tt.path, tt.user, tt.password, body); resp.StatusCode != tt.status {
+			t.Errorf("%s %s as %q: %s, want %d", tt.method, tt.path, tt.user, resp.Status, tt.status)
+		}
+	}
+	if data, err := srv.ReadFile("/a/new.txt"); err != nil || string(data) != "uploaded" {
+		t.Errorf("ReadFile = %q, %v", data, err)
+	}
+
+	srv.RemoveUser("alice")
+	if resp := do("GET", "/a/new.txt", "alice", "secret", ""); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("removed user: %s", resp.Status)
+	}
+}
+
+func TestTLSServer(t *testing.T) {
+	srv := davtest.NewTLSServer()
+	defer srv.Close()
+	srv.WriteFile("/x.txt", []byte("x"))
+	resp, err := srv.Client().Get(srv.URL + "/x.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if !strings.HasPrefix(srv.URL, "https://") || resp.StatusCode != http.StatusOK {
+		t.Errorf("%s: %s", srv.URL, resp.Status)
+	}
+}
+
+func Example() {
+	srv := davtest.NewServer()
+	defer srv.Close()
+	srv.AddUser(davtest.User{Name: "alice", Password: "secret"})
+	srv.WriteFile("/docs/readme.txt", []byte("hello"))
+
+	req, _ := http.NewRequest("GET", srv.URL+"/docs/readme.txt", nil)
+	req.SetBasicAuth("alice", "secret")
+	resp, err := srv.Client().Do(req)
+	if err != nil {
+		panic(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	fmt.Println(resp.StatusCode, string(body))
+	// Output: 200 hello
+}
@@ -0,0 +1,393 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"hash/adler32"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+	"golang.org/x/net/webdav"
+)
+
+var (
+	flagDelta          = flag.Bool("delta", false, "serve block checksums of files at ?blocks and accept PATCH uploads of just the changed byte ranges, for delta transfers of large files")
+	flagDeltaBlockSize = flag.String("delta-block-size", "1MiB", "block size of ?blocks checksums, unless the request names another as ?blocks=SIZE")
+)
+
+const (
+	minDeltaBlock = 4 << 10
+	maxDeltaBlock = 64 << 20
+	// maxBlockLists is how many files' block checksums are kept in memory.
+	maxBlockLists = 64
+)
+
+var deltaBlockSize int64
+
+func startDelta() error {
+	size, err := parseByteSize(*flagDeltaBlockSize)
+	if err != nil {
+		return err
+	}
+	if size < minDeltaBlock || size > maxDeltaBlock {
+		return fmt.Errorf("%s is not between 4KiB and 64MiB", *flagDeltaBlockSize)
+	}
+	deltaBlockSize = size
+	return nil
+}
+
+// blockSum checksums one block of a file, as rsync and zsync do: Weak is
+// the Adler-32 a client can roll through its copy to find blocks that
+// moved, Strong the SHA-256 that confirms a match.
+type blockSum struct {
+	Weak   uint32
+	Strong [sha256.Size]byte
+}
+
+// blockList holds the block checksums of a file as of its size and
+// modification time.
+type blockList struct {
+	size      int64
+	modTime   time.Time
+	blockSize int64
+	sums      []blockSum
+}
+
+type blockKey struct {
+	name      string
+	blockSize int64
+}
+
+// blockLists caches block checksums. PATCH updates the blocks it changes,
+// so a client syncing a large file need not wait for all of it to be read
+// again each time.
+var blockLists = struct {
+	sync.Mutex
+	m map[blockKey]*blockList
+}{m: make(map[blockKey]*blockList)}
+
+// sumBlocks recomputes the checksums of the blocks from first on of l,
+// reading them from f, to cover size bytes. With changed set, only the
+// blocks it reports true for are read.
+func (l *blockList) sumBlocks(ctx context.Context, f webdav.File, size int64, changed func(i int64) bool) error {
+	n := (size + l.blockSize - 1) / l.blockSize
+	sums := make([]blockSum, n)
+	copy(sums, l.sums)
+	buf := make([]byte, l.blockSize)
+	for i := int64(0); i < n; i++ {
+		if i < int64(len(l.sums)) && changed != nil && !changed(i) {
+			continue
+		}
+		if _, err := f.Seek(i*l.blockSize, io.SeekStart); err != nil {
+			return err
+		}
+		m, err := io.ReadFull(ctxFile{f, ctx}, buf)
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return err
+		}
+		sums[i] = blockSum{Weak: adler32.Checksum(buf[:m]), Strong: sha256.Sum256(buf[:m])}
+	}
+	l.sums = sums
+	return nil
+}
+
+// blocksOf returns the block checksums of name, computing them if the file
+// changed since they were last.
+func blocksOf(ctx context.Context, fs webdav.FileSystem, name string, blockSize int64) (*blockList, error) {
+	f, err := fs.OpenFile(ctx, name, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	key := blockKey{name, blockSize}
+	blockLists.Lock()
+	l := blockLists.m[key]
+	blockLists.Unlock()
+	if l != nil && l.size == fi.Size() && l.modTime.Equal(fi.ModTime()) {
+		return l, nil
+	}
+	l = &blockList{size: fi.Size(), modTime: fi.ModTime(), blockSize: blockSize}
+	if err := l.sumBlocks(ctx, f, fi.Size(), nil); err != nil {
+		return nil, err
+	}
+	blockLists.Lock()
+	if len(blockLists.m) >= maxBlockLists {
+		for k := range blockLists.m {
+			delete(blockLists.m, k)
+			break
+		}
+	}
+	blockLists.m[key] = l
+	blockLists.Unlock()
+	return l, nil
+}
+
+// handleBlocks answers ?blocks on a file with the checksums of its blocks,
+// for a client to work out which of them it needs to PATCH.
+func handleBlocks(fs webdav.FileSystem, w http.ResponseWriter, req *http.Request) {
+	blockSize := deltaBlockSize
+	if v := req.URL.Query().Get("blocks"); v != "" {
+		size, err := parseByteSize(v)
+		if err != nil || size < minDeltaBlock || size > maxDeltaBlock {
+			http.Error(w, "WebDAV: block size must be between 4KiB and 64MiB", http.StatusBadRequest)
+			return
+		}
+		blockSize = size
+	}
+	fi, err := fs.Stat(req.Context(), req.URL.Path)
+	if err != nil {
+		http.Error(w, "Not Found", http.StatusNotFound)
+		return
+	}
+	if fi.IsDir() {
+		http.Error(w, "WebDAV: ?blocks needs a file", http.StatusBadRequest)
+		return
+	}
+	l, err := blocksOf(req.Context(), fs, req.URL.Path, blockSize)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	type block struct {
+		Weak   uint32 `json:"weak"`
+		Strong string `json:"strong"`
+	}
+	blocks := make([]block, len(l.sums))
+	for i, s := range l.sums {
+		blocks[i] = block{s.Weak, hex.EncodeToString(s.Strong[:])}
+	}
+	w.Header().Set("ETag", davETag(fi))
+	w.Header().Set("Accept-Patch", "multipart/byteranges, application/octet-stream")
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"size":       l.size,
+		"block_size": l.blockSize,
+		"blocks":     blocks,
+	})
+}
+
+// byteRange is the first and last byte a PATCH writes, and the size the
+// file ends up with, or -1 if not given.
+type byteRange struct {
+	first, last, total int64
+}
+
+// parseContentRange parses "bytes first-last/total", total being * if
+// unknown.
+func parseContentRange(s string) (byteRange, error) {
+	r := byteRange{total: -1}
+	if !strings.HasPrefix(s, "bytes ") {
+		return r, fmt.Errorf("invalid Content-Range %q", s)
+	}
+	span, total, ok := strings.Cut(strings.TrimPrefix(s, "bytes "), "/")
+	first, last, ok2 := strings.Cut(span, "-")
+	if !ok || !ok2 {
+		return r, fmt.Errorf("invalid Content-Range %q", s)
+	}
+	var err1, err2, err3 error
+	r.first, err1 = strconv.ParseInt(first, 10, 64)
+	r.last, err2 = strconv.ParseInt(last, 10, 64)
+	if total != "*" {
+		r.total, err3 = strconv.ParseInt(total, 10, 64)
+	}
+	if err1 != nil || err2 != nil || err3 != nil || r.first < 0 || r.last < r.first || r.total >= 0 && r.last >= r.total {
+		return r, fmt.Errorf("invalid Content-Range %q", s)
+	}
+	return r, nil
+}
+
+var errPatchStatus = errors.New("patch failed")
+
+// handlePatch writes the byte ranges of a PATCH into an existing file: one
+// range given by the Content-Range header, or several as the parts of a
+// multipart/byteranges body. Ranges may extend the file but not shrink
+// it, which takes a PUT. The file is changed in place, so If-Match should
+// name the version the client's ranges were worked out against.
+func handlePatch(h *webdav.Handler, w http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+	name := req.URL.Path
+	fi, err := h.FileSystem.Stat(ctx, name)
+	if err != nil {
+		http.Error(w, "Not Found", http.StatusNotFound)
+		return
+	}
+	if fi.IsDir() {
+		http.Error(w, "WebDAV: PATCH needs a file", http.StatusMethodNotAllowed)
+		return
+	}
+	if m := req.Header.Get("If-Match"); m != "" && m != "*" && m != davETag(fi) {
+		http.Error(w, "WebDAV: the file has changed", http.StatusPreconditionFailed)
+		return
+	}
+
+	// next returns the ranges to write, one after the other.
+	var next func() (byteRange, io.Reader, error)
+	mediaType, params, _ := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	if mediaType == "multipart/byteranges" {
+		mr := multipart.NewReader(req.Body, params["boundary"])
+		next = func() (byteRange, io.Reader, error) {
+			p, err := mr.NextPart()
+			if err != nil {
+				return byteRange{}, nil, err
+			}
+			r, err := parseContentRange(p.Header.Get("Content-Range"))
+			return r, p, err
+		}
+	} else {
+		r, err := parseContentRange(req.Header.Get("Content-Range"))
+		if err != nil {
+			http.Error(w, "WebDAV: PATCH needs a Content-Range header or a multipart/byteranges body", http.StatusBadRequest)
+			return
+		}
+		done := false
+		next = func() (byteRange, io.Reader, error) {
+			if done {
+				return byteRange{}, nil, io.EOF
+			}
+			done = true
+			return r, req.Body, nil
+		}
+	}
+
+	// Like webdav.Handler, lock the file while it is written.
+	now := time.Now()
+	token, err := h.LockSystem.Create(now, webdav.LockDetails{Root: name, Duration: -1, ZeroDepth: true})
+	if err == webdav.ErrLocked {
+		http.Error(w, "Locked", webdav.StatusLocked)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer h.LockSystem.Unlock(now, token)
+
+	f, err := h.FileSystem.OpenFile(ctx, name, os.O_WRONLY, 0)
+	if err != nil {
+		if os.IsPermission(err) {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+	var (
+		written []byteRange
+		total   int64 = -1
+		status        = http.StatusBadRequest
+	)
+	err = func() error {
+		for {
+			r, body, err := next()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			if r.total >= 0 {
+				if total >= 0 && r.total != total || r.total < fi.Size() {
+					return fmt.Errorf("ranges must agree on a size no smaller than %d", fi.Size())
+				}
+				total = r.total
+			}
+			if _, err := f.Seek(r.first, io.SeekStart); err != nil {
+				status = http.StatusInternalServerError
+				return err
+			}
+			want := r.last - r.first + 1
+			n, err := io.Copy(f, io.LimitReader(body, want))
+			if n > 0 {
+				written = append(written, byteRange{r.first, r.first + n - 1, -1})
+			}
+			if err != nil {
+				status = http.StatusInternalServerError
+				return err
+			}
+			if n < want {
+				return fmt.Errorf("range %d-%d is short of data", r.first, r.last)
+			}
+		}
+	}()
+	if err == nil && total > 0 {
+		// Grow the file to the size the client asked for.
+		var end int64
+		if end, err = f.Seek(0, io.SeekEnd); err == nil && end < total {
+			if _, err = f.Seek(total-1, io.SeekStart); err == nil {
+				_, err = f.Write([]byte{0})
+			}
+		}
+		if err != nil {
+			status = http.StatusInternalServerError
+		}
+	}
+	if cerr := f.Close(); err == nil && cerr != nil {
+		err, status = cerr, http.StatusInternalServerError
+	}
+	updateBlocks(ctx, h.FileSystem, name, fi.Size(), written)
+	if err != nil {
+		http.Error(w, "WebDAV: "+err.Error(), status)
+		return
+	}
+	if fi, err := h.FileSystem.Stat(ctx, name); err == nil {
+		w.Header().Set("ETag", davETag(fi))
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// updateBlocks brings the cached block checksums of name up to date after
+// the given ranges were written to it, when it was oldSize bytes long.
+func updateBlocks(ctx context.Context, fs webdav.FileSystem, name string, oldSize int64, written []byteRange) {
+	blockLists.Lock()
+	defer blockLists.Unlock()
+	var f webdav.File
+	for key, l := range blockLists.m {
+		if key.name != name {
+			continue
+		}
+		if f == nil {
+			var err error
+			if f, err = fs.OpenFile(ctx, name, os.O_RDONLY, 0); err != nil {
+				delete(blockLists.m, key)
+				continue
+			}
+			defer f.Close()
+		}
+		fi, err := f.Stat()
+		if err != nil || l.size != oldSize {
+			delete(blockLists.m, key)
+			continue
+		}
+		// The block that ended the file has grown if the file has.
+		lastOld := (oldSize - 1) / l.blockSize
+		err = l.sumBlocks(ctx, f, fi.Size(), func(i int64) bool {
+			if i >= lastOld && fi.Size() != oldSize {
+				return true
+			}
+			for _, r := range written {
+				if r.first/l.blockSize <= i && i <= r.last/l.blockSize {
+					return true
+				}
+			}
+			return false
+		})
+		if err != nil {
+			delete(blockLists.m, key)
+			continue
+		}
+		l.size, l.modTime = fi.Size(), fi.ModTime()
+	}
+}
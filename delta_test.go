@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"hash/adler32"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/net/webdav"
+)
+
+func TestDeltaTransfer(t *testing.T) {
+	root := t.TempDir()
+	data := bytes.Repeat([]byte("0123456789abcdef"), 1024) // 16KiB, four blocks
+	file := filepath.Join(root, "disk.img")
+	os.WriteFile(file, data, 0644)
+	deltaBlockSize = 4 << 10
+	defer func() { deltaBlockSize = 0 }()
+	h := &webdav.Handler{FileSystem: webdav.Dir(root), LockSystem: webdav.NewMemLS()}
+
+	type listing struct {
+		Size      int64 `json:"size"`
+		BlockSize int64 `json:"block_size"`
+		Blocks    []struct {
+			Weak   uint32 `json:"weak"`
+			Strong string `json:"strong"`
+		} `json:"blocks"`
+	}
+	blocks := func() (listing, string) {
+		w := httptest.NewRecorder()
+		handleBlocks(h.FileSystem, w, httptest.NewRequest("GET", "/disk.img?blocks", nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("?blocks answered %d: %s", w.Code, w.Body)
+		}
+		var l listing
+		if err := json.Unmarshal(w.Body.Bytes(), &l); err != nil {
+			t.Fatal(err)
+		}
+		return l, w.Header().Get("ETag")
+	}
+	// check compares the listing with the checksums of the file on disk.
+	check := func(l listing) {
+		t.Helper()
+		data, _ := os.ReadFile(file)
+		if l.Size != int64(len(data)) || len(l.Blocks) != (len(data)+4095)/4096 {
+			t.Fatalf("listing of %d bytes in %d blocks, file has %d bytes", l.Size, len(l.Blocks), len(data))
+		}
+		for i, b := range l.Blocks {
+			block := data[i*4096:]
+			if len(block) > 4096 {
+				block = block[:4096]
+			}
+			sum := sha256.Sum256(block)
+			if b.Weak != adler32.Checksum(block) || b.Strong != hex.EncodeToString(sum[:]) {
+				t.Errorf("block %d has wrong checksums", i)
+			}
+		}
+	}
+	patch := func(header map[string]string, body []byte) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("PATCH", "/disk.img", bytes.NewReader(body))
+		for k, v := range header {
+			req.Header.Set(k, v)
+		}
+		w := httptest.NewRecorder()
+		handlePatch(h, w, req)
+		return w
+	}
+
+	l, etag := blocks()
+	if l.BlockSize != 4096 {
+		t.Errorf("block size %d", l.BlockSize)
+	}
+	check(l)
+
+	// One range, against the version listed.
+	w := patch(map[string]string{"Content-Range": "bytes 5000-5003/*", "If-Match": etag}, []byte("XXXX"))
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("PATCH answered %d: %s", w.Code, w.Body)
+	}
+	copy(data[5000:], "XXXX")
+	if got, _ := os.ReadFile(file); !bytes.Equal(got, data) {
+		t.Error("range not written")
+	}
+	l, _ = blocks()
+	check(l)
+
+	// The old version no longer matches.
+	if w := patch(map[string]string{"Content-Range": "bytes 0-3/*", "If-Match": etag}, []byte("YYYY")); w.Code != http.StatusPreconditionFailed {
+		t.Errorf("stale If-Match answered %d", w.Code)
+	}
+
+	// Several ranges as multipart/byteranges, growing the file.
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	for _, r := range []struct {
+		rng, data string
+	}{{"bytes 0-2/20000", "abc"}, {"bytes 16384-16387/20000", "tail"}} {
+		p, _ := mw.CreatePart(textproto.MIMEHeader{"Content-Range": {r.rng}})
+		p.Write([]byte(r.data))
+	}
+	mw.Close()
+	w = patch(map[string]string{"Content-Type": "multipart/byteranges; boundary=" + mw.Boundary()}, body.Bytes())
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("multipart PATCH answered %d: %s", w.Code, w.Body)
+	}
+	copy(data, "abc")
+	data = append(data, make([]byte, 20000-len(data))...)
+	copy(data[16384:], "tail")
+	if got, _ := os.ReadFile(file); !bytes.Equal(got, data) {
+		t.Error("ranges not written")
+	}
+	l, _ = blocks()
+	check(l)
+
+	// Shrinking takes a PUT, and short parts are refused.
+	if w := patch(map[string]string{"Content-Range": "bytes 0-3/4"}, []byte("abcd")); w.Code != http.StatusBadRequest {
+		t.Errorf("shrinking answered %d", w.Code)
+	}
+	if w := patch(map[string]string{"Content-Range": "bytes 0-9/*"}, []byte("abcd")); w.Code != http.StatusBadRequest {
+		t.Errorf("short range answered %d", w.Code)
+	}
+	if w := patch(nil, []byte("abcd")); w.Code != http.StatusBadRequest {
+		t.Errorf("PATCH without ranges answered %d", w.Code)
+	}
+}
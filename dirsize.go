@@ -0,0 +1,164 @@
+package main
+
+import (
+	"encoding/xml"
+	"flag"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"golang.org/x/net/context"
+	"golang.org/x/net/webdav"
+)
+
+var flagDirSizes = flag.Bool("dir-sizes", false, "show recursive directory sizes in listings and as a DAV property")
+
+// dirSizeProp is the DAV property carrying a collection's recursive size.
+var dirSizeProp = xml.Name{Space: "https://github.com/clgcn/gowebdav", Local: "recursive-size"}
+
+// dirSizeCache holds recursive directory sizes. Entries are computed on
+// demand from the sizes of their children, and a change anywhere in the tree
+// only invalidates the directories above it, so recomputation is
+// incremental.
+type dirSizeCache struct {
+	root string
+
+	mu    sync.Mutex
+	sizes map[string]int64
+	gen   uint64
+}
+
+var dirSizes *dirSizeCache
+
+func startDirSizes() error {
+	w, err := watchRoot()
+	if err != nil {
+		return err
+	}
+	c := &dirSizeCache{root: *flagRootDir, sizes: make(map[string]int64)}
+	w.subscribe(func(ev treeEvent) { c.invalidate(ev.Path) })
+	dirSizes = c
+	registerJob("usage-recalc", func(ctx context.Context) error {
+		c.invalidate("/")
+		_, err := c.size("/")
+		return err
+	})
+	return nil
+}
+
+// dirSize returns the recursive size of the directory at slash path name,
+// or false when directory sizes are disabled or unavailable.
+func dirSize(name string) (int64, bool) {
+	if dirSizes == nil {
+		return 0, false
+	}
+	size, err := dirSizes.size(name)
+	if err != nil {
+		log.Printf("Failed to size %s: %v", name, err)
+		return 0, false
+	}
+	return size, true
+}
+
+// invalidate drops the cached sizes of name and every directory above it.
+func (c *dirSizeCache) invalidate(name string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.gen++
+	prefix := strings.TrimSuffix(name, "/") + "/"
+	for p := range c.sizes {
+		if strings.HasPrefix(p, prefix) {
+			delete(c.sizes, p)
+		}
+	}
+	for p := path.Clean(name); ; p = path.Dir(p) {
+		delete(c.sizes, p)
+		if p == "/" {
+			return
+		}
+	}
+}
+
+func (c *dirSizeCache) size(name string) (int64, error) {
+	name = path.Clean("/" + name)
+	c.mu.Lock()
+	size, ok := c.sizes[name]
+	gen := c.gen
+	c.mu.Unlock()
+	if ok {
+		return size, nil
+	}
+
+	f, err := os.Open(filepath.Join(c.root, filepath.FromSlash(name)))
+	if err != nil {
+		return 0, err
+	}
+	err = readdirBatches(f, func(fis []os.FileInfo) error {
+		for _, fi := range fis {
+			if fi.IsDir() {
+				sub, err := c.size(path.Join(name, fi.Name()))
+				if err != nil {
+					return err
+				}
+				size += sub
+			} else if fi.Mode().IsRegular() {
+				size += fi.Size()
+			}
+		}
+		return nil
+	})
+	f.Close()
+	if err != nil {
+		return 0, err
+	}
+
+	c.mu.Lock()
+	// Only cache the result if nothing changed while the tree was walked.
+	if c.gen == gen {
+		c.sizes[name] = size
+	}
+	c.mu.Unlock()
+	return size, nil
+}
+
+// dirSizeFile exposes the recursive size of a directory as a dead property.
+type dirSizeFile struct {
+	webdav.File
+	name string
+}
+
+func withDirSize(name string, f webdav.File) webdav.File {
+	if dirSizes == nil {
+		return f
+	}
+	return dirSizeFile{File: f, name: name}
+}
+
+func (f dirSizeFile) DeadProps() (map[xml.Name]webdav.Property, error) {
+	fi, err := f.Stat()
+	if err != nil || !fi.IsDir() {
+		return nil, err
+	}
+	size, ok := dirSize(f.name)
+	if !ok {
+		return nil, nil
+	}
+	return map[xml.Name]webdav.Property{
+		dirSizeProp: {XMLName: dirSizeProp, InnerXML: []byte(strconv.FormatInt(size, 10))},
+	}, nil
+}
+
+func (f dirSizeFile) Patch(patches []webdav.Proppatch) ([]webdav.Propstat, error) {
+	pstat := webdav.Propstat{Status: http.StatusForbidden}
+	for _, patch := range patches {
+		for _, p := range patch.Props {
+			pstat.Props = append(pstat.Props, webdav.Property{XMLName: p.XMLName})
+		}
+	}
+	return []webdav.Propstat{pstat}, nil
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/net/context"
+	"golang.org/x/net/webdav"
+)
+
+func TestDirSizeCache(t *testing.T) {
+	root := t.TempDir()
+	os.MkdirAll(filepath.Join(root, "a", "b"), 0755)
+	os.MkdirAll(filepath.Join(root, "c"), 0755)
+	os.WriteFile(filepath.Join(root, "top"), make([]byte, 1), 0644)
+	os.WriteFile(filepath.Join(root, "a", "f"), make([]byte, 10), 0644)
+	os.WriteFile(filepath.Join(root, "a", "b", "g"), make([]byte, 100), 0644)
+	os.WriteFile(filepath.Join(root, "c", "h"), make([]byte, 1000), 0644)
+	c := &dirSizeCache{root: root, sizes: make(map[string]int64)}
+
+	check := func(want map[string]int64) {
+		t.Helper()
+		for name, size := range want {
+			got, err := c.size(name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != size {
+				t.Errorf("size(%s) = %d, want %d", name, got, size)
+			}
+		}
+	}
+	check(map[string]int64{"/": 1111, "/a": 110, "/a/b": 100, "/c": 1000, "a/b/": 100})
+
+	tests := []struct {
+		name    string
+		change  func()
+		changed string
+		dropped []string
+		kept    []string
+		want    map[string]int64
+	}{
+		{
+			"grow deep file",
+			func() { os.WriteFile(filepath.Join(root, "a", "b", "g"), make([]byte, 200), 0644) },
+			"/a/b/g",
+			[]string{"/", "/a", "/a/b"},
+			[]string{"/c"},
+			map[string]int64{"/": 1211, "/a": 210, "/a/b": 200, "/c": 1000},
+		},
+		{
+			"remove dir",
+			func() { os.RemoveAll(filepath.Join(root, "a")) },
+			"/a",
+			[]string{"/", "/a", "/a/b"},
+			[]string{"/c"},
+			map[string]int64{"/": 1001, "/c": 1000},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.change()
+			c.invalidate(tt.changed)
+			for _, p := range tt.dropped {
+				if _, ok := c.sizes[p]; ok {
+					t.Errorf("%s still cached", p)
+				}
+			}
+			for _, p := range tt.kept {
+				if _, ok := c.sizes[p]; !ok {
+					t.Errorf("%s was invalidated", p)
+				}
+			}
+			check(tt.want)
+		})
+	}
+}
+
+func TestDirSizeDeadProps(t *testing.T) {
+	root := t.TempDir()
+	os.Mkdir(filepath.Join(root, "d"), 0755)
+	os.WriteFile(filepath.Join(root, "d", "f"), make([]byte, 42), 0644)
+	defer func(c *dirSizeCache) { dirSizes = c }(dirSizes)
+	dirSizes = &dirSizeCache{root: root, sizes: make(map[string]int64)}
+	fs := SkipBrokenLink{webdav.Dir(root)}
+	ctx := context.Background()
+
+	tests := []struct {
+		name string
+		path string
+		want string
+	}{
+		{"directory", "/d", "42"},
+		{"file", "/d/f", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, err := fs.OpenFile(ctx, tt.path, os.O_RDONLY, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+			dph, ok := f.(webdav.DeadPropsHolder)
+			if !ok {
+				// Files are not wrapped, so have no recursive size.
+				if tt.want != "" {
+					t.Fatal("file does not hold dead properties")
+				}
+				return
+			}
+			props, err := dph.DeadProps()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := string(props[dirSizeProp].InnerXML); got != tt.want {
+				t.Errorf("recursive-size = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
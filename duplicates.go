@@ -0,0 +1,150 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+	"golang.org/x/net/webdav"
+)
+
+type duplicateGroup struct {
+	Size  int64    `json:"size"`
+	Hash  string   `json:"sha256"`
+	Paths []string `json:"paths"`
+}
+
+type duplicateReport struct {
+	State       string           `json:"state"`
+	Started     time.Time        `json:"started,omitempty"`
+	Finished    time.Time        `json:"finished,omitempty"`
+	Scanned     int              `json:"scanned_files"`
+	Candidates  int              `json:"candidate_files"`
+	Hashed      int              `json:"hashed_files"`
+	WastedBytes int64            `json:"wasted_bytes"`
+	Groups      []duplicateGroup `json:"groups"`
+	Error       string           `json:"error,omitempty"`
+}
+
+// duplicateFinder runs one duplicate scan at a time in the background and
+// keeps the latest report.
+type duplicateFinder struct {
+	fs webdav.FileSystem
+
+	mu     sync.Mutex
+	report duplicateReport
+}
+
+func newDuplicateFinder(fs webdav.FileSystem) *duplicateFinder {
+	return &duplicateFinder{fs: fs, report: duplicateReport{State: "idle"}}
+}
+
+func (d *duplicateFinder) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case "GET":
+		writeJSON(w, http.StatusOK, d.status())
+	case "POST":
+		if !d.start() {
+			writeJSON(w, http.StatusConflict, d.status())
+			return
+		}
+		writeJSON(w, http.StatusAccepted, d.status())
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (d *duplicateFinder) status() duplicateReport {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	r := d.report
+	r.Groups = append([]duplicateGroup(nil), r.Groups...)
+	return r
+}
+
+func (d *duplicateFinder) update(f func(r *duplicateReport)) {
+	d.mu.Lock()
+	f(&d.report)
+	d.mu.Unlock()
+}
+
+// start begins a scan unless one is already running.
+func (d *duplicateFinder) start() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.report.State == "running" {
+		return false
+	}
+	d.report = duplicateReport{State: "running", Started: time.Now()}
+	go d.run(context.Background())
+	return true
+}
+
+// run groups files by size first, and only hashes files that share their
+// size with another file.
+func (d *duplicateFinder) run(ctx context.Context) {
+	bySize := make(map[int64][]string)
+	err := walkFiles(ctx, d.fs, "/", func(name string, fi os.FileInfo) error {
+		if fi.Mode().IsRegular() && fi.Size() > 0 {
+			bySize[fi.Size()] = append(bySize[fi.Size()], name)
+		}
+		d.update(func(r *duplicateReport) { r.Scanned++ })
+		return nil
+	})
+
+	candidates := 0
+	for _, names := range bySize {
+		if len(names) > 1 {
+			candidates += len(names)
+		}
+	}
+	d.update(func(r *duplicateReport) { r.Candidates = candidates })
+
+	var groups []duplicateGroup
+	for size, names := range bySize {
+		if err != nil || len(names) < 2 {
+			continue
+		}
+		byHash := make(map[string][]string)
+		for _, name := range names {
+			sum, herr := fileHashes.sum(ctx, d.fs, name, "sha256")
+			d.update(func(r *duplicateReport) { r.Hashed++ })
+			if herr != nil {
+				continue
+			}
+			byHash[sum] = append(byHash[sum], name)
+		}
+		for sum, same := range byHash {
+			if len(same) > 1 {
+				sort.Strings(same)
+				groups = append(groups, duplicateGroup{Size: size, Hash: sum, Paths: same})
+			}
+		}
+	}
+	sort.Slice(groups, func(i, j int) bool {
+		wi := groups[i].Size * int64(len(groups[i].Paths)-1)
+		wj := groups[j].Size * int64(len(groups[j].Paths)-1)
+		if wi != wj {
+			return wi > wj
+		}
+		return groups[i].Paths[0] < groups[j].Paths[0]
+	})
+
+	d.update(func(r *duplicateReport) {
+		r.Finished = time.Now()
+		r.Groups = groups
+		for _, g := range groups {
+			r.WastedBytes += g.Size * int64(len(g.Paths)-1)
+		}
+		if err != nil {
+			r.State = "failed"
+			r.Error = err.Error()
+		} else {
+			r.State = "done"
+		}
+	})
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"golang.org/x/net/webdav"
+)
+
+func TestDuplicateFinder(t *testing.T) {
+	root := t.TempDir()
+	os.MkdirAll(filepath.Join(root, "sub"), 0755)
+	files := map[string]string{
+		"a.txt":     "same content",
+		"sub/b.txt": "same content",
+		"c.txt":     "same content",
+		"d.txt":     "diff content", // same size, different hash
+		"e.txt":     "unique",
+		"empty1":    "",
+		"empty2":    "",
+	}
+	for name, content := range files {
+		os.WriteFile(filepath.Join(root, name), []byte(content), 0644)
+	}
+	d := newDuplicateFinder(webdav.Dir(root))
+
+	tests := []struct {
+		method string
+		status int
+	}{
+		{"POST", http.StatusAccepted},
+		{"GET", http.StatusOK},
+		{"DELETE", http.StatusMethodNotAllowed},
+	}
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		d.ServeHTTP(rec, httptest.NewRequest(tt.method, "/duplicates", nil))
+		if rec.Code != tt.status && !(tt.method == "POST" && rec.Code == http.StatusConflict) {
+			t.Errorf("%s status = %d, want %d", tt.method, rec.Code, tt.status)
+		}
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	var r duplicateReport
+	for {
+		rec := httptest.NewRecorder()
+		d.ServeHTTP(rec, httptest.NewRequest("GET", "/duplicates", nil))
+		if err := json.Unmarshal(rec.Body.Bytes(), &r); err != nil {
+			t.Fatal(err)
+		}
+		if r.State != "running" || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if r.State != "done" {
+		t.Fatalf("state = %q (%s)", r.State, r.Error)
+	}
+	if r.Scanned != len(files) || r.Candidates != 4 || r.Hashed != 4 {
+		t.Errorf("progress = %d scanned, %d candidates, %d hashed", r.Scanned, r.Candidates, r.Hashed)
+	}
+	want := []string{"/a.txt", "/c.txt", "/sub/b.txt"}
+	if len(r.Groups) != 1 || !reflect.DeepEqual(r.Groups[0].Paths, want) {
+		t.Fatalf("groups = %+v, want one group %v", r.Groups, want)
+	}
+	if r.WastedBytes != 2*int64(len("same content")) {
+		t.Errorf("wasted = %d", r.WastedBytes)
+	}
+}
+
+func TestAdminAuthorized(t *testing.T) {
+	defer func(u, p string, l bool) { *flagUserName, *flagPassword, *flagAdminLoopback = u, p, l }(*flagUserName, *flagPassword, *flagAdminLoopback)
+	tests := []struct {
+		name       string
+		user, pass string
+		loopback   bool
+		remote     string
+		authUser   string
+		authPass   string
+		want       bool
+	}{
+		{"no auth, loopback", "", "", false, "127.0.0.1:1234", "", "", false},
+		{"no auth, trusted loopback", "", "", true, "127.0.0.1:1234", "", "", true},
+		{"no auth, trusted v6 loopback", "", "", true, "[::1]:1234", "", "", true},
+		{"no auth, remote", "", "", true, "192.168.1.5:1234", "", "", false},
+		{"auth, good credentials", "admin", "secret", false, "192.168.1.5:1234", "admin", "secret", true},
+		{"auth, bad credentials", "admin", "secret", true, "127.0.0.1:1234", "admin", "wrong", false},
+		{"auth, no credentials", "admin", "secret", true, "127.0.0.1:1234", "", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			*flagUserName, *flagPassword, *flagAdminLoopback = tt.user, tt.pass, tt.loopback
+			req := httptest.NewRequest("GET", "/.admin/duplicates", nil)
+			req.RemoteAddr = tt.remote
+			if tt.authUser != "" {
+				req.SetBasicAuth(tt.authUser, tt.authPass)
+			}
+			if got := adminAuthorized(req); got != tt.want {
+				t.Errorf("adminAuthorized = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
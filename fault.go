@@ -0,0 +1,102 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	flagFaultRate    = flag.Float64("fault-rate", 0, "inject a fault into this percentage of requests, for testing client retry logic (0 to disable)")
+	flagFaultPaths   = flag.String("fault-paths", "", "comma-separated path prefixes faults are limited to (default: every path)")
+	flagFaultModes   = flag.String("fault-modes", "latency,truncate,error", "comma-separated faults to pick from: latency, truncate, error")
+	flagFaultLatency = flag.Duration("fault-latency", 2*time.Second, "delay added by the latency fault")
+	flagFaultStatus  = flag.Int("fault-status", http.StatusServiceUnavailable, "status returned by the error fault")
+)
+
+// faultScoped reports whether faults may hit the request for p.
+func faultScoped(p string) bool {
+	if *flagFaultPaths == "" {
+		return true
+	}
+	for _, prefix := range strings.Split(*flagFaultPaths, ",") {
+		if prefix = strings.TrimSpace(prefix); prefix != "" && strings.HasPrefix(p, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// injectFault picks a fault for a share of the requests. Latency delays the
+// request; error answers it with -fault-status; truncate lets it run but
+// drops the connection halfway through the body. It returns the writer to
+// serve the request with, and false when the request was answered.
+func injectFault(w http.ResponseWriter, req *http.Request) (http.ResponseWriter, bool) {
+	if *flagFaultRate <= 0 || rand.Float64()*100 >= *flagFaultRate || !faultScoped(req.URL.Path) {
+		return w, true
+	}
+	var modes []string
+	for _, m := range strings.Split(*flagFaultModes, ",") {
+		if m = strings.TrimSpace(m); m != "" {
+			modes = append(modes, m)
+		}
+	}
+	if len(modes) == 0 {
+		return w, true
+	}
+	mode := modes[rand.Intn(len(modes))]
+	log.Printf("Fault: %s on %s %s", mode, req.Method, req.URL.Path)
+	switch mode {
+	case "latency":
+		select {
+		case <-time.After(*flagFaultLatency):
+		case <-req.Context().Done():
+		}
+	case "error":
+		http.Error(w, "WebDAV: injected fault", *flagFaultStatus)
+		return w, false
+	case "truncate":
+		return &truncatingWriter{ResponseWriter: w, limit: -1}, true
+	}
+	return w, true
+}
+
+// truncatingWriter aborts the response once half of its body, or a random
+// part of it when the length is unknown, has been written.
+type truncatingWriter struct {
+	http.ResponseWriter
+	limit   int64
+	written int64
+}
+
+func (t *truncatingWriter) WriteHeader(status int) {
+	if t.limit < 0 {
+		t.limit = rand.Int63n(64 << 10)
+		if n, err := strconv.ParseInt(t.Header().Get("Content-Length"), 10, 64); err == nil {
+			t.limit = n / 2
+		}
+	}
+	t.ResponseWriter.WriteHeader(status)
+}
+
+func (t *truncatingWriter) Write(p []byte) (int, error) {
+	if t.limit < 0 {
+		t.WriteHeader(http.StatusOK)
+	}
+	if t.written+int64(len(p)) <= t.limit {
+		n, err := t.ResponseWriter.Write(p)
+		t.written += int64(n)
+		return n, err
+	}
+	n, _ := t.ResponseWriter.Write(p[:t.limit-t.written])
+	t.written += int64(n)
+	if f, ok := t.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+	// Makes the server close the connection without finishing the body.
+	panic(http.ErrAbortHandler)
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestInjectFault(t *testing.T) {
+	defer func(rate float64, paths, modes string, latency time.Duration) {
+		*flagFaultRate, *flagFaultPaths, *flagFaultModes, *flagFaultLatency = rate, paths, modes, latency
+	}(*flagFaultRate, *flagFaultPaths, *flagFaultModes, *flagFaultLatency)
+	*flagFaultRate, *flagFaultPaths, *flagFaultLatency = 100, "/flaky/", 50*time.Millisecond
+
+	body := strings.Repeat("x", 10000)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var ok bool
+		if w, ok = injectFault(w, req); !ok {
+			return
+		}
+		w.Header().Set("Content-Length", "10000")
+		io.WriteString(w, body)
+	}))
+	defer srv.Close()
+
+	get := func(p string) (int, string, time.Duration, error) {
+		start := time.Now()
+		resp, err := http.Get(srv.URL + p)
+		if err != nil {
+			return 0, "", 0, err
+		}
+		defer resp.Body.Close()
+		data, err := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(data), time.Since(start), err
+	}
+
+	*flagFaultModes = "error"
+	if code, _, _, _ := get("/flaky/a"); code != http.StatusServiceUnavailable {
+		t.Errorf("error fault: status %d", code)
+	}
+	if code, data, _, err := get("/stable/a"); code != http.StatusOK || data != body || err != nil {
+		t.Errorf("out of scope: status %d, %d bytes, %v", code, len(data), err)
+	}
+
+	*flagFaultModes = "latency"
+	if code, _, d, _ := get("/flaky/a"); code != http.StatusOK || d < 50*time.Millisecond {
+		t.Errorf("latency fault: status %d after %v", code, d)
+	}
+
+	*flagFaultModes = "truncate"
+	_, data, _, err := get("/flaky/a")
+	if err == nil || len(data) != 5000 {
+		t.Errorf("truncate fault: got %d bytes, err %v; want 5000 and an error", len(data), err)
+	}
+}
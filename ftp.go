@@ -0,0 +1,637 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+	"golang.org/x/net/webdav"
+)
+
+var (
+	flagFTPAddr     = flag.String("ftp", "", "also serve the root over FTP on this address, e.g. :2121 (disabled when empty)")
+	flagFTPS        = flag.Bool("ftps", false, "require AUTH TLS on FTP connections, using the -https-cert-file and -https-key-file")
+	flagFTPPassive  = flag.String("ftp-passive-ports", "", "port range for passive FTP data connections, e.g. 50000-50100 (default: any)")
+	flagFTPPublicIP = flag.String("ftp-public-ip", "", "address to announce in PASV replies when behind NAT")
+)
+
+const (
+	ftpIdleTimeout = 5 * time.Minute
+	ftpDataTimeout = 30 * time.Second
+)
+
+// ftpServer exposes a webdav.FileSystem over FTP, for devices such as
+// scanners and cameras that can't speak WebDAV. It shares the HTTP
+// server's credentials and -read-only setting.
+type ftpServer struct {
+	fs       webdav.FileSystem
+	tls      *tls.Config
+	publicIP net.IP
+	portMin  int
+	portMax  int
+}
+
+func newFTPServer(fs webdav.FileSystem) (*ftpServer, error) {
+	s := &ftpServer{fs: fs}
+	if *flagFTPS {
+		cert, err := tls.LoadX509KeyPair(*flagCertFile, *flagKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		s.tls = &tls.Config{Certificates: []tls.Certificate{cert}}
+	}
+	if *flagFTPPublicIP != "" {
+		if s.publicIP = net.ParseIP(*flagFTPPublicIP).To4(); s.publicIP == nil {
+			return nil, fmt.Errorf("-ftp-public-ip %q is not an IPv4 address", *flagFTPPublicIP)
+		}
+	}
+	if *flagFTPPassive != "" {
+		lo, hi, _ := strings.Cut(*flagFTPPassive, "-")
+		var err1, err2 error
+		s.portMin, err1 = strconv.Atoi(lo)
+		s.portMax, err2 = strconv.Atoi(hi)
+		if err1 != nil || err2 != nil || s.portMin < 1 || s.portMax > 65535 || s.portMin > s.portMax {
+			return nil, fmt.Errorf("bad -ftp-passive-ports %q", *flagFTPPassive)
+		}
+	}
+	return s, nil
+}
+
+func startFTP(fs webdav.FileSystem) error {
+	s, err := newFTPServer(fs)
+	if err != nil {
+		return err
+	}
+	ln, err := net.Listen("tcp", *flagFTPAddr)
+	if err != nil {
+		return err
+	}
+	log.Printf("Serving FTP on %s", ln.Addr())
+	onShutdown(func() { ln.Close() })
+	go s.serve(ln)
+	return nil
+}
+
+func (s *ftpServer) serve(ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			log.Printf("FTP: %v", err)
+			time.Sleep(100 * time.Millisecond)
+			continue
+		}
+		go newFTPConn(s, conn).serve()
+	}
+}
+
+type ftpConn struct {
+	srv  *ftpServer
+	ctrl net.Conn
+	r    *bufio.Reader
+	w    *bufio.Writer
+
+	user     string
+	loggedIn bool
+	secure   bool
+	protect  bool
+	dir      string
+
+	pasv       net.Listener
+	active     string
+	renameFrom string
+	restart    int64
+}
+
+func newFTPConn(s *ftpServer, conn net.Conn) *ftpConn {
+	c := &ftpConn{srv: s, dir: "/"}
+	c.setCtrl(conn)
+	return c
+}
+
+func (c *ftpConn) setCtrl(conn net.Conn) {
+	c.ctrl = conn
+	c.r = bufio.NewReader(conn)
+	c.w = bufio.NewWriter(conn)
+}
+
+func (c *ftpConn) reply(code int, format string, args ...interface{}) {
+	fmt.Fprintf(c.w, "%d %s\r\n", code, fmt.Sprintf(format, args...))
+	c.w.Flush()
+}
+
+func (c *ftpConn) serve() {
+	defer func() {
+		c.closeData()
+		c.ctrl.Close()
+	}()
+	c.reply(220, "gowebdav FTP ready")
+	for {
+		c.ctrl.SetReadDeadline(time.Now().Add(ftpIdleTimeout))
+		line, err := c.r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		cmd, arg, _ := strings.Cut(strings.TrimRight(line, "\r\n"), " ")
+		if !c.handle(strings.ToUpper(cmd), arg) {
+			return
+		}
+	}
+}
+
+// ftpPublicCommands may be used before logging in.
+var ftpPublicCommands = map[string]bool{
+	"USER": true, "PASS": true, "AUTH": true, "PBSZ": true, "PROT": true,
+	"FEAT": true, "SYST": true, "OPTS": true, "NOOP": true, "QUIT": true,
+}
+
+// ftpWriteCommands are refused in -read-only mode.
+var ftpWriteCommands = map[string]bool{
+	"STOR": true, "APPE": true, "DELE": true, "MKD": true, "XMKD": true, "RMD": true, "XRMD": true,
+	"RNFR": true, "RNTO": true,
+}
+
+// handle runs one command and reports whether the session goes on.
+func (c *ftpConn) handle(cmd, arg string) bool {
+	if !ftpPublicCommands[cmd] && !c.loggedIn {
+		c.reply(530, "Please log in with USER and PASS")
+		return true
+	}
+	if ftpWriteCommands[cmd] && *flagReadonly {
+		c.reply(550, "Server is read-only")
+		return true
+	}
+	ctx := context.Background()
+	switch cmd {
+	case "QUIT":
+		c.reply(221, "Bye")
+		return false
+	case "NOOP":
+		c.reply(200, "OK")
+	case "SYST":
+		c.reply(215, "UNIX Type: L8")
+	case "FEAT":
+		fmt.Fprint(c.w, "211-Features:\r\n EPSV\r\n PASV\r\n SIZE\r\n MDTM\r\n REST STREAM\r\n UTF8\r\n")
+		if c.srv.tls != nil {
+			fmt.Fprint(c.w, " AUTH TLS\r\n PBSZ\r\n PROT\r\n")
+		}
+		c.reply(211, "End")
+	case "OPTS":
+		if strings.EqualFold(arg, "UTF8 ON") {
+			c.reply(200, "UTF8 is always on")
+		} else {
+			c.reply(501, "Unknown option")
+		}
+	case "AUTH":
+		if c.srv.tls == nil || !strings.EqualFold(arg, "TLS") && !strings.EqualFold(arg, "SSL") {
+			c.reply(504, "AUTH %s not supported", arg)
+			return true
+		}
+		c.reply(234, "Proceed with TLS")
+		conn := tls.Server(c.ctrl, c.srv.tls)
+		if err := conn.Handshake(); err != nil {
+			return false
+		}
+		c.setCtrl(conn)
+		c.secure = true
+	case "PBSZ":
+		c.reply(200, "PBSZ=0")
+	case "PROT":
+		switch strings.ToUpper(arg) {
+		case "P":
+			if !c.secure {
+				c.reply(503, "Use AUTH TLS first")
+				return true
+			}
+			c.protect = true
+		case "C":
+			c.protect = false
+		default:
+			c.reply(536, "Only C and P are supported")
+			return true
+		}
+		c.reply(200, "OK")
+	case "USER":
+		if c.srv.tls != nil && !c.secure {
+			c.reply(530, "Use AUTH TLS first")
+			return true
+		}
+		c.user, c.loggedIn = arg, false
+		c.reply(331, "Password required")
+	case "PASS":
+		if c.srv.tls != nil && !c.secure {
+			c.reply(530, "Use AUTH TLS first")
+			return true
+		}
+		if *flagUserName != "" && *flagPassword != "" && (c.user != *flagUserName || arg != *flagPassword) {
+			log.Printf("FTP: login failed for %q from %s", c.user, c.ctrl.RemoteAddr())
+			// Slow down password guessing.
+			time.Sleep(time.Second)
+			c.reply(530, "Login incorrect")
+			return true
+		}
+		c.loggedIn = true
+		c.reply(230, "Logged in")
+	case "PWD", "XPWD":
+		c.reply(257, "%q is the current directory", c.dir)
+	case "CWD", "XCWD", "CDUP", "XCUP":
+		dir := c.path(arg)
+		if cmd == "CDUP" || cmd == "XCUP" {
+			dir = path.Dir(c.dir)
+		}
+		if fi, err := c.srv.fs.Stat(ctx, dir); err != nil || !fi.IsDir() {
+			c.reply(550, "No such directory")
+			return true
+		}
+		c.dir = dir
+		c.reply(250, "Directory changed to %s", dir)
+	case "TYPE":
+		c.reply(200, "Type set to %s", arg)
+	case "MODE", "STRU":
+		if strings.EqualFold(arg, "S") || strings.EqualFold(arg, "F") {
+			c.reply(200, "OK")
+		} else {
+			c.reply(504, "Not supported")
+		}
+	case "PASV", "EPSV":
+		c.passive(cmd)
+	case "PORT", "EPRT":
+		c.port(cmd, arg)
+	case "REST":
+		n, err := strconv.ParseInt(arg, 10, 64)
+		if err != nil || n < 0 {
+			c.reply(501, "Bad offset")
+			return true
+		}
+		c.restart = n
+		c.reply(350, "Restarting at %d", n)
+	case "LIST", "NLST":
+		c.list(cmd, arg)
+	case "RETR":
+		c.retrieve(arg)
+	case "STOR", "APPE":
+		c.store(cmd, arg)
+	case "SIZE", "MDTM":
+		fi, err := c.srv.fs.Stat(ctx, c.path(arg))
+		if err != nil || fi.IsDir() {
+			c.reply(550, "No such file")
+		} else if cmd == "SIZE" {
+			c.reply(213, "%d", fi.Size())
+		} else {
+			c.reply(213, "%s", fi.ModTime().UTC().Format("20060102150405"))
+		}
+	case "DELE":
+		name := c.path(arg)
+		if fi, err := c.srv.fs.Stat(ctx, name); err != nil || fi.IsDir() {
+			c.reply(550, "No such file")
+		} else if err := c.srv.fs.RemoveAll(ctx, name); err != nil {
+			c.reply(550, "Delete failed")
+		} else {
+			c.reply(250, "Deleted")
+		}
+	case "MKD", "XMKD":
+		name := c.path(arg)
+		if err := c.srv.fs.Mkdir(ctx, name, 0755); err != nil {
+			c.reply(550, "Create failed")
+		} else {
+			c.reply(257, "%q created", name)
+		}
+	case "RMD", "XRMD":
+		name := c.path(arg)
+		f, err := c.srv.fs.OpenFile(ctx, name, os.O_RDONLY, 0)
+		if err != nil {
+			c.reply(550, "No such directory")
+			return true
+		}
+		fis, err := f.Readdir(1)
+		f.Close()
+		if len(fis) > 0 || err != nil && err != io.EOF || name == "/" {
+			c.reply(550, "Directory not empty")
+		} else if err := c.srv.fs.RemoveAll(ctx, name); err != nil {
+			c.reply(550, "Remove failed")
+		} else {
+			c.reply(250, "Removed")
+		}
+	case "RNFR":
+		name := c.path(arg)
+		if _, err := c.srv.fs.Stat(ctx, name); err != nil {
+			c.reply(550, "No such file")
+			return true
+		}
+		c.renameFrom = name
+		c.reply(350, "Ready for RNTO")
+	case "RNTO":
+		from := c.renameFrom
+		c.renameFrom = ""
+		if from == "" {
+			c.reply(503, "Use RNFR first")
+		} else if err := c.srv.fs.Rename(ctx, from, c.path(arg)); err != nil {
+			c.reply(550, "Rename failed")
+		} else {
+			c.reply(250, "Renamed")
+		}
+	case "ABOR":
+		c.closeData()
+		c.reply(226, "Aborted")
+	default:
+		c.reply(502, "%s not implemented", cmd)
+	}
+	return true
+}
+
+// path resolves an FTP argument against the current directory. Cleaning
+// from the root keeps ".." from leaving it.
+func (c *ftpConn) path(arg string) string {
+	if strings.HasPrefix(arg, "/") {
+		return path.Clean(arg)
+	}
+	return path.Join(c.dir, arg)
+}
+
+func (c *ftpConn) closeData() {
+	if c.pasv != nil {
+		c.pasv.Close()
+		c.pasv = nil
+	}
+	c.active = ""
+}
+
+func (c *ftpConn) passive(cmd string) {
+	c.closeData()
+	local := c.ctrl.LocalAddr().(*net.TCPAddr)
+	ln, err := c.srv.listenPassive(local.IP)
+	if err != nil {
+		c.reply(425, "Can't open data connection")
+		return
+	}
+	c.pasv = ln
+	port := ln.Addr().(*net.TCPAddr).Port
+	if cmd == "EPSV" {
+		c.reply(229, "Entering Extended Passive Mode (|||%d|)", port)
+		return
+	}
+	ip := c.srv.publicIP
+	if ip == nil {
+		ip = local.IP.To4()
+	}
+	if ip == nil {
+		c.reply(425, "Use EPSV for IPv6")
+		c.closeData()
+		return
+	}
+	c.reply(227, "Entering Passive Mode (%d,%d,%d,%d,%d,%d)", ip[0], ip[1], ip[2], ip[3], port>>8, port&0xff)
+}
+
+func (s *ftpServer) listenPassive(ip net.IP) (net.Listener, error) {
+	if s.portMin == 0 {
+		return net.Listen("tcp", net.JoinHostPort(ip.String(), "0"))
+	}
+	n := s.portMax - s.portMin + 1
+	start := rand.Intn(n)
+	for i := 0; i < n; i++ {
+		port := s.portMin + (start+i)%n
+		if ln, err := net.Listen("tcp", net.JoinHostPort(ip.String(), strconv.Itoa(port))); err == nil {
+			return ln, nil
+		}
+	}
+	return nil, errors.New("no free passive port")
+}
+
+// port accepts an active mode data address, which must be on the client's
+// own host so the server can't be used to connect elsewhere.
+func (c *ftpConn) port(cmd, arg string) {
+	c.closeData()
+	addr, err := parseFTPPort(cmd, arg)
+	if err != nil {
+		c.reply(501, "Bad address")
+		return
+	}
+	host, _, _ := net.SplitHostPort(addr)
+	remote := c.ctrl.RemoteAddr().(*net.TCPAddr)
+	if ip := net.ParseIP(host); ip == nil || !ip.Equal(remote.IP) {
+		c.reply(504, "Data address must match the control connection")
+		return
+	}
+	c.active = addr
+	c.reply(200, "OK")
+}
+
+// parseFTPPort parses a PORT "h1,h2,h3,h4,p1,p2" or EPRT "|1|ip|port|"
+// argument into a dialable address.
+func parseFTPPort(cmd, arg string) (string, error) {
+	if cmd == "EPRT" {
+		if len(arg) < 2 {
+			return "", errors.New("short EPRT")
+		}
+		parts := strings.Split(arg[1:len(arg)-1], arg[:1])
+		if len(parts) != 3 || net.ParseIP(parts[1]) == nil {
+			return "", errors.New("bad EPRT")
+		}
+		if p, err := strconv.Atoi(parts[2]); err != nil || p < 1 || p > 65535 {
+			return "", errors.New("bad EPRT port")
+		}
+		return net.JoinHostPort(parts[1], parts[2]), nil
+	}
+	fields := strings.Split(arg, ",")
+	if len(fields) != 6 {
+		return "", errors.New("bad PORT")
+	}
+	var b [6]int
+	for i, f := range fields {
+		n, err := strconv.Atoi(strings.TrimSpace(f))
+		if err != nil || n < 0 || n > 255 {
+			return "", errors.New("bad PORT")
+		}
+		b[i] = n
+	}
+	ip := fmt.Sprintf("%d.%d.%d.%d", b[0], b[1], b[2], b[3])
+	return net.JoinHostPort(ip, strconv.Itoa(b[4]<<8|b[5])), nil
+}
+
+// dataConn opens the data connection set up by PASV, EPSV, PORT or EPRT.
+func (c *ftpConn) dataConn() (net.Conn, error) {
+	defer c.closeData()
+	var conn net.Conn
+	switch {
+	case c.pasv != nil:
+		if tl, ok := c.pasv.(*net.TCPListener); ok {
+			tl.SetDeadline(time.Now().Add(ftpDataTimeout))
+		}
+		for {
+			var err error
+			if conn, err = c.pasv.Accept(); err != nil {
+				return nil, err
+			}
+			// Only the client may use its data port.
+			remote := conn.RemoteAddr().(*net.TCPAddr)
+			if remote.IP.Equal(c.ctrl.RemoteAddr().(*net.TCPAddr).IP) {
+				break
+			}
+			conn.Close()
+		}
+	case c.active != "":
+		var err error
+		if conn, err = net.DialTimeout("tcp", c.active, ftpDataTimeout); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, errors.New("no data connection")
+	}
+	if c.protect {
+		conn = tls.Server(conn, c.srv.tls)
+	}
+	return conn, nil
+}
+
+// transfer runs f over a fresh data connection with the usual 150/226
+// replies around it.
+func (c *ftpConn) transfer(f func(conn net.Conn) error) {
+	c.reply(150, "Opening data connection")
+	conn, err := c.dataConn()
+	if err != nil {
+		c.reply(425, "Can't open data connection")
+		return
+	}
+	err = f(conn)
+	if cerr := conn.Close(); err == nil {
+		err = cerr
+	}
+	if errors.Is(err, errQuotaExceeded) {
+		c.reply(552, "Quota exceeded")
+		return
+	}
+	if err != nil {
+		c.reply(426, "Transfer failed")
+		return
+	}
+	c.reply(226, "Transfer complete")
+}
+
+func (c *ftpConn) list(cmd, arg string) {
+	// Clients tend to pass ls options such as -la; there are no such files.
+	for strings.HasPrefix(arg, "-") {
+		_, arg, _ = strings.Cut(arg, " ")
+	}
+	ctx := context.Background()
+	name := c.path(arg)
+	fi, err := c.srv.fs.Stat(ctx, name)
+	if err != nil {
+		c.reply(550, "No such file or directory")
+		return
+	}
+	if fi.IsDir() {
+		f, err := c.srv.fs.OpenFile(ctx, name, os.O_RDONLY, 0)
+		if err != nil {
+			c.reply(550, "Can't open directory")
+			return
+		}
+		f.Close()
+	}
+	now := time.Now()
+	c.transfer(func(conn net.Conn) error {
+		w := bufio.NewWriter(conn)
+		line := func(fi os.FileInfo) error {
+			if cmd == "NLST" {
+				fmt.Fprintf(w, "%s\r\n", fi.Name())
+			} else {
+				fmt.Fprintf(w, "%s\r\n", ftpListLine(fi, now))
+			}
+			return nil
+		}
+		if fi.IsDir() {
+			if err := readdirSorted(ctx, c.srv.fs, name, os.FileInfo.Name, visibleEntry, line); err != nil {
+				return err
+			}
+		} else if visibleEntry(fi) {
+			line(fi)
+		}
+		return w.Flush()
+	})
+}
+
+// ftpListLine formats fi like ls -l, which is what FTP clients parse.
+func ftpListLine(fi os.FileInfo, now time.Time) string {
+	mode := fi.Mode().String()
+	if fi.IsDir() {
+		mode = "d" + mode[1:]
+	}
+	stamp := fi.ModTime().Format("Jan _2 15:04")
+	if age := now.Sub(fi.ModTime()); age > 180*24*time.Hour || age < -time.Hour {
+		stamp = fi.ModTime().Format("Jan _2  2006")
+	}
+	return fmt.Sprintf("%s 1 ftp ftp %12d %s %s", mode, fi.Size(), stamp, fi.Name())
+}
+
+func (c *ftpConn) retrieve(arg string) {
+	ctx := context.Background()
+	offset := c.restart
+	c.restart = 0
+	f, err := c.srv.fs.OpenFile(ctx, c.path(arg), os.O_RDONLY, 0)
+	if err != nil {
+		c.reply(550, "No such file")
+		return
+	}
+	defer f.Close()
+	if fi, err := f.Stat(); err != nil || fi.IsDir() {
+		c.reply(550, "Not a file")
+		return
+	}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		c.reply(550, "Bad offset")
+		return
+	}
+	c.transfer(func(conn net.Conn) error {
+		_, err := io.Copy(conn, f)
+		return err
+	})
+}
+
+func (c *ftpConn) store(cmd, arg string) {
+	ctx := context.Background()
+	name := c.path(arg)
+	offset := c.restart
+	c.restart = 0
+	flags := os.O_WRONLY | os.O_CREATE
+	switch {
+	case cmd == "APPE":
+		flags |= os.O_APPEND
+	case offset == 0:
+		flags |= os.O_TRUNC
+	}
+	f, err := c.srv.fs.OpenFile(ctx, name, flags, 0644)
+	if err != nil {
+		c.reply(550, "Can't create file")
+		return
+	}
+	defer f.Close()
+	if offset > 0 {
+		if _, err := f.Seek(offset, io.SeekStart); err != nil {
+			c.reply(550, "Bad offset")
+			return
+		}
+	}
+	c.transfer(func(conn net.Conn) error {
+		_, err := io.Copy(f, conn)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err == nil {
+			err = finishUpload(c.srv.fs, name, c.user, remoteHost(c.ctrl.RemoteAddr().String()))
+		}
+		return err
+	})
+}
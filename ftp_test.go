@@ -0,0 +1,224 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/webdav"
+)
+
+func TestParseFTPPort(t *testing.T) {
+	tests := []struct {
+		cmd, arg string
+		want     string
+		wantErr  bool
+	}{
+		{cmd: "PORT", arg: "127,0,0,1,4,1", want: "127.0.0.1:1025"},
+		{cmd: "PORT", arg: "10,0,0,2,195,80", want: "10.0.0.2:50000"},
+		{cmd: "PORT", arg: "127,0,0,1,4", wantErr: true},
+		{cmd: "PORT", arg: "127,0,0,256,4,1", wantErr: true},
+		{cmd: "EPRT", arg: "|1|127.0.0.1|2121|", want: "127.0.0.1:2121"},
+		{cmd: "EPRT", arg: "|2|::1|2121|", want: "[::1]:2121"},
+		{cmd: "EPRT", arg: "|2|nope|2121|", wantErr: true},
+		{cmd: "EPRT", arg: "|1|127.0.0.1|99999|", wantErr: true},
+		{cmd: "EPRT", arg: "|", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.cmd+" "+tt.arg, func(t *testing.T) {
+			got, err := parseFTPPort(tt.cmd, tt.arg)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("addr = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+type fakeFileInfo struct {
+	os.FileInfo
+	name  string
+	size  int64
+	mode  os.FileMode
+	mtime time.Time
+}
+
+func (fi fakeFileInfo) Name() string       { return fi.name }
+func (fi fakeFileInfo) Size() int64        { return fi.size }
+func (fi fakeFileInfo) Mode() os.FileMode  { return fi.mode }
+func (fi fakeFileInfo) ModTime() time.Time { return fi.mtime }
+func (fi fakeFileInfo) IsDir() bool        { return fi.mode.IsDir() }
+
+func TestFTPListLine(t *testing.T) {
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		fi   fakeFileInfo
+		want string
+	}{
+		{fakeFileInfo{name: "scan.pdf", size: 1234, mode: 0644, mtime: now.Add(-time.Hour)},
+			"-rw-r--r-- 1 ftp ftp         1234 Jun  1 11:00 scan.pdf"},
+		{fakeFileInfo{name: "photos", size: 4096, mode: os.ModeDir | 0755, mtime: now.AddDate(-1, 0, 0)},
+			"drwxr-xr-x 1 ftp ftp         4096 Jun  1  2023 photos"},
+	}
+	for _, tt := range tests {
+		if got := ftpListLine(tt.fi, now); got != tt.want {
+			t.Errorf("got  %q\nwant %q", got, tt.want)
+		}
+	}
+}
+
+// ftpClient is just enough of an FTP client to drive the server.
+type ftpClient struct {
+	t    *testing.T
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func (c *ftpClient) cmd(want int, format string, args ...interface{}) string {
+	c.t.Helper()
+	fmt.Fprintf(c.conn, format+"\r\n", args...)
+	return c.expect(want)
+}
+
+func (c *ftpClient) expect(want int) string {
+	c.t.Helper()
+	for {
+		line, err := c.r.ReadString('\n')
+		if err != nil {
+			c.t.Fatal(err)
+		}
+		if len(line) >= 4 && line[3] == ' ' {
+			if code, _ := strconv.Atoi(line[:3]); code != want {
+				c.t.Fatalf("got %q, want %d", line, want)
+			}
+			return strings.TrimSpace(line[4:])
+		}
+	}
+}
+
+// data opens a passive data connection and runs cmd over it.
+func (c *ftpClient) data(cmd string, upload string) string {
+	c.t.Helper()
+	reply := c.cmd(229, "EPSV")
+	port := strings.Trim(reply[strings.Index(reply, "(")+1:len(reply)-1], "|")
+	dc, err := net.Dial("tcp", "127.0.0.1:"+port)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	c.cmd(150, "%s", cmd)
+	var got []byte
+	if upload != "" {
+		io.WriteString(dc, upload)
+	} else {
+		got, _ = io.ReadAll(dc)
+	}
+	dc.Close()
+	c.expect(226)
+	return string(got)
+}
+
+func TestFTPSession(t *testing.T) {
+	root := t.TempDir()
+	os.WriteFile(filepath.Join(root, "hello.txt"), []byte("hello world"), 0644)
+	defer func(u, p string, ro bool) { *flagUserName, *flagPassword, *flagReadonly = u, p, ro }(*flagUserName, *flagPassword, *flagReadonly)
+	*flagUserName, *flagPassword = "scanner", "s3cret"
+
+	s, err := newFTPServer(webdav.Dir(root))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go s.serve(ln)
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	c := &ftpClient{t: t, conn: conn, r: bufio.NewReader(conn)}
+	c.expect(220)
+
+	c.cmd(530, "PWD")
+	c.cmd(331, "USER scanner")
+	c.cmd(530, "PASS wrong")
+	c.cmd(331, "USER scanner")
+	c.cmd(230, "PASS s3cret")
+	c.cmd(257, "PWD")
+
+	c.cmd(257, "MKD scans")
+	c.cmd(250, "CWD scans")
+	c.data("STOR page1.pdf", "%PDF-1.4 page one")
+	c.cmd(350, "REST 9")
+	if got := c.data("RETR page1.pdf", ""); got != "page one" {
+		t.Errorf("RETR after REST = %q", got)
+	}
+	c.data("APPE page1.pdf", ", more")
+	if got := c.cmd(213, "SIZE /scans/page1.pdf"); got != "23" {
+		t.Errorf("SIZE = %s", got)
+	}
+	c.cmd(250, "CDUP")
+	if got := c.data("NLST", ""); got != "hello.txt\r\nscans\r\n" {
+		t.Errorf("NLST = %q", got)
+	}
+	if got := c.data("LIST -la scans", ""); !strings.Contains(got, " page1.pdf\r\n") {
+		t.Errorf("LIST = %q", got)
+	}
+	if got := c.data("RETR ../../hello.txt", ""); got != "hello world" {
+		t.Errorf("RETR outside root = %q", got)
+	}
+	c.cmd(550, "RETR missing.txt")
+	c.cmd(550, "RMD scans")
+	c.cmd(350, "RNFR scans/page1.pdf")
+	c.cmd(250, "RNTO page1.pdf")
+	c.cmd(250, "RMD scans")
+	c.cmd(250, "DELE page1.pdf")
+	c.cmd(504, "PORT 10,0,0,1,4,1")
+
+	// Uploads are scanned like PUTs.
+	defer func(clamd, mode, action string) {
+		*flagClamd, *flagClamdMode, *flagClamdAction = clamd, mode, action
+	}(*flagClamd, *flagClamdMode, *flagClamdAction)
+	*flagClamd, *flagClamdMode, *flagClamdAction = fakeClamd(t, ""), "inline", "reject"
+	reply := c.cmd(229, "EPSV")
+	dc, err := net.Dial("tcp", "127.0.0.1:"+strings.Trim(reply[strings.Index(reply, "(")+1:len(reply)-1], "|"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.cmd(150, "STOR eicar.com")
+	io.WriteString(dc, "EICAR")
+	dc.Close()
+	c.expect(426)
+	if _, err := os.Stat(filepath.Join(root, "eicar.com")); !os.IsNotExist(err) {
+		t.Errorf("infected upload was kept: %v", err)
+	}
+	*flagClamd = ""
+	c.cmd(257, "XMKD kept")
+
+	*flagReadonly = true
+	c.cmd(550, "DELE hello.txt")
+	c.cmd(550, "XMKD made")
+	c.cmd(550, "XRMD kept")
+	c.cmd(221, "QUIT")
+
+	for _, name := range []string{"hello.txt", "kept"} {
+		if _, err := os.Stat(filepath.Join(root, name)); err != nil {
+			t.Error(err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(root, "made")); err == nil {
+		t.Error("XMKD created a folder on a read-only server")
+	}
+}
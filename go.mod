@@ -2,4 +2,13 @@ module github.com/clgcn/gowebdav
 
 go 1.19
 
-require golang.org/x/net v0.33.0
+require (
+	github.com/fsnotify/fsnotify v1.7.0
+	github.com/pkg/sftp v1.13.9
+	golang.org/x/crypto v0.31.0
+	golang.org/x/net v0.33.0
+	golang.org/x/sys v0.28.0
+	rsc.io/qr v0.2.0
+)
+
+require github.com/kr/fs v0.1.0 // indirect
@@ -1,14 +1,23 @@
 package main
 
 import (
+	"crypto/tls"
 	"flag"
 	"fmt"
+	"html"
+	"io"
 	"log"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
+	"path"
 	"path/filepath"
 	"sort"
 	"strings"
+	"syscall"
+	"time"
 
 	"golang.org/x/net/context"
 	"golang.org/x/net/webdav"
@@ -16,7 +25,7 @@ import (
 
 var (
 	flagRootDir    = flag.String("dir", "", "webdav root dir")
-	flagHttpAddr   = flag.String("port", "6086", "http ports to listen on")
+	flagHttpAddr   = flag.String("port", "6086", "port or address to listen on, e.g. 6086, 127.0.0.1:6086 or [fe80::1%eth0]:6086")
 	flagHttpsMode  = flag.Bool("https-mode", false, "use https mode")
 	flagCertFile   = flag.String("https-cert-file", "cert.pem", "https cert file")
 	flagKeyFile    = flag.String("https-key-file", "key.pem", "https key file")
@@ -27,7 +36,6 @@ var (
 )
 
 func init() {
-	flag.Parse()
 	flag.Usage = func() {
 		fmt.Fprintf(os.Stderr, "Usage of WebDAV Server\n")
 		flag.PrintDefaults()
@@ -46,24 +54,262 @@ func (d SkipBrokenLink) Stat(ctx context.Context, name string) (os.FileInfo, err
 	return fileinfo, err
 }
 
+// Rename forgets the digests remembered for both names, which a file of
+// the same size and time taking the place of another would not change.
+func (d SkipBrokenLink) Rename(ctx context.Context, oldName, newName string) error {
+	defer fileHashes.forget(newName)
+	defer fileHashes.forget(oldName)
+	return d.Dir.Rename(ctx, oldName, newName)
+}
+
+// OpenFile wraps directories to add properties and stop listings once ctx
+// is done. Files are returned as they are, so io.Copy can hand *os.File to
+// sendfile, unless ctx has a deadline, which only a wrapper can enforce.
+func (d SkipBrokenLink) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	f, err := d.Dir.OpenFile(ctx, name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	if fi, err := f.Stat(); err == nil && !fi.IsDir() {
+		if _, ok := ctx.Deadline(); !ok {
+			return f, nil
+		}
+		return ctxFile{f, ctx}, nil
+	}
+	return withPIM(name, withDirSize(name, ctxFile{f, ctx})), nil
+}
+
+// localPath maps a slash-separated WebDAV path to the file below the root
+// dir, resolving it the same way webdav.Dir does.
+func localPath(name string) string {
+	return filepath.Join(*flagRootDir, filepath.FromSlash(path.Clean("/"+name)))
+}
+
+// authorized reports whether req carries the configured credentials, or
+// whether no credentials are configured at all.
+func authorized(req *http.Request) bool {
+	if *flagUserName == "" || *flagPassword == "" {
+		return true
+	}
+	username, password, ok := req.BasicAuth()
+	return ok && username == *flagUserName && password == *flagPassword
+}
+
 func main() {
+	flag.Parse()
+	if runStateCommand(flag.Args()) || runBenchCommand(flag.Args()) || runReplayCommand(flag.Args()) {
+		return
+	}
 	if *flagRootDir == "" || *flagHttpAddr == "" {
 		flag.Usage()
 		fmt.Fprintln(os.Stderr, "\nError: -dir and -http flags are required.")
 		os.Exit(0)
 	}
 
-	httpAddress := *flagHttpAddr
-	if !strings.Contains(httpAddress, ":") {
-		httpAddress = ":" + httpAddress
+	httpAddress, err := listenAddress(*flagHttpAddr, *flagBindInterface)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	if *flagClamd != "" {
+		if err := checkClamdFlags(); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	if *flagIndex {
+		if err := startIndex(); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to start indexer: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	if *flagDirSizes {
+		if err := startDirSizes(); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to watch %s: %v\n", *flagRootDir, err)
+			os.Exit(1)
+		}
+	}
+
+	if *flagLive {
+		if err := startLive(); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to watch %s: %v\n", *flagRootDir, err)
+			os.Exit(1)
+		}
+	}
+
+	if *flagThumbs {
+		if err := startThumbs(); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to set up thumbnail cache: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	if *flagHLS {
+		if err := startHLS(); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to set up HLS previews: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	if *flagDelta {
+		if err := startDelta(); err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid -delta-block-size: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	startPIM()
+	startStaticSites()
+	startWORM()
+	startAppendOnly()
+
+	if *flagMemoryLimit != "" {
+		if err := startMemoryLimit(); err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid -memory-limit: %v\n", err)
+			os.Exit(1)
+		}
+	}
+	if *flagSMTPServer != "" {
+		if err := startMailNotifier(); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+	}
+	if *flagNotifyWebhook != "" {
+		if err := startChatNotifier(); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+	}
+	if *flagErrorReport != "" {
+		if err := startErrorReporter(); err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid -error-report: %v\n", err)
+			os.Exit(1)
+		}
+	}
+	if *flagAccessLog != "" {
+		if err := startAccessLog(); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to open access log: %v\n", err)
+			os.Exit(1)
+		}
+	}
+	if *flagRecordDir != "" {
+		if err := startRecorder(); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to set up session recording: %v\n", err)
+			os.Exit(1)
+		}
+	}
+	if *flagQuota != "" {
+		if err := startQuota(); err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid -quota: %v\n", err)
+			os.Exit(1)
+		}
+	}
+	if *flagTerms != "" {
+		if err := startTerms(); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to read -terms: %v\n", err)
+			os.Exit(1)
+		}
+	}
+	if *flagBanner != "" || *flagAdminPath != "" {
+		startBanner()
+	}
+	startQueue()
+	if *flagMaxConcurrent > 0 {
+		requestSlots = newPrioritySem(*flagMaxConcurrent)
+	}
+	if err := startScheduler(); err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid -schedule: %v\n", err)
+		os.Exit(1)
 	}
 
 	fs := &webdav.Handler{
 		FileSystem: SkipBrokenLink{webdav.Dir(*flagRootDir)},
 		LockSystem: webdav.NewMemLS(),
 	}
-	http.HandleFunc("/", func(w http.ResponseWriter, req *http.Request) {
-		if *flagUserName != "" && *flagPassword != "" {
+	if quota != nil {
+		fs.FileSystem = quotaFS{fs.FileSystem}
+	}
+	if wormPaths != nil {
+		fs.FileSystem = wormFS{fs.FileSystem}
+	}
+	if *flagRetention {
+		if err := startRetention(fs.FileSystem); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to load retention locks: %v\n", err)
+			os.Exit(1)
+		}
+		fs.FileSystem = retentionFS{fs.FileSystem}
+	}
+	// Outermost, so that purging backups through the admin API still
+	// honours the wrappers above.
+	if appendOnlyPaths != nil {
+		fs.FileSystem = appendOnlyFS{fs.FileSystem}
+	}
+	mux := http.NewServeMux()
+	if pimCollections != nil {
+		mux.HandleFunc("/.well-known/caldav", handleWellKnownPIM)
+		mux.HandleFunc("/.well-known/carddav", handleWellKnownPIM)
+	}
+	if *flagHealthPath != "" {
+		mux.HandleFunc(*flagHealthPath, handleHealthz)
+	}
+	if *flagMetricsPath != "" || *flagMetricsPush != "" {
+		serverStats = newServerMetrics()
+	}
+	if *flagMetricsPath != "" {
+		mux.HandleFunc(*flagMetricsPath, handleMetrics)
+	}
+	if *flagMetricsPush != "" {
+		if err := startMetricsPush(serverStats); err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid -metrics-push: %v\n", err)
+			os.Exit(1)
+		}
+	}
+	if *flagAdminPath != "" {
+		if err := startShares(fs.FileSystem); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to load share links: %v\n", err)
+			os.Exit(1)
+		}
+		if err := startSigning(); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to set up URL signing: %v\n", err)
+			os.Exit(1)
+		}
+		handleAdmin("duplicates", newDuplicateFinder(fs.FileSystem).ServeHTTP)
+		handleAdmin("backup", backupHandler(fs.FileSystem))
+		if appendOnlyPaths != nil {
+			handleAdmin("purge", purgeAdmin(fs.FileSystem.(appendOnlyFS)))
+		}
+		mux.HandleFunc(strings.TrimSuffix(*flagAdminPath, "/")+"/", serveAdmin)
+		if *flagUserName == "" || *flagPassword == "" {
+			if *flagAdminLoopback {
+				log.Print("Admin API open to every loopback client; behind a reverse proxy on this host, that is every client")
+			} else {
+				log.Print("Admin API refuses all requests: set -user and -password, or -admin-trust-loopback")
+			}
+		}
+	}
+	mux.HandleFunc("/", func(w http.ResponseWriter, req *http.Request) {
+		if d := operationTimeout(req.Method); d > 0 {
+			ctx, cancel := context.WithTimeout(req.Context(), d)
+			defer cancel()
+			req = req.WithContext(ctx)
+		}
+		if recorder != nil {
+			var done func()
+			w, req, done = recorder.record(w, req)
+			defer done()
+		}
+		setBannerHeader(w)
+		if refuseHotlink(w, req) {
+			return
+		}
+		if handleShare(fs.FileSystem, w, req) {
+			return
+		}
+		if !signedAccess(w, req) && *flagUserName != "" && *flagPassword != "" {
 			username, password, ok := req.BasicAuth()
 			if !ok {
 				w.Header().Set("WWW-Authenticate", `Basic realm="Restricted"`)
@@ -71,40 +317,236 @@ func main() {
 				return
 			}
 			if username != *flagUserName || password != *flagPassword {
+				authFailed(req)
 				http.Error(w, "WebDAV: need authorized!", http.StatusUnauthorized)
 				return
 			}
 		}
+		w, uploaded := trackUpload(w, req)
+		defer uploaded()
+		if handleTerms(w, req) {
+			return
+		}
+		var ok bool
+		if w, ok = injectFault(w, req); !ok {
+			return
+		}
+		if shedLoad(w, req) {
+			return
+		}
+		if requestSlots != nil {
+			interactive := isInteractive(fs.FileSystem, req)
+			if err := requestSlots.acquire(req.Context(), interactive); err != nil {
+				http.Error(w, "WebDAV: server busy", http.StatusServiceUnavailable)
+				return
+			}
+			defer requestSlots.release(interactive)
+		}
+		if id := req.URL.Query().Get("operation"); id != "" && req.Method == "GET" {
+			handleAsyncStatus(w, req, id)
+			return
+		}
+		if id := req.URL.Query().Get("task"); id != "" && req.Method == "GET" {
+			handleTaskOutput(w, req, id)
+			return
+		}
+		if req.Method == "SEARCH" && searchIndex != nil {
+			handleSearch(fs.FileSystem, w, req)
+			return
+		}
+		if req.Method == "OPTIONS" && searchIndex != nil {
+			w.Header().Set("DASL", "<DAV:basicsearch>")
+		}
+		if req.Method == "REPORT" && pimCollections != nil {
+			handleReport(fs.FileSystem, w, req)
+			return
+		}
+		if req.Method == "OPTIONS" && pimCollections != nil {
+			// The handler sets its headers without writing them, so they
+			// can still be extended once it returns.
+			fs.ServeHTTP(w, req)
+			w.Header().Set("DAV", w.Header().Get("DAV")+", calendar-access, addressbook")
+			if allow := w.Header().Get("Allow"); strings.Contains(allow, "PROPFIND") {
+				w.Header().Set("Allow", allow+", REPORT")
+			}
+			return
+		}
+		if algo := req.URL.Query().Get("hash"); algo != "" && *flagFileHash && (req.Method == "GET" || req.Method == "HEAD") {
+			handleFileHash(fs.FileSystem, w, req, algo)
+			return
+		}
+		if req.Method == "GET" && *flagDelta && req.URL.Query().Has("blocks") {
+			handleBlocks(fs.FileSystem, w, req)
+			return
+		}
+		if part := req.URL.Query().Get("hls"); req.Method == "GET" && hls != nil && part != "" {
+			handleHLS(fs.FileSystem, w, req, part)
+			return
+		}
+		if req.Method == "GET" && thumbs != nil && req.URL.Query().Get("thumb") != "" {
+			handleThumb(fs.FileSystem, w, req)
+			return
+		}
+		if (req.Method == "GET" || req.Method == "HEAD") && staticSites != nil && serveStatic(fs.FileSystem, w, req) {
+			return
+		}
 		if req.Method == "GET" && handleDirList(fs.FileSystem, w, req) {
 			return
 		}
+		if refusePropfind(w, req) || handlePropfindStream(fs, w, req) {
+			return
+		}
 		if *flagReadonly {
 			switch req.Method {
-			case "PUT", "DELETE", "PROPPATCH", "MKCOL", "COPY", "MOVE":
+			case "PUT", "PATCH", "DELETE", "PROPPATCH", "MKCOL", "COPY", "MOVE":
 				http.Error(w, "WebDAV: Read Only!!!", http.StatusForbidden)
 				return
 			}
 		}
+		if refuseWORM(fs.FileSystem, w, req) || refuseAppendOnly(fs.FileSystem, w, req) || refuseRetained(w, req) {
+			return
+		}
+		if rejectOverQuota(fs.FileSystem, w, req) {
+			return
+		}
+		if req.Method == "PATCH" && *flagDelta {
+			handlePatch(fs, w, req)
+			return
+		}
+		if wantsAsync(req) {
+			startAsync(w, req, func(w http.ResponseWriter, req *http.Request) {
+				if !handleTreeCopy(fs, w, req) {
+					fs.ServeHTTP(w, req)
+				}
+			})
+			return
+		}
+		if handleTreeCopy(fs, w, req) {
+			return
+		}
+		if req.Method == "PUT" && *flagClamd != "" {
+			serveScannedPut(fs, w, req)
+			return
+		}
 		fs.ServeHTTP(w, req)
 	})
 
+	handleSignals()
+	lns, err := listen(httpAddress)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to start server: %v\n", err)
+		os.Exit(1)
+	}
 	if *flagHttpsMode {
-		err := http.ListenAndServeTLS(httpAddress, *flagCertFile, *flagKeyFile, nil)
+		cert, err := tls.LoadX509KeyPair(*flagCertFile, *flagKeyFile)
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "Failed to start server: %v\n", err)
 			os.Exit(1)
 		}
-	} else {
-		err := http.ListenAndServe(httpAddress, nil)
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "Failed to start server: %v\n", err)
+		for i := range lns {
+			lns[i] = tls.NewListener(lns[i], &tls.Config{
+				Certificates: []tls.Certificate{cert},
+				NextProtos:   []string{"h2", "http/1.1"},
+			})
+		}
+	}
+	ln := lns[0]
+	url := serverURL(ln.Addr(), "")
+	log.Printf("Serving %s on %s", *flagRootDir, url)
+	if *flagFTPAddr != "" {
+		if err := startFTP(fs.FileSystem); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to start FTP server: %v\n", err)
+			os.Exit(1)
+		}
+	}
+	if *flagSFTPAddr != "" {
+		if err := startSFTP(fs.FileSystem); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to start SFTP server: %v\n", err)
 			os.Exit(1)
 		}
 	}
+	if *flagS3Addr != "" {
+		if err := startS3(fs.FileSystem); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to start S3 server: %v\n", err)
+			os.Exit(1)
+		}
+	}
+	if *flagQRCode {
+		if err := printQRCode(os.Stdout, lanURL(ln.Addr())); err != nil {
+			log.Printf("Failed to print QR code: %v", err)
+		}
+	}
+	if *flagMDNS {
+		if r, err := startMDNS(ln.Addr()); err != nil {
+			log.Printf("Failed to start mDNS: %v", err)
+		} else {
+			onShutdown(func() { r.Close() })
+		}
+	}
+	if *flagPortMap {
+		if m, err := startPortMap(ln.Addr()); err != nil {
+			log.Printf("Failed to map port: %v", err)
+		} else {
+			log.Printf("External url: %s", serverURL(m.ExternalAddr(), ""))
+			onShutdown(func() { m.Close() })
+		}
+	}
+	if *flagOpenBrowser {
+		if err := openBrowser(url); err != nil {
+			log.Printf("Failed to open browser: %v", err)
+		}
+	}
+
+	handler := recoverPanics(mux)
+	if serverStats != nil {
+		handler = serverStats.wrap(handler)
+	}
+	if accessLog != nil {
+		handler = accessLog.wrap(handler)
+	}
+	srv := newServer(handler)
+	if *flagReusePort {
+		// Let requests in flight finish, so a replacement process sharing
+		// the port can take over without failing any of them.
+		onShutdown(func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			defer cancel()
+			srv.Shutdown(ctx)
+		})
+	}
+	errc := make(chan error, len(lns))
+	for _, ln := range lns {
+		go func(ln net.Listener) { errc <- srv.Serve(ln) }(ln)
+	}
+	if err := <-errc; err != nil && err != http.ErrServerClosed {
+		fmt.Fprintf(os.Stderr, "Failed to start server: %v\n", err)
+		os.Exit(1)
+	}
+	select {}
+}
+
+var shutdownHooks []func()
+
+// onShutdown registers f to run when the process receives SIGINT or
+// SIGTERM, before it exits.
+func onShutdown(f func()) {
+	shutdownHooks = append(shutdownHooks, f)
+}
+
+func handleSignals() {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-c
+		for i := len(shutdownHooks) - 1; i >= 0; i-- {
+			shutdownHooks[i]()
+		}
+		os.Exit(0)
+	}()
 }
 
 func handleDirList(fs webdav.FileSystem, w http.ResponseWriter, req *http.Request) bool {
-	ctx := context.Background()
+	ctx := req.Context()
 	f, err := fs.OpenFile(ctx, req.URL.Path, os.O_RDONLY, 0)
 	if err != nil {
 		return false
@@ -117,42 +559,115 @@ func handleDirList(fs webdav.FileSystem, w http.ResponseWriter, req *http.Reques
 		http.Redirect(w, req, req.URL.Path+"/", 302)
 		return true
 	}
-	dirs, err := f.Readdir(-1)
-	if err != nil {
-		log.Print(w, "Error reading directory", http.StatusInternalServerError)
+	if algo := req.URL.Query().Get("manifest"); algo != "" && *flagManifest {
+		handleManifest(fs, w, req, req.URL.Path, algo)
+		return true
+	}
+	if req.URL.Query().Get("zip") != "" && *flagZip {
+		handleZip(fs, w, req, req.URL.Path)
+		return true
+	}
+	if live != nil && req.URL.Query().Get("events") != "" {
+		handleLiveEvents(fs, w, req)
+		return true
+	}
+	if q := req.URL.Query().Get("q"); q != "" && searchIndex != nil {
+		writeSearchResults(fs, w, req, q)
+		return true
+	}
+	// With -listing-limit, one sorted page of entries is shown at a time.
+	// Without it, entries are read and written a batch at a time, so giant
+	// directories start rendering at once; each batch lists its folders
+	// first.
+	var (
+		dirs []os.FileInfo
+		more bool
+	)
+	limit := *flagListingLimit
+	if limit > 0 {
+		dirs, more, err = listingPage(f, req.URL.Query().Get("after"), limit)
+	} else {
+		dirs, err = f.Readdir(readdirBatch)
+	}
+	if err != nil && err != io.EOF {
+		if ctx.Err() != nil {
+			http.Error(w, "WebDAV: operation timed out", http.StatusServiceUnavailable)
+			return true
+		}
+		log.Printf("Failed to read directory %s: %v", req.URL.Path, err)
 		return false
 	}
 
-	sort.Slice(dirs, func(i, j int) bool {
-		if dirs[i].IsDir() && !dirs[j].IsDir() {
-			return true
+	writeListingHead(w, filepath.Base(req.URL.Path), listingNav(req.URL.Path))
+	if req.URL.Path != "/" {
+		fmt.Fprintf(w, "<tr><td></td><td><a href=\"../\"><svg xmlns=\"http://www.w3.org/2000/svg\" class=\"icon icon-tabler icon-tabler-corner-left-up\" width=\"24\" height=\"24\" viewBox=\"0 0 24 24\" stroke-width=\"2\" stroke=\"currentColor\" fill=\"none\" stroke-linecap=\"round\" stroke-linejoin=\"round\"><path stroke=\"none\" d=\"M0 0h24v24H0z\" fill=\"none\"></path><path d=\"M18 18h-6a3 3 0 0 1 -3 -3v-10l-4 4m8 0l-4 -4\"></path></svg><span class=\"go-up\">Up</span></a></td></tr>\n")
+	}
+	flusher, _ := w.(http.Flusher)
+	writeRows := func(dirs []os.FileInfo) error {
+		sort.Slice(dirs, func(i, j int) bool {
+			if dirs[i].IsDir() && !dirs[j].IsDir() {
+				return true
+			}
+			if !dirs[i].IsDir() && dirs[j].IsDir() {
+				return false
+			}
+			return dirs[i].Name() < dirs[j].Name()
+		})
+		for _, d := range dirs {
+			if !*flagShowHidden && strings.HasPrefix(d.Name(), ".") {
+				continue
+			}
+			name := d.Name()
+			if d.IsDir() {
+				name += "/"
+			}
+			writeListingRow(w, path.Join(req.URL.Path, d.Name()), name, d)
 		}
-		if !dirs[i].IsDir() && dirs[j].IsDir() {
-			return false
+		if flusher != nil {
+			flusher.Flush()
 		}
-		return dirs[i].Name() < dirs[j].Name()
-	})
-
-	folderName := filepath.Base(req.URL.Path)
-	currentDir := req.URL.Path
+		return nil
+	}
+	writeRows(dirs)
+	if more {
+		next := "?after=" + url.QueryEscape(listingKey(dirs[len(dirs)-1]))
+		fmt.Fprintf(w, "<tr><td></td><td><a class=\"next\" href=\"%s\">More entries&hellip;</a></td></tr>\n", html.EscapeString(next))
+	} else if limit <= 0 && err == nil {
+		if err := readdirBatches(f, writeRows); err != nil && ctx.Err() == nil {
+			log.Printf("Failed to read directory %s: %v", req.URL.Path, err)
+		}
+	}
+	writeListingFoot(w)
+	return true
+}
 
+// listingNav renders the breadcrumb header for currentDir.
+func listingNav(currentDir string) string {
 	parts := strings.Split(currentDir, "/")
 	var navLinks []string
 	for i := 1; i < len(parts); i++ {
 		navPath := "/" + strings.Join(parts[1:i+1], "/")
-		navLinks = append(navLinks, fmt.Sprintf(`<a href="%s">%s</a>`, navPath, parts[i]))
+		navLinks = append(navLinks, fmt.Sprintf(`<a href="%s">%s</a>`, html.EscapeString(navPath), html.EscapeString(parts[i])))
+	}
+
+	search := ""
+	if searchIndex != nil {
+		search = `<form class="search" method="get"><input type="search" name="q" placeholder="Search file contents"></form>`
 	}
 
-	nav := fmt.Sprintf(`
+	return fmt.Sprintf(`
 	<header>
 	<div class="wrapper"><div class="breadcrumbs">Folder Path</div>
 			<h1>
 			<a href="/">/</a>%s
 			</h1>
+			%s
 		</div>
 	</header>
-	`, strings.Join(navLinks, " / "))
+	`, strings.Join(navLinks, " / "), search)
+}
 
+func writeListingHead(w http.ResponseWriter, title, nav string) {
 	w.Header().Set("Content-Type", "text/html; charset=utf-8")
 	fmt.Fprintf(w, `
 		<!DOCTYPE html>
@@ -242,6 +757,16 @@ func handleDirList(fs webdav.FileSystem, w http.ResponseWriter, req *http.Reques
 				box-shadow: 0px 0px 20px 0px rgb(0 0 0 / 10%%);
 			}
 
+			.search input {
+				margin-top: 10px;
+				padding: 6px 10px;
+				width: 100%%;
+				max-width: 400px;
+				font-size: 14px;
+				border: 1px solid #ccc;
+				border-radius: 5px;
+			}
+
 			.breadcrumbs {
 				text-transform: uppercase;
 				font-size: 10px;
@@ -290,6 +815,20 @@ func handleDirList(fs webdav.FileSystem, w http.ResponseWriter, req *http.Reques
 				box-shadow: 0 2px 5px 1px rgb(0 0 0 / 5%%);
 			}
 
+			.quota-warning {
+				padding: 0.5em 1em;
+				border-radius: 5px;
+				background: #fff4ce;
+				color: #6b4e00;
+			}
+
+			.banner {
+				padding: 0.5em 1em;
+				border-radius: 5px;
+				background: #e5f1fb;
+				color: #004578;
+			}
+
 			.meta {
 				display: flex;
 				gap: 1em;
@@ -490,6 +1029,7 @@ func handleDirList(fs webdav.FileSystem, w http.ResponseWriter, req *http.Reques
 			<div class="wrapper">
 			<main>
 				<div class="meta">
+				%s%s
 				</div>
 				<div class="listing">
 				<table aria-describedby="summary">
@@ -502,39 +1042,57 @@ func handleDirList(fs webdav.FileSystem, w http.ResponseWriter, req *http.Reques
 						<th class="hideable"></th>
 					</tr>
 				</thead>
-				<tbody>`, folderName, nav)
-	if req.URL.Path != "/" {
-		fmt.Fprintf(w, "<tr><td></td><td><a href=\"../\"><svg xmlns=\"http://www.w3.org/2000/svg\" class=\"icon icon-tabler icon-tabler-corner-left-up\" width=\"24\" height=\"24\" viewBox=\"0 0 24 24\" stroke-width=\"2\" stroke=\"currentColor\" fill=\"none\" stroke-linecap=\"round\" stroke-linejoin=\"round\"><path stroke=\"none\" d=\"M0 0h24v24H0z\" fill=\"none\"></path><path d=\"M18 18h-6a3 3 0 0 1 -3 -3v-10l-4 4m8 0l-4 -4\"></path></svg><span class=\"go-up\">Up</span></a></td></tr>\n")
+				<tbody>`, html.EscapeString(title), nav, bannerHTML(), quotaBanner())
+}
+
+// writeListingRow writes one table row for the file at slash path p,
+// labelled name.
+func writeListingRow(w io.Writer, p, name string, d os.FileInfo) {
+	href := (&url.URL{Path: p}).EscapedPath()
+	if d.IsDir() {
+		href += "/"
 	}
-	for _, d := range dirs {
-		if !*flagShowHidden && strings.HasPrefix(d.Name(), ".") {
-			continue
-		}
-		link := d.Name()
-		if d.IsDir() {
-			link += "/"
-		}
-		name := link
-		if d.IsDir() {
-			fmt.Fprintf(w, "<tr class=\"file\"><td></td><td><a href=\"%s\"><svg xmlns=\"http://www.w3.org/2000/svg\" class=\"icon icon-tabler icon-tabler-folder-filled\" width=\"24\" height=\"24\" viewBox=\"0 0 24 24\" stroke-width=\"2\" stroke=\"currentColor\" fill=\"none\" stroke-linecap=\"round\" stroke-linejoin=\"round\"><path stroke=\"none\" d=\"M0 0h24v24H0z\" fill=\"none\"></path><path d=\"M9 3a1 1 0 0 1 .608 .206l.1 .087l2.706 2.707h6.586a3 3 0 0 1 2.995 2.824l.005 .176v8a3 3 0 0 1 -2.824 2.995l-.176 .005h-14a3 3 0 0 1 -2.995 -2.824l-.005 -.176v-11a3 3 0 0 1 2.824 -2.995l.176 -.005h4z\" stroke-width=\"0\" fill=\"#ffb900\"></path></svg><span class=\"name\">%s</span></a></td>", link, name)
-			fmt.Fprintf(w, "<td>—</td>")
+	link := html.EscapeString(href)
+	name = html.EscapeString(name)
+	row := fmt.Sprintf("<tr class=\"file\" data-name=\"%s\">", name)
+	if d.IsDir() {
+		fmt.Fprintf(w, "%s<td></td><td><a href=\"%s\"><svg xmlns=\"http://www.w3.org/2000/svg\" class=\"icon icon-tabler icon-tabler-folder-filled\" width=\"24\" height=\"24\" viewBox=\"0 0 24 24\" stroke-width=\"2\" stroke=\"currentColor\" fill=\"none\" stroke-linecap=\"round\" stroke-linejoin=\"round\"><path stroke=\"none\" d=\"M0 0h24v24H0z\" fill=\"none\"></path><path d=\"M9 3a1 1 0 0 1 .608 .206l.1 .087l2.706 2.707h6.586a3 3 0 0 1 2.995 2.824l.005 .176v8a3 3 0 0 1 -2.824 2.995l-.176 .005h-14a3 3 0 0 1 -2.995 -2.824l-.005 -.176v-11a3 3 0 0 1 2.824 -2.995l.176 -.005h4z\" stroke-width=\"0\" fill=\"#ffb900\"></path></svg><span class=\"name\">%s</span></a></td>", row, link, name)
+		if size, ok := dirSize(p); ok {
+			fmt.Fprintf(w, "<td class=\"size\">%s</td>", formatSize(size))
 		} else {
-			fmt.Fprintf(w, "<tr class=\"file\"><td></td><td><a href=\"%s\"><svg xmlns=\"http://www.w3.org/2000/svg\" class=\"icon icon-tabler icon-tabler-file\" width=\"24\" height=\"24\" viewBox=\"0 0 24 24\" stroke-width=\"2\" stroke=\"currentColor\" fill=\"none\" stroke-linecap=\"round\" stroke-linejoin=\"round\"><path stroke=\"none\" d=\"M0 0h24v24H0z\" fill=\"none\"></path><path d=\"M14 3v4a1 1 0 0 0 1 1h4\"></path><path d=\"M17 21h-10a2 2 0 0 1 -2 -2v-14a2 2 0 0 1 2 -2h7l5 5v11a2 2 0 0 1 -2 2z\"></path></svg><span class=\"name\">%s</span></a></td>", link, name)
-			fmt.Fprintf(w, "<td class=\"size\">%s</td>", formatSize(d.Size()))
+			fmt.Fprintf(w, "<td>—</td>")
+		}
+	} else {
+		thumb := ""
+		if thumbs != nil && isThumbable(p) {
+			thumb = fmt.Sprintf(`<img src="%s?thumb=1" loading="lazy" alt="">`, link)
 		}
-		fmt.Fprintf(w, "<td class=\"timestamp hideable\">%s</td>", d.ModTime().Format("2006/01/02 15:04:05"))
+		fmt.Fprintf(w, "%s<td>%s</td><td><a href=\"%s\"><svg xmlns=\"http://www.w3.org/2000/svg\" class=\"icon icon-tabler icon-tabler-file\" width=\"24\" height=\"24\" viewBox=\"0 0 24 24\" stroke-width=\"2\" stroke=\"currentColor\" fill=\"none\" stroke-linecap=\"round\" stroke-linejoin=\"round\"><path stroke=\"none\" d=\"M0 0h24v24H0z\" fill=\"none\"></path><path d=\"M14 3v4a1 1 0 0 0 1 1h4\"></path><path d=\"M17 21h-10a2 2 0 0 1 -2 -2v-14a2 2 0 0 1 2 -2h7l5 5v11a2 2 0 0 1 -2 2z\"></path></svg><span class=\"name\">%s</span></a></td>", row, thumb, link, name)
+		fmt.Fprintf(w, "<td class=\"size\">%s</td>", formatSize(d.Size()))
+	}
+	fmt.Fprintf(w, "<td class=\"timestamp hideable\">%s</td>", d.ModTime().Format("2006/01/02 15:04:05"))
+	if hls != nil && !d.IsDir() && isVideo(p) {
+		fmt.Fprintf(w, "<td class=\"hideable\"><a href=\"%s?hls=view\">Preview</a></td></tr>\n", link)
+	} else {
 		fmt.Fprintln(w, "<td class=\"hideable\"></td></tr>")
 	}
+}
+
+func writeListingFoot(w io.Writer) {
+	script := ""
+	if live != nil {
+		script = liveScript
+	}
 	fmt.Fprintf(w, `
 				</tbody>
 				</table>
 				</div>
 			</main>
 			</div>
+			%s
 		</body>
 		<footer></footer>
-		</html>`)
-	return true
+		</html>`, script)
 }
 
 func formatSize(bytes int64) string {
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"log"
+	"net/http"
+	"os"
+	"time"
+)
+
+var (
+	flagHealthPath = flag.String("health-path", "", "serve a health check at this path, e.g. /healthz (disabled when empty)")
+	flagHealthDeep = flag.Bool("health-deep", false, "probe the root dir, and write a temp file to the state dir unless -read-only, on the health check instead of always reporting ok")
+)
+
+// healthProbePrefix names the temp files written by the deep probe.
+const healthProbePrefix = "healthz-"
+
+type backendHealth struct {
+	Status   string `json:"status"`
+	Writable bool   `json:"writable"`
+	Error    string `json:"error,omitempty"`
+	Latency  string `json:"latency"`
+}
+
+type healthReport struct {
+	Status string `json:"status"`
+	// Backends is keyed by backend name. The server has a single backend,
+	// the -dir root, reported as "root".
+	Backends map[string]backendHealth `json:"backends,omitempty"`
+}
+
+func handleHealthz(w http.ResponseWriter, req *http.Request) {
+	report := healthReport{Status: "ok"}
+	if *flagHealthDeep {
+		root := probeDir(*flagRootDir, !*flagReadonly)
+		if root.Error != "" {
+			log.Printf("Health check failed: %s", root.Error)
+			if !authorized(req) {
+				root.Error = ""
+			}
+		}
+		report.Backends = map[string]backendHealth{"root": root}
+		if root.Status != "ok" {
+			report.Status = "fail"
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if report.Status != "ok" {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(report)
+}
+
+// probeDir stats dir so a vanished mount is detected and, when writable,
+// round-trips a small temp file through the state dir, which unlike dir is
+// not served, so clients never see the probe's files.
+func probeDir(dir string, writable bool) backendHealth {
+	start := time.Now()
+	h := backendHealth{Status: "ok", Writable: writable}
+
+	fail := func(err error) backendHealth {
+		h.Status = "fail"
+		h.Error = err.Error()
+		h.Latency = time.Since(start).String()
+		return h
+	}
+
+	fi, err := os.Stat(dir)
+	if err != nil {
+		return fail(err)
+	}
+	if !fi.IsDir() {
+		return fail(&os.PathError{Op: "stat", Path: dir, Err: os.ErrInvalid})
+	}
+	if !writable {
+		h.Latency = time.Since(start).String()
+		return h
+	}
+
+	state, err := stateDir()
+	if err != nil {
+		return fail(err)
+	}
+	f, err := os.CreateTemp(state, healthProbePrefix+"*")
+	if err != nil {
+		return fail(err)
+	}
+	name := f.Name()
+	_, err = f.Write([]byte("ok"))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if rerr := os.Remove(name); err == nil {
+		err = rerr
+	}
+	if err != nil {
+		return fail(err)
+	}
+	h.Latency = time.Since(start).String()
+	return h
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+	"golang.org/x/net/webdav"
+)
+
+func TestProbeDir(t *testing.T) {
+	dir, state := t.TempDir(), t.TempDir()
+	defer func(s string) { *flagStateDir = s }(*flagStateDir)
+	*flagStateDir = state
+	file := filepath.Join(dir, "file")
+	if err := os.WriteFile(file, []byte("x"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		dir      string
+		writable bool
+		status   string
+	}{
+		{"writable dir", dir, true, "ok"},
+		{"read-only dir", dir, false, "ok"},
+		{"missing dir", filepath.Join(dir, "missing"), false, "fail"},
+		{"missing dir writable", filepath.Join(dir, "missing"), true, "fail"},
+		{"not a dir", file, false, "fail"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := probeDir(tt.dir, tt.writable)
+			if h.Status != tt.status {
+				t.Errorf("status = %q, want %q (error %q)", h.Status, tt.status, h.Error)
+			}
+			if (h.Error != "") != (tt.status == "fail") {
+				t.Errorf("error = %q for status %q", h.Error, h.Status)
+			}
+			if h.Latency == "" {
+				t.Error("latency not set")
+			}
+		})
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("probe wrote to the probed dir: %v", entries)
+	}
+	if entries, _ := os.ReadDir(state); len(entries) != 0 {
+		t.Errorf("probe left files behind: %v", entries)
+	}
+}
+
+func TestOpenFileWrapsOnlyDirs(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "a"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	fs := SkipBrokenLink{webdav.Dir(dir)}
+	f, err := fs.OpenFile(context.Background(), "/a", os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, ok := f.(*os.File); !ok {
+		t.Errorf("file opened as %T, want *os.File", f)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	g, err := fs.OpenFile(ctx, "/a", os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer g.Close()
+	if _, ok := g.(ctxFile); !ok {
+		t.Errorf("file opened with a deadline as %T, want ctxFile", g)
+	}
+}
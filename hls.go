@@ -0,0 +1,211 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"html"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/webdav"
+)
+
+var (
+	flagHLS         = flag.Bool("hls", false, "offer HLS previews of videos, transcoded on demand with ffmpeg")
+	flagFFmpeg      = flag.String("ffmpeg", "ffmpeg", "ffmpeg binary used for -hls")
+	flagHLSCacheDir = flag.String("hls-cache-dir", "", "directory to keep transcoded HLS segments in (default: user cache dir)")
+	flagHLSJobs     = flag.Int("hls-jobs", 1, "maximum number of concurrent ffmpeg transcodes")
+)
+
+const hlsPlaylistWait = 30 * time.Second
+
+var (
+	videoExts      = map[string]bool{".mp4": true, ".m4v": true, ".mov": true, ".mkv": true, ".avi": true, ".webm": true, ".mts": true}
+	hlsSegmentName = regexp.MustCompile(`^seg[0-9]{5}\.ts$`)
+)
+
+func isVideo(name string) bool {
+	return videoExts[strings.ToLower(path.Ext(name))]
+}
+
+// hlsTranscoder runs ffmpeg to turn videos into cached HLS renditions, at
+// most -hls-jobs at a time.
+type hlsTranscoder struct {
+	dir    string
+	ffmpeg string
+	slots  chan struct{}
+
+	mu      sync.Mutex
+	running map[string]bool
+}
+
+var hls *hlsTranscoder
+
+func startHLS() error {
+	dir := *flagHLSCacheDir
+	if dir == "" {
+		base, err := os.UserCacheDir()
+		if err != nil {
+			return err
+		}
+		dir = filepath.Join(base, "gowebdav", "hls")
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	ffmpeg, err := exec.LookPath(*flagFFmpeg)
+	if err != nil {
+		return err
+	}
+	jobs := *flagHLSJobs
+	if jobs < 1 {
+		jobs = 1
+	}
+	hls = &hlsTranscoder{dir: dir, ffmpeg: ffmpeg, slots: make(chan struct{}, jobs), running: make(map[string]bool)}
+	return nil
+}
+
+func (t *hlsTranscoder) outDir(name string, fi os.FileInfo) string {
+	h := sha256.Sum256([]byte(fmt.Sprintf("%s\x00%d\x00%d", name, fi.Size(), fi.ModTime().UnixNano())))
+	return filepath.Join(t.dir, hex.EncodeToString(h[:16]))
+}
+
+func hlsArgs(src, out string) []string {
+	return []string{
+		"-hide_banner", "-loglevel", "error", "-nostdin",
+		"-i", src,
+		"-c:v", "libx264", "-preset", "veryfast", "-crf", "26",
+		"-vf", "scale=-2:'min(720,ih)'",
+		"-c:a", "aac", "-b:a", "128k",
+		"-f", "hls", "-hls_time", "6", "-hls_playlist_type", "event",
+		"-hls_base_url", "?hls=",
+		"-hls_segment_filename", filepath.Join(out, "seg%05d.ts"),
+		filepath.Join(out, "index.m3u8"),
+	}
+}
+
+// ensure starts transcoding src into out unless it is done or under way. It
+// returns false when all transcode slots are busy.
+func (t *hlsTranscoder) ensure(src, out string) bool {
+	if _, err := os.Stat(filepath.Join(out, "done")); err == nil {
+		return true
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.running[out] {
+		return true
+	}
+	select {
+	case t.slots <- struct{}{}:
+	default:
+		return false
+	}
+	t.running[out] = true
+	go func() {
+		defer func() {
+			t.mu.Lock()
+			delete(t.running, out)
+			t.mu.Unlock()
+			<-t.slots
+		}()
+		os.RemoveAll(out)
+		if err := os.MkdirAll(out, 0700); err != nil {
+			log.Printf("HLS: %v", err)
+			return
+		}
+		cmd := exec.Command(t.ffmpeg, hlsArgs(src, out)...)
+		if msg, err := cmd.CombinedOutput(); err != nil {
+			log.Printf("HLS: transcoding %s failed: %v: %s", src, err, strings.TrimSpace(string(msg)))
+			os.RemoveAll(out)
+			return
+		}
+		os.WriteFile(filepath.Join(out, "done"), nil, 0600)
+	}()
+	return true
+}
+
+// handleHLS serves ?hls=view (a player page), ?hls=index.m3u8 and the
+// segments it references, for the video at the request path.
+func handleHLS(fs webdav.FileSystem, w http.ResponseWriter, req *http.Request, part string) {
+	name := req.URL.Path
+	if !isVideo(name) {
+		http.Error(w, "WebDAV: not a video", http.StatusBadRequest)
+		return
+	}
+	fi, err := fs.Stat(req.Context(), name)
+	if err != nil || fi.IsDir() {
+		http.Error(w, "Not Found", http.StatusNotFound)
+		return
+	}
+	if part == "view" {
+		writeHLSPlayer(w, path.Base(name))
+		return
+	}
+	if part != "index.m3u8" && !hlsSegmentName.MatchString(part) {
+		http.Error(w, "WebDAV: invalid hls part", http.StatusBadRequest)
+		return
+	}
+
+	out := hls.outDir(name, fi)
+	if !hls.ensure(localPath(name), out) {
+		w.Header().Set("Retry-After", "30")
+		http.Error(w, "WebDAV: transcoder busy", http.StatusServiceUnavailable)
+		return
+	}
+	p := filepath.Join(out, part)
+	deadline := time.Now().Add(hlsPlaylistWait)
+	for {
+		if _, err := os.Stat(p); err == nil {
+			break
+		}
+		if time.Now().After(deadline) || req.Context().Err() != nil {
+			http.Error(w, "Not Found", http.StatusNotFound)
+			return
+		}
+		time.Sleep(250 * time.Millisecond)
+	}
+	if part == "index.m3u8" {
+		w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+		w.Header().Set("Cache-Control", "no-cache")
+	} else {
+		w.Header().Set("Content-Type", "video/mp2t")
+	}
+	http.ServeFile(w, req, p)
+}
+
+func writeHLSPlayer(w http.ResponseWriter, title string) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	fmt.Fprintf(w, `<!DOCTYPE html>
+<html>
+<head>
+	<title>%s</title>
+	<meta charset="utf-8">
+	<meta name="viewport" content="width=device-width, initial-scale=1.0">
+	<style>body { margin: 0; background: black; } video { width: 100vw; height: 100vh; }</style>
+</head>
+<body>
+	<video id="v" controls autoplay></video>
+	<script>
+	var v = document.getElementById("v"), src = "?hls=index.m3u8";
+	if (v.canPlayType("application/vnd.apple.mpegurl")) {
+		v.src = src;
+	} else {
+		var s = document.createElement("script");
+		s.src = "https://cdn.jsdelivr.net/npm/hls.js@1";
+		s.onload = function () { var h = new Hls(); h.loadSource(src); h.attachMedia(v); };
+		document.body.appendChild(s);
+	}
+	</script>
+</body>
+</html>`, html.EscapeString(title))
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/webdav"
+)
+
+// fakeFFmpeg writes a script that mimics ffmpeg's HLS output: a playlist
+// and one segment next to the last argument.
+func fakeFFmpeg(t *testing.T) string {
+	t.Helper()
+	p := filepath.Join(t.TempDir(), "ffmpeg")
+	script := `#!/bin/sh
+for a; do out=$a; done
+dir=$(dirname "$out")
+printf 'segment' > "$dir/seg00000.ts"
+printf '#EXTM3U\n?hls=seg00000.ts\n#EXT-X-ENDLIST\n' > "$out"
+`
+	if err := os.WriteFile(p, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestHandleHLS(t *testing.T) {
+	root := t.TempDir()
+	os.WriteFile(filepath.Join(root, "clip.mp4"), []byte("not really a video"), 0644)
+	os.WriteFile(filepath.Join(root, "doc.txt"), []byte("text"), 0644)
+	defer func(dir string) { *flagRootDir = dir }(*flagRootDir)
+	*flagRootDir = root
+	defer func(h *hlsTranscoder) { hls = h }(hls)
+	hls = &hlsTranscoder{dir: t.TempDir(), ffmpeg: fakeFFmpeg(t), slots: make(chan struct{}, 1), running: make(map[string]bool)}
+	fs := webdav.Dir(root)
+
+	tests := []struct {
+		name   string
+		target string
+		status int
+		body   string
+	}{
+		{"player", "/clip.mp4?hls=view", http.StatusOK, "<video"},
+		{"playlist", "/clip.mp4?hls=index.m3u8", http.StatusOK, "#EXTM3U"},
+		{"segment", "/clip.mp4?hls=seg00000.ts", http.StatusOK, "segment"},
+		{"escape attempt", "/clip.mp4?hls=../../etc/passwd", http.StatusBadRequest, ""},
+		{"not a video", "/doc.txt?hls=index.m3u8", http.StatusBadRequest, ""},
+		{"missing", "/gone.mp4?hls=index.m3u8", http.StatusNotFound, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", tt.target, nil)
+			rec := httptest.NewRecorder()
+			handleHLS(fs, rec, req, req.URL.Query().Get("hls"))
+			if rec.Code != tt.status {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.status, rec.Body)
+			}
+			if !strings.Contains(rec.Body.String(), tt.body) {
+				t.Errorf("body = %q, want it to contain %q", rec.Body, tt.body)
+			}
+		})
+	}
+}
+
+func TestHLSTranscoderBusy(t *testing.T) {
+	h := &hlsTranscoder{dir: t.TempDir(), ffmpeg: "/bin/false", slots: make(chan struct{}, 1), running: make(map[string]bool)}
+	h.slots <- struct{}{}
+	if h.ensure("/src", filepath.Join(h.dir, "a")) {
+		t.Error("ensure succeeded with every slot taken")
+	}
+	<-h.slots
+	out := filepath.Join(h.dir, "b")
+	if !h.ensure("/src", out) {
+		t.Fatal("ensure failed with a free slot")
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		h.mu.Lock()
+		n := len(h.running)
+		h.mu.Unlock()
+		if n == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("transcode never finished")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if _, err := os.Stat(out); !os.IsNotExist(err) {
+		t.Errorf("failed transcode left %s behind", out)
+	}
+}
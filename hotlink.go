@@ -0,0 +1,74 @@
+package main
+
+import (
+	"flag"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+var (
+	flagHotlinkProtect = flag.Bool("hotlink-protect", false, "refuse unauthenticated GETs, on a server without -user or through share links and signed URLs, that other websites make by embedding files")
+	flagHotlinkAllow   = flag.String("hotlink-allow", "", "comma-separated hosts besides this one that may embed files under -hotlink-protect, e.g. example.com,*.example.org")
+)
+
+// hotlinkAllowed reports whether host, the site a request came from, may
+// embed files served for serverHost.
+func hotlinkAllowed(host, serverHost string) bool {
+	host = strings.ToLower(stripPort(host))
+	if host == strings.ToLower(stripPort(serverHost)) {
+		return true
+	}
+	for _, pattern := range strings.Split(*flagHotlinkAllow, ",") {
+		pattern = strings.ToLower(strings.TrimSpace(pattern))
+		switch {
+		case pattern == "":
+		case strings.HasPrefix(pattern, "*."):
+			if strings.HasSuffix(host, pattern[1:]) {
+				return true
+			}
+		case host == pattern:
+			return true
+		}
+	}
+	return false
+}
+
+func stripPort(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		return h
+	}
+	return host
+}
+
+// refuseHotlink answers 403 to unauthenticated GETs that another site made,
+// as told by Origin or Referer. Clicking a link to a file on another site
+// still works in browsers that send Sec-Fetch headers; what they refuse is
+// embedding it in images, players and frames. Requests without either
+// header, such as from download tools, are let through.
+func refuseHotlink(w http.ResponseWriter, req *http.Request) bool {
+	if !*flagHotlinkProtect || req.Method != "GET" && req.Method != "HEAD" {
+		return false
+	}
+	public := *flagUserName == "" || *flagPassword == ""
+	if q := req.URL.Query(); !public && q.Get("share") == "" && q.Get("sig") == "" {
+		return false
+	}
+	from := req.Header.Get("Origin")
+	if from == "" || from == "null" {
+		from = req.Header.Get("Referer")
+	}
+	if from == "" {
+		return false
+	}
+	u, err := url.Parse(from)
+	if err == nil && hotlinkAllowed(u.Host, req.Host) {
+		return false
+	}
+	if req.Header.Get("Sec-Fetch-Mode") == "navigate" && req.Header.Get("Sec-Fetch-Dest") == "document" {
+		return false
+	}
+	http.Error(w, "WebDAV: files may not be embedded by other sites", http.StatusForbidden)
+	return true
+}
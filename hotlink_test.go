@@ -0,0 +1,47 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRefuseHotlink(t *testing.T) {
+	*flagHotlinkProtect = true
+	*flagHotlinkAllow = "blog.example.com, *.example.org"
+	defer func() { *flagHotlinkProtect, *flagHotlinkAllow = false, "" }()
+
+	tests := []struct {
+		target   string
+		header   map[string]string
+		authUser bool
+		refused  bool
+	}{
+		{"/a.jpg", nil, false, false},
+		{"/a.jpg", map[string]string{"Referer": "https://dav.example.net/photos/"}, false, false},
+		{"/a.jpg", map[string]string{"Referer": "https://evil.test/page"}, false, true},
+		{"/a.jpg", map[string]string{"Origin": "https://evil.test"}, false, true},
+		{"/a.jpg", map[string]string{"Referer": "https://blog.example.com/post"}, false, false},
+		{"/a.jpg", map[string]string{"Referer": "https://cdn.example.org/"}, false, false},
+		{"/a.jpg", map[string]string{"Referer": "https://example.org.evil.test/"}, false, true},
+		// Following a link is fine, embedding is not.
+		{"/a.jpg", map[string]string{"Referer": "https://evil.test/", "Sec-Fetch-Mode": "navigate", "Sec-Fetch-Dest": "document"}, false, false},
+		{"/a.jpg", map[string]string{"Referer": "https://evil.test/", "Sec-Fetch-Mode": "navigate", "Sec-Fetch-Dest": "iframe"}, false, true},
+		// With credentials set, only share links are unauthenticated.
+		{"/a.jpg", map[string]string{"Referer": "https://evil.test/"}, true, false},
+		{"/a.jpg?share=abc", map[string]string{"Referer": "https://evil.test/"}, true, true},
+	}
+	for _, tt := range tests {
+		if tt.authUser {
+			*flagUserName, *flagPassword = "user", "pass"
+		}
+		req := httptest.NewRequest("GET", "http://dav.example.net:8080"+tt.target, nil)
+		for k, v := range tt.header {
+			req.Header.Set(k, v)
+		}
+		w := httptest.NewRecorder()
+		if got := refuseHotlink(w, req); got != tt.refused {
+			t.Errorf("%s %v (auth %v): refused = %v, want %v", tt.target, tt.header, tt.authUser, got, tt.refused)
+		}
+		*flagUserName, *flagPassword = "", ""
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+
+	"golang.org/x/net/webdav"
+)
+
+var (
+	flagListingLimit  = flag.Int("listing-limit", 0, "show at most this many entries per directory listing page, linking to the next, e.g. 10000 (0 for no limit)")
+	flagPropfindLimit = flag.Int("propfind-limit", 0, "answer at most this many members per PROPFIND and refuse Depth: infinity, e.g. 100000 (0 for no limit)")
+)
+
+// errTruncated stops a walk that reached its entry limit.
+var errTruncated = errors.New("entry limit reached")
+
+// listingKey orders folders before files, then by name; it is also the
+// continuation token of listing pages.
+func listingKey(fi os.FileInfo) string {
+	if fi.IsDir() {
+		return "0" + fi.Name()
+	}
+	return "1" + fi.Name()
+}
+
+// listingPage returns the first limit visible entries of dir that sort
+// after the key after, in listing order, and whether more follow, holding
+// no more than limit+1 entries at any time.
+func listingPage(dir webdav.File, after string, limit int) ([]os.FileInfo, bool, error) {
+	return firstEntries(dir, after, limit, listingKey, visibleEntry)
+}
+
+// refusePropfind turns away Depth: infinity PROPFINDs, whose size nothing
+// bounds, while -propfind-limit is set, as RFC 4918 allows.
+func refusePropfind(w http.ResponseWriter, req *http.Request) bool {
+	if req.Method != "PROPFIND" || *flagPropfindLimit <= 0 {
+		return false
+	}
+	if depth := req.Header.Get("Depth"); depth != "" && !strings.EqualFold(depth, "infinity") {
+		return false
+	}
+	w.Header().Set("Content-Type", "text/xml; charset=utf-8")
+	w.WriteHeader(http.StatusForbidden)
+	io.WriteString(w, `<?xml version="1.0" encoding="UTF-8"?><D:error xmlns:D="DAV:"><D:propfind-finite-depth/></D:error>`)
+	return true
+}
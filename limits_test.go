@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/webdav"
+)
+
+func TestListingPage(t *testing.T) {
+	root := t.TempDir()
+	var want []string
+	for i := 0; i < 5; i++ {
+		os.Mkdir(filepath.Join(root, fmt.Sprintf("d%d", i)), 0755)
+		want = append(want, fmt.Sprintf("d%d", i))
+	}
+	for i := 0; i < 20; i++ {
+		os.WriteFile(filepath.Join(root, fmt.Sprintf("f%02d", i)), nil, 0644)
+		want = append(want, fmt.Sprintf("f%02d", i))
+	}
+	os.WriteFile(filepath.Join(root, ".hidden"), nil, 0644)
+
+	var got []string
+	after, pages := "", 0
+	for {
+		f, err := os.Open(root)
+		if err != nil {
+			t.Fatal(err)
+		}
+		page, more, err := listingPage(f, after, 7)
+		f.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(page) > 7 {
+			t.Fatalf("page of %d entries", len(page))
+		}
+		pages++
+		for _, fi := range page {
+			got = append(got, fi.Name())
+		}
+		if !more {
+			break
+		}
+		after = listingKey(page[len(page)-1])
+	}
+	if pages != 4 || strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Errorf("%d pages listing %v, want 4 pages listing %v", pages, got, want)
+	}
+}
+
+func TestDirListLimit(t *testing.T) {
+	defer func(n int) { *flagListingLimit = n }(*flagListingLimit)
+	*flagListingLimit = 10
+	root := t.TempDir()
+	for i := 0; i < 15; i++ {
+		os.WriteFile(filepath.Join(root, fmt.Sprintf("f%02d", i)), nil, 0644)
+	}
+	rec := httptest.NewRecorder()
+	handleDirList(webdav.Dir(root), rec, httptest.NewRequest("GET", "/", nil))
+	body := rec.Body.String()
+	if got := strings.Count(body, `data-name="f`); got != 10 {
+		t.Errorf("first page has %d rows, want 10", got)
+	}
+	if !strings.Contains(body, `href="?after=1f09"`) {
+		t.Error("first page has no link to the next")
+	}
+
+	rec = httptest.NewRecorder()
+	handleDirList(webdav.Dir(root), rec, httptest.NewRequest("GET", "/?after=1f09", nil))
+	body = rec.Body.String()
+	if got := strings.Count(body, `data-name="f`); got != 5 || !strings.Contains(body, `data-name="f10"`) {
+		t.Errorf("second page has %d rows", got)
+	}
+	if strings.Contains(body, "?after=") {
+		t.Error("last page links to a next one")
+	}
+}
+
+func TestPropfindLimit(t *testing.T) {
+	defer func(n int) { *flagPropfindLimit = n }(*flagPropfindLimit)
+	*flagPropfindLimit = 10
+	root := t.TempDir()
+	for i := 0; i < 15; i++ {
+		os.WriteFile(filepath.Join(root, fmt.Sprintf("f%02d", i)), nil, 0644)
+	}
+	h := &webdav.Handler{FileSystem: SkipBrokenLink{webdav.Dir(root)}, LockSystem: webdav.NewMemLS()}
+
+	req := httptest.NewRequest("PROPFIND", "/", nil)
+	req.Header.Set("Depth", "1")
+	rec := httptest.NewRecorder()
+	if !handlePropfindStream(h, rec, req) {
+		t.Fatal("PROPFIND over the limit was not handled")
+	}
+	body := rec.Body.String()
+	if got := strings.Count(body, "<D:response>"); got != 12 {
+		t.Errorf("got %d responses, want the folder, 10 members and the 507", got)
+	}
+	if !strings.Contains(body, "507 Insufficient Storage") || !strings.HasSuffix(body, "</D:multistatus>") {
+		t.Errorf("truncated response: %s", body)
+	}
+
+	for _, depth := range []string{"", "infinity"} {
+		req := httptest.NewRequest("PROPFIND", "/", nil)
+		if depth != "" {
+			req.Header.Set("Depth", depth)
+		}
+		rec := httptest.NewRecorder()
+		if !refusePropfind(rec, req) || rec.Code != http.StatusForbidden || !strings.Contains(rec.Body.String(), "propfind-finite-depth") {
+			t.Errorf("Depth %q: status %d", depth, rec.Code)
+		}
+	}
+	req = httptest.NewRequest("PROPFIND", "/", nil)
+	req.Header.Set("Depth", "1")
+	if refusePropfind(httptest.NewRecorder(), req) {
+		t.Error("Depth 1 was refused")
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"strconv"
+)
+
+var flagBindInterface = flag.String("bind-interface", "", "bind to the first address of this network interface")
+
+var interfaceAddrs = func(name string) ([]net.Addr, error) {
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return nil, err
+	}
+	return iface.Addrs()
+}
+
+// listenAddress turns the -port value into a listen address. It accepts a
+// bare port ("6086"), ":port", "host:port" and bracketed IPv6 with an
+// optional zone ("[fe80::1%eth0]:6086"). With iface set, the host is taken
+// from that interface and spec may only name a port.
+func listenAddress(spec, iface string) (string, error) {
+	host, port := "", spec
+	if _, err := strconv.Atoi(spec); err != nil {
+		if host, port, err = net.SplitHostPort(spec); err != nil {
+			return "", fmt.Errorf("invalid listen address %q: %v", spec, err)
+		}
+	}
+	if n, err := strconv.Atoi(port); err != nil || n < 0 || n > 65535 {
+		if _, err := net.LookupPort("tcp", port); err != nil {
+			return "", fmt.Errorf("invalid port %q", port)
+		}
+	}
+
+	if iface != "" {
+		if host != "" {
+			return "", fmt.Errorf("listen address %q names a host, which conflicts with -bind-interface", spec)
+		}
+		ip, zone, err := interfaceIP(iface)
+		if err != nil {
+			return "", err
+		}
+		host = ip.String()
+		if zone != "" {
+			host += "%" + zone
+		}
+	}
+	return net.JoinHostPort(host, port), nil
+}
+
+// interfaceIP picks the first IPv4 address of the named interface, or its
+// first IPv6 address otherwise. Link-local IPv6 addresses come with the zone
+// needed to bind them.
+func interfaceIP(name string) (net.IP, string, error) {
+	addrs, err := interfaceAddrs(name)
+	if err != nil {
+		return nil, "", fmt.Errorf("interface %s: %v", name, err)
+	}
+	var v6 net.IP
+	for _, a := range addrs {
+		ipnet, ok := a.(*net.IPNet)
+		if !ok {
+			continue
+		}
+		if ipnet.IP.To4() != nil {
+			return ipnet.IP, "", nil
+		}
+		if v6 == nil {
+			v6 = ipnet.IP
+		}
+	}
+	if v6 == nil {
+		return nil, "", fmt.Errorf("interface %s has no addresses", name)
+	}
+	if v6.IsLinkLocalUnicast() {
+		return v6, name, nil
+	}
+	return v6, "", nil
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"testing"
+)
+
+func TestListenAddress(t *testing.T) {
+	ifaces := map[string][]net.Addr{
+		"eth0": {
+			&net.IPNet{IP: net.ParseIP("fe80::1"), Mask: net.CIDRMask(64, 128)},
+			&net.IPNet{IP: net.IPv4(192, 168, 1, 7), Mask: net.CIDRMask(24, 32)},
+		},
+		"wg0":  {&net.IPNet{IP: net.ParseIP("fe80::2"), Mask: net.CIDRMask(64, 128)}},
+		"sit0": {&net.IPNet{IP: net.ParseIP("2001:db8::3"), Mask: net.CIDRMask(64, 128)}},
+		"down": {},
+	}
+	defer func(f func(string) ([]net.Addr, error)) { interfaceAddrs = f }(interfaceAddrs)
+	interfaceAddrs = func(name string) ([]net.Addr, error) {
+		addrs, ok := ifaces[name]
+		if !ok {
+			return nil, errors.New("no such network interface")
+		}
+		return addrs, nil
+	}
+
+	tests := []struct {
+		name    string
+		spec    string
+		iface   string
+		want    string
+		wantErr bool
+	}{
+		{"bare port", "6086", "", ":6086", false},
+		{"colon port", ":6086", "", ":6086", false},
+		{"v4 host", "127.0.0.1:6086", "", "127.0.0.1:6086", false},
+		{"v6 host", "[::1]:6086", "", "[::1]:6086", false},
+		{"v6 zone", "[fe80::1%eth0]:5005", "", "[fe80::1%eth0]:5005", false},
+		{"named port", ":http", "", ":http", false},
+		{"bare v6 without port", "::1", "", "", true},
+		{"bad port", "localhost:99999", "", "", true},
+		{"garbage", "not a port", "", "", true},
+		{"interface v4", "6086", "eth0", "192.168.1.7:6086", false},
+		{"interface link-local v6", ":6086", "wg0", "[fe80::2%wg0]:6086", false},
+		{"interface global v6", "6086", "sit0", "[2001:db8::3]:6086", false},
+		{"interface and host", "127.0.0.1:6086", "eth0", "", true},
+		{"interface without addresses", "6086", "down", "", true},
+		{"unknown interface", "6086", "nope0", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := listenAddress(tt.spec, tt.iface)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("listenAddress = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
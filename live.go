@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/webdav"
+)
+
+var flagLive = flag.Bool("live", false, "update directory listings in the browser as files change")
+
+const (
+	liveCoalesce  = 250 * time.Millisecond
+	liveHeartbeat = 30 * time.Second
+)
+
+// liveHub fans tree changes out to the listing pages open on the directory
+// they happened in.
+type liveHub struct {
+	mu   sync.Mutex
+	dirs map[string]map[chan string]struct{}
+}
+
+var live *liveHub
+
+func startLive() error {
+	w, err := watchRoot()
+	if err != nil {
+		return err
+	}
+	live = newLiveHub()
+	w.subscribe(live.handleEvent)
+	return nil
+}
+
+func newLiveHub() *liveHub {
+	return &liveHub{dirs: make(map[string]map[chan string]struct{})}
+}
+
+// watch returns a channel of names changed directly in dir, and a function
+// to stop watching.
+func (h *liveHub) watch(dir string) (chan string, func()) {
+	dir = path.Clean(dir)
+	ch := make(chan string, 64)
+	h.mu.Lock()
+	if h.dirs[dir] == nil {
+		h.dirs[dir] = make(map[chan string]struct{})
+	}
+	h.dirs[dir][ch] = struct{}{}
+	h.mu.Unlock()
+	return ch, func() {
+		h.mu.Lock()
+		delete(h.dirs[dir], ch)
+		if len(h.dirs[dir]) == 0 {
+			delete(h.dirs, dir)
+		}
+		h.mu.Unlock()
+	}
+}
+
+func (h *liveHub) handleEvent(ev treeEvent) {
+	if ev.Path == "/" {
+		return
+	}
+	dir, name := path.Split(ev.Path)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for ch := range h.dirs[path.Clean(dir)] {
+		// A page that can't keep up misses the event rather than stalling
+		// the watcher; it catches up on the next change to the same name.
+		select {
+		case ch <- name:
+		default:
+		}
+	}
+}
+
+// liveChange is one server-sent event: the listing row for Name, or an
+// empty Row when Name is gone.
+type liveChange struct {
+	Name string `json:"name"`
+	Row  string `json:"row,omitempty"`
+}
+
+// handleLiveEvents streams changes to the directory req refers to as
+// server-sent events, coalescing bursts such as a file being written.
+func handleLiveEvents(fs webdav.FileSystem, w http.ResponseWriter, req *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "WebDAV: streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	dir := req.URL.Path
+	ch, stop := live.watch(dir)
+	defer stop()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	pending := make(map[string]bool)
+	coalesce := time.NewTimer(liveCoalesce)
+	coalesce.Stop()
+	heartbeat := time.NewTicker(liveHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-req.Context().Done():
+			return
+		case name := <-ch:
+			if !*flagShowHidden && strings.HasPrefix(name, ".") {
+				continue
+			}
+			if len(pending) == 0 {
+				coalesce.Reset(liveCoalesce)
+			}
+			pending[name] = true
+		case <-coalesce.C:
+			names := make([]string, 0, len(pending))
+			for name := range pending {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			pending = make(map[string]bool)
+			for _, name := range names {
+				data, _ := json.Marshal(liveRow(fs, req, path.Join(dir, name)))
+				fmt.Fprintf(w, "data: %s\n\n", data)
+			}
+			flusher.Flush()
+		case <-heartbeat.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+			flusher.Flush()
+		}
+	}
+}
+
+func liveRow(fs webdav.FileSystem, req *http.Request, p string) liveChange {
+	c := liveChange{Name: path.Base(p)}
+	fi, err := fs.Stat(req.Context(), p)
+	if err != nil {
+		return c
+	}
+	name := fi.Name()
+	if fi.IsDir() {
+		name += "/"
+	}
+	var row bytes.Buffer
+	writeListingRow(&row, p, name, fi)
+	c.Row = row.String()
+	return c
+}
+
+// liveScript keeps the listing table in sync with the event stream, keeping
+// directories first and names sorted as the server renders them.
+const liveScript = `
+<script>
+(function () {
+	var body = document.querySelector("tbody");
+	var src = new EventSource("?events=1");
+	function key(row) {
+		var n = row.dataset.name;
+		return (n.slice(-1) === "/" ? "0" : "1") + n;
+	}
+	src.onmessage = function (e) {
+		var c = JSON.parse(e.data), old = [];
+		body.querySelectorAll("tr[data-name]").forEach(function (r) {
+			if (r.dataset.name === c.name || r.dataset.name === c.name + "/") {
+				old.push(r);
+			}
+		});
+		if (!c.row) {
+			old.forEach(function (r) { r.remove(); });
+			return;
+		}
+		var t = document.createElement("template");
+		t.innerHTML = c.row.trim();
+		var row = t.content.firstChild;
+		if (old.length) {
+			old[0].replaceWith(row);
+			return;
+		}
+		var next = null;
+		body.querySelectorAll("tr[data-name]").forEach(function (r) {
+			if (!next && key(r) > key(row)) {
+				next = r;
+			}
+		});
+		body.insertBefore(row, next);
+	};
+})();
+</script>`
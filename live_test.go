@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"golang.org/x/net/webdav"
+)
+
+func TestLiveHubDispatch(t *testing.T) {
+	h := newLiveHub()
+	docs, stopDocs := h.watch("/docs/")
+	root, stopRoot := h.watch("/")
+	defer stopRoot()
+
+	tests := []struct {
+		path     string
+		docs     string
+		rootName string
+	}{
+		{path: "/docs/a.txt", docs: "a.txt"},
+		{path: "/docs", rootName: "docs"},
+		{path: "/docs/sub/b.txt"},
+		{path: "/"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			h.handleEvent(treeEvent{Path: tt.path, Op: fsnotify.Write})
+			for _, c := range []struct {
+				ch   chan string
+				want string
+			}{{docs, tt.docs}, {root, tt.rootName}} {
+				select {
+				case got := <-c.ch:
+					if got != c.want {
+						t.Errorf("got %q, want %q", got, c.want)
+					}
+				default:
+					if c.want != "" {
+						t.Errorf("no event, want %q", c.want)
+					}
+				}
+			}
+		})
+	}
+
+	stopDocs()
+	if len(h.dirs) != 1 {
+		t.Errorf("%d dirs watched after stop, want 1", len(h.dirs))
+	}
+}
+
+func TestHandleLiveEvents(t *testing.T) {
+	root := t.TempDir()
+	defer func(h *liveHub) { live = h }(live)
+	live = newLiveHub()
+	fs := webdav.Dir(root)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		handleLiveEvents(fs, w, req)
+	}))
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/?events=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("Content-Type = %q", ct)
+	}
+
+	os.WriteFile(filepath.Join(root, "new.txt"), []byte("hello"), 0644)
+	// Bursts of events for one name arrive as a single update.
+	for i := 0; i < 3; i++ {
+		live.handleEvent(treeEvent{Path: "/new.txt", Op: fsnotify.Write})
+	}
+	live.handleEvent(treeEvent{Path: "/.hidden", Op: fsnotify.Create})
+	live.handleEvent(treeEvent{Path: "/gone.txt", Op: fsnotify.Remove})
+
+	lines := make(chan string)
+	go func() {
+		sc := bufio.NewScanner(resp.Body)
+		for sc.Scan() {
+			if data := strings.TrimPrefix(sc.Text(), "data: "); data != sc.Text() {
+				lines <- data
+			}
+		}
+		close(lines)
+	}()
+	var got []liveChange
+	for len(got) < 2 {
+		select {
+		case data := <-lines:
+			var c liveChange
+			if err := json.Unmarshal([]byte(data), &c); err != nil {
+				t.Fatal(err)
+			}
+			got = append(got, c)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out with %d events", len(got))
+		}
+	}
+	if got[0].Name != "gone.txt" || got[0].Row != "" {
+		t.Errorf("first event = %+v, want removal of gone.txt", got[0])
+	}
+	if got[1].Name != "new.txt" || !strings.Contains(got[1].Row, `data-name="new.txt"`) {
+		t.Errorf("second event = %+v, want row for new.txt", got[1])
+	}
+	select {
+	case data := <-lines:
+		t.Errorf("unexpected extra event %s", data)
+	case <-time.After(2 * liveCoalesce):
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"mime"
+	"net"
+	"net/smtp"
+	"os"
+	"strings"
+	"time"
+)
+
+var (
+	flagSMTPServer   = flag.String("smtp-server", "", "SMTP server host:port to email notifications through, using STARTTLS when offered")
+	flagSMTPUser     = flag.String("smtp-user", "", "SMTP username")
+	flagSMTPPassword = flag.String("smtp-password", "", "SMTP password")
+	flagSMTPFrom     = flag.String("smtp-from", "", "sender address of notification emails")
+	flagSMTPTo       = flag.String("smtp-to", "", "comma-separated recipients of notification emails")
+)
+
+// mailNotifier emails each batch of events as one message.
+type mailNotifier struct {
+	server string
+	auth   smtp.Auth
+	from   string
+	to     []string
+	// sendMail is smtp.SendMail, replaced in tests.
+	sendMail func(addr string, a smtp.Auth, from string, to []string, msg []byte) error
+}
+
+func startMailNotifier() error {
+	host, _, err := net.SplitHostPort(*flagSMTPServer)
+	if err != nil {
+		return fmt.Errorf("invalid -smtp-server %q: %v", *flagSMTPServer, err)
+	}
+	m := &mailNotifier{server: *flagSMTPServer, from: *flagSMTPFrom, sendMail: smtp.SendMail}
+	for _, to := range strings.Split(*flagSMTPTo, ",") {
+		if to = strings.TrimSpace(to); to != "" {
+			m.to = append(m.to, to)
+		}
+	}
+	if len(m.to) == 0 || m.from == "" {
+		return errors.New("-smtp-server needs -smtp-from and -smtp-to")
+	}
+	if *flagSMTPUser != "" {
+		// PlainAuth refuses to send the password unless the connection is
+		// encrypted or goes to localhost.
+		m.auth = smtp.PlainAuth("", *flagSMTPUser, *flagSMTPPassword, host)
+	}
+	addNotifier(m)
+	return nil
+}
+
+func (m *mailNotifier) name() string { return "email" }
+
+func (m *mailNotifier) send(events []notifyEvent) error {
+	return m.sendMail(m.server, m.auth, m.from, m.to, m.message(events, time.Now()))
+}
+
+// message formats events as a plain text email.
+func (m *mailNotifier) message(events []notifyEvent, now time.Time) []byte {
+	host, _ := os.Hostname()
+	subject := events[0].Message
+	if len(events) > 1 {
+		subject = fmt.Sprintf("%d events on %s", len(events), host)
+	}
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "From: %s\r\n", m.from)
+	fmt.Fprintf(&b, "To: %s\r\n", strings.Join(m.to, ", "))
+	fmt.Fprintf(&b, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", "[gowebdav] "+subject))
+	fmt.Fprintf(&b, "Date: %s\r\n", now.Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\nContent-Type: text/plain; charset=utf-8\r\nContent-Transfer-Encoding: 8bit\r\n\r\n")
+	for _, ev := range events {
+		fmt.Fprintf(&b, "%s  %s\r\n", ev.Time.Format("2006-01-02 15:04:05"), ev.Message)
+		if ev.Client != "" {
+			fmt.Fprintf(&b, "    client: %s\r\n", ev.Client)
+		}
+	}
+	fmt.Fprintf(&b, "\r\n-- \r\ngowebdav on %s serving %s\r\n", host, *flagRootDir)
+	return b.Bytes()
+}
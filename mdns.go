@@ -0,0 +1,282 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+var (
+	flagMDNS     = flag.Bool("mdns", false, "advertise the share via mDNS/Bonjour")
+	flagMDNSName = flag.String("mdns-name", "", "mDNS service instance name (default: host name)")
+)
+
+var mdnsGroup = &net.UDPAddr{IP: net.IPv4(224, 0, 0, 251), Port: 5353}
+
+const (
+	mdnsTTL = 120
+
+	// The top bit of the class field means cache-flush in a resource
+	// record and unicast-response (QU) in a question (RFC 6762 5.4, 10.2).
+	mdnsCacheFlush      = 0x8000
+	mdnsUnicastResponse = 0x8000
+
+	// mdnsMinInterval is the minimum time between multicasts of the same
+	// record (RFC 6762 section 6).
+	mdnsMinInterval = time.Second
+)
+
+// mdnsResponder answers DNS-SD queries for a single WebDAV service. It is
+// deliberately minimal: IPv4 multicast only, no probing or conflict
+// resolution, which is enough for Finder and GNOME Files to find the share.
+type mdnsResponder struct {
+	conn     *net.UDPConn
+	services dnsmessage.Name
+	service  dnsmessage.Name
+	instance dnsmessage.Name
+	host     dnsmessage.Name
+	port     uint16
+	path     string
+	ips      []net.IP
+
+	mu            sync.Mutex
+	lastMulticast map[string]time.Time
+}
+
+// newMDNSResponder describes the service for a listener bound to addr. A
+// listener bound to a specific address advertises only that address. Only
+// IPv4 addresses are advertised, since they are answered over IPv4 only.
+func newMDNSResponder(addr net.Addr, hostname, instance string) (*mdnsResponder, error) {
+	tcp, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return nil, fmt.Errorf("unsupported listener address %v", addr)
+	}
+	if tcp.IP.IsLoopback() {
+		return nil, errors.New("listener is bound to a loopback address")
+	}
+	candidates := []net.IP{tcp.IP}
+	if tcp.IP == nil || tcp.IP.IsUnspecified() {
+		candidates = localIPs()
+	}
+	var ips []net.IP
+	for _, ip := range candidates {
+		if ip4 := ip.To4(); ip4 != nil {
+			ips = append(ips, ip4)
+		}
+	}
+	if len(ips) == 0 {
+		return nil, errors.New("no IPv4 address to advertise")
+	}
+
+	hostname = strings.SplitN(hostname, ".", 2)[0]
+	if instance == "" {
+		instance = hostname
+	}
+	service := "_webdav._tcp.local."
+	if *flagHttpsMode {
+		service = "_webdavs._tcp.local."
+	}
+
+	r := &mdnsResponder{
+		port:          uint16(tcp.Port),
+		path:          "/",
+		ips:           ips,
+		lastMulticast: make(map[string]time.Time),
+	}
+	var err error
+	if r.services, err = dnsmessage.NewName("_services._dns-sd._udp.local."); err != nil {
+		return nil, err
+	}
+	if r.service, err = dnsmessage.NewName(service); err != nil {
+		return nil, err
+	}
+	if r.instance, err = dnsmessage.NewName(strings.ReplaceAll(instance, ".", "-") + "." + service); err != nil {
+		return nil, fmt.Errorf("invalid instance name %q: %v", instance, err)
+	}
+	if r.host, err = dnsmessage.NewName(hostname + ".local."); err != nil {
+		return nil, fmt.Errorf("invalid host name %q: %v", hostname, err)
+	}
+	return r, nil
+}
+
+func startMDNS(addr net.Addr) (*mdnsResponder, error) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return nil, err
+	}
+	r, err := newMDNSResponder(addr, hostname, *flagMDNSName)
+	if err != nil {
+		return nil, err
+	}
+	if r.conn, err = net.ListenMulticastUDP("udp4", nil, mdnsGroup); err != nil {
+		return nil, err
+	}
+	go r.serve()
+	go func() {
+		for i := 0; i < 2; i++ {
+			r.multicast()
+			time.Sleep(mdnsMinInterval)
+		}
+	}()
+	return r, nil
+}
+
+// Close sends a goodbye (TTL 0) for every record so browsers drop the share
+// immediately instead of waiting for the TTL to expire.
+func (r *mdnsResponder) Close() error {
+	r.send(r.message(0, nil, r.records(0)), mdnsGroup)
+	return r.conn.Close()
+}
+
+func (r *mdnsResponder) serve() {
+	buf := make([]byte, 9000)
+	for {
+		n, src, err := r.conn.ReadFromUDP(buf)
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				log.Printf("mDNS: %v", err)
+			}
+			return
+		}
+		var p dnsmessage.Parser
+		h, err := p.Start(buf[:n])
+		if err != nil || h.Response {
+			continue
+		}
+		questions, err := p.AllQuestions()
+		if err != nil {
+			continue
+		}
+		var matched []dnsmessage.Question
+		unicast := false
+		for _, q := range questions {
+			if r.matches(q) {
+				matched = append(matched, q)
+				unicast = unicast || q.Class&mdnsUnicastResponse != 0
+			}
+		}
+		switch {
+		case len(matched) == 0:
+		case src.Port != mdnsGroup.Port:
+			// Legacy unicast query (RFC 6762 section 6.7): reply directly,
+			// echoing the ID and questions.
+			r.send(r.message(h.ID, matched, r.records(mdnsTTL)), src)
+		case unicast:
+			r.send(r.message(0, nil, r.records(mdnsTTL)), src)
+		default:
+			r.multicast()
+		}
+	}
+}
+
+func (r *mdnsResponder) matches(q dnsmessage.Question) bool {
+	class := q.Class &^ mdnsUnicastResponse
+	if class != dnsmessage.ClassINET && class != dnsmessage.ClassANY {
+		return false
+	}
+	name := strings.ToLower(q.Name.String())
+	for _, n := range []dnsmessage.Name{r.services, r.service, r.instance, r.host} {
+		if name == strings.ToLower(n.String()) {
+			return true
+		}
+	}
+	return false
+}
+
+// multicast sends the records that have not been multicast within the last
+// mdnsMinInterval.
+func (r *mdnsResponder) multicast() {
+	records := r.throttle(r.records(mdnsTTL), time.Now())
+	if len(records) > 0 {
+		r.send(r.message(0, nil, records), mdnsGroup)
+	}
+}
+
+func (r *mdnsResponder) throttle(records []dnsmessage.Resource, now time.Time) []dnsmessage.Resource {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var due []dnsmessage.Resource
+	for _, rec := range records {
+		key := rec.GoString()
+		if last, ok := r.lastMulticast[key]; ok && now.Sub(last) < mdnsMinInterval {
+			continue
+		}
+		r.lastMulticast[key] = now
+		due = append(due, rec)
+	}
+	return due
+}
+
+func (r *mdnsResponder) records(ttl uint32) []dnsmessage.Resource {
+	shared := func(name dnsmessage.Name) dnsmessage.ResourceHeader {
+		return dnsmessage.ResourceHeader{Name: name, Class: dnsmessage.ClassINET, TTL: ttl}
+	}
+	unique := func(name dnsmessage.Name) dnsmessage.ResourceHeader {
+		return dnsmessage.ResourceHeader{Name: name, Class: dnsmessage.ClassINET | mdnsCacheFlush, TTL: ttl}
+	}
+
+	records := []dnsmessage.Resource{
+		{Header: shared(r.services), Body: &dnsmessage.PTRResource{PTR: r.service}},
+		{Header: shared(r.service), Body: &dnsmessage.PTRResource{PTR: r.instance}},
+		{Header: unique(r.instance), Body: &dnsmessage.SRVResource{Target: r.host, Port: r.port}},
+		{Header: unique(r.instance), Body: &dnsmessage.TXTResource{TXT: []string{"path=" + r.path}}},
+	}
+	for _, ip := range r.ips {
+		a := &dnsmessage.AResource{}
+		copy(a.A[:], ip.To4())
+		records = append(records, dnsmessage.Resource{Header: unique(r.host), Body: a})
+	}
+	return records
+}
+
+func (r *mdnsResponder) message(id uint16, questions []dnsmessage.Question, records []dnsmessage.Resource) dnsmessage.Message {
+	return dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: id, Response: true, Authoritative: true},
+		Questions: questions,
+		Answers:   records,
+	}
+}
+
+func (r *mdnsResponder) send(msg dnsmessage.Message, to *net.UDPAddr) {
+	b, err := msg.Pack()
+	if err != nil {
+		log.Printf("mDNS: %v", err)
+		return
+	}
+	if _, err := r.conn.WriteToUDP(b, to); err != nil {
+		log.Printf("mDNS: %v", err)
+	}
+}
+
+// localIPs lists the non-loopback unicast addresses of all interfaces that
+// are up.
+func localIPs() []net.IP {
+	var ips []net.IP
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil
+	}
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, a := range addrs {
+			if ipnet, ok := a.(*net.IPNet); ok && ipnet.IP.IsGlobalUnicast() {
+				ips = append(ips, ipnet.IP)
+			}
+		}
+	}
+	return ips
+}
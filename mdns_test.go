@@ -0,0 +1,156 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestNewMDNSResponder(t *testing.T) {
+	tests := []struct {
+		name     string
+		addr     net.Addr
+		instance string
+		wantErr  bool
+		wantIPs  []string
+	}{
+		{"specific v4", &net.TCPAddr{IP: net.IPv4(192, 168, 1, 7), Port: 6086}, "", false, []string{"192.168.1.7"}},
+		{"specific v6", &net.TCPAddr{IP: net.ParseIP("2001:db8::7"), Port: 6086}, "", true, nil},
+		{"loopback", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 6086}, "", true, nil},
+		{"loopback v6", &net.TCPAddr{IP: net.IPv6loopback, Port: 6086}, "", true, nil},
+		{"not tcp", &net.UDPAddr{IP: net.IPv4(192, 168, 1, 7), Port: 6086}, "", true, nil},
+		{"name too long", &net.TCPAddr{IP: net.IPv4(192, 168, 1, 7), Port: 6086}, strings.Repeat("x", 300), true, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := newMDNSResponder(tt.addr, "box.example.com", tt.instance)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			var got []string
+			for _, ip := range r.ips {
+				got = append(got, ip.String())
+			}
+			if strings.Join(got, ",") != strings.Join(tt.wantIPs, ",") {
+				t.Errorf("ips = %v, want %v", got, tt.wantIPs)
+			}
+			if r.host.String() != "box.local." {
+				t.Errorf("host = %q", r.host.String())
+			}
+		})
+	}
+}
+
+func testResponder(t *testing.T) *mdnsResponder {
+	t.Helper()
+	r, err := newMDNSResponder(&net.TCPAddr{IP: net.IPv4(192, 168, 1, 7), Port: 6086}, "box", "My Share")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func TestMDNSMatches(t *testing.T) {
+	r := testResponder(t)
+	tests := []struct {
+		name  string
+		qname string
+		class dnsmessage.Class
+		want  bool
+	}{
+		{"service", "_webdav._tcp.local.", dnsmessage.ClassINET, true},
+		{"service case-insensitive", "_WebDAV._TCP.local.", dnsmessage.ClassINET, true},
+		{"service QU", "_webdav._tcp.local.", dnsmessage.ClassINET | mdnsUnicastResponse, true},
+		{"enumeration", "_services._dns-sd._udp.local.", dnsmessage.ClassINET, true},
+		{"instance", "My Share._webdav._tcp.local.", dnsmessage.ClassINET, true},
+		{"host", "box.local.", dnsmessage.ClassANY, true},
+		{"other service", "_http._tcp.local.", dnsmessage.ClassINET, false},
+		{"wrong class", "_webdav._tcp.local.", dnsmessage.ClassCHAOS, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := dnsmessage.Question{Name: dnsmessage.MustNewName(tt.qname), Type: dnsmessage.TypePTR, Class: tt.class}
+			if got := r.matches(q); got != tt.want {
+				t.Errorf("matches = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMDNSRecords(t *testing.T) {
+	r := testResponder(t)
+	tests := []struct {
+		name string
+		ttl  uint32
+	}{
+		{"announce", mdnsTTL},
+		{"goodbye", 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg := r.message(0, nil, r.records(tt.ttl))
+			b, err := msg.Pack()
+			if err != nil {
+				t.Fatal(err)
+			}
+			var parsed dnsmessage.Message
+			if err := parsed.Unpack(b); err != nil {
+				t.Fatal(err)
+			}
+			if !parsed.Header.Response || !parsed.Header.Authoritative {
+				t.Errorf("header = %+v", parsed.Header)
+			}
+			var sawSRV, sawA bool
+			for _, rec := range parsed.Answers {
+				if rec.Header.TTL != tt.ttl {
+					t.Errorf("%v TTL = %d, want %d", rec.Header.Type, rec.Header.TTL, tt.ttl)
+				}
+				switch body := rec.Body.(type) {
+				case *dnsmessage.SRVResource:
+					sawSRV = true
+					if body.Port != 6086 {
+						t.Errorf("SRV port = %d", body.Port)
+					}
+				case *dnsmessage.AResource:
+					sawA = true
+					if net.IP(body.A[:]).String() != "192.168.1.7" {
+						t.Errorf("A = %v", body.A)
+					}
+				case *dnsmessage.AAAAResource:
+					t.Errorf("unexpected AAAA record %v", body.AAAA)
+				}
+			}
+			if !sawSRV || !sawA {
+				t.Errorf("missing records: SRV %v, A %v", sawSRV, sawA)
+			}
+		})
+	}
+}
+
+func TestMDNSThrottle(t *testing.T) {
+	r := testResponder(t)
+	records := r.records(mdnsTTL)
+	now := time.Now()
+	tests := []struct {
+		name string
+		at   time.Time
+		want int
+	}{
+		{"first", now, len(records)},
+		{"within interval", now.Add(mdnsMinInterval / 2), 0},
+		{"after interval", now.Add(mdnsMinInterval), len(records)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := len(r.throttle(records, tt.at)); got != tt.want {
+				t.Errorf("throttle returned %d records, want %d", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"runtime/debug"
+	"runtime/metrics"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+var flagMemoryLimit = flag.String("memory-limit", "", "soft memory limit such as 400MiB; sets GOMEMLIMIT and answers 503 to heavy requests once memory use nears it")
+
+// memoryShedAt is the share of -memory-limit above which heavy requests
+// are turned away.
+const memoryShedAt = 0.9
+
+// memoryPressure is set while memory use is above memoryShedAt.
+var memoryPressure int32
+
+// parseByteSize parses sizes the way GOMEMLIMIT does: a number of bytes
+// with an optional B, KiB, MiB, GiB or TiB suffix.
+func parseByteSize(s string) (int64, error) {
+	units := []struct {
+		suffix string
+		scale  int64
+	}{{"TiB", 1 << 40}, {"GiB", 1 << 30}, {"MiB", 1 << 20}, {"KiB", 1 << 10}, {"B", 1}}
+	scale := int64(1)
+	for _, u := range units {
+		if strings.HasSuffix(s, u.suffix) {
+			s, scale = strings.TrimSuffix(s, u.suffix), u.scale
+			break
+		}
+	}
+	n, err := strconv.ParseInt(strings.TrimSpace(s), 10, 64)
+	if err != nil || n <= 0 || n > (1<<62)/scale {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return n * scale, nil
+}
+
+func startMemoryLimit() error {
+	limit, err := parseByteSize(*flagMemoryLimit)
+	if err != nil {
+		return err
+	}
+	debug.SetMemoryLimit(limit)
+	stop := make(chan struct{})
+	onShutdown(func() { close(stop) })
+	go watchMemory(uint64(float64(limit)*memoryShedAt), stop)
+	return nil
+}
+
+// watchMemory samples the memory the runtime holds and flags pressure
+// while it is above threshold.
+func watchMemory(threshold uint64, stop chan struct{}) {
+	samples := []metrics.Sample{
+		{Name: "/memory/classes/total:bytes"},
+		{Name: "/memory/classes/heap/released:bytes"},
+	}
+	ticker := time.NewTicker(250 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		metrics.Read(samples)
+		used := samples[0].Value.Uint64() - samples[1].Value.Uint64()
+		var pressure int32
+		if used > threshold {
+			pressure = 1
+		}
+		if old := atomic.SwapInt32(&memoryPressure, pressure); old != pressure {
+			if pressure == 1 {
+				log.Printf("Memory use %s is near -memory-limit, refusing heavy requests", formatSize(int64(used)))
+			} else {
+				log.Printf("Memory use back to %s, accepting heavy requests", formatSize(int64(used)))
+			}
+		}
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// isHeavy tells the requests whose memory use grows with the size of the
+// tree or file they touch.
+func isHeavy(req *http.Request) bool {
+	switch req.Method {
+	case "PROPFIND":
+		return req.Header.Get("Depth") != "0"
+	case "SEARCH", "REPORT", "PUT", "COPY", "MOVE":
+		return true
+	case "GET":
+		q := req.URL.Query()
+		return q.Get("zip") != "" || q.Get("manifest") != "" || q.Get("thumb") != "" || q.Get("q") != ""
+	}
+	return false
+}
+
+// shedLoad answers heavy requests with 503 while memory is short, so a
+// burst of them can't get the whole process killed.
+func shedLoad(w http.ResponseWriter, req *http.Request) bool {
+	if atomic.LoadInt32(&memoryPressure) == 0 || !isHeavy(req) {
+		return false
+	}
+	w.Header().Set("Retry-After", "5")
+	http.Error(w, "WebDAV: server is low on memory, try again later", http.StatusServiceUnavailable)
+	return true
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestParseByteSize(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    int64
+		wantErr bool
+	}{
+		{"400MiB", 400 << 20, false},
+		{"2GiB", 2 << 30, false},
+		{"1048576", 1 << 20, false},
+		{"512B", 512, false},
+		{"64KiB", 64 << 10, false},
+		{"1.5GiB", 0, true},
+		{"400MB", 0, true},
+		{"0", 0, true},
+		{"", 0, true},
+	}
+	for _, tt := range tests {
+		got, err := parseByteSize(tt.in)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("parseByteSize(%q) = %d, %v; want %d, err %v", tt.in, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestShedLoad(t *testing.T) {
+	defer atomic.StoreInt32(&memoryPressure, 0)
+	stop, done := make(chan struct{}), make(chan struct{})
+	go func() {
+		watchMemory(1, stop)
+		close(done)
+	}()
+	for deadline := time.Now().Add(time.Second); atomic.LoadInt32(&memoryPressure) == 0; time.Sleep(5 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("no memory pressure over a 1 byte threshold")
+		}
+	}
+	close(stop)
+	<-done
+
+	tests := []struct {
+		method, target, depth string
+		shed                  bool
+	}{
+		{"PROPFIND", "/", "1", true},
+		{"PROPFIND", "/", "0", false},
+		{"PUT", "/f", "", true},
+		{"GET", "/f", "", false},
+		{"GET", "/d/?zip=1", "", true},
+		{"OPTIONS", "/", "", false},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(tt.method, tt.target, nil)
+		if tt.depth != "" {
+			req.Header.Set("Depth", tt.depth)
+		}
+		rec := httptest.NewRecorder()
+		if got := shedLoad(rec, req); got != tt.shed {
+			t.Errorf("%s %s: shed = %v, want %v", tt.method, tt.target, got, tt.shed)
+		}
+		if tt.shed && (rec.Code != http.StatusServiceUnavailable || rec.Header().Get("Retry-After") == "") {
+			t.Errorf("%s %s: status %d, Retry-After %q", tt.method, tt.target, rec.Code, rec.Header().Get("Retry-After"))
+		}
+	}
+
+	atomic.StoreInt32(&memoryPressure, 0)
+	req := httptest.NewRequest("PUT", "/f", nil)
+	if shedLoad(httptest.NewRecorder(), req) {
+		t.Error("request shed without memory pressure")
+	}
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var flagMetricsPath = flag.String("metrics-path", "", "serve Prometheus metrics at this path, e.g. /metrics (disabled when empty)")
+
+var (
+	// latencyBuckets are in seconds, from a cached PROPFIND to a large
+	// upload over a slow link.
+	latencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 300}
+	// sizeBuckets grow by a factor of 4 from 1KiB to 4GiB.
+	sizeBuckets = func() []float64 {
+		var b []float64
+		for n := float64(1 << 10); n <= 4<<30; n *= 4 {
+			b = append(b, n)
+		}
+		return b
+	}()
+)
+
+// metricMethods are the methods that get their own label value; the rest
+// count as "other" so odd clients cannot blow up the number of series.
+var metricMethods = map[string]bool{
+	"GET": true, "HEAD": true, "PUT": true, "POST": true, "DELETE": true, "OPTIONS": true,
+	"PROPFIND": true, "PROPPATCH": true, "MKCOL": true, "COPY": true, "MOVE": true,
+	"LOCK": true, "UNLOCK": true, "SEARCH": true, "REPORT": true,
+}
+
+type histogram struct {
+	bounds []float64
+	counts []uint64 // counts[i] observations <= bounds[i]; the last is +Inf
+	sum    float64
+	count  uint64
+}
+
+func newHistogram(bounds []float64) *histogram {
+	return &histogram{bounds: bounds, counts: make([]uint64, len(bounds)+1)}
+}
+
+func (h *histogram) observe(v float64) {
+	i := sort.SearchFloat64s(h.bounds, v)
+	h.counts[i]++
+	h.sum += v
+	h.count++
+}
+
+// sample is one value of a metric family, with its labels in order.
+type sample struct {
+	suffix string
+	labels [][2]string
+	value  float64
+}
+
+// metricFamily is a metric in the shape of the Prometheus text format.
+type metricFamily struct {
+	name, help, typ string
+	samples         []sample
+}
+
+// serverMetrics counts requests by method and status, and keeps latency
+// and transfer size distributions per method.
+type serverMetrics struct {
+	mu            sync.Mutex
+	started       time.Time
+	inFlight      int
+	requests      map[[2]string]uint64
+	latency       map[string]*histogram
+	requestBytes  map[string]*histogram
+	responseBytes map[string]*histogram
+}
+
+func newServerMetrics() *serverMetrics {
+	return &serverMetrics{
+		started:       time.Now(),
+		requests:      make(map[[2]string]uint64),
+		latency:       make(map[string]*histogram),
+		requestBytes:  make(map[string]*histogram),
+		responseBytes: make(map[string]*histogram),
+	}
+}
+
+var serverStats *serverMetrics
+
+// countingBody counts the bytes read from a request body.
+type countingBody struct {
+	io.ReadCloser
+	n int64
+}
+
+func (b *countingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.n += int64(n)
+	return n, err
+}
+
+// wrap records every request served by h.
+func (m *serverMetrics) wrap(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		method := req.Method
+		if !metricMethods[method] {
+			method = "other"
+		}
+		sw := &statusWriter{ResponseWriter: w}
+		body := &countingBody{ReadCloser: http.NoBody}
+		if req.Body != nil {
+			body.ReadCloser = req.Body
+			req.Body = body
+		}
+		start := time.Now()
+		m.mu.Lock()
+		m.inFlight++
+		m.mu.Unlock()
+		defer func() {
+			d := time.Since(start)
+			if sw.status == 0 {
+				sw.status = http.StatusOK
+			}
+			m.mu.Lock()
+			defer m.mu.Unlock()
+			m.inFlight--
+			m.requests[[2]string{method, strconv.Itoa(sw.status)}]++
+			observe(m.latency, method, latencyBuckets, d.Seconds())
+			observe(m.requestBytes, method, sizeBuckets, float64(body.n))
+			observe(m.responseBytes, method, sizeBuckets, float64(sw.size))
+		}()
+		h.ServeHTTP(sw, req)
+	})
+}
+
+func observe(hs map[string]*histogram, method string, bounds []float64, v float64) {
+	h := hs[method]
+	if h == nil {
+		h = newHistogram(bounds)
+		hs[method] = h
+	}
+	h.observe(v)
+}
+
+// gather returns a snapshot of the metrics.
+func (m *serverMetrics) gather() []metricFamily {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	requests := metricFamily{name: "gowebdav_requests_total", help: "Requests served, by method and status code.", typ: "counter"}
+	keys := make([][2]string, 0, len(m.requests))
+	for k := range m.requests {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i][0] < keys[j][0] || keys[i][0] == keys[j][0] && keys[i][1] < keys[j][1]
+	})
+	for _, k := range keys {
+		requests.samples = append(requests.samples, sample{labels: [][2]string{{"method", k[0]}, {"code", k[1]}}, value: float64(m.requests[k])})
+	}
+	return []metricFamily{
+		{name: "gowebdav_uptime_seconds", help: "Seconds since the server started.", typ: "gauge",
+			samples: []sample{{value: time.Since(m.started).Seconds()}}},
+		{name: "gowebdav_requests_in_flight", help: "Requests being served.", typ: "gauge",
+			samples: []sample{{value: float64(m.inFlight)}}},
+		requests,
+		histogramFamily("gowebdav_request_duration_seconds", "Time taken to serve requests, by method.", m.latency),
+		histogramFamily("gowebdav_request_size_bytes", "Request body sizes, by method.", m.requestBytes),
+		histogramFamily("gowebdav_response_size_bytes", "Response body sizes, by method.", m.responseBytes),
+	}
+}
+
+func histogramFamily(name, help string, hs map[string]*histogram) metricFamily {
+	f := metricFamily{name: name, help: help, typ: "histogram"}
+	methods := make([]string, 0, len(hs))
+	for method := range hs {
+		methods = append(methods, method)
+	}
+	sort.Strings(methods)
+	for _, method := range methods {
+		h := hs[method]
+		var cum uint64
+		for i, c := range h.counts {
+			cum += c
+			le := "+Inf"
+			if i < len(h.bounds) {
+				le = strconv.FormatFloat(h.bounds[i], 'g', -1, 64)
+			}
+			f.samples = append(f.samples, sample{suffix: "_bucket", labels: [][2]string{{"method", method}, {"le", le}}, value: float64(cum)})
+		}
+		f.samples = append(f.samples,
+			sample{suffix: "_sum", labels: [][2]string{{"method", method}}, value: h.sum},
+			sample{suffix: "_count", labels: [][2]string{{"method", method}}, value: float64(h.count)})
+	}
+	return f
+}
+
+// writeMetricsText writes families in the Prometheus text format.
+func writeMetricsText(w io.Writer, families []metricFamily) {
+	for _, f := range families {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", f.name, f.help, f.name, f.typ)
+		for _, s := range f.samples {
+			fmt.Fprintf(w, "%s%s%s %s\n", f.name, s.suffix, formatLabels(s.labels), strconv.FormatFloat(s.value, 'g', -1, 64))
+		}
+	}
+}
+
+func formatLabels(labels [][2]string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	parts := make([]string, len(labels))
+	for i, l := range labels {
+		parts[i] = l[0] + "=" + strconv.Quote(l[1])
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+// handleMetrics serves the metrics to Prometheus. It needs the server's
+// credentials when they are set.
+func handleMetrics(w http.ResponseWriter, req *http.Request) {
+	if *flagUserName != "" && *flagPassword != "" && !authorized(req) {
+		w.Header().Set("WWW-Authenticate", `Basic realm="Restricted"`)
+		http.Error(w, "WebDAV: need authorized!", http.StatusUnauthorized)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.Header().Set("Cache-Control", "no-store")
+	writeMetricsText(w, serverStats.gather())
+}
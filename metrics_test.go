@@ -0,0 +1,62 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetrics(t *testing.T) {
+	m := newServerMetrics()
+	h := m.wrap(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		io.Copy(io.Discard, req.Body)
+		switch req.Method {
+		case "PROPFIND":
+			time.Sleep(30 * time.Millisecond)
+			w.WriteHeader(http.StatusMultiStatus)
+		case "GET":
+			w.Write(make([]byte, 5000))
+		}
+	}))
+	for _, r := range []struct{ method, body string }{
+		{"PROPFIND", ""},
+		{"GET", ""},
+		{"GET", ""},
+		{"PUT", strings.Repeat("x", 2000)},
+		{"BREW", ""},
+	} {
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(r.method, "/", strings.NewReader(r.body)))
+	}
+
+	var out strings.Builder
+	writeMetricsText(&out, m.gather())
+	text := out.String()
+	for _, want := range []string{
+		"# TYPE gowebdav_request_duration_seconds histogram\n",
+		`gowebdav_requests_total{method="GET",code="200"} 2` + "\n",
+		`gowebdav_requests_total{method="PROPFIND",code="207"} 1` + "\n",
+		`gowebdav_requests_total{method="other",code="200"} 1` + "\n",
+		`gowebdav_request_duration_seconds_bucket{method="PROPFIND",le="0.025"} 0` + "\n",
+		`gowebdav_request_duration_seconds_bucket{method="PROPFIND",le="+Inf"} 1` + "\n",
+		`gowebdav_request_duration_seconds_count{method="GET"} 2` + "\n",
+		`gowebdav_response_size_bytes_bucket{method="GET",le="4096"} 0` + "\n",
+		`gowebdav_response_size_bytes_bucket{method="GET",le="16384"} 2` + "\n",
+		`gowebdav_response_size_bytes_sum{method="GET"} 10000` + "\n",
+		`gowebdav_request_size_bytes_bucket{method="PUT",le="1024"} 0` + "\n",
+		`gowebdav_request_size_bytes_bucket{method="PUT",le="4096"} 1` + "\n",
+		"gowebdav_requests_in_flight 0\n",
+	} {
+		if !strings.Contains(text, want) {
+			t.Errorf("metrics lack %q", want)
+		}
+	}
+	if strings.Contains(text, "BREW") {
+		t.Error("unknown method got its own series")
+	}
+	if t.Failed() {
+		t.Log(text)
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	flagMetricsPush         = flag.String("metrics-push", "", "push metrics to this endpoint: a Pushgateway URL, an InfluxDB write URL, or a statsd host:port, as chosen by -metrics-push-format")
+	flagMetricsPushFormat   = flag.String("metrics-push-format", "pushgateway", "protocol of -metrics-push: pushgateway, influx or statsd")
+	flagMetricsPushInterval = flag.Duration("metrics-push-interval", 15*time.Second, "how often to push metrics")
+)
+
+// metricsPusher sends the metrics out at an interval, for servers that
+// cannot be scraped.
+type metricsPusher struct {
+	format   string
+	endpoint string
+	user     *url.Userinfo
+	client   *http.Client
+	stats    *serverMetrics
+
+	// last holds the counter values of the previous statsd push, which
+	// wants the increments.
+	last map[string]float64
+}
+
+func startMetricsPush(stats *serverMetrics) error {
+	p := &metricsPusher{format: *flagMetricsPushFormat, stats: stats, client: &http.Client{Timeout: 10 * time.Second}}
+	switch p.format {
+	case "pushgateway", "influx":
+		u, err := url.Parse(*flagMetricsPush)
+		if err != nil || u.Host == "" {
+			return fmt.Errorf("invalid URL %q", *flagMetricsPush)
+		}
+		p.user, u.User = u.User, nil
+		if p.format == "pushgateway" {
+			host, _ := os.Hostname()
+			u.Path = strings.TrimSuffix(u.Path, "/") + "/metrics/job/gowebdav/instance/" + url.PathEscape(host)
+		}
+		p.endpoint = u.String()
+	case "statsd":
+		if _, _, err := net.SplitHostPort(*flagMetricsPush); err != nil {
+			return fmt.Errorf("invalid statsd address %q: %v", *flagMetricsPush, err)
+		}
+		p.endpoint = *flagMetricsPush
+		p.last = make(map[string]float64)
+	default:
+		return fmt.Errorf("unknown -metrics-push-format %q", p.format)
+	}
+	go func() {
+		for range time.Tick(*flagMetricsPushInterval) {
+			if err := p.push(); err != nil {
+				log.Printf("Failed to push metrics: %v", err)
+			}
+		}
+	}()
+	// Send what the last interval counted before exiting.
+	onShutdown(func() { p.push() })
+	return nil
+}
+
+func (p *metricsPusher) push() error {
+	families := p.stats.gather()
+	var body bytes.Buffer
+	switch p.format {
+	case "pushgateway":
+		writeMetricsText(&body, families)
+		return p.send("PUT", "text/plain; version=0.0.4", body.Bytes())
+	case "influx":
+		writeInfluxLines(&body, families, time.Now())
+		return p.send("POST", "text/plain; charset=utf-8", body.Bytes())
+	}
+	return p.sendStatsd(families)
+}
+
+func (p *metricsPusher) send(method, contentType string, body []byte) error {
+	req, err := http.NewRequest(method, p.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentType)
+	if p.user != nil {
+		pw, _ := p.user.Password()
+		req.SetBasicAuth(p.user.Username(), pw)
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("%s answered %s", p.endpoint, resp.Status)
+	}
+	return nil
+}
+
+// writeInfluxLines writes families in the InfluxDB line protocol, a
+// measurement per metric and suffix with the labels as tags.
+func writeInfluxLines(w *bytes.Buffer, families []metricFamily, t time.Time) {
+	tag := strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `)
+	for _, f := range families {
+		for _, s := range f.samples {
+			w.WriteString(f.name + s.suffix)
+			for _, l := range s.labels {
+				w.WriteString("," + l[0] + "=" + tag.Replace(l[1]))
+			}
+			fmt.Fprintf(w, " value=%s %d\n", strconv.FormatFloat(s.value, 'g', -1, 64), t.UnixNano())
+		}
+	}
+}
+
+// sendStatsd sends gauges as they are and counters as the increase since
+// the last push. Histogram buckets have no statsd equivalent; their sum
+// and count go out as counters.
+func (p *metricsPusher) sendStatsd(families []metricFamily) error {
+	conn, err := net.Dial("udp", p.endpoint)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	var packet bytes.Buffer
+	flush := func() error {
+		if packet.Len() == 0 {
+			return nil
+		}
+		_, err := conn.Write(packet.Bytes())
+		packet.Reset()
+		return err
+	}
+	for _, f := range families {
+		for _, s := range f.samples {
+			if s.suffix == "_bucket" {
+				continue
+			}
+			name := strings.Replace(strings.TrimPrefix(f.name, "gowebdav_"), "_", ".", -1) + strings.Replace(s.suffix, "_", ".", 1)
+			name = "gowebdav." + name
+			for _, l := range s.labels {
+				name += "." + strings.NewReplacer(".", "_", ":", "_", "|", "_").Replace(l[1])
+			}
+			var line string
+			if f.typ == "gauge" {
+				line = fmt.Sprintf("%s:%s|g\n", name, strconv.FormatFloat(s.value, 'g', -1, 64))
+			} else {
+				delta := s.value - p.last[name]
+				p.last[name] = s.value
+				if delta == 0 {
+					continue
+				}
+				line = fmt.Sprintf("%s:%s|c\n", name, strconv.FormatFloat(delta, 'g', -1, 64))
+			}
+			// Stay under the usual 1432 byte UDP payload.
+			if packet.Len()+len(line) > 1432 {
+				if err := flush(); err != nil {
+					return err
+				}
+			}
+			packet.WriteString(line)
+		}
+	}
+	return flush()
+}
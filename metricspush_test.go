@@ -0,0 +1,85 @@
+package main
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetricsPush(t *testing.T) {
+	stats := newServerMetrics()
+	h := stats.wrap(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}))
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+
+	type pushed struct{ method, path, user, body string }
+	got := make(chan pushed, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := io.ReadAll(req.Body)
+		user, _, _ := req.BasicAuth()
+		got <- pushed{req.Method, req.URL.RequestURI(), user, string(body)}
+	}))
+	defer srv.Close()
+
+	p := &metricsPusher{format: "pushgateway", endpoint: srv.URL + "/metrics/job/gowebdav/instance/host", client: srv.Client(), stats: stats}
+	if err := p.push(); err != nil {
+		t.Fatal(err)
+	}
+	r := <-got
+	if r.method != "PUT" || !strings.Contains(r.body, `gowebdav_requests_total{method="GET",code="200"} 1`) {
+		t.Errorf("unexpected Pushgateway push %+v", r)
+	}
+
+	p = &metricsPusher{format: "influx", endpoint: srv.URL + "/write?db=gowebdav", client: srv.Client(), stats: stats}
+	if err := p.push(); err != nil {
+		t.Fatal(err)
+	}
+	r = <-got
+	if r.method != "POST" || r.path != "/write?db=gowebdav" || !strings.Contains(r.body, "gowebdav_requests_total,method=GET,code=200 value=1 ") {
+		t.Errorf("unexpected InfluxDB push %+v", r)
+	}
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	p = &metricsPusher{format: "statsd", endpoint: pc.LocalAddr().String(), stats: stats, last: make(map[string]float64)}
+	read := func() string {
+		if err := p.push(); err != nil {
+			t.Fatal(err)
+		}
+		pc.SetReadDeadline(time.Now().Add(5 * time.Second))
+		var all strings.Builder
+		b := make([]byte, 2048)
+		for {
+			n, _, err := pc.ReadFrom(b)
+			if err != nil {
+				t.Fatal(err)
+			}
+			all.Write(b[:n])
+			if strings.Contains(string(b[:n]), "gowebdav.response.size.bytes") {
+				return all.String()
+			}
+		}
+	}
+	first := read()
+	for _, want := range []string{"gowebdav.requests.total.GET.200:1|c\n", "gowebdav.requests.in.flight:0|g\n", "gowebdav.request.duration.seconds.count.GET:1|c\n"} {
+		if !strings.Contains(first, want) {
+			t.Errorf("statsd push lacks %q:\n%s", want, first)
+		}
+	}
+	if strings.Contains(first, "bucket") {
+		t.Errorf("statsd push has histogram buckets:\n%s", first)
+	}
+
+	// Counters go out as increments.
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	if second := read(); !strings.Contains(second, "gowebdav.requests.total.GET.200:2|c\n") {
+		t.Errorf("statsd push did not send the increment:\n%s", second)
+	}
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	flagNotifyEvents       = flag.String("notify-events", "upload,quota,auth-failures", "comma-separated events notifiers are told about: upload, quota, auth-failures")
+	flagNotifyPaths        = flag.String("notify-paths", "", "comma-separated folders whose uploads are notified (default: every folder)")
+	flagNotifyDelay        = flag.Duration("notify-delay", time.Minute, "collect events for this long and send them in one notification")
+	flagNotifyAuthFailures = flag.Int("notify-auth-failures", 5, "notify after this many failed logins from one client within 10 minutes")
+)
+
+// notifyEvent is something notifiers tell people about.
+type notifyEvent struct {
+	Time    time.Time `json:"time"`
+	Kind    string    `json:"kind"`
+	Path    string    `json:"path,omitempty"`
+	User    string    `json:"user,omitempty"`
+	Client  string    `json:"client,omitempty"`
+	Message string    `json:"message"`
+}
+
+// notifier delivers a batch of events, such as by email.
+type notifier interface {
+	name() string
+	send(events []notifyEvent) error
+}
+
+// notifications batches events for -notify-delay and hands each batch to
+// every notifier.
+var notifications struct {
+	sync.Mutex
+	notifiers []notifier
+	kinds     map[string]bool
+	pending   []notifyEvent
+	timer     *time.Timer
+}
+
+// addNotifier enables n for the events selected by -notify-events.
+func addNotifier(n notifier) {
+	notifications.Lock()
+	defer notifications.Unlock()
+	if notifications.kinds == nil {
+		notifications.kinds = make(map[string]bool)
+		for _, k := range strings.Split(*flagNotifyEvents, ",") {
+			notifications.kinds[strings.TrimSpace(k)] = true
+		}
+		onShutdown(flushNotifications)
+	}
+	notifications.notifiers = append(notifications.notifiers, n)
+}
+
+// notify queues ev for the notifiers, if any of them wants it.
+func notify(ev notifyEvent) {
+	notifications.Lock()
+	defer notifications.Unlock()
+	if len(notifications.notifiers) == 0 || !notifications.kinds[ev.Kind] {
+		return
+	}
+	if ev.Time.IsZero() {
+		ev.Time = time.Now()
+	}
+	notifications.pending = append(notifications.pending, ev)
+	if notifications.timer == nil {
+		notifications.timer = time.AfterFunc(*flagNotifyDelay, flushNotifications)
+	}
+}
+
+func flushNotifications() {
+	notifications.Lock()
+	events, notifiers := notifications.pending, notifications.notifiers
+	notifications.pending = nil
+	if notifications.timer != nil {
+		notifications.timer.Stop()
+		notifications.timer = nil
+	}
+	notifications.Unlock()
+	if len(events) == 0 {
+		return
+	}
+	for _, n := range notifiers {
+		if err := n.send(events); err != nil {
+			log.Printf("Failed to send %d notifications by %s: %v", len(events), n.name(), err)
+		}
+	}
+}
+
+// notifyScoped reports whether uploads to p are notified.
+func notifyScoped(p string) bool {
+	if *flagNotifyPaths == "" {
+		return true
+	}
+	for _, dir := range strings.Split(*flagNotifyPaths, ",") {
+		dir = "/" + strings.Trim(strings.TrimSpace(dir), "/")
+		if dir == "/" || p == dir || strings.HasPrefix(p, dir+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// trackUpload returns w wrapped to notify a successful PUT of req; call the
+// returned function once the request has been served.
+func trackUpload(w http.ResponseWriter, req *http.Request) (http.ResponseWriter, func()) {
+	if req.Method != "PUT" || !uploadsNotified(req.URL.Path) {
+		return w, func() {}
+	}
+	sw := &statusWriter{ResponseWriter: w}
+	return sw, func() {
+		if sw.status != http.StatusCreated && sw.status != http.StatusNoContent {
+			return
+		}
+		user, _, _ := req.BasicAuth()
+		notifyUpload(req.URL.Path, user, clientIP(req))
+	}
+}
+
+// uploadsNotified reports whether uploads to p are to be notified.
+func uploadsNotified(p string) bool {
+	notifications.Lock()
+	enabled := len(notifications.notifiers) > 0 && notifications.kinds["upload"]
+	notifications.Unlock()
+	return enabled && notifyScoped(p)
+}
+
+// notifyUpload notifies the upload of p by user from client, if uploads to
+// p are notified.
+func notifyUpload(p, user, client string) {
+	if !uploadsNotified(p) {
+		return
+	}
+	msg := fmt.Sprintf("%s uploaded", p)
+	if user != "" {
+		msg += " by " + user
+	}
+	notify(notifyEvent{Kind: "upload", Path: p, User: user, Client: client, Message: msg})
+}
+
+const authFailureWindow = 10 * time.Minute
+
+var authFailures struct {
+	sync.Mutex
+	byClient map[string][]time.Time
+}
+
+// authFailed counts a failed login and notifies when a client keeps
+// failing.
+func authFailed(req *http.Request) {
+	if *flagNotifyAuthFailures <= 0 {
+		return
+	}
+	ip := clientIP(req)
+	now := time.Now()
+	authFailures.Lock()
+	if authFailures.byClient == nil {
+		authFailures.byClient = make(map[string][]time.Time)
+	}
+	var recent []time.Time
+	for _, t := range authFailures.byClient[ip] {
+		if now.Sub(t) < authFailureWindow {
+			recent = append(recent, t)
+		}
+	}
+	recent = append(recent, now)
+	n := len(recent)
+	if len(authFailures.byClient) > 10000 {
+		for client, ts := range authFailures.byClient {
+			if now.Sub(ts[len(ts)-1]) >= authFailureWindow {
+				delete(authFailures.byClient, client)
+			}
+		}
+	}
+	if n >= *flagNotifyAuthFailures {
+		// Start counting again, so a client that keeps trying is reported
+		// once per batch of failures.
+		delete(authFailures.byClient, ip)
+	} else {
+		authFailures.byClient[ip] = recent
+	}
+	authFailures.Unlock()
+
+	if n >= *flagNotifyAuthFailures {
+		user, _, _ := req.BasicAuth()
+		notify(notifyEvent{Kind: "auth-failures", User: user, Client: ip,
+			Message: fmt.Sprintf("%d failed logins from %s within %d minutes", n, ip, int(authFailureWindow.Minutes()))})
+	}
+}
+
+func clientIP(req *http.Request) string {
+	return remoteHost(req.RemoteAddr)
+}
+
+// remoteHost strips the port from a client's address.
+func remoteHost(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
+}
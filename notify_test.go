@@ -0,0 +1,120 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/smtp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type fakeNotifier struct {
+	mu      sync.Mutex
+	batches [][]notifyEvent
+}
+
+func (f *fakeNotifier) name() string { return "fake" }
+
+func (f *fakeNotifier) send(events []notifyEvent) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.batches = append(f.batches, events)
+	return nil
+}
+
+// withNotifier installs n as the only notifier for the test.
+func withNotifier(t *testing.T, n notifier) {
+	notifications.Lock()
+	notifications.notifiers, notifications.kinds, notifications.pending = nil, nil, nil
+	notifications.Unlock()
+	addNotifier(n)
+	t.Cleanup(func() {
+		notifications.Lock()
+		notifications.notifiers, notifications.kinds, notifications.pending = nil, nil, nil
+		notifications.Unlock()
+	})
+}
+
+func TestNotifyUploads(t *testing.T) {
+	f := &fakeNotifier{}
+	withNotifier(t, f)
+	*flagNotifyPaths = "/inbox"
+	defer func() { *flagNotifyPaths = "" }()
+
+	h := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if strings.HasSuffix(req.URL.Path, "/denied.txt") {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+	})
+	for _, p := range []string{"/inbox/a.txt", "/inbox/denied.txt", "/other/b.txt", "/inboxes/c.txt"} {
+		req := httptest.NewRequest("PUT", p, strings.NewReader("x"))
+		req.SetBasicAuth("bob", "secret")
+		w, done := trackUpload(httptest.NewRecorder(), req)
+		h.ServeHTTP(w, req)
+		done()
+	}
+	flushNotifications()
+	if len(f.batches) != 1 || len(f.batches[0]) != 1 {
+		t.Fatalf("got batches %v, want one upload", f.batches)
+	}
+	if ev := f.batches[0][0]; ev.Kind != "upload" || ev.Path != "/inbox/a.txt" || ev.Message != "/inbox/a.txt uploaded by bob" {
+		t.Errorf("unexpected event %+v", ev)
+	}
+}
+
+func TestNotifyAuthFailures(t *testing.T) {
+	f := &fakeNotifier{}
+	withNotifier(t, f)
+	for i := 0; i < 2*5+1; i++ {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = "192.0.2.9:5000"
+		authFailed(req)
+	}
+	other := httptest.NewRequest("GET", "/", nil)
+	other.RemoteAddr = "192.0.2.10:5000"
+	authFailed(other)
+	flushNotifications()
+	if len(f.batches) != 1 || len(f.batches[0]) != 2 {
+		t.Fatalf("got batches %v, want two reports", f.batches)
+	}
+	if ev := f.batches[0][0]; ev.Kind != "auth-failures" || ev.Client != "192.0.2.9" {
+		t.Errorf("unexpected event %+v", ev)
+	}
+}
+
+func TestMailNotifier(t *testing.T) {
+	var got []byte
+	var to []string
+	m := &mailNotifier{server: "mail:25", from: "dav@example.com", to: []string{"a@example.com", "b@example.com"},
+		sendMail: func(addr string, a smtp.Auth, from string, rcpt []string, msg []byte) error {
+			got, to = msg, rcpt
+			return nil
+		}}
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	if err := m.send([]notifyEvent{{Time: now, Kind: "upload", Message: "/inbox/a.txt uploaded by bob", Client: "192.0.2.9"}}); err != nil {
+		t.Fatal(err)
+	}
+	msg := string(got)
+	for _, want := range []string{
+		"From: dav@example.com\r\n",
+		"To: a@example.com, b@example.com\r\n",
+		"Subject: [gowebdav] /inbox/a.txt uploaded by bob\r\n",
+		"2024-05-01 12:00:00  /inbox/a.txt uploaded by bob\r\n    client: 192.0.2.9\r\n",
+	} {
+		if !strings.Contains(msg, want) {
+			t.Errorf("message lacks %q:\n%s", want, msg)
+		}
+	}
+	if len(to) != 2 {
+		t.Errorf("sent to %v", to)
+	}
+
+	m.send([]notifyEvent{{Time: now, Message: "one"}, {Time: now, Message: "two"}})
+	if !strings.Contains(string(got), "Subject: [gowebdav] 2 events on ") {
+		t.Errorf("batch subject missing:\n%s", got)
+	}
+}
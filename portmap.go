@@ -0,0 +1,445 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	flagPortMap         = flag.Bool("portmap", false, "request a port mapping from the router via NAT-PMP or UPnP and print the external url")
+	flagPortMapExternal = flag.Int("portmap-external-port", 0, "external port to request (default: same as the listen port)")
+)
+
+const (
+	natpmpPort     = 5351
+	portMapTTL     = time.Hour
+	portMapTimeout = 3 * time.Second
+)
+
+// portMapping is an active mapping on the router. Close removes it.
+type portMapping interface {
+	ExternalAddr() *net.TCPAddr
+	Refresh() error
+	Close() error
+}
+
+// startPortMap maps the listener's port on the local router, trying NAT-PMP
+// first and falling back to UPnP IGD, and keeps the mapping alive.
+func startPortMap(addr net.Addr) (portMapping, error) {
+	tcp, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return nil, fmt.Errorf("unsupported listener address %v", addr)
+	}
+	external := *flagPortMapExternal
+	if external == 0 {
+		external = tcp.Port
+	}
+
+	var m portMapping
+	gw, err := defaultGateway()
+	if err == nil {
+		m, err = mapNATPMP(gw, tcp.Port, external)
+	}
+	if err != nil {
+		log.Printf("NAT-PMP unavailable (%v), trying UPnP", err)
+		m, err = mapUPnP(tcp.IP, tcp.Port, external)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	r := &refreshedMapping{portMapping: m, done: make(chan struct{})}
+	go r.refresh()
+	return r, nil
+}
+
+// refreshedMapping renews a mapping before its lease runs out, until it is
+// closed.
+type refreshedMapping struct {
+	portMapping
+	done chan struct{}
+	once sync.Once
+}
+
+func (m *refreshedMapping) refresh() {
+	t := time.NewTicker(portMapTTL / 2)
+	defer t.Stop()
+	for {
+		select {
+		case <-m.done:
+			return
+		case <-t.C:
+			if err := m.Refresh(); err != nil {
+				log.Printf("Failed to refresh port mapping: %v", err)
+			}
+		}
+	}
+}
+
+func (m *refreshedMapping) Close() error {
+	m.once.Do(func() { close(m.done) })
+	return m.portMapping.Close()
+}
+
+// defaultGateway reads the IPv4 default route on Linux, and otherwise guesses
+// the .1 address of the LAN subnet, which is right for most home routers.
+func defaultGateway() (net.IP, error) {
+	if f, err := os.Open("/proc/net/route"); err == nil {
+		defer f.Close()
+		if gw, err := parseRouteGateway(f); err == nil {
+			return gw, nil
+		}
+	}
+	ip, err := lanIP()
+	if err != nil {
+		return nil, err
+	}
+	ip4 := ip.To4()
+	if ip4 == nil {
+		return nil, errors.New("no IPv4 LAN address")
+	}
+	return net.IPv4(ip4[0], ip4[1], ip4[2], 1), nil
+}
+
+// parseRouteGateway finds the default route in the /proc/net/route format,
+// where addresses are little-endian hex.
+func parseRouteGateway(r io.Reader) (net.IP, error) {
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) < 3 || fields[1] != "00000000" {
+			continue
+		}
+		b, err := hex.DecodeString(fields[2])
+		if err != nil || len(b) != 4 {
+			continue
+		}
+		return net.IPv4(b[3], b[2], b[1], b[0]), nil
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	return nil, errors.New("no default route")
+}
+
+type natpmpMapping struct {
+	gateway  *net.UDPAddr
+	internal int
+	ip       net.IP
+
+	mu       sync.Mutex // guards external, which the gateway may change
+	external int
+}
+
+func mapNATPMP(gw net.IP, internal, external int) (portMapping, error) {
+	m := &natpmpMapping{gateway: &net.UDPAddr{IP: gw, Port: natpmpPort}, internal: internal, external: external}
+	resp, err := m.call([]byte{0, 0}, 12)
+	if err != nil {
+		return nil, err
+	}
+	m.ip = net.IP(resp[8:12])
+	if err := m.Refresh(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (m *natpmpMapping) ExternalAddr() *net.TCPAddr {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return &net.TCPAddr{IP: m.ip, Port: m.external}
+}
+
+func (m *natpmpMapping) Refresh() error {
+	return m.request(portMapTTL)
+}
+
+func (m *natpmpMapping) Close() error {
+	return m.request(0)
+}
+
+// request renews the mapping for lifetime or, with a lifetime of 0, deletes
+// it, which takes an external port of 0 (RFC 6886 section 3.4).
+func (m *natpmpMapping) request(lifetime time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	external := m.external
+	if lifetime == 0 {
+		external = 0
+	}
+	resp, err := m.call(natpmpMapRequest(m.internal, external, lifetime), 16)
+	if err != nil {
+		return err
+	}
+	if lifetime > 0 {
+		m.external = int(binary.BigEndian.Uint16(resp[10:12]))
+	}
+	return nil
+}
+
+// natpmpMapRequest encodes a TCP mapping request (RFC 6886 section 3.3).
+func natpmpMapRequest(internal, external int, lifetime time.Duration) []byte {
+	req := make([]byte, 12)
+	req[1] = 2
+	binary.BigEndian.PutUint16(req[4:6], uint16(internal))
+	binary.BigEndian.PutUint16(req[6:8], uint16(external))
+	binary.BigEndian.PutUint32(req[8:12], uint32(lifetime/time.Second))
+	return req
+}
+
+func (m *natpmpMapping) call(req []byte, size int) ([]byte, error) {
+	conn, err := net.DialUDP("udp4", nil, m.gateway)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	resp := make([]byte, 16)
+	// RFC 6886 retransmits starting at 250ms, doubling each time.
+	for wait := 250 * time.Millisecond; wait <= 2*time.Second; wait *= 2 {
+		if _, err := conn.Write(req); err != nil {
+			return nil, err
+		}
+		conn.SetReadDeadline(time.Now().Add(wait))
+		n, err := conn.Read(resp)
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				continue
+			}
+			return nil, err
+		}
+		return checkNATPMPResponse(resp[:n], req[1], size)
+	}
+	return nil, errors.New("NAT-PMP gateway did not respond")
+}
+
+func checkNATPMPResponse(resp []byte, op byte, size int) ([]byte, error) {
+	if len(resp) < size || resp[0] != 0 || resp[1] != op|0x80 {
+		return nil, errors.New("malformed NAT-PMP response")
+	}
+	if code := binary.BigEndian.Uint16(resp[2:4]); code != 0 {
+		return nil, fmt.Errorf("NAT-PMP result code %d", code)
+	}
+	return resp, nil
+}
+
+var upnpServiceTypes = []string{
+	"urn:schemas-upnp-org:service:WANIPConnection:2",
+	"urn:schemas-upnp-org:service:WANIPConnection:1",
+	"urn:schemas-upnp-org:service:WANPPPConnection:1",
+}
+
+type upnpMapping struct {
+	controlURL  string
+	serviceType string
+	client      net.IP
+	internal    int
+	external    int
+	ip          net.IP
+}
+
+// mapUPnP maps external to internal on the address the listener is bound
+// to, or on the LAN address when it listens on all of them.
+func mapUPnP(bound net.IP, internal, external int) (portMapping, error) {
+	location, err := discoverIGD()
+	if err != nil {
+		return nil, err
+	}
+	client := &http.Client{Timeout: portMapTimeout}
+	resp, err := client.Get(location)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	desc, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+	control, serviceType, err := findControlURL(desc, location)
+	if err != nil {
+		return nil, err
+	}
+	if bound == nil || bound.IsUnspecified() {
+		if bound, err = lanIP(); err != nil {
+			return nil, err
+		}
+	}
+
+	m := &upnpMapping{controlURL: control, serviceType: serviceType, client: bound, internal: internal, external: external}
+	out, err := m.soap("GetExternalIPAddress", "")
+	if err != nil {
+		return nil, err
+	}
+	m.ip = net.ParseIP(soapValue(out, "NewExternalIPAddress"))
+	if m.ip == nil {
+		return nil, errors.New("router did not report an external address")
+	}
+	if err := m.Refresh(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// discoverIGD sends an SSDP M-SEARCH for an Internet Gateway Device and
+// returns the location of its description document.
+func discoverIGD() (string, error) {
+	conn, err := net.ListenUDP("udp4", nil)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	search := "M-SEARCH * HTTP/1.1\r\n" +
+		"HOST: 239.255.255.250:1900\r\n" +
+		"ST: urn:schemas-upnp-org:device:InternetGatewayDevice:1\r\n" +
+		"MAN: \"ssdp:discover\"\r\n" +
+		"MX: 2\r\n\r\n"
+	if _, err := conn.WriteToUDP([]byte(search), &net.UDPAddr{IP: net.IPv4(239, 255, 255, 250), Port: 1900}); err != nil {
+		return "", err
+	}
+	conn.SetReadDeadline(time.Now().Add(portMapTimeout))
+	buf := make([]byte, 2048)
+	for {
+		n, _, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			return "", errors.New("no UPnP gateway found")
+		}
+		resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(buf[:n])), nil)
+		if err != nil {
+			continue
+		}
+		if loc := resp.Header.Get("Location"); loc != "" {
+			return loc, nil
+		}
+	}
+}
+
+type upnpDevice struct {
+	Services []struct {
+		ServiceType string `xml:"serviceType"`
+		ControlURL  string `xml:"controlURL"`
+	} `xml:"serviceList>service"`
+	Devices []upnpDevice `xml:"deviceList>device"`
+}
+
+// findControlURL locates a WAN connection service in an IGD description and
+// resolves its control URL against the description's location.
+func findControlURL(desc []byte, location string) (string, string, error) {
+	var root struct {
+		URLBase string     `xml:"URLBase"`
+		Device  upnpDevice `xml:"device"`
+	}
+	if err := xml.Unmarshal(desc, &root); err != nil {
+		return "", "", err
+	}
+	base, err := url.Parse(location)
+	if err != nil {
+		return "", "", err
+	}
+	if root.URLBase != "" {
+		if base, err = url.Parse(root.URLBase); err != nil {
+			return "", "", err
+		}
+	}
+	for _, st := range upnpServiceTypes {
+		queue := []upnpDevice{root.Device}
+		for len(queue) > 0 {
+			d := queue[0]
+			queue = append(queue[1:], d.Devices...)
+			for _, s := range d.Services {
+				if s.ServiceType == st {
+					u, err := base.Parse(s.ControlURL)
+					if err != nil {
+						return "", "", err
+					}
+					return u.String(), st, nil
+				}
+			}
+		}
+	}
+	return "", "", errors.New("gateway has no WAN connection service")
+}
+
+func (m *upnpMapping) ExternalAddr() *net.TCPAddr {
+	return &net.TCPAddr{IP: m.ip, Port: m.external}
+}
+
+func (m *upnpMapping) Refresh() error {
+	_, err := m.soap("AddPortMapping", fmt.Sprintf(
+		"<NewRemoteHost></NewRemoteHost>"+
+			"<NewExternalPort>%d</NewExternalPort>"+
+			"<NewProtocol>TCP</NewProtocol>"+
+			"<NewInternalPort>%d</NewInternalPort>"+
+			"<NewInternalClient>%s</NewInternalClient>"+
+			"<NewEnabled>1</NewEnabled>"+
+			"<NewPortMappingDescription>gowebdav</NewPortMappingDescription>"+
+			"<NewLeaseDuration>%d</NewLeaseDuration>",
+		m.external, m.internal, m.client, int(portMapTTL/time.Second)))
+	return err
+}
+
+func (m *upnpMapping) Close() error {
+	_, err := m.soap("DeletePortMapping", fmt.Sprintf(
+		"<NewRemoteHost></NewRemoteHost>"+
+			"<NewExternalPort>%d</NewExternalPort>"+
+			"<NewProtocol>TCP</NewProtocol>", m.external))
+	return err
+}
+
+func (m *upnpMapping) soap(action, args string) ([]byte, error) {
+	body := `<?xml version="1.0"?>` +
+		`<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/">` +
+		`<s:Body><u:` + action + ` xmlns:u="` + m.serviceType + `">` + args + `</u:` + action + `></s:Body></s:Envelope>`
+	req, err := http.NewRequest("POST", m.controlURL, strings.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", `text/xml; charset="utf-8"`)
+	req.Header.Set("SOAPAction", strconv.Quote(m.serviceType+"#"+action))
+	client := &http.Client{Timeout: portMapTimeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	out, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("UPnP %s failed: %s %s", action, resp.Status, soapValue(out, "errorDescription"))
+	}
+	return out, nil
+}
+
+// soapValue returns the text of the first element with the given local name.
+func soapValue(doc []byte, name string) string {
+	d := xml.NewDecoder(bytes.NewReader(doc))
+	for {
+		tok, err := d.Token()
+		if err != nil {
+			return ""
+		}
+		if se, ok := tok.(xml.StartElement); ok && se.Name.Local == name {
+			var v string
+			if d.DecodeElement(&v, &se) != nil {
+				return ""
+			}
+			return strings.TrimSpace(v)
+		}
+	}
+}
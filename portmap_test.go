@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseRouteGateway(t *testing.T) {
+	const header = "Iface\tDestination\tGateway \tFlags\tRefCnt\tUse\tMetric\tMask\t\tMTU\tWindow\tIRTT\n"
+	tests := []struct {
+		name    string
+		table   string
+		want    string
+		wantErr bool
+	}{
+		{"default route", header + "eth0\t0000A8C0\t00000000\t0001\t0\t0\t0\t00FFFFFF\t0\t0\t0\neth0\t00000000\t0100A8C0\t0003\t0\t0\t0\t00000000\t0\t0\t0\n", "192.168.0.1", false},
+		{"no default route", header + "eth0\t0000A8C0\t00000000\t0001\t0\t0\t0\t00FFFFFF\t0\t0\t0\n", "", true},
+		{"empty", "", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gw, err := parseRouteGateway(strings.NewReader(tt.table))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && gw.String() != tt.want {
+				t.Errorf("gateway = %v, want %v", gw, tt.want)
+			}
+		})
+	}
+}
+
+func TestNATPMPMapRequest(t *testing.T) {
+	tests := []struct {
+		name     string
+		internal int
+		external int
+		lifetime time.Duration
+		want     []byte
+	}{
+		{"map", 6086, 8080, time.Hour, []byte{0, 2, 0, 0, 0x17, 0xc6, 0x1f, 0x90, 0, 0, 0x0e, 0x10}},
+		{"delete", 6086, 0, 0, []byte{0, 2, 0, 0, 0x17, 0xc6, 0, 0, 0, 0, 0, 0}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := natpmpMapRequest(tt.internal, tt.external, tt.lifetime); !bytes.Equal(got, tt.want) {
+				t.Errorf("request = %x, want %x", got, tt.want)
+			}
+		})
+	}
+}
+
+type fakeMapping struct{ closed int }
+
+func (m *fakeMapping) ExternalAddr() *net.TCPAddr { return &net.TCPAddr{} }
+func (m *fakeMapping) Refresh() error             { return nil }
+func (m *fakeMapping) Close() error               { m.closed++; return nil }
+
+func TestRefreshedMappingClose(t *testing.T) {
+	inner := &fakeMapping{}
+	m := &refreshedMapping{portMapping: inner, done: make(chan struct{})}
+	stopped := make(chan struct{})
+	go func() {
+		m.refresh()
+		close(stopped)
+	}()
+	m.Close()
+	m.Close()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("refresh goroutine still running after Close")
+	}
+	if inner.closed != 2 {
+		t.Errorf("mapping closed %d times, want 2", inner.closed)
+	}
+}
+
+func TestCheckNATPMPResponse(t *testing.T) {
+	tests := []struct {
+		name    string
+		resp    []byte
+		op      byte
+		size    int
+		wantErr bool
+	}{
+		{"external address", []byte{0, 128, 0, 0, 0, 0, 0, 1, 203, 0, 113, 5}, 0, 12, false},
+		{"mapping", []byte{0, 130, 0, 0, 0, 0, 0, 1, 0x17, 0xc6, 0x1f, 0x90, 0, 0, 0x0e, 0x10}, 2, 16, false},
+		{"short", []byte{0, 128, 0, 0}, 0, 12, true},
+		{"wrong opcode", []byte{0, 129, 0, 0, 0, 0, 0, 1, 203, 0, 113, 5}, 0, 12, true},
+		{"refused", []byte{0, 130, 0, 2, 0, 0, 0, 1, 0x17, 0xc6, 0x1f, 0x90, 0, 0, 0, 0}, 2, 16, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := checkNATPMPResponse(tt.resp, tt.op, tt.size)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestFindControlURL(t *testing.T) {
+	const nested = `<?xml version="1.0"?>
+<root xmlns="urn:schemas-upnp-org:device-1-0">
+  <device>
+    <deviceType>urn:schemas-upnp-org:device:InternetGatewayDevice:1</deviceType>
+    <deviceList><device>
+      <deviceType>urn:schemas-upnp-org:device:WANDevice:1</deviceType>
+      <deviceList><device>
+        <serviceList><service>
+          <serviceType>urn:schemas-upnp-org:service:WANIPConnection:1</serviceType>
+          <controlURL>/ctl/IPConn</controlURL>
+        </service></serviceList>
+      </device></deviceList>
+    </device></deviceList>
+  </device>
+</root>`
+	const withBase = `<root><URLBase>http://10.0.0.1:5000/</URLBase><device><serviceList><service>
+<serviceType>urn:schemas-upnp-org:service:WANPPPConnection:1</serviceType><controlURL>ppp</controlURL>
+</service></serviceList></device></root>`
+	tests := []struct {
+		name        string
+		desc        string
+		want        string
+		wantService string
+		wantErr     bool
+	}{
+		{"nested ip connection", nested, "http://192.168.0.1:1900/ctl/IPConn", "urn:schemas-upnp-org:service:WANIPConnection:1", false},
+		{"url base", withBase, "http://10.0.0.1:5000/ppp", "urn:schemas-upnp-org:service:WANPPPConnection:1", false},
+		{"no service", `<root><device></device></root>`, "", "", true},
+		{"not xml", `nope`, "", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, service, err := findControlURL([]byte(tt.desc), "http://192.168.0.1:1900/rootDesc.xml")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want || service != tt.wantService {
+				t.Errorf("got %q %q, want %q %q", got, service, tt.want, tt.wantService)
+			}
+		})
+	}
+}
+
+func TestSoapValue(t *testing.T) {
+	const resp = `<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/"><s:Body>
+<u:GetExternalIPAddressResponse xmlns:u="urn:schemas-upnp-org:service:WANIPConnection:1">
+<NewExternalIPAddress> 203.0.113.5 </NewExternalIPAddress></u:GetExternalIPAddressResponse></s:Body></s:Envelope>`
+	tests := []struct {
+		name string
+		doc  string
+		elem string
+		want string
+	}{
+		{"found", resp, "NewExternalIPAddress", "203.0.113.5"},
+		{"missing", resp, "errorDescription", ""},
+		{"garbage", "<<<", "NewExternalIPAddress", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := soapValue([]byte(tt.doc), tt.elem); got != tt.want {
+				t.Errorf("soapValue = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
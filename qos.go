@@ -0,0 +1,153 @@
+package main
+
+import (
+	"flag"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"golang.org/x/net/context"
+	"golang.org/x/net/webdav"
+)
+
+var (
+	flagMaxConcurrent = flag.Int("max-concurrent", 0, "serve at most this many requests at once, keeping a quarter of them for interactive ones such as PROPFIND and small GETs (0 for no limit)")
+	flagQoSSmall      = flag.Int64("qos-small", 1<<20, "GETs and PUTs of at most this many bytes count as interactive under -max-concurrent")
+)
+
+// prioritySem hands out a fixed number of request slots. Interactive
+// requests are served before bulk ones when the slots run out, and bulk
+// requests can never take the slots reserved for interactive ones, so
+// browsing stays responsive while big transfers run.
+type prioritySem struct {
+	mu       sync.Mutex
+	free     int
+	bulk     int
+	bulkMax  int
+	waitHigh []chan struct{}
+	waitLow  []chan struct{}
+}
+
+func newPrioritySem(n int) *prioritySem {
+	reserve := n / 4
+	if reserve < 1 {
+		reserve = 1
+	}
+	bulkMax := n - reserve
+	if bulkMax < 1 {
+		bulkMax = 1
+	}
+	return &prioritySem{free: n, bulkMax: bulkMax}
+}
+
+var requestSlots *prioritySem
+
+// acquire waits for a slot, or returns ctx.Err() when ctx ends first.
+func (s *prioritySem) acquire(ctx context.Context, interactive bool) error {
+	s.mu.Lock()
+	if s.free > 0 && (interactive || len(s.waitHigh) == 0 && s.bulk < s.bulkMax) {
+		s.take(interactive)
+		s.mu.Unlock()
+		return nil
+	}
+	ch := make(chan struct{})
+	if interactive {
+		s.waitHigh = append(s.waitHigh, ch)
+	} else {
+		s.waitLow = append(s.waitLow, ch)
+	}
+	s.mu.Unlock()
+
+	select {
+	case <-ch:
+		return nil
+	case <-ctx.Done():
+		s.mu.Lock()
+		select {
+		case <-ch:
+			// Granted just as ctx ended; hand the slot on.
+			s.mu.Unlock()
+			s.release(interactive)
+		default:
+			if interactive {
+				s.waitHigh = removeWaiter(s.waitHigh, ch)
+			} else {
+				s.waitLow = removeWaiter(s.waitLow, ch)
+			}
+			s.mu.Unlock()
+		}
+		return ctx.Err()
+	}
+}
+
+func (s *prioritySem) take(interactive bool) {
+	s.free--
+	if !interactive {
+		s.bulk++
+	}
+}
+
+func (s *prioritySem) release(interactive bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.free++
+	if !interactive {
+		s.bulk--
+	}
+	switch {
+	case len(s.waitHigh) > 0:
+		ch := s.waitHigh[0]
+		s.waitHigh = s.waitHigh[1:]
+		s.take(true)
+		close(ch)
+	case len(s.waitLow) > 0 && s.bulk < s.bulkMax:
+		ch := s.waitLow[0]
+		s.waitLow = s.waitLow[1:]
+		s.take(false)
+		close(ch)
+	}
+}
+
+func removeWaiter(waiters []chan struct{}, ch chan struct{}) []chan struct{} {
+	for i, w := range waiters {
+		if w == ch {
+			return append(waiters[:i], waiters[i+1:]...)
+		}
+	}
+	return waiters
+}
+
+// isInteractive tells the requests a file manager waits on while the user
+// looks at it from bulk transfers.
+func isInteractive(fs webdav.FileSystem, req *http.Request) bool {
+	switch req.Method {
+	case "PROPFIND":
+		depth := req.Header.Get("Depth")
+		return depth == "0" || depth == "1"
+	case "GET":
+		fi, err := fs.Stat(req.Context(), req.URL.Path)
+		return err != nil || fi.IsDir() || fi.Size() <= *flagQoSSmall || isSmallRange(req.Header.Get("Range"))
+	case "PUT":
+		return req.ContentLength >= 0 && req.ContentLength <= *flagQoSSmall
+	case "COPY", "MOVE", "DELETE", "SEARCH", "REPORT":
+		return false
+	}
+	// OPTIONS, HEAD, LOCK, UNLOCK, PROPPATCH, MKCOL.
+	return true
+}
+
+// isSmallRange reports whether a Range header asks for a single bounded
+// range no larger than -qos-small, as thumbnailers and media probes do.
+func isSmallRange(r string) bool {
+	if !strings.HasPrefix(r, "bytes=") || strings.Contains(r, ",") {
+		return false
+	}
+	start, end, ok := strings.Cut(strings.TrimPrefix(r, "bytes="), "-")
+	if !ok {
+		return false
+	}
+	a, err1 := strconv.ParseInt(start, 10, 64)
+	b, err2 := strconv.ParseInt(end, 10, 64)
+	return err1 == nil && err2 == nil && b >= a && b-a < *flagQoSSmall
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+	"golang.org/x/net/webdav"
+)
+
+func TestIsInteractive(t *testing.T) {
+	root := t.TempDir()
+	os.WriteFile(filepath.Join(root, "small.txt"), []byte("hi"), 0644)
+	os.WriteFile(filepath.Join(root, "big.bin"), make([]byte, 2<<20), 0644)
+	fs := webdav.Dir(root)
+	tests := []struct {
+		method, path string
+		header       map[string]string
+		body         string
+		want         bool
+	}{
+		{"OPTIONS", "/", nil, "", true},
+		{"PROPFIND", "/", map[string]string{"Depth": "1"}, "", true},
+		{"PROPFIND", "/", map[string]string{"Depth": "infinity"}, "", false},
+		{"GET", "/", nil, "", true},
+		{"GET", "/small.txt", nil, "", true},
+		{"GET", "/big.bin", nil, "", false},
+		{"GET", "/big.bin", map[string]string{"Range": "bytes=0-4095"}, "", true},
+		{"GET", "/big.bin", map[string]string{"Range": "bytes=0-"}, "", false},
+		{"PUT", "/new.txt", nil, "small", true},
+		{"PUT", "/new.bin", nil, strings.Repeat("x", 2<<20), false},
+		{"COPY", "/small.txt", nil, "", false},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body))
+		for k, v := range tt.header {
+			req.Header.Set(k, v)
+		}
+		if got := isInteractive(fs, req); got != tt.want {
+			t.Errorf("%s %s %v: interactive = %v, want %v", tt.method, tt.path, tt.header, got, tt.want)
+		}
+	}
+}
+
+func TestPrioritySem(t *testing.T) {
+	s := newPrioritySem(4)
+	ctx := context.Background()
+	for i := 0; i < 3; i++ {
+		if err := s.acquire(ctx, false); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The last slot is kept for interactive requests.
+	short, cancel := context.WithTimeout(ctx, 20*time.Millisecond)
+	defer cancel()
+	if err := s.acquire(short, false); err == nil {
+		t.Fatal("bulk request took the reserved slot")
+	}
+	if err := s.acquire(ctx, true); err != nil {
+		t.Fatal(err)
+	}
+
+	// With every slot taken, a waiting interactive request goes first.
+	order := make(chan string, 2)
+	go func() {
+		s.acquire(ctx, false)
+		order <- "bulk"
+	}()
+	time.Sleep(10 * time.Millisecond)
+	go func() {
+		s.acquire(ctx, true)
+		order <- "interactive"
+	}()
+	time.Sleep(10 * time.Millisecond)
+	s.release(false)
+	if got := <-order; got != "interactive" {
+		t.Errorf("%s request was served first", got)
+	}
+	s.release(true)
+	if got := <-order; got != "bulk" {
+		t.Errorf("%s request was served second", got)
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strings"
+
+	"rsc.io/qr"
+)
+
+var flagQRCode = flag.Bool("qr", false, "print a QR code of the LAN url on startup")
+
+// lanIP returns the address of the interface that routes to the outside
+// world. No packets are sent; dialing UDP only selects a source address.
+// Without a default route it falls back to the first interface address,
+// preferring IPv4.
+func lanIP() (net.IP, error) {
+	if conn, err := net.Dial("udp", "8.8.8.8:80"); err == nil {
+		defer conn.Close()
+		if ip := conn.LocalAddr().(*net.UDPAddr).IP; !ip.IsLoopback() {
+			return ip, nil
+		}
+	}
+	ips := localIPs()
+	for _, ip := range ips {
+		if ip.To4() != nil {
+			return ip, nil
+		}
+	}
+	if len(ips) > 0 {
+		return ips[0], nil
+	}
+	return nil, errors.New("no LAN address found")
+}
+
+var findLANIP = lanIP
+
+// lanURL is serverURL with unspecified and loopback hosts replaced by the
+// primary interface address, so the URL works from other devices.
+func lanURL(addr net.Addr) string {
+	if tcp, ok := addr.(*net.TCPAddr); ok && tcp.IP != nil && !tcp.IP.IsUnspecified() && !tcp.IP.IsLoopback() {
+		return serverURL(addr, "")
+	}
+	ip, err := findLANIP()
+	if err != nil {
+		log.Printf("Warning: %v, QR code points at this host only", err)
+		return serverURL(addr, "")
+	}
+	return serverURL(addr, ip.String())
+}
+
+func printQRCode(w io.Writer, text string) error {
+	code, err := qr.Encode(text, qr.L)
+	if err != nil {
+		return err
+	}
+	const quiet = 2
+	black := func(x, y int) bool {
+		x, y = x-quiet, y-quiet
+		return x >= 0 && y >= 0 && x < code.Size && y < code.Size && code.Black(x, y)
+	}
+
+	var b strings.Builder
+	size := code.Size + 2*quiet
+	for y := 0; y < size; y += 2 {
+		b.WriteString("\x1b[30;47m")
+		for x := 0; x < size; x++ {
+			top, bottom := black(x, y), black(x, y+1)
+			switch {
+			case top && bottom:
+				b.WriteString("█")
+			case top:
+				b.WriteString("▀")
+			case bottom:
+				b.WriteString("▄")
+			default:
+				b.WriteString(" ")
+			}
+		}
+		b.WriteString("\x1b[0m\n")
+	}
+	_, err = fmt.Fprintf(w, "%s%s\n", b.String(), text)
+	return err
+}
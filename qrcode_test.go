@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"rsc.io/qr"
+)
+
+func TestLanURL(t *testing.T) {
+	tests := []struct {
+		name  string
+		addr  net.Addr
+		lanIP net.IP
+		err   error
+		want  string
+	}{
+		{"specific ip kept", &net.TCPAddr{IP: net.IPv4(10, 1, 2, 3), Port: 6086}, net.IPv4(192, 168, 0, 9), nil, "http://10.1.2.3:6086/"},
+		{"unspecified uses lan ip", &net.TCPAddr{IP: net.IPv4zero, Port: 6086}, net.IPv4(192, 168, 0, 9), nil, "http://192.168.0.9:6086/"},
+		{"loopback uses lan ip", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 6086}, net.IPv4(192, 168, 0, 9), nil, "http://192.168.0.9:6086/"},
+		{"v6 lan ip", &net.TCPAddr{IP: net.IPv6unspecified, Port: 6086}, net.ParseIP("2001:db8::2"), nil, "http://[2001:db8::2]:6086/"},
+		{"no lan ip", &net.TCPAddr{IP: net.IPv4zero, Port: 6086}, nil, errors.New("no LAN address found"), "http://localhost:6086/"},
+	}
+	defer func(f func() (net.IP, error)) { findLANIP = f }(findLANIP)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			findLANIP = func() (net.IP, error) { return tt.lanIP, tt.err }
+			if got := lanURL(tt.addr); got != tt.want {
+				t.Errorf("lanURL = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPrintQRCode(t *testing.T) {
+	tests := []string{
+		"http://192.168.0.9:6086/",
+		"https://[fe80::1%25eth0]:5005/",
+	}
+	for _, text := range tests {
+		t.Run(text, func(t *testing.T) {
+			code, err := qr.Encode(text, qr.L)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var buf bytes.Buffer
+			if err := printQRCode(&buf, text); err != nil {
+				t.Fatal(err)
+			}
+			lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+			if last := lines[len(lines)-1]; last != text {
+				t.Errorf("last line = %q, want %q", last, text)
+			}
+			rows := lines[:len(lines)-1]
+			size := code.Size + 4
+			if want := (size + 1) / 2; len(rows) != want {
+				t.Errorf("got %d rows, want %d", len(rows), want)
+			}
+			for i, row := range rows {
+				row = strings.TrimPrefix(row, "\x1b[30;47m")
+				row = strings.TrimSuffix(row, "\x1b[0m")
+				if n := utf8.RuneCountInString(row); n != size {
+					t.Errorf("row %d has %d modules, want %d", i, n, size)
+				}
+			}
+		})
+	}
+}
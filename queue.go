@@ -0,0 +1,275 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+var flagQueueWorkers = flag.Int("queue-workers", 2, "run at most this many heavy background tasks (zip downloads, manifests, async COPY, MOVE and DELETE, maintenance jobs) at once")
+
+// taskKeep is how long a finished task and its output are kept around.
+const taskKeep = time.Hour
+
+var errTaskCanceled = errors.New("canceled")
+
+// task is a unit of heavy work, such as a zip download or a maintenance
+// job, that waits for a slot in the queue before it runs.
+type task struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu     sync.Mutex
+	status taskStatus
+
+	// output holds the result of tasks run with Prefer: respond-async.
+	output      string
+	contentType string
+	filename    string
+}
+
+type taskStatus struct {
+	ID       string    `json:"id"`
+	Kind     string    `json:"kind"`
+	Name     string    `json:"name"`
+	State    string    `json:"state"`
+	Created  time.Time `json:"created"`
+	Started  time.Time `json:"started,omitempty"`
+	Finished time.Time `json:"finished,omitempty"`
+	Error    string    `json:"error,omitempty"`
+}
+
+func (t *task) state() taskStatus {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.status
+}
+
+// taskQueue limits how many tasks run at once and keeps their status for
+// the admin API.
+type taskQueue struct {
+	mu    sync.Mutex
+	slots chan struct{}
+	tasks map[string]*task
+}
+
+var queue = newTaskQueue(2)
+
+func newTaskQueue(workers int) *taskQueue {
+	if workers < 1 {
+		workers = 1
+	}
+	return &taskQueue{slots: make(chan struct{}, workers), tasks: make(map[string]*task)}
+}
+
+func startQueue() {
+	queue = newTaskQueue(*flagQueueWorkers)
+	handleAdmin("tasks", queue.serveAdmin)
+	onShutdown(queue.close)
+}
+
+// add registers a queued task whose context derives from parent.
+func (q *taskQueue) add(parent context.Context, kind, name string) *task {
+	var b [8]byte
+	rand.Read(b[:])
+	t := &task{status: taskStatus{ID: hex.EncodeToString(b[:]), Kind: kind, Name: name, State: "queued", Created: time.Now()}}
+	t.ctx, t.cancel = context.WithCancel(parent)
+
+	q.mu.Lock()
+	q.tasks[t.status.ID] = t
+	q.mu.Unlock()
+	return t
+}
+
+func (q *taskQueue) get(id string) *task {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.tasks[id]
+}
+
+// do waits for a free slot, runs fn and records how it went.
+func (q *taskQueue) do(t *task, fn func(ctx context.Context) error) error {
+	select {
+	case q.slots <- struct{}{}:
+	case <-t.ctx.Done():
+		q.finish(t, errTaskCanceled)
+		return t.ctx.Err()
+	}
+	defer func() { <-q.slots }()
+	t.mu.Lock()
+	t.status.State = "running"
+	t.status.Started = time.Now()
+	t.mu.Unlock()
+	err := fn(t.ctx)
+	if err != nil && t.ctx.Err() != nil {
+		err = errTaskCanceled
+	}
+	q.finish(t, err)
+	return err
+}
+
+func (q *taskQueue) finish(t *task, err error) {
+	t.cancel()
+	time.AfterFunc(taskKeep, func() { q.expire(t) })
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.status.Finished = time.Now()
+	switch {
+	case err == errTaskCanceled:
+		t.status.State = "canceled"
+	case err != nil:
+		t.status.State = "failed"
+		t.status.Error = err.Error()
+		log.Printf("Task %s %s failed: %v", t.status.Kind, t.status.Name, err)
+	default:
+		t.status.State = "done"
+	}
+}
+
+// run executes fn as a task of the request or job ctx belongs to, once a
+// slot is free.
+func (q *taskQueue) run(ctx context.Context, kind, name string, fn func(ctx context.Context) error) error {
+	return q.do(q.add(ctx, kind, name), fn)
+}
+
+// expire forgets a finished task and removes its output.
+func (q *taskQueue) expire(t *task) {
+	q.mu.Lock()
+	delete(q.tasks, t.status.ID)
+	q.mu.Unlock()
+	t.mu.Lock()
+	output := t.output
+	t.output = ""
+	t.mu.Unlock()
+	if output != "" {
+		os.Remove(output)
+	}
+}
+
+// close cancels every task and removes the outputs of finished ones;
+// running ones remove theirs as they fail.
+func (q *taskQueue) close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for _, t := range q.tasks {
+		t.cancel()
+		t.mu.Lock()
+		if !t.status.Finished.IsZero() && t.output != "" {
+			os.Remove(t.output)
+			t.output = ""
+		}
+		t.mu.Unlock()
+	}
+}
+
+func (q *taskQueue) status() []taskStatus {
+	q.mu.Lock()
+	st := make([]taskStatus, 0, len(q.tasks))
+	for _, t := range q.tasks {
+		st = append(st, t.state())
+	}
+	q.mu.Unlock()
+	sort.Slice(st, func(i, j int) bool { return st[i].Created.Before(st[j].Created) })
+	return st
+}
+
+// serveAdmin lists the tasks on GET; POST ?cancel=id stops one.
+func (q *taskQueue) serveAdmin(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case "GET":
+		writeJSON(w, http.StatusOK, q.status())
+	case "POST":
+		t := q.get(req.URL.Query().Get("cancel"))
+		if t == nil {
+			http.Error(w, "unknown task", http.StatusNotFound)
+			return
+		}
+		t.cancel()
+		w.WriteHeader(http.StatusAccepted)
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// serveTaskOutput answers req with what write produces, as a queued task.
+// With Prefer: respond-async the output goes to a temporary file and the
+// client gets 202 Accepted and a ?task= URL to fetch it from; otherwise it
+// is streamed once the task gets its slot.
+func serveTaskOutput(w http.ResponseWriter, req *http.Request, kind, filename, contentType string, write func(ctx context.Context, w io.Writer) error) {
+	if !prefersAsync(req) {
+		w.Header().Set("Content-Type", contentType)
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, filename))
+		queue.run(req.Context(), kind, req.URL.Path, func(ctx context.Context) error {
+			return write(ctx, w)
+		})
+		return
+	}
+
+	t := queue.add(context.Background(), kind, req.URL.Path)
+	t.contentType, t.filename = contentType, filename
+	go queue.do(t, func(ctx context.Context) error {
+		f, err := os.CreateTemp("", "gowebdav-task-*")
+		if err != nil {
+			return err
+		}
+		t.mu.Lock()
+		t.output = f.Name()
+		t.mu.Unlock()
+		if err := write(ctx, f); err != nil {
+			f.Close()
+			os.Remove(f.Name())
+			return err
+		}
+		return f.Close()
+	})
+	w.Header().Set("Location", (&url.URL{Path: req.URL.Path, RawQuery: "task=" + t.status.ID}).String())
+	w.Header().Set("Preference-Applied", "respond-async")
+	writeJSON(w, http.StatusAccepted, t.state())
+}
+
+// handleTaskOutput serves the output of a finished ?task=, or its status
+// while it is still queued or running.
+func handleTaskOutput(w http.ResponseWriter, req *http.Request, id string) {
+	t := queue.get(id)
+	if t == nil {
+		http.Error(w, "Not Found", http.StatusNotFound)
+		return
+	}
+	s := t.state()
+	switch s.State {
+	case "queued", "running":
+		writeJSON(w, http.StatusAccepted, s)
+		return
+	case "failed":
+		writeJSON(w, http.StatusInternalServerError, s)
+		return
+	case "canceled":
+		writeJSON(w, http.StatusGone, s)
+		return
+	}
+	t.mu.Lock()
+	output := t.output
+	t.mu.Unlock()
+	f, err := os.Open(output)
+	if err != nil {
+		http.Error(w, "Not Found", http.StatusNotFound)
+		return
+	}
+	defer f.Close()
+	w.Header().Set("Content-Type", t.contentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, t.filename))
+	http.ServeContent(w, req, "", s.Finished, f)
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+	"golang.org/x/net/webdav"
+)
+
+func TestTaskQueueLimit(t *testing.T) {
+	q := newTaskQueue(1)
+	started := make(chan struct{})
+	release := make(chan struct{})
+	go q.run(context.Background(), "test", "first", func(ctx context.Context) error {
+		close(started)
+		<-release
+		return nil
+	})
+	<-started
+
+	second := q.add(context.Background(), "test", "second")
+	done := make(chan error)
+	go func() { done <- q.do(second, func(ctx context.Context) error { return nil }) }()
+	time.Sleep(20 * time.Millisecond)
+	if s := second.state(); s.State != "queued" {
+		t.Errorf("second task is %s while the only slot is taken", s.State)
+	}
+	close(release)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if s := second.state(); s.State != "done" {
+		t.Errorf("second task is %s, want done", s.State)
+	}
+}
+
+func TestTaskQueueCancel(t *testing.T) {
+	q := newTaskQueue(1)
+	tk := q.add(context.Background(), "test", "slow")
+	done := make(chan error)
+	go func() {
+		done <- q.do(tk, func(ctx context.Context) error {
+			<-ctx.Done()
+			return ctx.Err()
+		})
+	}()
+
+	rec := httptest.NewRecorder()
+	q.serveAdmin(rec, httptest.NewRequest("POST", "/tasks?cancel="+tk.state().ID, nil))
+	if rec.Code != http.StatusAccepted {
+		t.Fatalf("cancel status = %d", rec.Code)
+	}
+	<-done
+	if s := tk.state(); s.State != "canceled" {
+		t.Errorf("task is %s, want canceled", s.State)
+	}
+
+	rec = httptest.NewRecorder()
+	q.serveAdmin(rec, httptest.NewRequest("POST", "/tasks?cancel=nope", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("cancel of unknown task: status %d", rec.Code)
+	}
+}
+
+func TestZipTask(t *testing.T) {
+	defer func(q *taskQueue) { queue = q }(queue)
+	queue = newTaskQueue(1)
+	root := t.TempDir()
+	os.MkdirAll(filepath.Join(root, "docs", "sub"), 0755)
+	os.WriteFile(filepath.Join(root, "docs", "a.txt"), []byte("alpha"), 0644)
+	os.WriteFile(filepath.Join(root, "docs", "sub", "b.txt"), []byte("beta"), 0644)
+	os.WriteFile(filepath.Join(root, "docs", ".hidden"), []byte("secret"), 0644)
+	fs := webdav.Dir(root)
+
+	check := func(t *testing.T, data []byte) {
+		t.Helper()
+		zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := make(map[string]string)
+		for _, f := range zr.File {
+			rc, _ := f.Open()
+			b, _ := io.ReadAll(rc)
+			rc.Close()
+			got[f.Name] = string(b)
+		}
+		if len(got) != 2 || got["a.txt"] != "alpha" || got["sub/b.txt"] != "beta" {
+			t.Errorf("zip holds %v", got)
+		}
+	}
+
+	t.Run("streamed", func(t *testing.T) {
+		rec := httptest.NewRecorder()
+		handleZip(fs, rec, httptest.NewRequest("GET", "/docs/?zip=1", nil), "/docs/")
+		if cd := rec.Header().Get("Content-Disposition"); !strings.Contains(cd, "docs.zip") {
+			t.Errorf("Content-Disposition = %q", cd)
+		}
+		check(t, rec.Body.Bytes())
+	})
+
+	t.Run("async", func(t *testing.T) {
+		req := httptest.NewRequest("GET", "/docs/?zip=1", nil)
+		req.Header.Set("Prefer", "respond-async")
+		rec := httptest.NewRecorder()
+		handleZip(fs, rec, req, "/docs/")
+		if rec.Code != http.StatusAccepted {
+			t.Fatalf("status = %d", rec.Code)
+		}
+		loc := rec.Header().Get("Location")
+		id := loc[strings.Index(loc, "task=")+len("task="):]
+		for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+			rec = httptest.NewRecorder()
+			handleTaskOutput(rec, httptest.NewRequest("GET", loc, nil), id)
+			if rec.Code != http.StatusAccepted {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatal("task did not finish")
+			}
+		}
+		if rec.Code != http.StatusOK {
+			t.Fatalf("output status = %d: %s", rec.Code, rec.Body)
+		}
+		check(t, rec.Body.Bytes())
+	})
+
+	if st := queue.status(); len(st) != 2 || st[0].Kind != "zip" || st[0].State != "done" {
+		t.Errorf("queue status = %+v", st)
+	}
+}
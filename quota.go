@@ -0,0 +1,125 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"html"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/webdav"
+)
+
+var (
+	flagQuota     = flag.String("quota", "", "storage limit of the served dir, e.g. 50GiB; uploads past it get 507 Insufficient Storage (no limit when empty)")
+	flagQuotaWarn = flag.String("quota-warn", "80,95", "comma-separated usage percentages of -quota that show a warning in listings and notify")
+)
+
+// quotaCheckInterval is how often usage is compared with the thresholds.
+const quotaCheckInterval = 30 * time.Second
+
+// storageQuota tracks usage of the served dir against -quota.
+type storageQuota struct {
+	limit      int64
+	thresholds []int // ascending percentages
+
+	mu    sync.Mutex
+	used  int64
+	level int // highest threshold crossed, 0 for none
+}
+
+var quota *storageQuota
+
+func startQuota() error {
+	limit, err := parseByteSize(*flagQuota)
+	if err != nil {
+		return err
+	}
+	if limit <= 0 {
+		return fmt.Errorf("%q is not a positive size", *flagQuota)
+	}
+	q := &storageQuota{limit: limit}
+	for _, s := range strings.Split(*flagQuotaWarn, ",") {
+		if s = strings.TrimSuffix(strings.TrimSpace(s), "%"); s == "" {
+			continue
+		}
+		pct, err := strconv.Atoi(s)
+		if err != nil || pct <= 0 || pct > 100 {
+			return fmt.Errorf("invalid -quota-warn percentage %q", s)
+		}
+		q.thresholds = append(q.thresholds, pct)
+	}
+	sort.Ints(q.thresholds)
+	// Usage comes from the directory size cache, kept current by watching
+	// the tree.
+	if dirSizes == nil {
+		if err := startDirSizes(); err != nil {
+			return err
+		}
+	}
+	quota = q
+	go func() {
+		for {
+			if used, ok := dirSize("/"); ok {
+				q.update(used)
+			}
+			time.Sleep(quotaCheckInterval)
+		}
+	}()
+	return nil
+}
+
+// update records the usage and notifies when it crosses a higher
+// threshold. Dropping below a threshold rearms it.
+func (q *storageQuota) update(used int64) {
+	q.mu.Lock()
+	q.used = used
+	level := 0
+	for _, t := range q.thresholds {
+		if used*100 >= int64(t)*q.limit {
+			level = t
+		}
+	}
+	crossed := level > q.level
+	q.level = level
+	q.mu.Unlock()
+	if crossed {
+		msg := fmt.Sprintf("Storage is %d%% full: %s of %s used", used*100/q.limit, formatSize(used), formatSize(q.limit))
+		log.Print(msg)
+		notify(notifyEvent{Kind: "quota", Message: msg})
+	}
+}
+
+// rejectOverQuota answers 507 to uploads that would take usage past the
+// quota, and reports whether it did.
+func rejectOverQuota(fs webdav.FileSystem, w http.ResponseWriter, req *http.Request) bool {
+	if req.Method != "PUT" || checkQuota(req.Context(), fs, req.URL.Path, req.ContentLength) == nil {
+		return false
+	}
+	quota.mu.Lock()
+	used := quota.used
+	quota.mu.Unlock()
+	http.Error(w, fmt.Sprintf("WebDAV: quota exceeded, %s of %s used", formatSize(used), formatSize(quota.limit)), http.StatusInsufficientStorage)
+	return true
+}
+
+// quotaBanner returns the warning shown above listings once usage has
+// crossed a threshold.
+func quotaBanner() string {
+	if quota == nil {
+		return ""
+	}
+	quota.mu.Lock()
+	used, level := quota.used, quota.level
+	quota.mu.Unlock()
+	if level == 0 {
+		return ""
+	}
+	return fmt.Sprintf(`<div class="quota-warning" role="alert">%s</div>`, html.EscapeString(fmt.Sprintf(
+		"Storage is %d%% full: %s of %s used.", used*100/quota.limit, formatSize(used), formatSize(quota.limit))))
+}
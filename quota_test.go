@@ -0,0 +1,109 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/context"
+	"golang.org/x/net/webdav"
+)
+
+func TestQuota(t *testing.T) {
+	root := t.TempDir()
+	os.WriteFile(filepath.Join(root, "a.bin"), make([]byte, 700), 0644)
+	defer func(c *dirSizeCache, q *storageQuota) { dirSizes, quota = c, q }(dirSizes, quota)
+	dirSizes = &dirSizeCache{root: root, sizes: make(map[string]int64)}
+	quota = &storageQuota{limit: 1000, thresholds: []int{80, 95}}
+	f := &fakeNotifier{}
+	withNotifier(t, f)
+	fs := webdav.Dir(root)
+
+	put := func(p string, size int) int {
+		req := httptest.NewRequest("PUT", p, strings.NewReader(strings.Repeat("x", size)))
+		w := httptest.NewRecorder()
+		if !rejectOverQuota(fs, w, req) {
+			return http.StatusCreated
+		}
+		return w.Code
+	}
+	if code := put("/b.bin", 200); code != http.StatusCreated {
+		t.Errorf("upload under the quota answered %d", code)
+	}
+	if quotaBanner() != "" {
+		t.Error("banner shown below the thresholds")
+	}
+	if code := put("/b.bin", 400); code != http.StatusInsufficientStorage {
+		t.Errorf("upload past the quota answered %d", code)
+	}
+	// Replacing a file only needs room for the difference.
+	if code := put("/a.bin", 900); code != http.StatusCreated {
+		t.Errorf("overwrite within the quota answered %d", code)
+	}
+
+	quota.update(850)
+	quota.update(860)
+	if b := quotaBanner(); !strings.Contains(b, "Storage is 86% full") {
+		t.Errorf("banner = %q", b)
+	}
+	quota.update(990)
+	quota.update(500)
+	quota.update(820)
+	flushNotifications()
+	var got []string
+	for _, b := range f.batches {
+		for _, ev := range b {
+			if ev.Kind != "quota" {
+				t.Errorf("unexpected event %+v", ev)
+			}
+			got = append(got, ev.Message)
+		}
+	}
+	want := []string{
+		"Storage is 85% full: 850 B of 1000 B used",
+		"Storage is 99% full: 990 B of 1000 B used",
+		"Storage is 82% full: 820 B of 1000 B used",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("notified:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestQuotaFS(t *testing.T) {
+	root := t.TempDir()
+	os.WriteFile(filepath.Join(root, "a.bin"), make([]byte, 700), 0644)
+	defer func(c *dirSizeCache, q *storageQuota) { dirSizes, quota = c, q }(dirSizes, quota)
+	dirSizes = &dirSizeCache{root: root, sizes: make(map[string]int64)}
+	quota = &storageQuota{limit: 1000}
+	fs := quotaFS{webdav.Dir(root)}
+
+	write := func(name string, flag int, size int) error {
+		dirSizes.invalidate("/")
+		f, err := fs.OpenFile(context.Background(), name, flag, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		_, err = f.Write(make([]byte, size))
+		return err
+	}
+	if err := write("/b.bin", os.O_WRONLY|os.O_CREATE, 300); err != nil {
+		t.Errorf("write up to the quota: %v", err)
+	}
+	if err := write("/c.bin", os.O_WRONLY|os.O_CREATE, 1); err != errQuotaExceeded {
+		t.Errorf("write past the quota: %v", err)
+	}
+	// Rewriting or truncating a file reuses its room.
+	if err := write("/a.bin", os.O_WRONLY, 700); err != nil {
+		t.Errorf("rewrite in place: %v", err)
+	}
+	if err := write("/a.bin", os.O_WRONLY|os.O_APPEND, 1); err != errQuotaExceeded {
+		t.Errorf("append past the quota: %v", err)
+	}
+	if err := write("/a.bin", os.O_WRONLY|os.O_TRUNC, 700); err != nil {
+		t.Errorf("overwrite: %v", err)
+	}
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"bytes"
+	"container/heap"
+	"fmt"
+	"html"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"golang.org/x/net/context"
+	"golang.org/x/net/webdav"
+)
+
+// readdirBatch is how many entries are read from a directory at a time, so
+// giant directories are never held in memory whole.
+const readdirBatch = 512
+
+// readdirBatches calls fn with the entries of dir, at most readdirBatch at a
+// time, until the directory is exhausted or fn fails.
+func readdirBatches(dir webdav.File, fn func([]os.FileInfo) error) error {
+	for {
+		fis, err := dir.Readdir(readdirBatch)
+		if len(fis) > 0 {
+			if err := fn(fis); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF || err == nil && len(fis) == 0 {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// visibleEntry reports whether a directory entry is shown, which hidden ones
+// are only with -show-hidden.
+func visibleEntry(fi os.FileInfo) bool {
+	return *flagShowHidden || !strings.HasPrefix(fi.Name(), ".")
+}
+
+// entryHeap keeps the entries with the largest keys on top, so the smallest
+// ones seen so far can be kept by popping whatever overflows the page.
+type entryHeap struct {
+	fis []os.FileInfo
+	key func(os.FileInfo) string
+}
+
+func (h *entryHeap) Len() int           { return len(h.fis) }
+func (h *entryHeap) Less(i, j int) bool { return h.key(h.fis[i]) > h.key(h.fis[j]) }
+func (h *entryHeap) Swap(i, j int)      { h.fis[i], h.fis[j] = h.fis[j], h.fis[i] }
+func (h *entryHeap) Push(x interface{}) { h.fis = append(h.fis, x.(os.FileInfo)) }
+func (h *entryHeap) Pop() interface{} {
+	fi := h.fis[len(h.fis)-1]
+	h.fis = h.fis[:len(h.fis)-1]
+	return fi
+}
+
+// firstEntries returns the first limit entries of dir that keep accepts and
+// whose key sorts after the key after, in key order, and whether more
+// follow. The directory is read in batches and no more than limit+1
+// entries are held at any time, however large it is.
+func firstEntries(dir webdav.File, after string, limit int, key func(os.FileInfo) string, keep func(os.FileInfo) bool) ([]os.FileInfo, bool, error) {
+	h := &entryHeap{fis: make([]os.FileInfo, 0, limit+1), key: key}
+	more := false
+	err := readdirBatches(dir, func(fis []os.FileInfo) error {
+		for _, fi := range fis {
+			if !keep(fi) || after != "" && key(fi) <= after {
+				continue
+			}
+			heap.Push(h, fi)
+			if h.Len() > limit {
+				heap.Pop(h)
+				more = true
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	page := h.fis
+	sort.Slice(page, func(i, j int) bool { return key(page[i]) < key(page[j]) })
+	return page, more, nil
+}
+
+// readdirPage opens the directory name and returns its first limit entries
+// after the key after, as firstEntries does.
+func readdirPage(ctx context.Context, fs webdav.FileSystem, name, after string, limit int, key func(os.FileInfo) string, keep func(os.FileInfo) bool) ([]os.FileInfo, bool, error) {
+	f, err := fs.OpenFile(ctx, name, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, false, err
+	}
+	defer f.Close()
+	return firstEntries(f, after, limit, key, keep)
+}
+
+// readdirSorted calls fn for the entries of the directory name that keep
+// accepts, in key order. It reads the directory once per readdirBatch
+// entries rather than holding it all to sort it, and fn runs with the
+// directory closed, so walks may recurse as deep as the tree goes.
+func readdirSorted(ctx context.Context, fs webdav.FileSystem, name string, key func(os.FileInfo) string, keep func(os.FileInfo) bool, fn func(os.FileInfo) error) error {
+	after := ""
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		page, more, err := readdirPage(ctx, fs, name, after, readdirBatch, key, keep)
+		if err != nil {
+			return err
+		}
+		for _, fi := range page {
+			if err := fn(fi); err != nil {
+				return err
+			}
+		}
+		if !more || len(page) == 0 {
+			return nil
+		}
+		after = key(page[len(page)-1])
+	}
+}
+
+// subResponse buffers the response of a request served on behalf of another.
+type subResponse struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (r *subResponse) Header() http.Header         { return r.header }
+func (r *subResponse) Write(p []byte) (int, error) { return r.body.Write(p) }
+func (r *subResponse) WriteHeader(status int)      { r.status = status }
+
+const multistatusOpen = `<D:multistatus xmlns:D="DAV:">`
+
+// propfindResponses runs a Depth: 0 PROPFIND for name through h and returns
+// the <D:response> elements of its multistatus body.
+func propfindResponses(h *webdav.Handler, req *http.Request, body []byte, name string) []byte {
+	sub := req.Clone(req.Context())
+	sub.URL.Path, sub.URL.RawPath = name, ""
+	sub.Header.Set("Depth", "0")
+	sub.Body = io.NopCloser(bytes.NewReader(body))
+	sub.ContentLength = int64(len(body))
+	rec := &subResponse{header: make(http.Header), status: http.StatusOK}
+	h.ServeHTTP(rec, sub)
+	if rec.status != webdav.StatusMulti {
+		return nil
+	}
+	out := rec.body.Bytes()
+	i := bytes.Index(out, []byte(multistatusOpen))
+	j := bytes.LastIndex(out, []byte("</D:multistatus>"))
+	if i < 0 || j < i {
+		return nil
+	}
+	return out[i+len(multistatusOpen) : j]
+}
+
+// handlePropfindStream answers Depth: 1 PROPFINDs on large directories one
+// batch of members at a time. webdav.Handler reads the whole directory
+// before writing anything, so each member is looked up with a Depth: 0
+// PROPFIND of its own and the answers are spliced into one multistatus as
+// they come. Past -propfind-limit members the response is cut short with a
+// 507 for the directory itself. Directories that fit in a single batch and
+// under the limit, and every other request, are left to h and reported as
+// not handled.
+func handlePropfindStream(h *webdav.Handler, w http.ResponseWriter, req *http.Request) bool {
+	if req.Method != "PROPFIND" || req.Header.Get("Depth") != "1" {
+		return false
+	}
+	ctx := req.Context()
+	dir := path.Clean("/" + req.URL.Path)
+	f, err := h.FileSystem.OpenFile(ctx, dir, os.O_RDONLY, 0)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	if fi, err := f.Stat(); err != nil || !fi.IsDir() {
+		return false
+	}
+	limit := *flagPropfindLimit
+	first, err := f.Readdir(readdirBatch)
+	if err != nil || len(first) < readdirBatch && (limit <= 0 || len(first) <= limit) {
+		return false
+	}
+	body, err := io.ReadAll(io.LimitReader(req.Body, 1<<20))
+	if err != nil {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return true
+	}
+
+	w.Header().Set("Content-Type", "text/xml; charset=utf-8")
+	w.WriteHeader(webdav.StatusMulti)
+	io.WriteString(w, `<?xml version="1.0" encoding="UTF-8"?>`+multistatusOpen)
+	w.Write(propfindResponses(h, req, body, dir))
+	flusher, _ := w.(http.Flusher)
+	members := 0
+	write := func(fis []os.FileInfo) error {
+		for _, fi := range fis {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			if members++; limit > 0 && members > limit {
+				return errTruncated
+			}
+			if _, err := w.Write(propfindResponses(h, req, body, path.Join(dir, fi.Name()))); err != nil {
+				return err
+			}
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+		return nil
+	}
+	err = write(first)
+	if err == nil {
+		err = readdirBatches(f, write)
+	}
+	if err == errTruncated {
+		href := dir
+		if href != "/" {
+			href += "/"
+		}
+		fmt.Fprintf(w, `<D:response><D:href>%s</D:href><D:status>HTTP/1.1 507 Insufficient Storage</D:status><D:error><D:number-of-matches-within-limits/></D:error></D:response>`,
+			html.EscapeString((&url.URL{Path: href}).EscapedPath()))
+	} else if err != nil && ctx.Err() == nil {
+		log.Printf("Failed to read directory %s: %v", dir, err)
+	}
+	io.WriteString(w, "</D:multistatus>")
+	return true
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/context"
+	"golang.org/x/net/webdav"
+)
+
+func TestReaddirBatches(t *testing.T) {
+	root := t.TempDir()
+	n := readdirBatch*2 + 7
+	for i := 0; i < n; i++ {
+		os.WriteFile(filepath.Join(root, fmt.Sprintf("f%04d", i)), nil, 0644)
+	}
+	f, err := os.Open(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var batches, total int
+	err = readdirBatches(f, func(fis []os.FileInfo) error {
+		if len(fis) > readdirBatch {
+			t.Errorf("batch of %d entries", len(fis))
+		}
+		batches++
+		total += len(fis)
+		return nil
+	})
+	if err != nil || batches != 3 || total != n {
+		t.Errorf("got %d batches, %d entries, err %v; want 3, %d", batches, total, err, n)
+	}
+}
+
+func TestReaddirSorted(t *testing.T) {
+	root := t.TempDir()
+	n := readdirBatch*2 + 7
+	for i := n - 1; i >= 0; i-- {
+		os.WriteFile(filepath.Join(root, fmt.Sprintf("f%04d", i)), nil, 0644)
+	}
+	os.WriteFile(filepath.Join(root, ".hidden"), nil, 0644)
+	var names []string
+	err := readdirSorted(context.Background(), webdav.Dir(root), "/", os.FileInfo.Name, visibleEntry, func(fi os.FileInfo) error {
+		names = append(names, fi.Name())
+		return nil
+	})
+	if err != nil || len(names) != n {
+		t.Fatalf("got %d entries, err %v; want %d", len(names), err, n)
+	}
+	for i, name := range names {
+		if want := fmt.Sprintf("f%04d", i); name != want {
+			t.Fatalf("entry %d is %s, want %s", i, name, want)
+		}
+	}
+}
+
+func TestPropfindStream(t *testing.T) {
+	root := t.TempDir()
+	for _, dir := range []string{"small", "big"} {
+		os.Mkdir(filepath.Join(root, dir), 0755)
+	}
+	os.WriteFile(filepath.Join(root, "small", "a.txt"), []byte("a"), 0644)
+	n := readdirBatch + 10
+	for i := 0; i < n; i++ {
+		os.WriteFile(filepath.Join(root, "big", fmt.Sprintf("f%04d.txt", i)), []byte("x"), 0644)
+	}
+	os.Mkdir(filepath.Join(root, "big", "sub dir"), 0755)
+	h := &webdav.Handler{FileSystem: SkipBrokenLink{webdav.Dir(root)}, LockSystem: webdav.NewMemLS()}
+
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest("PROPFIND", "/small/", nil)
+	req.Header.Set("Depth", "1")
+	if handlePropfindStream(h, rec, req) {
+		t.Error("small directory was streamed")
+	}
+
+	rec = httptest.NewRecorder()
+	req = httptest.NewRequest("PROPFIND", "/big/", strings.NewReader(`<?xml version="1.0"?><D:propfind xmlns:D="DAV:"><D:prop><D:getcontentlength/><D:resourcetype/></D:prop></D:propfind>`))
+	req.Header.Set("Depth", "1")
+	if !handlePropfindStream(h, rec, req) {
+		t.Fatal("big directory was not streamed")
+	}
+	if rec.Code != webdav.StatusMulti {
+		t.Fatalf("status = %d", rec.Code)
+	}
+	var ms struct {
+		Responses []struct {
+			Href   string `xml:"href"`
+			Length string `xml:"propstat>prop>getcontentlength"`
+		} `xml:"response"`
+	}
+	if err := xml.Unmarshal(rec.Body.Bytes(), &ms); err != nil {
+		t.Fatalf("bad multistatus: %v", err)
+	}
+	if len(ms.Responses) != n+2 {
+		t.Fatalf("got %d responses, want %d", len(ms.Responses), n+2)
+	}
+	hrefs := make(map[string]string)
+	for _, r := range ms.Responses {
+		hrefs[r.Href] = r.Length
+	}
+	if _, ok := hrefs["/big/"]; !ok {
+		t.Error("no response for the directory itself")
+	}
+	if _, ok := hrefs["/big/sub%20dir/"]; !ok {
+		t.Error("no response for the subdirectory")
+	}
+	if l := hrefs["/big/f0000.txt"]; l != "1" {
+		t.Errorf("getcontentlength of f0000.txt = %q, want 1", l)
+	}
+}
+
+func TestDirListBatches(t *testing.T) {
+	root := t.TempDir()
+	n := readdirBatch + 10
+	for i := 0; i < n; i++ {
+		os.WriteFile(filepath.Join(root, fmt.Sprintf("f%04d", i)), nil, 0644)
+	}
+	rec := httptest.NewRecorder()
+	if !handleDirList(webdav.Dir(root), rec, httptest.NewRequest("GET", "/", nil)) {
+		t.Fatal("listing not handled")
+	}
+	if got := strings.Count(rec.Body.String(), `data-name="f`); got != n {
+		t.Errorf("listing has %d rows, want %d", got, n)
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/webdav"
+)
+
+func TestRecordAndReplay(t *testing.T) {
+	dir := t.TempDir()
+	r := &sessionRecorder{dir: dir, maxBody: 1 << 10, files: make(map[string]*os.File)}
+	defer r.close()
+	h := &webdav.Handler{FileSystem: webdav.Dir(t.TempDir()), LockSystem: webdav.NewMemLS()}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w, req, done := r.record(w, req)
+		defer done()
+		h.ServeHTTP(w, req)
+	}))
+	defer srv.Close()
+
+	send := func(method, p, body string) {
+		req, _ := http.NewRequest(method, srv.URL+p, strings.NewReader(body))
+		req.SetBasicAuth("alice", "secret")
+		if method == "COPY" {
+			req.Header.Set("Destination", srv.URL+"/copy.txt")
+		}
+		resp, err := srv.Client().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+	send("MKCOL", "/docs", "")
+	send("PUT", "/docs/a.txt", "hello")
+	send("PUT", "/big.bin", strings.Repeat("x", 2<<10))
+	send("COPY", "/docs/a.txt", "")
+	send("GET", "/docs/a.txt", "")
+	r.close()
+
+	files, _ := filepath.Glob(filepath.Join(dir, "*.jsonl"))
+	if len(files) != 1 {
+		t.Fatalf("%d session files, want 1", len(files))
+	}
+	data, _ := os.ReadFile(files[0])
+	if bytes.Contains(data, []byte("Basic ")) {
+		t.Error("credentials were recorded")
+	}
+
+	// A fresh server answers the same way.
+	h2 := &webdav.Handler{FileSystem: webdav.Dir(t.TempDir()), LockSystem: webdav.NewMemLS()}
+	srv2 := httptest.NewServer(h2)
+	defer srv2.Close()
+	base, _ := url.Parse(srv2.URL)
+	var out bytes.Buffer
+	n, err := replaySession(bytes.NewReader(data), base, srv2.Client(), true, &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 0 {
+		t.Errorf("%d requests differed:\n%s", n, out.String())
+	}
+	if !strings.Contains(out.String(), "4 requests replayed, 0 differed, 1 skipped") {
+		t.Errorf("unexpected summary:\n%s", out.String())
+	}
+
+	// Replaying against a server in another state reports the difference.
+	out.Reset()
+	n, _ = replaySession(bytes.NewReader(data), base, srv2.Client(), false, &out)
+	if n == 0 || !strings.Contains(out.String(), "MKCOL /docs: status 405, recorded 201") {
+		t.Errorf("difference not reported:\n%s", out.String())
+	}
+}
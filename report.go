@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"strings"
+	"time"
+)
+
+var flagErrorReport = flag.String("error-report", "", "report panics and 5xx responses to this Sentry DSN (https://key@host/project), or POST them as JSON to any other URL")
+
+// errorReport describes a panic or a 5xx response. It is the JSON body of
+// generic reports; Sentry gets it converted to an event.
+type errorReport struct {
+	Time    time.Time         `json:"time"`
+	Message string            `json:"message"`
+	Panic   bool              `json:"panic,omitempty"`
+	Stack   string            `json:"stack,omitempty"`
+	Method  string            `json:"method"`
+	URL     string            `json:"url"`
+	Headers map[string]string `json:"headers,omitempty"`
+	Status  int               `json:"status"`
+	Host    string            `json:"host"`
+
+	frames []runtime.Frame
+}
+
+// errorReporter sends reports in the background, dropping them when the
+// endpoint cannot keep up rather than slowing requests down.
+type errorReporter struct {
+	endpoint string
+	sentry   *url.URL
+	client   *http.Client
+	queue    chan *errorReport
+}
+
+var reporter *errorReporter
+
+func startErrorReporter() error {
+	u, err := url.Parse(*flagErrorReport)
+	if err != nil || u.Host == "" {
+		return fmt.Errorf("invalid URL %q", *flagErrorReport)
+	}
+	r := &errorReporter{endpoint: u.String(), client: &http.Client{Timeout: 10 * time.Second}, queue: make(chan *errorReport, 64)}
+	if u.User != nil && u.User.Username() != "" {
+		project := strings.Trim(u.Path, "/")
+		if project == "" {
+			return fmt.Errorf("Sentry DSN %q has no project", *flagErrorReport)
+		}
+		r.sentry = u
+		r.endpoint = (&url.URL{Scheme: u.Scheme, Host: u.Host, Path: "/api/" + project + "/store/"}).String()
+	}
+	reporter = r
+	go r.run()
+	return nil
+}
+
+func (r *errorReporter) report(rep *errorReport) {
+	select {
+	case r.queue <- rep:
+	default:
+		log.Printf("Error report queue full, dropping: %s", rep.Message)
+	}
+}
+
+func (r *errorReporter) run() {
+	for rep := range r.queue {
+		if err := r.send(rep); err != nil {
+			log.Printf("Failed to send error report: %v", err)
+		}
+	}
+}
+
+func (r *errorReporter) send(rep *errorReport) error {
+	var body interface{} = rep
+	if r.sentry != nil {
+		body = rep.sentryEvent()
+	}
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", r.endpoint, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if r.sentry != nil {
+		req.Header.Set("X-Sentry-Auth", "Sentry sentry_version=7, sentry_client=gowebdav/1.0, sentry_key="+r.sentry.User.Username())
+	}
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("%s answered %s", r.endpoint, resp.Status)
+	}
+	return nil
+}
+
+// sentryEvent converts the report to a Sentry store API event.
+func (rep *errorReport) sentryEvent() map[string]interface{} {
+	var id [16]byte
+	rand.Read(id[:])
+	event := map[string]interface{}{
+		"event_id":    hex.EncodeToString(id[:]),
+		"timestamp":   rep.Time.UTC().Format(time.RFC3339),
+		"level":       "error",
+		"platform":    "go",
+		"server_name": rep.Host,
+		"message":     rep.Message,
+		"request": map[string]interface{}{
+			"method":  rep.Method,
+			"url":     rep.URL,
+			"headers": rep.Headers,
+		},
+		"tags": map[string]string{"status": fmt.Sprint(rep.Status)},
+	}
+	if rep.Panic {
+		// Sentry lists frames from the outermost call in.
+		frames := make([]map[string]interface{}, 0, len(rep.frames))
+		for i := len(rep.frames) - 1; i >= 0; i-- {
+			f := rep.frames[i]
+			frames = append(frames, map[string]interface{}{"function": f.Function, "filename": f.File, "lineno": f.Line})
+		}
+		event["exception"] = map[string]interface{}{
+			"values": []map[string]interface{}{{
+				"type":       "panic",
+				"value":      rep.Message,
+				"stacktrace": map[string]interface{}{"frames": frames},
+			}},
+		}
+	}
+	return event
+}
+
+// newErrorReport describes req; credentials are left out of its headers.
+func newErrorReport(req *http.Request, status int, message string) *errorReport {
+	host, _ := os.Hostname()
+	rep := &errorReport{
+		Time:    time.Now(),
+		Message: message,
+		Method:  req.Method,
+		URL:     req.URL.String(),
+		Headers: make(map[string]string),
+		Status:  status,
+		Host:    host,
+	}
+	for k := range req.Header {
+		switch k {
+		case "Authorization", "Cookie":
+			rep.Headers[k] = "[redacted]"
+		default:
+			rep.Headers[k] = req.Header.Get(k)
+		}
+	}
+	return rep
+}
+
+// recoverPanics keeps a panicking request from taking the process down:
+// it logs the stack and answers 500 if nothing was sent yet. Panics and 5xx
+// responses are reported when -error-report is set.
+func recoverPanics(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		sw := &statusWriter{ResponseWriter: w}
+		defer func() {
+			p := recover()
+			if p == nil {
+				if sw.status >= 500 && reporter != nil {
+					msg := fmt.Sprintf("%s %s: %d %s", req.Method, req.URL.Path, sw.status, http.StatusText(sw.status))
+					reporter.report(newErrorReport(req, sw.status, msg))
+				}
+				return
+			}
+			if p == http.ErrAbortHandler {
+				panic(p)
+			}
+			stack := debug.Stack()
+			log.Printf("Panic serving %s %s: %v\n%s", req.Method, req.URL.Path, p, stack)
+			if sw.status == 0 {
+				http.Error(sw, "Internal Server Error", http.StatusInternalServerError)
+			}
+			if reporter != nil {
+				rep := newErrorReport(req, http.StatusInternalServerError, fmt.Sprint(p))
+				rep.Panic, rep.Stack, rep.frames = true, string(stack), callers()
+				reporter.report(rep)
+			}
+		}()
+		h.ServeHTTP(sw, req)
+	})
+}
+
+// callers returns the stack of a deferred recover, starting at the frame
+// that panicked.
+func callers() []runtime.Frame {
+	pcs := make([]uintptr, 64)
+	n := runtime.Callers(4, pcs)
+	frames := runtime.CallersFrames(pcs[:n])
+	var out []runtime.Frame
+	for {
+		f, more := frames.Next()
+		if !strings.HasPrefix(f.Function, "runtime.") {
+			out = append(out, f)
+		}
+		if !more {
+			return out
+		}
+	}
+}
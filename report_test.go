@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRecoverPanics(t *testing.T) {
+	reports := make(chan map[string]interface{}, 4)
+	auth := make(chan string, 4)
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var m map[string]interface{}
+		json.NewDecoder(req.Body).Decode(&m)
+		auth <- req.Header.Get("X-Sentry-Auth")
+		reports <- m
+	}))
+	defer collector.Close()
+
+	h := recoverPanics(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/panic":
+			panic("boom")
+		case "/abort":
+			panic(http.ErrAbortHandler)
+		case "/fail":
+			http.Error(w, "disk full", http.StatusInsufficientStorage)
+		}
+	}))
+	get := func(p string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", p, nil)
+		req.SetBasicAuth("alice", "secret")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w
+	}
+	receive := func() (map[string]interface{}, string) {
+		select {
+		case m := <-reports:
+			return m, <-auth
+		case <-time.After(5 * time.Second):
+			t.Fatal("no report received")
+		}
+		return nil, ""
+	}
+
+	defer func(r *errorReporter) { reporter = r }(reporter)
+	*flagErrorReport = collector.URL + "/hook"
+	defer func() { *flagErrorReport = "" }()
+	if err := startErrorReporter(); err != nil {
+		t.Fatal(err)
+	}
+	if w := get("/panic"); w.Code != http.StatusInternalServerError {
+		t.Errorf("panic answered %d", w.Code)
+	}
+	m, _ := receive()
+	if m["message"] != "boom" || m["panic"] != true || !strings.Contains(m["stack"].(string), "TestRecoverPanics") {
+		t.Errorf("unexpected panic report %v", m)
+	}
+	if hdr := m["headers"].(map[string]interface{}); hdr["Authorization"] != "[redacted]" {
+		t.Errorf("credentials were reported: %v", hdr)
+	}
+
+	get("/fail")
+	if m, _ := receive(); m["status"] != float64(http.StatusInsufficientStorage) || m["panic"] != nil {
+		t.Errorf("unexpected 5xx report %v", m)
+	}
+
+	func() {
+		defer func() {
+			if p := recover(); p != http.ErrAbortHandler {
+				t.Errorf("recovered %v, want http.ErrAbortHandler", p)
+			}
+		}()
+		get("/abort")
+	}()
+
+	// A DSN sends Sentry events to the project's store endpoint.
+	*flagErrorReport = strings.Replace(collector.URL, "http://", "http://public@", 1) + "/42"
+	if err := startErrorReporter(); err != nil {
+		t.Fatal(err)
+	}
+	if reporter.endpoint != collector.URL+"/api/42/store/" {
+		t.Errorf("endpoint %q", reporter.endpoint)
+	}
+	get("/panic")
+	m, a := receive()
+	if !strings.Contains(a, "sentry_key=public") {
+		t.Errorf("X-Sentry-Auth = %q", a)
+	}
+	exc, _ := m["exception"].(map[string]interface{})
+	if m["message"] != "boom" || exc == nil || len(m["event_id"].(string)) != 32 {
+		t.Errorf("unexpected Sentry event %v", m)
+	}
+}
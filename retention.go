@@ -0,0 +1,375 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+	"golang.org/x/net/webdav"
+)
+
+var flagRetention = flag.Bool("retention-locks", false, "let retention locks be placed on files and folders, through the admin API or by PROPPATCH of retain-until; locked paths cannot be changed, moved or deleted until the lock runs out")
+
+const retentionState = "retention.json"
+
+// retentionProp holds when the retention lock on a file or folder runs out,
+// as an RFC 3339 time. Setting it places or extends the lock.
+var retentionProp = xml.Name{Space: "https://github.com/clgcn/gowebdav", Local: "retain-until"}
+
+// retention maps locked paths to when their locks run out. Locks can be
+// extended but never shortened or lifted. m is nil unless -retention-locks
+// is set.
+var retention struct {
+	sync.Mutex
+	m map[string]time.Time
+}
+
+// startRetention loads the retention locks and registers their admin
+// endpoint.
+func startRetention(fs webdav.FileSystem) error {
+	m := make(map[string]time.Time)
+	data, err := readState(retentionState)
+	if err != nil {
+		return err
+	}
+	if data != nil {
+		if err := json.Unmarshal(data, &m); err != nil {
+			return err
+		}
+	}
+	retention.Lock()
+	retention.m = m
+	retention.Unlock()
+	handleAdmin("retention", retentionAdmin(fs))
+	return nil
+}
+
+// saveRetention drops the locks that ran out and writes the others to the
+// state dir. The caller holds the lock.
+func saveRetention() error {
+	now := time.Now()
+	for p, until := range retention.m {
+		if !now.Before(until) {
+			delete(retention.m, p)
+		}
+	}
+	data, err := json.MarshalIndent(retention.m, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeState(retentionState, data)
+}
+
+var errRetentionShortened = errors.New("retention locks can be extended but not shortened")
+
+// retain locks name until the given time.
+func retain(name string, until time.Time) error {
+	name = path.Clean("/" + name)
+	until = until.UTC().Truncate(time.Second)
+	retention.Lock()
+	defer retention.Unlock()
+	old, ok := retention.m[name]
+	if ok && until.Before(old) {
+		return errRetentionShortened
+	}
+	retention.m[name] = until
+	if err := saveRetention(); err != nil {
+		if ok {
+			retention.m[name] = old
+		} else {
+			delete(retention.m, name)
+		}
+		return err
+	}
+	log.Printf("Retention lock on %s until %s", name, until.Format(time.RFC3339))
+	return nil
+}
+
+// ownLock returns when the lock placed on name itself runs out.
+func ownLock(name string) time.Time {
+	retention.Lock()
+	defer retention.Unlock()
+	return retention.m[path.Clean("/"+name)]
+}
+
+// retainedUntil returns when the locks on name, and on the folders above
+// it, run out; the zero time when it is not locked.
+func retainedUntil(name string) time.Time {
+	name = path.Clean("/" + name)
+	now := time.Now()
+	var until time.Time
+	retention.Lock()
+	defer retention.Unlock()
+	for p, t := range retention.m {
+		if now.Before(t) && t.After(until) && inScope(name, p) {
+			until = t
+		}
+	}
+	return until
+}
+
+// holdsRetained reports whether name, or anything below it, is locked.
+func holdsRetained(name string) bool {
+	name = path.Clean("/" + name)
+	now := time.Now()
+	retention.Lock()
+	defer retention.Unlock()
+	for p, t := range retention.m {
+		if now.Before(t) && inScope(p, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// retainedError refuses changing name while it, or a folder above it, is
+// locked. With tree set, locks below name count too.
+func retainedError(op, name string, tree bool) error {
+	if !retainedUntil(name).IsZero() || tree && holdsRetained(name) {
+		return permissionError(op, name)
+	}
+	return nil
+}
+
+// retentionFS enforces retention locks on every change made through the
+// file system, and exposes them as the retain-until property.
+type retentionFS struct {
+	webdav.FileSystem
+}
+
+func (fs retentionFS) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	if flag == os.O_RDWR {
+		// PROPPATCH opens its target so, which fails for folders and must
+		// not fail for locked files, whose properties are still read and
+		// whose lock can be extended. Nothing needs writing.
+		if fi, err := fs.FileSystem.Stat(ctx, name); err == nil && fi.IsDir() || !retainedUntil(name).IsZero() {
+			flag = os.O_RDONLY
+		}
+	}
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_CREATE|os.O_TRUNC|os.O_APPEND) != 0 {
+		if err := retainedError("write", name, false); err != nil {
+			return nil, err
+		}
+	}
+	f, err := fs.FileSystem.OpenFile(ctx, name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return retentionFile{File: f, name: path.Clean("/" + name)}, nil
+}
+
+func (fs retentionFS) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	if err := retainedError("mkdir", name, false); err != nil {
+		return err
+	}
+	return fs.FileSystem.Mkdir(ctx, name, perm)
+}
+
+func (fs retentionFS) RemoveAll(ctx context.Context, name string) error {
+	if err := retainedError("remove", name, true); err != nil {
+		return err
+	}
+	return fs.FileSystem.RemoveAll(ctx, name)
+}
+
+func (fs retentionFS) Rename(ctx context.Context, oldName, newName string) error {
+	if err := retainedError("rename", oldName, true); err != nil {
+		return err
+	}
+	if err := retainedError("rename", newName, true); err != nil {
+		return err
+	}
+	return fs.FileSystem.Rename(ctx, oldName, newName)
+}
+
+// retentionFile adds the retain-until property to a file or folder, and
+// sets it on PROPPATCH.
+type retentionFile struct {
+	webdav.File
+	name string
+}
+
+func (f retentionFile) DeadProps() (map[xml.Name]webdav.Property, error) {
+	props := make(map[xml.Name]webdav.Property)
+	if dph, ok := f.File.(webdav.DeadPropsHolder); ok {
+		inner, err := dph.DeadProps()
+		if err != nil {
+			return nil, err
+		}
+		for n, p := range inner {
+			props[n] = p
+		}
+	}
+	// Only the lock placed on the path itself, which copies keep like other
+	// dead properties.
+	if until := ownLock(f.name); time.Now().Before(until) {
+		props[retentionProp] = webdav.Property{XMLName: retentionProp, InnerXML: []byte(until.UTC().Format(time.RFC3339))}
+	}
+	return props, nil
+}
+
+// Patch sets retain-until and hands other properties to the file below,
+// unless the file is locked. Like PROPPATCH itself, it applies all the
+// patches or none.
+func (f retentionFile) Patch(patches []webdav.Proppatch) ([]webdav.Propstat, error) {
+	var (
+		until          time.Time
+		others         []webdav.Proppatch
+		failed, passed webdav.Propstat
+	)
+	failed.Status = http.StatusForbidden
+	passed.Status = http.StatusFailedDependency
+	locked := !retainedUntil(f.name).IsZero()
+	inner, _ := f.File.(webdav.DeadPropsHolder)
+	for _, patch := range patches {
+		var rest []webdav.Property
+		for _, p := range patch.Props {
+			if p.XMLName != retentionProp {
+				rest = append(rest, p)
+				if locked || inner == nil {
+					failed.Props = append(failed.Props, webdav.Property{XMLName: p.XMLName})
+				} else {
+					passed.Props = append(passed.Props, webdav.Property{XMLName: p.XMLName})
+				}
+				continue
+			}
+			t, err := time.Parse(time.RFC3339, strings.TrimSpace(string(p.InnerXML)))
+			if patch.Remove || err != nil || !t.After(time.Now()) || t.Before(ownLock(f.name)) {
+				failed.Props = append(failed.Props, webdav.Property{XMLName: p.XMLName})
+				continue
+			}
+			until = t
+			passed.Props = append(passed.Props, webdav.Property{XMLName: p.XMLName})
+		}
+		if rest != nil {
+			others = append(others, webdav.Proppatch{Remove: patch.Remove, Props: rest})
+		}
+	}
+	if len(failed.Props) > 0 {
+		var ret []webdav.Propstat
+		for _, pstat := range []webdav.Propstat{failed, passed} {
+			if len(pstat.Props) > 0 {
+				ret = append(ret, pstat)
+			}
+		}
+		return ret, nil
+	}
+	var ret []webdav.Propstat
+	if others != nil {
+		var err error
+		if ret, err = inner.Patch(others); err != nil {
+			return nil, err
+		}
+	}
+	if !until.IsZero() {
+		if err := retain(f.name, until); err != nil {
+			return nil, err
+		}
+		ret = append(ret, webdav.Propstat{Status: http.StatusOK, Props: []webdav.Property{{XMLName: retentionProp}}})
+	}
+	return ret, nil
+}
+
+// refuseRetained answers 403 to WebDAV requests that would change a locked
+// path. retentionFS would fail them too, but with less fitting status
+// codes.
+func refuseRetained(w http.ResponseWriter, req *http.Request) bool {
+	if retention.m == nil {
+		return false
+	}
+	var err error
+	switch req.Method {
+	case "PUT", "MKCOL":
+		err = retainedError("write", req.URL.Path, false)
+	case "DELETE", "MOVE":
+		err = retainedError("remove", req.URL.Path, true)
+	}
+	if err == nil && (req.Method == "MOVE" || req.Method == "COPY") {
+		if u, perr := url.Parse(req.Header.Get("Destination")); perr == nil && u.Path != "" {
+			err = retainedError("write", u.Path, true)
+		}
+	}
+	if err == nil {
+		return false
+	}
+	http.Error(w, "WebDAV: the path is under a retention lock", http.StatusForbidden)
+	return true
+}
+
+// retentionAdmin lists the retention locks on GET and places or extends
+// one on POST of {"path": ..., "until": ...} or {"path": ..., "for": ...},
+// until being an RFC 3339 time and for a duration such as "8760h".
+func retentionAdmin(fs webdav.FileSystem) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		switch req.Method {
+		case "GET":
+			type lock struct {
+				Path  string    `json:"path"`
+				Until time.Time `json:"until"`
+			}
+			now := time.Now()
+			list := []lock{}
+			retention.Lock()
+			for p, until := range retention.m {
+				if now.Before(until) {
+					list = append(list, lock{p, until})
+				}
+			}
+			retention.Unlock()
+			sort.Slice(list, func(i, j int) bool { return list[i].Path < list[j].Path })
+			writeJSON(w, http.StatusOK, list)
+		case "POST":
+			var r struct {
+				Path  string    `json:"path"`
+				Until time.Time `json:"until"`
+				For   string    `json:"for"`
+			}
+			if err := json.NewDecoder(http.MaxBytesReader(w, req.Body, 64<<10)).Decode(&r); err != nil {
+				http.Error(w, "invalid request: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+			if r.For != "" {
+				d, err := time.ParseDuration(r.For)
+				if err != nil {
+					http.Error(w, fmt.Sprintf("invalid duration %q", r.For), http.StatusBadRequest)
+					return
+				}
+				r.Until = time.Now().Add(d)
+			}
+			if !r.Until.After(time.Now()) {
+				http.Error(w, "until must lie in the future", http.StatusBadRequest)
+				return
+			}
+			name := path.Clean("/" + r.Path)
+			if _, err := fs.Stat(req.Context(), name); err != nil {
+				http.Error(w, "not found", http.StatusNotFound)
+				return
+			}
+			switch err := retain(name, r.Until); err {
+			case nil:
+			case errRetentionShortened:
+				http.Error(w, err.Error(), http.StatusConflict)
+				return
+			default:
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			writeJSON(w, http.StatusOK, map[string]interface{}{"path": name, "until": ownLock(name)})
+		default:
+			w.Header().Set("Allow", "GET, POST")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	}
+}
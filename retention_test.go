@@ -0,0 +1,117 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+	"golang.org/x/net/webdav"
+)
+
+func TestRetentionLocks(t *testing.T) {
+	root := t.TempDir()
+	os.MkdirAll(filepath.Join(root, "records", "2026"), 0755)
+	os.WriteFile(filepath.Join(root, "records", "2026", "ledger.csv"), []byte("1,2,3"), 0644)
+	os.WriteFile(filepath.Join(root, "notes.txt"), []byte("notes"), 0644)
+	*flagStateDir = t.TempDir()
+	defer func() { *flagStateDir = "" }()
+	defer func() { retention.m = nil }()
+	defer func(m *http.ServeMux) { adminMux = m }(adminMux)
+	adminMux = http.NewServeMux()
+	fs := retentionFS{webdav.Dir(root)}
+	if err := startRetention(fs); err != nil {
+		t.Fatal(err)
+	}
+	h := &webdav.Handler{FileSystem: fs, LockSystem: webdav.NewMemLS()}
+	do := func(method, target string, header map[string]string, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		for k, v := range header {
+			req.Header.Set(k, v)
+		}
+		w := httptest.NewRecorder()
+		if !refuseRetained(w, req) {
+			h.ServeHTTP(w, req)
+		}
+		return w
+	}
+
+	// A lock placed through the admin API covers the folder's contents.
+	admin := retentionAdmin(fs)
+	w := httptest.NewRecorder()
+	admin(w, httptest.NewRequest("POST", "/retention", strings.NewReader(`{"path": "/records/2026", "for": "24h"}`)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("POST answered %d: %s", w.Code, w.Body)
+	}
+	w = httptest.NewRecorder()
+	admin(w, httptest.NewRequest("POST", "/retention", strings.NewReader(`{"path": "/records/2026", "for": "1h"}`)))
+	if w.Code != http.StatusConflict {
+		t.Errorf("shortening answered %d", w.Code)
+	}
+
+	// And one placed by PROPPATCH on a single file.
+	until := time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+	w = do("PROPPATCH", "/notes.txt", nil, `<?xml version="1.0"?>
+<D:propertyupdate xmlns:D="DAV:" xmlns:G="https://github.com/clgcn/gowebdav">
+<D:set><D:prop><G:retain-until>`+until+`</G:retain-until></D:prop></D:set>
+</D:propertyupdate>`)
+	if w.Code != http.StatusMultiStatus || !strings.Contains(w.Body.String(), "200 OK") {
+		t.Fatalf("PROPPATCH answered %d: %s", w.Code, w.Body)
+	}
+	w = do("PROPFIND", "/notes.txt", map[string]string{"Depth": "0"}, `<?xml version="1.0"?>
+<D:propfind xmlns:D="DAV:"><D:prop><G:retain-until xmlns:G="https://github.com/clgcn/gowebdav"/></D:prop></D:propfind>`)
+	if !strings.Contains(w.Body.String(), until) {
+		t.Errorf("PROPFIND does not show the lock: %s", w.Body)
+	}
+
+	for _, tt := range []struct {
+		method, target, dest string
+		want                 int
+	}{
+		{"PUT", "/records/2026/ledger.csv", "", http.StatusForbidden},
+		{"PUT", "/records/2026/new.csv", "", http.StatusForbidden},
+		{"MKCOL", "/records/2026/q4", "", http.StatusForbidden},
+		{"DELETE", "/records/2026/ledger.csv", "", http.StatusForbidden},
+		{"DELETE", "/records", "", http.StatusForbidden},
+		{"MOVE", "/records/2026", "/old", http.StatusForbidden},
+		{"COPY", "/notes.txt", "/records/2026/notes.txt", http.StatusForbidden},
+		{"PUT", "/notes.txt", "", http.StatusForbidden},
+		{"COPY", "/records/2026/ledger.csv", "/ledger.csv", http.StatusCreated},
+		{"PUT", "/records/2025.csv", "", http.StatusCreated},
+	} {
+		header := map[string]string{}
+		if tt.dest != "" {
+			header["Destination"] = tt.dest
+		}
+		var body string
+		if tt.method == "PUT" {
+			body = "x"
+		}
+		if w := do(tt.method, tt.target, header, body); w.Code != tt.want {
+			t.Errorf("%s %s %s answered %d, want %d", tt.method, tt.target, tt.dest, w.Code, tt.want)
+		}
+	}
+	ctx := context.Background()
+	if _, err := fs.OpenFile(ctx, "/records/2026/ledger.csv", os.O_WRONLY|os.O_TRUNC, 0); !os.IsPermission(err) {
+		t.Errorf("truncating answered %v", err)
+	}
+	if err := fs.Rename(ctx, "/records", "/r"); !os.IsPermission(err) {
+		t.Errorf("renaming a folder holding a lock answered %v", err)
+	}
+
+	// Locks survive a restart, and run out.
+	retention.m = nil
+	adminMux = http.NewServeMux()
+	startRetention(fs)
+	if len(retention.m) != 2 {
+		t.Fatalf("reloaded locks %v", retention.m)
+	}
+	retention.m["/notes.txt"] = time.Now().Add(-time.Second)
+	if w := do("PUT", "/notes.txt", nil, "x"); w.Code != http.StatusCreated {
+		t.Errorf("PUT after the lock ran out answered %d", w.Code)
+	}
+}
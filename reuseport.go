@@ -0,0 +1,52 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"net"
+
+	"golang.org/x/net/context"
+)
+
+var (
+	flagReusePort   = flag.Bool("reuse-port", false, "bind the port with SO_REUSEPORT, so several processes can share it and a new one can take over before the old one exits")
+	flagAcceptLoops = flag.Int("accept-loops", 1, "with -reuse-port, open this many listening sockets, each with its own accept loop")
+)
+
+// listen opens the HTTP listeners: one, or with -reuse-port one per
+// -accept-loops, all bound to the same address. The kernel spreads new
+// connections across them.
+func listen(addr string) ([]net.Listener, error) {
+	if !*flagReusePort {
+		ln, err := net.Listen("tcp", addr)
+		if err != nil {
+			return nil, err
+		}
+		return []net.Listener{ln}, nil
+	}
+	if !reusePortSupported {
+		return nil, errors.New("-reuse-port is not supported on this platform")
+	}
+	n := *flagAcceptLoops
+	if n < 1 {
+		n = 1
+	}
+	lc := net.ListenConfig{Control: setReusePort}
+	var lns []net.Listener
+	for i := 0; i < n; i++ {
+		// Later sockets bind the port the first one got, which matters
+		// for ":0".
+		if i > 0 {
+			addr = lns[0].Addr().String()
+		}
+		ln, err := lc.Listen(context.Background(), "tcp", addr)
+		if err != nil {
+			for _, ln := range lns {
+				ln.Close()
+			}
+			return nil, err
+		}
+		lns = append(lns, ln)
+	}
+	return lns, nil
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+func TestListenReusePort(t *testing.T) {
+	if !reusePortSupported {
+		t.Skip("SO_REUSEPORT is not supported on this platform")
+	}
+	defer func(reuse bool, loops int) { *flagReusePort, *flagAcceptLoops = reuse, loops }(*flagReusePort, *flagAcceptLoops)
+	*flagReusePort, *flagAcceptLoops = true, 3
+	lns, err := listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		for _, ln := range lns {
+			ln.Close()
+		}
+	}()
+	if len(lns) != 3 {
+		t.Fatalf("got %d listeners, want 3", len(lns))
+	}
+	for _, ln := range lns[1:] {
+		if ln.Addr().String() != lns[0].Addr().String() {
+			t.Errorf("listener on %s, want %s", ln.Addr(), lns[0].Addr())
+		}
+	}
+
+	// Another process could join too.
+	*flagAcceptLoops = 1
+	more, err := listen(lns[0].Addr().String())
+	if err != nil {
+		t.Fatalf("second bind of the port: %v", err)
+	}
+	more[0].Close()
+
+	*flagReusePort = false
+	if _, err := net.Listen("tcp", lns[0].Addr().String()); err == nil {
+		t.Error("port bound without SO_REUSEPORT while shared")
+	}
+}
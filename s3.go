@@ -0,0 +1,1061 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"flag"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+	"golang.org/x/net/webdav"
+)
+
+var (
+	flagS3Addr   = flag.String("s3", "", "also serve the root over a minimal S3-compatible API on this address, e.g. :9000, with -user and -password as access key and secret key (disabled when empty)")
+	flagS3Bucket = flag.String("s3-bucket", "gowebdav", "name of the one bucket the root is served as over S3")
+)
+
+const (
+	s3TimeFormat    = "2006-01-02T15:04:05.000Z"
+	s3DateFormat    = "20060102T150405Z"
+	s3MaxKeys       = 1000
+	s3MaxSkew       = 15 * time.Minute
+	s3UploadTimeout = 24 * time.Hour
+)
+
+// s3Server exposes a webdav.FileSystem as a single S3 bucket, for backup
+// and sync tools that speak nothing else. It supports path-style requests
+// signed with AWS Signature Version 4, and shares the HTTP server's
+// credentials and -read-only setting. Folders are implied by keys, as in
+// S3: uploads create them, and listings show them as common prefixes.
+type s3Server struct {
+	fs      webdav.FileSystem
+	bucket  string
+	partDir string // parts of multipart uploads, outside the served tree
+
+	mu      sync.Mutex
+	uploads map[string]*s3Upload
+}
+
+// s3Upload is a multipart upload in progress.
+type s3Upload struct {
+	key     string
+	dir     string
+	created time.Time
+	parts   map[int]string // part number to hex MD5
+}
+
+func startS3(fs webdav.FileSystem) error {
+	partDir, err := os.MkdirTemp("", "gowebdav-s3-")
+	if err != nil {
+		return err
+	}
+	s := &s3Server{fs: fs, bucket: *flagS3Bucket, partDir: partDir, uploads: make(map[string]*s3Upload)}
+	ln, err := net.Listen("tcp", *flagS3Addr)
+	if err != nil {
+		os.RemoveAll(partDir)
+		return err
+	}
+	if *flagHttpsMode {
+		cert, err := tls.LoadX509KeyPair(*flagCertFile, *flagKeyFile)
+		if err != nil {
+			ln.Close()
+			os.RemoveAll(partDir)
+			return err
+		}
+		ln = tls.NewListener(ln, &tls.Config{Certificates: []tls.Certificate{cert}})
+	}
+	srv := newServer(recoverPanics(s))
+	log.Printf("Serving S3 bucket %s on %s", s.bucket, ln.Addr())
+	onShutdown(func() {
+		srv.Close()
+		os.RemoveAll(partDir)
+	})
+	go srv.Serve(ln)
+	return nil
+}
+
+// s3Error is an S3 error response.
+type s3Error struct {
+	status  int
+	code    string
+	message string
+}
+
+func (e *s3Error) Error() string { return e.code + ": " + e.message }
+
+var (
+	errS3AccessDenied      = &s3Error{http.StatusForbidden, "AccessDenied", "Access Denied."}
+	errS3BadDigest         = &s3Error{http.StatusBadRequest, "BadDigest", "The Content-MD5 you specified did not match what was received."}
+	errS3ContentSHA256     = &s3Error{http.StatusBadRequest, "XAmzContentSHA256Mismatch", "The provided x-amz-content-sha256 header does not match what was computed."}
+	errS3InvalidAccessKey  = &s3Error{http.StatusForbidden, "InvalidAccessKeyId", "The access key ID you provided does not exist in our records."}
+	errS3InvalidKey        = &s3Error{http.StatusBadRequest, "InvalidArgument", "Keys may not contain empty, . or .. segments."}
+	errS3InvalidPart       = &s3Error{http.StatusBadRequest, "InvalidPart", "One or more of the specified parts could not be found."}
+	errS3InvalidPartOrder  = &s3Error{http.StatusBadRequest, "InvalidPartOrder", "The list of parts was not in ascending order."}
+	errS3MalformedXML      = &s3Error{http.StatusBadRequest, "MalformedXML", "The XML you provided was not well-formed."}
+	errS3MethodNotAllowed  = &s3Error{http.StatusMethodNotAllowed, "MethodNotAllowed", "The specified method is not allowed against this resource."}
+	errS3NoSuchBucket      = &s3Error{http.StatusNotFound, "NoSuchBucket", "The specified bucket does not exist."}
+	errS3NoSuchKey         = &s3Error{http.StatusNotFound, "NoSuchKey", "The specified key does not exist."}
+	errS3NoSuchUpload      = &s3Error{http.StatusNotFound, "NoSuchUpload", "The specified multipart upload does not exist."}
+	errS3QuotaExceeded     = &s3Error{http.StatusInsufficientStorage, "QuotaExceeded", "The upload would take the server past its storage quota."}
+	errS3NotImplemented    = &s3Error{http.StatusNotImplemented, "NotImplemented", "A header or query you provided implies functionality that is not implemented."}
+	errS3SignatureMismatch = &s3Error{http.StatusForbidden, "SignatureDoesNotMatch", "The request signature we calculated does not match the signature you provided."}
+	errS3TimeSkewed        = &s3Error{http.StatusForbidden, "RequestTimeTooSkewed", "The difference between the request time and the server's time is too large."}
+)
+
+func s3InvalidArgument(message string) *s3Error {
+	return &s3Error{http.StatusBadRequest, "InvalidArgument", message}
+}
+
+func writeS3Error(w http.ResponseWriter, req *http.Request, err error) {
+	var e *s3Error
+	switch {
+	case errors.As(err, &e):
+	case os.IsNotExist(err) || errors.Is(err, filepath.SkipDir):
+		e = errS3NoSuchKey
+	case os.IsPermission(err):
+		e = errS3AccessDenied
+	case errors.Is(err, errQuotaExceeded):
+		e = errS3QuotaExceeded
+	case errors.As(err, new(*virusError)):
+		e = &s3Error{http.StatusForbidden, "AccessDenied", "Upload rejected: " + err.Error() + "."}
+	default:
+		log.Printf("S3: %s %s: %v", req.Method, req.URL.Path, err)
+		e = &s3Error{http.StatusInternalServerError, "InternalError", "We encountered an internal error. Please try again."}
+	}
+	if req.Method == "HEAD" {
+		w.WriteHeader(e.status)
+		return
+	}
+	writeS3XML(w, e.status, struct {
+		XMLName  xml.Name `xml:"Error"`
+		Code     string
+		Message  string
+		Resource string
+	}{Code: e.code, Message: e.message, Resource: req.URL.Path})
+}
+
+func writeS3XML(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	io.WriteString(w, xml.Header)
+	if err := xml.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("S3: %v", err)
+	}
+}
+
+func (s *s3Server) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if err := s.authenticate(req); err != nil {
+		writeS3Error(w, req, err)
+		return
+	}
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(req.URL.Path, "/"), "/")
+	q := req.URL.Query()
+	var err error
+	switch {
+	case bucket == "" && req.Method == "GET":
+		err = s.listBuckets(w, req)
+	case bucket == "":
+		err = errS3MethodNotAllowed
+	case bucket != s.bucket:
+		err = errS3NoSuchBucket
+	case key == "" && req.Method == "HEAD":
+	case key == "" && req.Method == "GET" && q.Has("location"):
+		writeS3XML(w, http.StatusOK, struct {
+			XMLName xml.Name `xml:"http://s3.amazonaws.com/doc/2006-03-01/ LocationConstraint"`
+		}{})
+	case key == "" && req.Method == "GET":
+		err = s.listObjects(w, req)
+	case key == "":
+		err = errS3MethodNotAllowed
+	case req.Method == "GET" || req.Method == "HEAD":
+		err = s.getObject(w, req, key)
+	case *flagReadonly && (req.Method == "PUT" || req.Method == "POST" || req.Method == "DELETE"):
+		err = errS3AccessDenied
+	case req.Method == "PUT" && q.Has("uploadId"):
+		err = s.putPart(w, req, key)
+	case req.Method == "PUT" && req.Header.Get("X-Amz-Copy-Source") != "":
+		err = errS3NotImplemented
+	case req.Method == "PUT":
+		err = s.putObject(w, req, key)
+	case req.Method == "POST" && q.Has("uploads"):
+		err = s.createUpload(w, req, key)
+	case req.Method == "POST" && q.Has("uploadId"):
+		err = s.completeUpload(w, req, key)
+	case req.Method == "DELETE" && q.Has("uploadId"):
+		err = s.abortUpload(w, req, key)
+	case req.Method == "DELETE":
+		err = s.deleteObject(w, req, key)
+	default:
+		err = errS3NotImplemented
+	}
+	if err != nil {
+		writeS3Error(w, req, err)
+	}
+}
+
+// objectName maps an object key to its path in the file system. Keys that
+// path.Clean would change cannot be stored as files, and are refused.
+func objectName(key string) (string, error) {
+	name := "/" + strings.TrimSuffix(key, "/")
+	if name == "/" || path.Clean(name) != name {
+		return "", errS3InvalidKey
+	}
+	return name, nil
+}
+
+// objectETag returns the MD5 of the file when it is known, from an upload
+// or an earlier ?hash=md5. Otherwise it returns a tag derived from the
+// file's name, size and modification time, in the form S3 gives multipart
+// uploads, which clients don't take for an MD5 of the content.
+func objectETag(name string, fi os.FileInfo) string {
+	if sum, ok := fileHashes.cached(name, "md5", fi); ok {
+		return `"` + sum + `"`
+	}
+	h := md5.New()
+	fmt.Fprintf(h, "%s\x00%d\x00%d", name, fi.Size(), fi.ModTime().UnixNano())
+	return `"` + hex.EncodeToString(h.Sum(nil)) + `-1"`
+}
+
+func (s *s3Server) listBuckets(w http.ResponseWriter, req *http.Request) error {
+	fi, err := s.fs.Stat(req.Context(), "/")
+	if err != nil {
+		return err
+	}
+	type bucket struct {
+		Name         string
+		CreationDate string
+	}
+	writeS3XML(w, http.StatusOK, struct {
+		XMLName xml.Name `xml:"http://s3.amazonaws.com/doc/2006-03-01/ ListAllMyBucketsResult"`
+		Owner   struct{ ID, DisplayName string }
+		Buckets []bucket `xml:"Buckets>Bucket"`
+	}{Buckets: []bucket{{s.bucket, fi.ModTime().UTC().Format(s3TimeFormat)}}})
+	return nil
+}
+
+// s3Entry is an object, or with a trailing slash a folder, found while
+// listing.
+type s3Entry struct {
+	key string
+	fi  os.FileInfo
+}
+
+// errS3PageFull stops walkObjects once a listing has all it can show.
+var errS3PageFull = errors.New("page full")
+
+// walkObjects calls fn, in key order, with the entries below dir whose keys
+// start with prefix and sort after after. Unless recursive, folders are
+// passed to fn themselves instead of their contents. Folders wholly before
+// after are never read, so each page of a listing costs about as much as
+// the entries on it, plus reading the folders it passes through.
+func (s *s3Server) walkObjects(ctx context.Context, dir, prefix, after string, recursive bool, fn func(s3Entry) error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	// Sorting by key, folders with their slash, lists each folder's
+	// contents between the keys around it.
+	key := func(fi os.FileInfo) string {
+		if fi.IsDir() {
+			return fi.Name() + "/"
+		}
+		return fi.Name()
+	}
+	base := strings.TrimPrefix(dir, "/")
+	if base != "" {
+		base += "/"
+	}
+	keep := func(fi os.FileInfo) bool {
+		if !visibleEntry(fi) || !fi.IsDir() && !fi.Mode().IsRegular() {
+			return false
+		}
+		key := base + key(fi)
+		// A folder may hold keys that match when its own does not.
+		descend := recursive && fi.IsDir()
+		if !strings.HasPrefix(key, prefix) && !(descend && strings.HasPrefix(prefix, key)) {
+			return false
+		}
+		return key > after || descend && strings.HasPrefix(after, key)
+	}
+	return readdirSorted(ctx, s.fs, dir, key, keep, func(fi os.FileInfo) error {
+		if recursive && fi.IsDir() {
+			return s.walkObjects(ctx, path.Join(dir, fi.Name()), prefix, after, true, fn)
+		}
+		return fn(s3Entry{base + key(fi), fi})
+	})
+}
+
+type s3Object struct {
+	Key          string
+	LastModified string
+	ETag         string
+	Size         int64
+	StorageClass string
+}
+
+type s3Prefix struct {
+	Prefix string
+}
+
+// s3ListResult answers ListObjectsV2, and the ListObjects it replaced.
+type s3ListResult struct {
+	XMLName               xml.Name `xml:"http://s3.amazonaws.com/doc/2006-03-01/ ListBucketResult"`
+	Name                  string
+	Prefix                string
+	Delimiter             string `xml:",omitempty"`
+	EncodingType          string `xml:",omitempty"`
+	MaxKeys               int
+	IsTruncated           bool
+	KeyCount              *int    `xml:",omitempty"`
+	ContinuationToken     string  `xml:",omitempty"`
+	NextContinuationToken string  `xml:",omitempty"`
+	StartAfter            string  `xml:",omitempty"`
+	Marker                *string `xml:",omitempty"`
+	NextMarker            string  `xml:",omitempty"`
+	Contents              []s3Object
+	CommonPrefixes        []s3Prefix
+}
+
+func (s *s3Server) listObjects(w http.ResponseWriter, req *http.Request) error {
+	q := req.URL.Query()
+	prefix, delimiter := q.Get("prefix"), q.Get("delimiter")
+	maxKeys := s3MaxKeys
+	if v := q.Get("max-keys"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return s3InvalidArgument("max-keys must be a non-negative integer.")
+		}
+		if n < maxKeys {
+			maxKeys = n
+		}
+	}
+	encoding := q.Get("encoding-type")
+	if encoding != "" && encoding != "url" {
+		return s3InvalidArgument("Invalid encoding-type " + encoding + ".")
+	}
+	v2 := q.Get("list-type") == "2"
+	res := s3ListResult{Name: s.bucket, Prefix: prefix, Delimiter: delimiter, EncodingType: encoding, MaxKeys: maxKeys}
+	var after string
+	if v2 {
+		res.StartAfter, after = q.Get("start-after"), q.Get("start-after")
+		if token := q.Get("continuation-token"); token != "" {
+			b, err := base64.RawURLEncoding.DecodeString(token)
+			if err != nil {
+				return s3InvalidArgument("The continuation token provided is incorrect.")
+			}
+			res.ContinuationToken, after = token, string(b)
+		}
+	} else {
+		after = q.Get("marker")
+		res.Marker = &after
+	}
+
+	var last string
+	count := 0
+	add := func(e s3Entry) error {
+		key, common := e.key, ""
+		if delimiter != "" {
+			if i := strings.Index(key[len(prefix):], delimiter); i >= 0 {
+				common = key[:len(prefix)+i+len(delimiter)]
+			}
+		}
+		if common != "" {
+			key = common
+		} else if e.fi.IsDir() {
+			return nil
+		}
+		if key <= after || key == last {
+			// Entries at or before the marker, and the rest of a common
+			// prefix already listed.
+			return nil
+		}
+		if count == maxKeys {
+			res.IsTruncated = true
+			return errS3PageFull
+		}
+		count++
+		last = key
+		if common != "" {
+			res.CommonPrefixes = append(res.CommonPrefixes, s3Prefix{s3EncodeKey(key, encoding)})
+			return nil
+		}
+		res.Contents = append(res.Contents, s3Object{
+			Key:          s3EncodeKey(key, encoding),
+			LastModified: e.fi.ModTime().UTC().Format(s3TimeFormat),
+			ETag:         objectETag("/"+key, e.fi),
+			Size:         e.fi.Size(),
+			StorageClass: "STANDARD",
+		})
+		return nil
+	}
+	// Listing starts in the folder prefix points into, if there is one.
+	dir := "/"
+	if i := strings.LastIndex(prefix, "/"); i >= 0 {
+		dir = "/" + prefix[:i]
+	}
+	if fi, err := s.fs.Stat(req.Context(), dir); err == nil && fi.IsDir() && path.Clean(dir) == dir {
+		err := s.walkObjects(req.Context(), dir, prefix, after, delimiter != "/", add)
+		if err != nil && err != errS3PageFull {
+			return err
+		}
+	}
+	if res.IsTruncated {
+		if v2 {
+			res.NextContinuationToken = base64.RawURLEncoding.EncodeToString([]byte(last))
+		} else {
+			res.NextMarker = s3EncodeKey(last, encoding)
+		}
+	}
+	if v2 {
+		res.KeyCount = &count
+	}
+	if encoding != "" {
+		res.Prefix = s3EncodeKey(prefix, encoding)
+		res.Delimiter = s3EncodeKey(delimiter, encoding)
+		res.StartAfter = s3EncodeKey(res.StartAfter, encoding)
+	}
+	writeS3XML(w, http.StatusOK, res)
+	return nil
+}
+
+func s3EncodeKey(key, encoding string) string {
+	if encoding != "url" {
+		return key
+	}
+	return s3Escape(key, false)
+}
+
+func (s *s3Server) getObject(w http.ResponseWriter, req *http.Request, key string) error {
+	name, err := objectName(key)
+	if err != nil {
+		return err
+	}
+	f, err := s.fs.OpenFile(req.Context(), name, os.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if fi.IsDir() {
+		return errS3NoSuchKey
+	}
+	w.Header().Set("ETag", objectETag(name, fi))
+	http.ServeContent(w, req, fi.Name(), fi.ModTime(), f)
+	return nil
+}
+
+// mkdirAll creates dir and the folders above it, which S3 clients take
+// for granted.
+func (s *s3Server) mkdirAll(ctx context.Context, dir string) error {
+	if dir == "/" {
+		return nil
+	}
+	if fi, err := s.fs.Stat(ctx, dir); err == nil {
+		if !fi.IsDir() {
+			return s3InvalidArgument("A prefix of the key is an object.")
+		}
+		return nil
+	}
+	if err := s.mkdirAll(ctx, path.Dir(dir)); err != nil {
+		return err
+	}
+	if err := s.fs.Mkdir(ctx, dir, 0755); err != nil && !os.IsExist(err) {
+		return err
+	}
+	return nil
+}
+
+// s3Body reads a request body, decoding aws-chunked uploads, and checks
+// it against the digests the client sent. Chunk signatures are not
+// verified; the seed signature covers the request headers only.
+type s3Body struct {
+	io.Reader
+	md5       hash.Hash
+	sha256    hash.Hash
+	wantMD5   []byte
+	wantSHA   string
+	streaming bool
+}
+
+func newS3Body(req *http.Request) (*s3Body, error) {
+	b := &s3Body{md5: md5.New(), sha256: sha256.New(), wantSHA: req.Header.Get("X-Amz-Content-Sha256")}
+	if v := req.Header.Get("Content-MD5"); v != "" {
+		sum, err := base64.StdEncoding.DecodeString(v)
+		if err != nil || len(sum) != md5.Size {
+			return nil, &s3Error{http.StatusBadRequest, "InvalidDigest", "The Content-MD5 you specified was invalid."}
+		}
+		b.wantMD5 = sum
+	}
+	var r io.Reader = req.Body
+	if strings.HasPrefix(b.wantSHA, "STREAMING-") {
+		r = &awsChunkedReader{r: bufio.NewReader(req.Body)}
+		b.streaming = true
+	}
+	b.Reader = io.TeeReader(r, io.MultiWriter(b.md5, b.sha256))
+	return b, nil
+}
+
+// check verifies the digests once the body has been read, and returns the
+// hex MD5.
+func (b *s3Body) check() (string, error) {
+	sum := b.md5.Sum(nil)
+	if b.wantMD5 != nil && !bytes.Equal(sum, b.wantMD5) {
+		return "", errS3BadDigest
+	}
+	if len(b.wantSHA) == 64 && !b.streaming && hex.EncodeToString(b.sha256.Sum(nil)) != strings.ToLower(b.wantSHA) {
+		return "", errS3ContentSHA256
+	}
+	return hex.EncodeToString(sum), nil
+}
+
+// awsChunkedReader decodes the aws-chunked content encoding: chunks of
+// "hex-size;chunk-signature=...\r\n" followed by the data and "\r\n",
+// ending with a chunk of size 0 and optional trailing headers.
+type awsChunkedReader struct {
+	r       *bufio.Reader
+	left    int64
+	started bool
+	done    bool
+}
+
+func (c *awsChunkedReader) Read(p []byte) (int, error) {
+	if c.done {
+		return 0, io.EOF
+	}
+	if c.left == 0 {
+		if c.started {
+			if line, err := c.r.ReadString('\n'); err != nil || strings.TrimRight(line, "\r\n") != "" {
+				return 0, errors.New("aws-chunked: missing CRLF after chunk")
+			}
+		}
+		c.started = true
+		line, err := c.r.ReadString('\n')
+		if err != nil {
+			return 0, io.ErrUnexpectedEOF
+		}
+		size, _, _ := strings.Cut(strings.TrimRight(line, "\r\n"), ";")
+		n, err := strconv.ParseInt(strings.TrimSpace(size), 16, 64)
+		if err != nil || n < 0 {
+			return 0, fmt.Errorf("aws-chunked: bad chunk size %q", size)
+		}
+		if n == 0 {
+			// Skip the trailers, such as x-amz-checksum-crc32.
+			for {
+				line, err := c.r.ReadString('\n')
+				if err != nil || strings.TrimRight(line, "\r\n") == "" {
+					break
+				}
+			}
+			c.done = true
+			return 0, io.EOF
+		}
+		c.left = n
+	}
+	if int64(len(p)) > c.left {
+		p = p[:c.left]
+	}
+	n, err := c.r.Read(p)
+	c.left -= int64(n)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+func (s *s3Server) putObject(w http.ResponseWriter, req *http.Request, key string) error {
+	ctx := req.Context()
+	name, err := objectName(key)
+	if err != nil {
+		return err
+	}
+	body, err := newS3Body(req)
+	if err != nil {
+		return err
+	}
+	if strings.HasSuffix(key, "/") {
+		// A folder marker, as made by clients creating an empty folder.
+		if n, _ := io.Copy(io.Discard, body); n > 0 {
+			return s3InvalidArgument("Keys ending in / name folders, which hold no data.")
+		}
+		if err := s.mkdirAll(ctx, name); err != nil {
+			return err
+		}
+		w.Header().Set("ETag", `"`+hex.EncodeToString(md5.New().Sum(nil))+`"`)
+		return nil
+	}
+	size := req.ContentLength
+	if body.streaming {
+		size, _ = strconv.ParseInt(req.Header.Get("X-Amz-Decoded-Content-Length"), 10, 64)
+	}
+	if err := checkQuota(ctx, s.fs, name, size); err != nil {
+		return err
+	}
+	if err := s.mkdirAll(ctx, path.Dir(name)); err != nil {
+		return err
+	}
+	var sum string
+	err = s.store(ctx, name, func(w io.Writer) error {
+		if _, err := io.Copy(w, body); err != nil {
+			return err
+		}
+		sum, err = body.check()
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if err := finishUpload(s.fs, name, *flagUserName, clientIP(req)); err != nil {
+		return err
+	}
+	if fi, err := s.fs.Stat(ctx, name); err == nil {
+		fileHashes.put(name, "md5", fi, sum)
+	}
+	w.Header().Set("ETag", `"`+sum+`"`)
+	return nil
+}
+
+// store writes an object to name with write. A new object is written in
+// place: write-once folders let files be created but not renamed. An
+// existing one is only replaced once write succeeded, by renaming a
+// temporary file written beside it, so a failed upload leaves it untouched.
+func (s *s3Server) store(ctx context.Context, name string, write func(io.Writer) error) error {
+	tmp := name
+	f, err := s.fs.OpenFile(ctx, name, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644)
+	if os.IsExist(err) {
+		// Check that name may be replaced before uploading anything.
+		if f, err = s.fs.OpenFile(ctx, name, os.O_WRONLY, 0); err != nil {
+			return err
+		}
+		f.Close()
+		var b [8]byte
+		if _, err := rand.Read(b[:]); err != nil {
+			return err
+		}
+		tmp = path.Join(path.Dir(name), ".s3-upload-"+hex.EncodeToString(b[:]))
+		f, err = s.fs.OpenFile(ctx, tmp, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644)
+	}
+	if err != nil {
+		return err
+	}
+	err = write(f)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil && tmp != name {
+		err = s.fs.Rename(ctx, tmp, name)
+	}
+	if err != nil {
+		if rerr := s.fs.RemoveAll(ctx, tmp); rerr != nil {
+			log.Printf("S3: failed to remove incomplete upload %s: %v", tmp, rerr)
+		}
+	}
+	return err
+}
+
+func (s *s3Server) deleteObject(w http.ResponseWriter, req *http.Request, key string) error {
+	ctx := req.Context()
+	name, err := objectName(key)
+	if err != nil {
+		return err
+	}
+	// Deleting what isn't there succeeds, as in S3.
+	if fi, err := s.fs.Stat(ctx, name); err == nil {
+		switch {
+		case !fi.IsDir():
+			err = s.fs.RemoveAll(ctx, name)
+		case strings.HasSuffix(key, "/") && s.isEmpty(ctx, name):
+			// Folder markers go with the folder, if nothing else is in it.
+			err = s.fs.RemoveAll(ctx, name)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+func (s *s3Server) isEmpty(ctx context.Context, dir string) bool {
+	f, err := s.fs.OpenFile(ctx, dir, os.O_RDONLY, 0)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	fis, _ := f.Readdir(1)
+	return len(fis) == 0
+}
+
+func (s *s3Server) createUpload(w http.ResponseWriter, req *http.Request, key string) error {
+	if _, err := objectName(key); err != nil || strings.HasSuffix(key, "/") {
+		return errS3InvalidKey
+	}
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return err
+	}
+	id := hex.EncodeToString(b[:])
+	dir := filepath.Join(s.partDir, id)
+	if err := os.Mkdir(dir, 0700); err != nil {
+		return err
+	}
+	now := time.Now()
+	s.mu.Lock()
+	// Drop uploads abandoned long ago, with their parts.
+	for id, u := range s.uploads {
+		if now.Sub(u.created) > s3UploadTimeout {
+			os.RemoveAll(u.dir)
+			delete(s.uploads, id)
+		}
+	}
+	s.uploads[id] = &s3Upload{key: key, dir: dir, created: now, parts: make(map[int]string)}
+	s.mu.Unlock()
+	writeS3XML(w, http.StatusOK, struct {
+		XMLName  xml.Name `xml:"http://s3.amazonaws.com/doc/2006-03-01/ InitiateMultipartUploadResult"`
+		Bucket   string
+		Key      string
+		UploadId string
+	}{Bucket: s.bucket, Key: key, UploadId: id})
+	return nil
+}
+
+// upload returns the multipart upload named by ?uploadId= for key.
+func (s *s3Server) upload(req *http.Request, key string) (*s3Upload, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u := s.uploads[req.URL.Query().Get("uploadId")]
+	if u == nil || u.key != key {
+		return nil, errS3NoSuchUpload
+	}
+	return u, nil
+}
+
+func partFile(u *s3Upload, n int) string {
+	return filepath.Join(u.dir, fmt.Sprintf("%05d", n))
+}
+
+func (s *s3Server) putPart(w http.ResponseWriter, req *http.Request, key string) error {
+	u, err := s.upload(req, key)
+	if err != nil {
+		return err
+	}
+	n, err := strconv.Atoi(req.URL.Query().Get("partNumber"))
+	if err != nil || n < 1 || n > 10000 {
+		return s3InvalidArgument("Part number must be an integer between 1 and 10000, inclusive.")
+	}
+	body, err := newS3Body(req)
+	if err != nil {
+		return err
+	}
+	// Parts are written aside and renamed into place, so a part being
+	// uploaded again replaces the old one only once complete.
+	f, err := os.CreateTemp(u.dir, "part-")
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, body)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	var sum string
+	if err == nil {
+		sum, err = body.check()
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), partFile(u, n))
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	s.mu.Lock()
+	u.parts[n] = sum
+	s.mu.Unlock()
+	w.Header().Set("ETag", `"`+sum+`"`)
+	return nil
+}
+
+func (s *s3Server) completeUpload(w http.ResponseWriter, req *http.Request, key string) error {
+	ctx := req.Context()
+	u, err := s.upload(req, key)
+	if err != nil {
+		return err
+	}
+	var body struct {
+		Parts []struct {
+			PartNumber int
+			ETag       string
+		} `xml:"Part"`
+	}
+	if err := xml.NewDecoder(http.MaxBytesReader(w, req.Body, 1<<20)).Decode(&body); err != nil || len(body.Parts) == 0 {
+		return errS3MalformedXML
+	}
+	s.mu.Lock()
+	parts := make([]string, len(body.Parts))
+	for i, p := range body.Parts {
+		if i > 0 && p.PartNumber <= body.Parts[i-1].PartNumber {
+			s.mu.Unlock()
+			return errS3InvalidPartOrder
+		}
+		sum, ok := u.parts[p.PartNumber]
+		if !ok || strings.Trim(p.ETag, `"`) != sum {
+			s.mu.Unlock()
+			return errS3InvalidPart
+		}
+		parts[i] = sum
+	}
+	s.mu.Unlock()
+
+	name, _ := objectName(key)
+	var size int64
+	for _, p := range body.Parts {
+		if fi, err := os.Stat(partFile(u, p.PartNumber)); err == nil {
+			size += fi.Size()
+		}
+	}
+	if err := checkQuota(ctx, s.fs, name, size); err != nil {
+		return err
+	}
+	if err := s.mkdirAll(ctx, path.Dir(name)); err != nil {
+		return err
+	}
+	whole, sums := md5.New(), md5.New()
+	err = s.store(ctx, name, func(w io.Writer) error {
+		for i, p := range body.Parts {
+			if err := appendFile(io.MultiWriter(w, whole), partFile(u, p.PartNumber)); err != nil {
+				return err
+			}
+			b, _ := hex.DecodeString(parts[i])
+			sums.Write(b)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	s.dropUpload(req.URL.Query().Get("uploadId"))
+	if err := finishUpload(s.fs, name, *flagUserName, clientIP(req)); err != nil {
+		return err
+	}
+	if fi, err := s.fs.Stat(ctx, name); err == nil {
+		fileHashes.put(name, "md5", fi, hex.EncodeToString(whole.Sum(nil)))
+	}
+
+	writeS3XML(w, http.StatusOK, struct {
+		XMLName  xml.Name `xml:"http://s3.amazonaws.com/doc/2006-03-01/ CompleteMultipartUploadResult"`
+		Location string
+		Bucket   string
+		Key      string
+		ETag     string
+	}{
+		Location: "/" + s.bucket + "/" + key,
+		Bucket:   s.bucket,
+		Key:      key,
+		ETag:     fmt.Sprintf(`"%s-%d"`, hex.EncodeToString(sums.Sum(nil)), len(parts)),
+	})
+	return nil
+}
+
+func appendFile(w io.Writer, name string) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(w, f)
+	return err
+}
+
+func (s *s3Server) abortUpload(w http.ResponseWriter, req *http.Request, key string) error {
+	if _, err := s.upload(req, key); err != nil {
+		return err
+	}
+	s.dropUpload(req.URL.Query().Get("uploadId"))
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+func (s *s3Server) dropUpload(id string) {
+	s.mu.Lock()
+	u := s.uploads[id]
+	delete(s.uploads, id)
+	s.mu.Unlock()
+	if u != nil {
+		os.RemoveAll(u.dir)
+	}
+}
+
+// authenticate checks the AWS Signature Version 4 of req, given in the
+// Authorization header or, for presigned URLs, the query. The access key
+// is -user and the secret key -password; without them, anyone may use
+// the bucket.
+func (s *s3Server) authenticate(req *http.Request) error {
+	if *flagUserName == "" || *flagPassword == "" {
+		return nil
+	}
+	q := req.URL.Query()
+	var (
+		credential, signedHeaders, signature, amzDate, payload string
+		expires                                                time.Duration
+	)
+	if auth := req.Header.Get("Authorization"); strings.HasPrefix(auth, "AWS4-HMAC-SHA256 ") {
+		for _, field := range strings.Split(strings.TrimPrefix(auth, "AWS4-HMAC-SHA256 "), ",") {
+			k, v, _ := strings.Cut(strings.TrimSpace(field), "=")
+			switch k {
+			case "Credential":
+				credential = v
+			case "SignedHeaders":
+				signedHeaders = v
+			case "Signature":
+				signature = v
+			}
+		}
+		amzDate = req.Header.Get("X-Amz-Date")
+		if payload = req.Header.Get("X-Amz-Content-Sha256"); payload == "" {
+			return s3InvalidArgument("Missing required header x-amz-content-sha256.")
+		}
+	} else if q.Get("X-Amz-Algorithm") == "AWS4-HMAC-SHA256" {
+		credential, signedHeaders, signature = q.Get("X-Amz-Credential"), q.Get("X-Amz-SignedHeaders"), q.Get("X-Amz-Signature")
+		amzDate, payload = q.Get("X-Amz-Date"), "UNSIGNED-PAYLOAD"
+		secs, err := strconv.Atoi(q.Get("X-Amz-Expires"))
+		if err != nil || secs < 1 || secs > 7*24*3600 {
+			return s3InvalidArgument("X-Amz-Expires must be between 1 and 604800 seconds.")
+		}
+		expires = time.Duration(secs) * time.Second
+	} else {
+		if req.Header.Get("Authorization") != "" {
+			return s3InvalidArgument("Only AWS Signature Version 4 is supported.")
+		}
+		return errS3AccessDenied
+	}
+
+	parts := strings.Split(credential, "/")
+	if len(parts) != 5 || parts[4] != "aws4_request" || signedHeaders == "" || signature == "" {
+		return errS3AccessDenied
+	}
+	if parts[0] != *flagUserName {
+		return errS3InvalidAccessKey
+	}
+	t, err := time.Parse(s3DateFormat, amzDate)
+	if err != nil || !strings.HasPrefix(amzDate, parts[1]) {
+		return errS3AccessDenied
+	}
+	now := time.Now()
+	switch {
+	case expires > 0 && now.After(t.Add(expires)):
+		return &s3Error{http.StatusForbidden, "AccessDenied", "Request has expired."}
+	case expires == 0 && (now.Sub(t) > s3MaxSkew || t.Sub(now) > s3MaxSkew):
+		return errS3TimeSkewed
+	}
+	scope := strings.Join(parts[1:], "/")
+	want := s3Signature(*flagPassword, req, strings.Split(signedHeaders, ";"), payload, amzDate, scope)
+	if !hmac.Equal([]byte(want), []byte(strings.ToLower(signature))) {
+		return errS3SignatureMismatch
+	}
+	return nil
+}
+
+// s3Signature returns the hex AWS Signature Version 4 of req.
+func s3Signature(secret string, req *http.Request, signedHeaders []string, payload, amzDate, scope string) string {
+	canonical := s3CanonicalRequest(req, signedHeaders, payload)
+	sum := sha256.Sum256([]byte(canonical))
+	toSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(sum[:])
+
+	key := []byte("AWS4" + secret)
+	for _, part := range strings.Split(scope, "/") {
+		key = hmacSHA256(key, part)
+	}
+	return hex.EncodeToString(hmacSHA256(key, toSign))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	m := hmac.New(sha256.New, key)
+	m.Write([]byte(data))
+	return m.Sum(nil)
+}
+
+func s3CanonicalRequest(req *http.Request, signedHeaders []string, payload string) string {
+	uri := s3Escape(req.URL.Path, false)
+	if uri == "" {
+		uri = "/"
+	}
+	var query []string
+	for k, vs := range req.URL.Query() {
+		if k == "X-Amz-Signature" {
+			continue
+		}
+		for _, v := range vs {
+			query = append(query, s3Escape(k, true)+"="+s3Escape(v, true))
+		}
+	}
+	sort.Strings(query)
+	var headers strings.Builder
+	for _, h := range signedHeaders {
+		var v string
+		switch h {
+		case "host":
+			v = req.Host
+		case "content-length":
+			if v = req.Header.Get("Content-Length"); v == "" && req.ContentLength >= 0 {
+				v = strconv.FormatInt(req.ContentLength, 10)
+			}
+		default:
+			var vs []string
+			for _, hv := range req.Header.Values(h) {
+				vs = append(vs, strings.Join(strings.Fields(hv), " "))
+			}
+			v = strings.Join(vs, ",")
+		}
+		headers.WriteString(h + ":" + v + "\n")
+	}
+	return strings.Join([]string{
+		req.Method,
+		uri,
+		strings.Join(query, "&"),
+		headers.String(),
+		strings.Join(signedHeaders, ";"),
+		payload,
+	}, "\n")
+}
+
+// s3Escape percent-encodes s the way Signature Version 4 does: everything
+// but unreserved characters and, unless encodeSlash, slashes.
+func s3Escape(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9', c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+	"golang.org/x/net/webdav"
+)
+
+// The example from the AWS documentation on signing GET Object requests.
+func TestS3Signature(t *testing.T) {
+	req := httptest.NewRequest("GET", "http://examplebucket.s3.amazonaws.com/test.txt", nil)
+	req.Header.Set("Range", "bytes=0-9")
+	req.Header.Set("X-Amz-Content-Sha256", "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855")
+	req.Header.Set("X-Amz-Date", "20130524T000000Z")
+	got := s3Signature("wJalrXUtnFEMI/K7MDENG/bPxRfiCYEXAMPLEKEY", req,
+		[]string{"host", "range", "x-amz-content-sha256", "x-amz-date"},
+		"e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855",
+		"20130524T000000Z", "20130524/us-east-1/s3/aws4_request")
+	if want := "f0e8bdb87c964420e857bd35b5d6ed310bd44f0170aba48dd91039c6036bdb41"; got != want {
+		t.Errorf("signature %s, want %s", got, want)
+	}
+}
+
+func TestS3(t *testing.T) {
+	root := t.TempDir()
+	defer func(u, p string) { *flagUserName, *flagPassword = u, p }(*flagUserName, *flagPassword)
+	*flagUserName, *flagPassword = "AKID", "secret"
+	s := &s3Server{fs: webdav.Dir(root), bucket: "backup", partDir: t.TempDir(), uploads: make(map[string]*s3Upload)}
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+
+	secret := "secret"
+	do := func(method, target, body string, header map[string]string) (*http.Response, string) {
+		req, _ := http.NewRequest(method, ts.URL+target, strings.NewReader(body))
+		req.Host = req.URL.Host
+		sum := sha256.Sum256([]byte(body))
+		req.Header.Set("X-Amz-Content-Sha256", hex.EncodeToString(sum[:]))
+		now := time.Now().UTC()
+		req.Header.Set("X-Amz-Date", now.Format(s3DateFormat))
+		for k, v := range header {
+			req.Header.Set(k, v)
+		}
+		scope := now.Format("20060102") + "/us-east-1/s3/aws4_request"
+		signed := []string{"host", "x-amz-content-sha256", "x-amz-date"}
+		sig := s3Signature(secret, req, signed, req.Header.Get("X-Amz-Content-Sha256"), req.Header.Get("X-Amz-Date"), scope)
+		req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential=AKID/"+scope+", SignedHeaders="+strings.Join(signed, ";")+", Signature="+sig)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		data, _ := io.ReadAll(resp.Body)
+		return resp, string(data)
+	}
+	list := func(query string) s3ListResult {
+		resp, body := do("GET", "/backup?"+query, "", nil)
+		var res s3ListResult
+		if err := xml.Unmarshal([]byte(body), &res); resp.StatusCode != http.StatusOK || err != nil {
+			t.Fatalf("list %s answered %d: %s", query, resp.StatusCode, body)
+		}
+		return res
+	}
+
+	if resp, err := http.Get(ts.URL + "/backup/"); err != nil || resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("unsigned request: %v %v", resp, err)
+	}
+	secret = "wrong"
+	if resp, body := do("GET", "/", "", nil); !strings.Contains(body, "SignatureDoesNotMatch") {
+		t.Errorf("wrong secret answered %d: %s", resp.StatusCode, body)
+	}
+	secret = "secret"
+
+	resp, _ := do("PUT", "/backup/docs/a.txt", "hello", nil)
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("ETag") != `"5d41402abc4b2a76b9719d911017c592"` {
+		t.Fatalf("PUT answered %d, ETag %s", resp.StatusCode, resp.Header.Get("ETag"))
+	}
+	if data, _ := os.ReadFile(filepath.Join(root, "docs", "a.txt")); string(data) != "hello" {
+		t.Errorf("stored %q", data)
+	}
+	if resp, body := do("GET", "/backup/docs/a.txt", "", map[string]string{"Range": "bytes=1-3"}); resp.StatusCode != http.StatusPartialContent || body != "ell" {
+		t.Errorf("range GET answered %d %q", resp.StatusCode, body)
+	}
+	if resp, _ := do("HEAD", "/backup/docs/a.txt", "", nil); resp.Header.Get("ETag") != `"5d41402abc4b2a76b9719d911017c592"` {
+		t.Errorf("HEAD ETag %s", resp.Header.Get("ETag"))
+	}
+	if resp, body := do("PUT", "/backup/bad.txt", "tampered", map[string]string{"X-Amz-Content-Sha256": strings.Repeat("0", 64)}); !strings.Contains(body, "XAmzContentSHA256Mismatch") {
+		t.Errorf("bad digest answered %d: %s", resp.StatusCode, body)
+	}
+	if _, err := os.Stat(filepath.Join(root, "bad.txt")); !os.IsNotExist(err) {
+		t.Errorf("upload failing its digest was kept: %v", err)
+	}
+	// A failed overwrite leaves the object as it was.
+	if resp, body := do("PUT", "/backup/docs/a.txt", "tampered", map[string]string{"X-Amz-Content-Sha256": strings.Repeat("0", 64)}); !strings.Contains(body, "XAmzContentSHA256Mismatch") {
+		t.Errorf("bad digest over an object answered %d: %s", resp.StatusCode, body)
+	}
+	if data, _ := os.ReadFile(filepath.Join(root, "docs", "a.txt")); string(data) != "hello" {
+		t.Errorf("failed overwrite left %q", data)
+	}
+	if resp, _ := do("PUT", "/backup/docs/a.txt", "hello", nil); resp.StatusCode != http.StatusOK {
+		t.Errorf("overwrite answered %d", resp.StatusCode)
+	}
+	if fis, _ := os.ReadDir(filepath.Join(root, "docs")); len(fis) != 1 {
+		t.Errorf("overwrites left %d files behind", len(fis))
+	}
+
+	// Streaming uploads, as sent by newer SDKs.
+	chunked := "5;chunk-signature=aa\r\nhello\r\n6;chunk-signature=bb\r\n world\r\n0;chunk-signature=cc\r\nx-amz-checksum-crc32:AAAA\r\n\r\n"
+	if resp, body := do("PUT", "/backup/top.txt", chunked, map[string]string{"X-Amz-Content-Sha256": "STREAMING-UNSIGNED-PAYLOAD-TRAILER"}); resp.StatusCode != http.StatusOK {
+		t.Errorf("chunked PUT answered %d: %s", resp.StatusCode, body)
+	}
+	if data, _ := os.ReadFile(filepath.Join(root, "top.txt")); string(data) != "hello world" {
+		t.Errorf("chunked upload stored %q", data)
+	}
+
+	res := list("list-type=2&delimiter=/")
+	if len(res.CommonPrefixes) != 1 || res.CommonPrefixes[0].Prefix != "docs/" || len(res.Contents) != 1 || res.Contents[0].Key != "top.txt" || res.Contents[0].Size != 11 {
+		t.Errorf("listing with delimiter: %+v", res)
+	}
+	res = list("list-type=2&max-keys=1")
+	if !res.IsTruncated || len(res.Contents) != 1 || res.Contents[0].Key != "docs/a.txt" {
+		t.Fatalf("first page: %+v", res)
+	}
+	res = list("list-type=2&max-keys=1&continuation-token=" + url.QueryEscape(res.NextContinuationToken))
+	if res.IsTruncated || len(res.Contents) != 1 || res.Contents[0].Key != "top.txt" {
+		t.Errorf("second page: %+v", res)
+	}
+	if res = list("prefix=docs/"); len(res.Contents) != 1 || res.Marker == nil {
+		t.Errorf("version 1 listing: %+v", res)
+	}
+
+	// Multipart upload, parts arriving out of order.
+	_, body := do("POST", "/backup/big/archive.tar?uploads", "", nil)
+	var initiated struct{ UploadId string }
+	xml.Unmarshal([]byte(body), &initiated)
+	part := func(n, data string) string {
+		resp, body := do("PUT", "/backup/big/archive.tar?partNumber="+n+"&uploadId="+initiated.UploadId, data, nil)
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("part %s answered %d: %s", n, resp.StatusCode, body)
+		}
+		return resp.Header.Get("ETag")
+	}
+	etag2 := part("2", "world")
+	etag1 := part("1", "hello ")
+	complete := func(etag1 string) (*http.Response, string) {
+		return do("POST", "/backup/big/archive.tar?uploadId="+initiated.UploadId,
+			"<CompleteMultipartUpload><Part><PartNumber>1</PartNumber><ETag>"+etag1+"</ETag></Part>"+
+				"<Part><PartNumber>2</PartNumber><ETag>"+etag2+"</ETag></Part></CompleteMultipartUpload>", nil)
+	}
+	if resp, body := complete(`"0000"`); !strings.Contains(body, "InvalidPart") {
+		t.Errorf("completing with a wrong ETag answered %d: %s", resp.StatusCode, body)
+	}
+	if resp, body := complete(etag1); resp.StatusCode != http.StatusOK || !strings.Contains(body, `-2&#34;</ETag>`) {
+		t.Errorf("complete answered %d: %s", resp.StatusCode, body)
+	}
+	if data, _ := os.ReadFile(filepath.Join(root, "big", "archive.tar")); string(data) != "hello world" {
+		t.Errorf("multipart upload stored %q", data)
+	}
+	if len(s.uploads) != 0 {
+		t.Errorf("finished upload still tracked")
+	}
+
+	// Uploads are scanned like PUTs.
+	defer func(clamd, mode, action string) {
+		*flagClamd, *flagClamdMode, *flagClamdAction = clamd, mode, action
+	}(*flagClamd, *flagClamdMode, *flagClamdAction)
+	*flagClamd, *flagClamdMode, *flagClamdAction = fakeClamd(t, ""), "inline", "reject"
+	if resp, body := do("PUT", "/backup/eicar.com", "EICAR", nil); resp.StatusCode != http.StatusForbidden || !strings.Contains(body, "virus") {
+		t.Errorf("infected upload answered %d: %s", resp.StatusCode, body)
+	}
+	if _, err := os.Stat(filepath.Join(root, "eicar.com")); !os.IsNotExist(err) {
+		t.Errorf("infected upload was kept: %v", err)
+	}
+	*flagClamd = ""
+
+	if resp, _ := do("DELETE", "/backup/docs/a.txt", "", nil); resp.StatusCode != http.StatusNoContent {
+		t.Errorf("DELETE answered %d", resp.StatusCode)
+	}
+	if resp, body := do("GET", "/backup/docs/a.txt", "", nil); resp.StatusCode != http.StatusNotFound || !strings.Contains(body, "NoSuchKey") {
+		t.Errorf("GET of a deleted key answered %d: %s", resp.StatusCode, body)
+	}
+	if resp, _ := do("GET", "/other/x", "", nil); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("unknown bucket answered %d", resp.StatusCode)
+	}
+
+	// Presigned URLs carry the signature in the query.
+	now := time.Now().UTC()
+	scope := now.Format("20060102") + "/us-east-1/s3/aws4_request"
+	q := url.Values{
+		"X-Amz-Algorithm":     {"AWS4-HMAC-SHA256"},
+		"X-Amz-Credential":    {"AKID/" + scope},
+		"X-Amz-Date":          {now.Format(s3DateFormat)},
+		"X-Amz-Expires":       {"300"},
+		"X-Amz-SignedHeaders": {"host"},
+	}
+	req := httptest.NewRequest("GET", ts.URL+"/backup/top.txt?"+q.Encode(), nil)
+	q.Set("X-Amz-Signature", s3Signature("secret", req, []string{"host"}, "UNSIGNED-PAYLOAD", now.Format(s3DateFormat), scope))
+	resp, err := http.Get(ts.URL + "/backup/top.txt?" + q.Encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || !bytes.Equal(data, []byte("hello world")) {
+		t.Errorf("presigned GET answered %d %q", resp.StatusCode, data)
+	}
+}
+
+func TestS3ListOrder(t *testing.T) {
+	root := t.TempDir()
+	for _, name := range []string{"a/x", "a/y/z", "a-b", "a0", "b/c", ".hidden"} {
+		os.MkdirAll(filepath.Dir(filepath.Join(root, name)), 0755)
+		os.WriteFile(filepath.Join(root, name), []byte(name), 0644)
+	}
+	s := &s3Server{fs: webdav.Dir(root)}
+	walk := func(after string) []string {
+		var keys []string
+		err := s.walkObjects(context.Background(), "/", "", after, true, func(e s3Entry) error {
+			keys = append(keys, e.key)
+			if len(keys) == 3 {
+				return errS3PageFull
+			}
+			return nil
+		})
+		if err != nil && err != errS3PageFull {
+			t.Fatal(err)
+		}
+		return keys
+	}
+	// Keys sort with the slash of their folder: a-b comes before a/x.
+	if got := strings.Join(walk(""), " "); got != "a-b a/x a/y/z" {
+		t.Errorf("first page %s", got)
+	}
+	if got := strings.Join(walk("a/y/z"), " "); got != "a0 b/c" {
+		t.Errorf("second page %s", got)
+	}
+}
@@ -0,0 +1,370 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+var flagSchedules scheduleFlags
+
+func init() {
+	flag.Var(&flagSchedules, "schedule", "run a maintenance job on a schedule, as job=spec with a 5-field cron spec, @hourly, @daily, @weekly or @every <duration> (repeatable)")
+}
+
+type scheduleFlags []string
+
+func (s *scheduleFlags) String() string { return strings.Join(*s, ", ") }
+
+func (s *scheduleFlags) Set(v string) error {
+	if !strings.Contains(v, "=") {
+		return fmt.Errorf("want job=spec, got %q", v)
+	}
+	*s = append(*s, v)
+	return nil
+}
+
+// schedule yields the first run time strictly after t.
+type schedule interface {
+	next(t time.Time) time.Time
+}
+
+type everySchedule time.Duration
+
+func (e everySchedule) next(t time.Time) time.Time {
+	return t.Add(time.Duration(e))
+}
+
+// cronSchedule is a classic five-field crontab entry, each field a bit set
+// of the values it matches.
+type cronSchedule struct {
+	minute, hour, dom, month, dow uint64
+	// As in cron, when both day fields are restricted a day matching
+	// either of them is enough.
+	domStar, dowStar bool
+}
+
+var cronFields = []struct {
+	name     string
+	min, max int
+}{
+	{"minute", 0, 59},
+	{"hour", 0, 23},
+	{"day of month", 1, 31},
+	{"month", 1, 12},
+	{"day of week", 0, 7},
+}
+
+func parseSchedule(spec string) (schedule, error) {
+	spec = strings.TrimSpace(spec)
+	switch spec {
+	case "@hourly":
+		spec = "0 * * * *"
+	case "@daily", "@midnight":
+		spec = "0 0 * * *"
+	case "@weekly":
+		spec = "0 0 * * 0"
+	case "@monthly":
+		spec = "0 0 1 * *"
+	}
+	if d := strings.TrimPrefix(spec, "@every "); d != spec {
+		dur, err := time.ParseDuration(strings.TrimSpace(d))
+		if err != nil {
+			return nil, err
+		}
+		if dur < time.Second {
+			return nil, fmt.Errorf("interval %v is shorter than a second", dur)
+		}
+		return everySchedule(dur), nil
+	}
+
+	fields := strings.Fields(spec)
+	if len(fields) != len(cronFields) {
+		return nil, fmt.Errorf("want %d fields, got %d in %q", len(cronFields), len(fields), spec)
+	}
+	var sets [5]uint64
+	for i, f := range fields {
+		set, err := parseCronField(f, cronFields[i].min, cronFields[i].max)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", cronFields[i].name, err)
+		}
+		sets[i] = set
+	}
+	// Sunday is both 0 and 7.
+	if sets[4]&(1<<7) != 0 {
+		sets[4] |= 1
+	}
+	return &cronSchedule{
+		minute: sets[0], hour: sets[1], dom: sets[2], month: sets[3], dow: sets[4],
+		domStar: fields[2] == "*", dowStar: fields[4] == "*",
+	}, nil
+}
+
+// parseCronField parses a comma-separated list of *, n, a-b, each with an
+// optional /step.
+func parseCronField(field string, min, max int) (uint64, error) {
+	var set uint64
+	for _, part := range strings.Split(field, ",") {
+		rng, step := part, 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			n, err := strconv.Atoi(part[i+1:])
+			if err != nil || n < 1 {
+				return 0, fmt.Errorf("bad step in %q", part)
+			}
+			rng, step = part[:i], n
+		}
+		lo, hi := min, max
+		if rng != "*" {
+			a, b, isRange := strings.Cut(rng, "-")
+			var err error
+			if lo, err = strconv.Atoi(a); err != nil {
+				return 0, fmt.Errorf("bad value %q", part)
+			}
+			hi = lo
+			if isRange {
+				if hi, err = strconv.Atoi(b); err != nil {
+					return 0, fmt.Errorf("bad value %q", part)
+				}
+			} else if step > 1 {
+				hi = max
+			}
+		}
+		if lo < min || hi > max || lo > hi {
+			return 0, fmt.Errorf("%q out of range %d-%d", part, min, max)
+		}
+		for v := lo; v <= hi; v += step {
+			set |= 1 << uint(v)
+		}
+	}
+	return set, nil
+}
+
+func (c *cronSchedule) dayMatches(t time.Time) bool {
+	dom := c.dom&(1<<uint(t.Day())) != 0
+	dow := c.dow&(1<<uint(t.Weekday())) != 0
+	if c.domStar || c.dowStar {
+		return dom && dow
+	}
+	return dom || dow
+}
+
+func (c *cronSchedule) next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	// Every valid spec matches within a few years; give up after five
+	// rather than loop forever on something like Feb 30.
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		if c.month&(1<<uint(t.Month())) == 0 {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if !c.dayMatches(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if c.hour&(1<<uint(t.Hour())) == 0 {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+			continue
+		}
+		if c.minute&(1<<uint(t.Minute())) == 0 {
+			t = t.Add(time.Minute)
+			continue
+		}
+		return t
+	}
+	return time.Time{}
+}
+
+// job is a maintenance task the scheduler can run, on a schedule or on
+// request through the admin API.
+type job struct {
+	name string
+	run  func(ctx context.Context) error
+
+	spec  string
+	sched schedule
+
+	mu     sync.Mutex
+	status jobStatus
+}
+
+type jobStatus struct {
+	Name         string    `json:"name"`
+	Schedule     string    `json:"schedule,omitempty"`
+	Next         time.Time `json:"next,omitempty"`
+	Running      bool      `json:"running"`
+	Runs         int       `json:"runs"`
+	LastStart    time.Time `json:"last_start,omitempty"`
+	LastDuration string    `json:"last_duration,omitempty"`
+	LastError    string    `json:"last_error,omitempty"`
+}
+
+type scheduler struct {
+	mu   sync.Mutex
+	jobs map[string]*job
+}
+
+var jobs = &scheduler{jobs: make(map[string]*job)}
+
+// registerJob makes a maintenance task available to -schedule and the admin
+// API. Features register their jobs when they start.
+func registerJob(name string, run func(ctx context.Context) error) {
+	jobs.mu.Lock()
+	defer jobs.mu.Unlock()
+	jobs.jobs[name] = &job{name: name, run: run, status: jobStatus{Name: name}}
+}
+
+func (s *scheduler) get(name string) *job {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.jobs[name]
+}
+
+func (s *scheduler) names() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var names []string
+	for name := range s.jobs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// configure attaches the -schedule specs to their jobs.
+func (s *scheduler) configure(specs []string) error {
+	for _, v := range specs {
+		name, spec, _ := strings.Cut(v, "=")
+		j := s.get(name)
+		if j == nil {
+			avail := strings.Join(s.names(), ", ")
+			if avail == "" {
+				avail = "none; enable the features they belong to"
+			}
+			return fmt.Errorf("unknown job %q (available: %s)", name, avail)
+		}
+		sched, err := parseSchedule(spec)
+		if err != nil {
+			return fmt.Errorf("job %s: %v", name, err)
+		}
+		j.spec, j.sched = spec, sched
+		j.status.Schedule = spec
+	}
+	return nil
+}
+
+// start runs every scheduled job in its own goroutine until ctx is done.
+func (s *scheduler) start(ctx context.Context) {
+	for _, name := range s.names() {
+		if j := s.get(name); j.sched != nil {
+			go j.loop(ctx)
+		}
+	}
+}
+
+func (j *job) loop(ctx context.Context) {
+	for {
+		next := j.sched.next(time.Now())
+		if next.IsZero() {
+			log.Printf("Job %s: schedule %q never fires again", j.name, j.spec)
+			return
+		}
+		j.mu.Lock()
+		j.status.Next = next
+		j.mu.Unlock()
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+		if !j.execute(ctx) {
+			log.Printf("Job %s: skipped, previous run still going", j.name)
+		}
+	}
+}
+
+// execute runs the job unless it is already running, and records the
+// outcome.
+func (j *job) execute(ctx context.Context) bool {
+	j.mu.Lock()
+	if j.status.Running {
+		j.mu.Unlock()
+		return false
+	}
+	start := time.Now()
+	j.status.Running = true
+	j.status.LastStart = start
+	j.mu.Unlock()
+
+	err := queue.run(ctx, "job", j.name, j.run)
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.status.Running = false
+	j.status.Runs++
+	j.status.LastDuration = time.Since(start).Round(time.Millisecond).String()
+	j.status.LastError = ""
+	if err != nil {
+		j.status.LastError = err.Error()
+		log.Printf("Job %s failed: %v", j.name, err)
+	}
+	return true
+}
+
+func (s *scheduler) status() []jobStatus {
+	var st []jobStatus
+	for _, name := range s.names() {
+		j := s.get(name)
+		j.mu.Lock()
+		st = append(st, j.status)
+		j.mu.Unlock()
+	}
+	return st
+}
+
+// serveAdmin lists the jobs on GET; POST ?run=name starts one right away.
+func (s *scheduler) serveAdmin(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case "GET":
+		writeJSON(w, http.StatusOK, s.status())
+	case "POST":
+		j := s.get(req.URL.Query().Get("run"))
+		if j == nil {
+			http.Error(w, "unknown job", http.StatusNotFound)
+			return
+		}
+		j.mu.Lock()
+		running := j.status.Running
+		j.mu.Unlock()
+		if running {
+			http.Error(w, "job already running", http.StatusConflict)
+			return
+		}
+		go j.execute(context.Background())
+		w.WriteHeader(http.StatusAccepted)
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func startScheduler() error {
+	if err := jobs.configure(flagSchedules); err != nil {
+		return err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	onShutdown(cancel)
+	jobs.start(ctx)
+	handleAdmin("jobs", jobs.serveAdmin)
+	return nil
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+func TestParseSchedule(t *testing.T) {
+	from := time.Date(2024, 2, 28, 22, 30, 15, 0, time.UTC) // a Wednesday
+	tests := []struct {
+		spec    string
+		want    time.Time
+		wantErr bool
+	}{
+		{spec: "@every 90m", want: from.Add(90 * time.Minute)},
+		{spec: "@hourly", want: time.Date(2024, 2, 28, 23, 0, 0, 0, time.UTC)},
+		{spec: "@daily", want: time.Date(2024, 2, 29, 0, 0, 0, 0, time.UTC)},
+		{spec: "@weekly", want: time.Date(2024, 3, 3, 0, 0, 0, 0, time.UTC)},
+		{spec: "*/20 * * * *", want: time.Date(2024, 2, 28, 22, 40, 0, 0, time.UTC)},
+		{spec: "15 3 * * *", want: time.Date(2024, 2, 29, 3, 15, 0, 0, time.UTC)},
+		{spec: "0 4 * * 7", want: time.Date(2024, 3, 3, 4, 0, 0, 0, time.UTC)},
+		{spec: "0 0 31 * *", want: time.Date(2024, 3, 31, 0, 0, 0, 0, time.UTC)},
+		{spec: "0 9-17/4 * * 1-5", want: time.Date(2024, 2, 29, 9, 0, 0, 0, time.UTC)},
+		// Both day fields restricted: the 1st of the month or a Friday.
+		{spec: "0 0 1 * 5", want: time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)},
+		{spec: "30 22 28 2 *", want: time.Date(2025, 2, 28, 22, 30, 0, 0, time.UTC)},
+		{spec: "0 0 30 2 *", want: time.Time{}},
+		{spec: "@every 1ms", wantErr: true},
+		{spec: "@every soon", wantErr: true},
+		{spec: "* * * *", wantErr: true},
+		{spec: "60 * * * *", wantErr: true},
+		{spec: "5-1 * * * *", wantErr: true},
+		{spec: "*/0 * * * *", wantErr: true},
+		{spec: "a * * * *", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.spec, func(t *testing.T) {
+			s, err := parseSchedule(tt.spec)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if got := s.next(from); !got.Equal(tt.want) {
+				t.Errorf("next = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSchedulerConfigure(t *testing.T) {
+	s := &scheduler{jobs: map[string]*job{"reindex": {name: "reindex"}}}
+	tests := []struct {
+		specs   []string
+		wantErr string
+	}{
+		{specs: []string{"reindex=@daily"}},
+		{specs: []string{"trash-purge=@daily"}, wantErr: `unknown job "trash-purge" (available: reindex)`},
+		{specs: []string{"reindex=never"}, wantErr: "job reindex"},
+	}
+	for _, tt := range tests {
+		t.Run(strings.Join(tt.specs, " "), func(t *testing.T) {
+			err := s.configure(tt.specs)
+			if tt.wantErr == "" && err != nil {
+				t.Fatalf("err = %v", err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Fatalf("err = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestSchedulerAdmin(t *testing.T) {
+	release := make(chan struct{})
+	s := &scheduler{jobs: make(map[string]*job)}
+	s.jobs["fail"] = &job{name: "fail", status: jobStatus{Name: "fail"}, run: func(ctx context.Context) error {
+		<-release
+		return errors.New("disk on fire")
+	}}
+
+	tests := []struct {
+		method string
+		target string
+		status int
+	}{
+		{"POST", "/jobs?run=fail", http.StatusAccepted},
+		{"POST", "/jobs?run=fail", http.StatusConflict},
+		{"POST", "/jobs?run=nope", http.StatusNotFound},
+		{"DELETE", "/jobs", http.StatusMethodNotAllowed},
+		{"GET", "/jobs", http.StatusOK},
+	}
+	for i, tt := range tests {
+		rec := httptest.NewRecorder()
+		s.serveAdmin(rec, httptest.NewRequest(tt.method, tt.target, nil))
+		if rec.Code != tt.status {
+			t.Errorf("%d: %s %s = %d, want %d", i, tt.method, tt.target, rec.Code, tt.status)
+		}
+		if i == 0 {
+			// Let the run register before asking for a second one.
+			for deadline := time.Now().Add(5 * time.Second); !s.status()[0].Running; {
+				if time.Now().After(deadline) {
+					t.Fatal("job never started")
+				}
+				time.Sleep(time.Millisecond)
+			}
+		}
+	}
+
+	close(release)
+	for deadline := time.Now().Add(5 * time.Second); s.status()[0].Running; {
+		if time.Now().After(deadline) {
+			t.Fatal("job never finished")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if st := s.status()[0]; st.Runs != 1 || st.LastError != "disk on fire" {
+		t.Errorf("status = %+v", st)
+	}
+}
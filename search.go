@@ -0,0 +1,459 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/xml"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/fsnotify/fsnotify"
+	"golang.org/x/net/context"
+	"golang.org/x/net/webdav"
+)
+
+var (
+	flagIndex        = flag.Bool("index", false, "index text and PDF content for the SEARCH method and the listing search box")
+	flagIndexMaxSize = flag.Int64("index-max-size", 10<<20, "skip files larger than this many bytes when indexing")
+)
+
+const (
+	searchMaxResults = 200
+	indexDelay       = time.Second
+)
+
+// contentIndex is an in-memory inverted index from lower-cased words to the
+// files containing them, kept current by a treeWatcher.
+type contentIndex struct {
+	root    string
+	maxSize int64
+
+	mu       sync.RWMutex
+	postings map[string]map[string]struct{}
+	docs     map[string][]string
+
+	pendingMu sync.Mutex
+	pending   map[string]struct{}
+}
+
+var searchIndex *contentIndex
+
+func newContentIndex(root string, maxSize int64) *contentIndex {
+	return &contentIndex{
+		root:     root,
+		maxSize:  maxSize,
+		postings: make(map[string]map[string]struct{}),
+		docs:     make(map[string][]string),
+		pending:  make(map[string]struct{}),
+	}
+}
+
+// startIndex builds the index in the background and follows changes.
+func startIndex() error {
+	w, err := watchRoot()
+	if err != nil {
+		return err
+	}
+	x := newContentIndex(*flagRootDir, *flagIndexMaxSize)
+	w.subscribe(x.handleEvent)
+	go func() {
+		start := time.Now()
+		x.rebuild()
+		log.Printf("Indexed %d files in %v", x.len(), time.Since(start).Round(time.Millisecond))
+	}()
+	go func() {
+		for range time.Tick(indexDelay) {
+			x.flush()
+		}
+	}()
+	searchIndex = x
+	registerJob("reindex", x.reindex)
+	return nil
+}
+
+func (x *contentIndex) len() int {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	return len(x.docs)
+}
+
+// rebuild indexes every file in the tree.
+func (x *contentIndex) rebuild() {
+	filepath.WalkDir(x.root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(x.root, p)
+		if err == nil {
+			x.indexFile("/" + filepath.ToSlash(rel))
+		}
+		return nil
+	})
+}
+
+// reindex rebuilds the index from scratch, dropping files that have
+// disappeared without the watcher noticing.
+func (x *contentIndex) reindex(ctx context.Context) error {
+	seen := make(map[string]bool)
+	err := filepath.WalkDir(x.root, func(p string, d fs.DirEntry, err error) error {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err != nil || d.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(x.root, p)
+		if err == nil {
+			name := "/" + filepath.ToSlash(rel)
+			seen[name] = true
+			x.indexFile(name)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	for name := range x.docs {
+		if !seen[name] {
+			x.removeLocked(name)
+		}
+	}
+	return nil
+}
+
+// handleEvent queues created and written files, which are indexed once they
+// have been quiet for indexDelay, and drops removed ones right away.
+func (x *contentIndex) handleEvent(ev treeEvent) {
+	if ev.Op.Has(fsnotify.Remove) || ev.Op.Has(fsnotify.Rename) {
+		x.remove(ev.Path)
+		return
+	}
+	if ev.Op.Has(fsnotify.Create) || ev.Op.Has(fsnotify.Write) {
+		x.pendingMu.Lock()
+		x.pending[ev.Path] = struct{}{}
+		x.pendingMu.Unlock()
+	}
+}
+
+func (x *contentIndex) flush() {
+	x.pendingMu.Lock()
+	pending := x.pending
+	x.pending = make(map[string]struct{})
+	x.pendingMu.Unlock()
+	for p := range pending {
+		x.indexFile(p)
+	}
+}
+
+func (x *contentIndex) indexFile(name string) {
+	p := filepath.Join(x.root, filepath.FromSlash(name))
+	fi, err := os.Stat(p)
+	if err != nil || fi.IsDir() {
+		return
+	}
+	if isHidden(name) || fi.Size() > x.maxSize {
+		x.remove(name)
+		return
+	}
+	data, err := os.ReadFile(p)
+	if err != nil {
+		return
+	}
+	x.add(name, extractText(name, data))
+}
+
+func (x *contentIndex) add(name, text string) {
+	terms := uniqueTerms(text)
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	x.removeLocked(name)
+	if len(terms) == 0 {
+		return
+	}
+	x.docs[name] = terms
+	for _, t := range terms {
+		set := x.postings[t]
+		if set == nil {
+			set = make(map[string]struct{})
+			x.postings[t] = set
+		}
+		set[name] = struct{}{}
+	}
+}
+
+// remove drops name and, if it was a directory, everything below it.
+func (x *contentIndex) remove(name string) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	x.removeLocked(name)
+	prefix := strings.TrimSuffix(name, "/") + "/"
+	for doc := range x.docs {
+		if strings.HasPrefix(doc, prefix) {
+			x.removeLocked(doc)
+		}
+	}
+}
+
+func (x *contentIndex) removeLocked(name string) {
+	for _, t := range x.docs[name] {
+		delete(x.postings[t], name)
+		if len(x.postings[t]) == 0 {
+			delete(x.postings, t)
+		}
+	}
+	delete(x.docs, name)
+}
+
+// search returns the files below scope that contain every word of query.
+func (x *contentIndex) search(query, scope string, limit int) []string {
+	terms := uniqueTerms(query)
+	if len(terms) == 0 {
+		return nil
+	}
+	prefix := strings.TrimSuffix(scope, "/") + "/"
+
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	sort.Slice(terms, func(i, j int) bool { return len(x.postings[terms[i]]) < len(x.postings[terms[j]]) })
+	var results []string
+	for doc := range x.postings[terms[0]] {
+		if !strings.HasPrefix(doc, prefix) {
+			continue
+		}
+		found := true
+		for _, t := range terms[1:] {
+			if _, ok := x.postings[t][doc]; !ok {
+				found = false
+				break
+			}
+		}
+		if found {
+			results = append(results, doc)
+		}
+	}
+	sort.Strings(results)
+	if len(results) > limit {
+		results = results[:limit]
+	}
+	return results
+}
+
+func uniqueTerms(text string) []string {
+	seen := make(map[string]struct{})
+	var terms []string
+	for _, w := range strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	}) {
+		if utf8.RuneCountInString(w) < 2 {
+			continue
+		}
+		if _, ok := seen[w]; !ok {
+			seen[w] = struct{}{}
+			terms = append(terms, w)
+		}
+	}
+	return terms
+}
+
+func isHidden(name string) bool {
+	if *flagShowHidden {
+		return false
+	}
+	for _, part := range strings.Split(name, "/") {
+		if strings.HasPrefix(part, ".") {
+			return true
+		}
+	}
+	return false
+}
+
+// extractText returns the indexable text of a file: PDFs go through
+// pdfText, other files are used as-is when they look like text.
+func extractText(name string, data []byte) string {
+	if strings.EqualFold(path.Ext(name), ".pdf") || bytes.HasPrefix(data, []byte("%PDF-")) {
+		return pdfText(data)
+	}
+	if !strings.HasPrefix(http.DetectContentType(data), "text/") && !utf8.Valid(data) {
+		return ""
+	}
+	return string(data)
+}
+
+// pdfText is a best-effort PDF text extractor: it inflates content streams
+// and collects the string operands of text-showing operators inside BT/ET
+// blocks. Text in fonts with custom encodings comes out garbled, but plain
+// documents produced by office suites index well enough to be found.
+func pdfText(data []byte) string {
+	var out strings.Builder
+	for {
+		i := bytes.Index(data, []byte("stream"))
+		if i < 0 {
+			break
+		}
+		dict := data[:i]
+		if j := bytes.LastIndex(dict, []byte("<<")); j >= 0 {
+			dict = dict[j:]
+		}
+		data = data[i+len("stream"):]
+		data = bytes.TrimLeft(data, "\r\n")
+		end := bytes.Index(data, []byte("endstream"))
+		if end < 0 {
+			break
+		}
+		content := data[:end]
+		data = data[end+len("endstream"):]
+
+		if bytes.Contains(dict, []byte("/FlateDecode")) {
+			r, err := zlib.NewReader(bytes.NewReader(content))
+			if err != nil {
+				continue
+			}
+			content, err = io.ReadAll(io.LimitReader(r, 16<<20))
+			if err != nil && len(content) == 0 {
+				continue
+			}
+		} else if bytes.Contains(dict, []byte("/Filter")) {
+			continue
+		}
+		pdfContentText(&out, content)
+	}
+	return out.String()
+}
+
+func pdfContentText(out *strings.Builder, content []byte) {
+	inText := false
+	for i := 0; i < len(content); i++ {
+		switch c := content[i]; {
+		case c == 'B' && i+1 < len(content) && content[i+1] == 'T':
+			inText = true
+		case c == 'E' && i+1 < len(content) && content[i+1] == 'T':
+			inText = false
+			out.WriteByte('\n')
+		case c == '(' && inText:
+			var s []byte
+			depth := 1
+			for i++; i < len(content) && depth > 0; i++ {
+				switch content[i] {
+				case '\\':
+					i++
+					if i < len(content) {
+						switch content[i] {
+						case 'n', 'r', 't':
+							s = append(s, ' ')
+						default:
+							s = append(s, content[i])
+						}
+					}
+				case '(':
+					depth++
+					s = append(s, '(')
+				case ')':
+					depth--
+					if depth > 0 {
+						s = append(s, ')')
+					}
+				default:
+					s = append(s, content[i])
+				}
+			}
+			i--
+			out.Write(s)
+			out.WriteByte(' ')
+		}
+	}
+}
+
+// basicSearch is the subset of an RFC 5323 basicsearch request the server
+// understands: a scope and either a content match or a name pattern.
+type basicSearch struct {
+	Scope    string `xml:"basicsearch>from>scope>href"`
+	Contains string `xml:"basicsearch>where>contains"`
+	Literal  string `xml:"basicsearch>where>like>literal"`
+}
+
+type searchResponse struct {
+	XMLName   xml.Name         `xml:"D:multistatus"`
+	XMLNS     string           `xml:"xmlns:D,attr"`
+	Responses []searchResource `xml:"D:response"`
+}
+
+type searchResource struct {
+	Href   string `xml:"D:href"`
+	Name   string `xml:"D:propstat>D:prop>D:displayname"`
+	Length int64  `xml:"D:propstat>D:prop>D:getcontentlength"`
+	Mod    string `xml:"D:propstat>D:prop>D:getlastmodified"`
+	Status string `xml:"D:propstat>D:status"`
+}
+
+// handleSearch serves the WebDAV SEARCH method from the content index.
+func handleSearch(fs webdav.FileSystem, w http.ResponseWriter, req *http.Request) {
+	var q basicSearch
+	if err := xml.NewDecoder(io.LimitReader(req.Body, 1<<20)).Decode(&q); err != nil {
+		http.Error(w, "WebDAV: invalid SEARCH body", http.StatusBadRequest)
+		return
+	}
+	text := q.Contains
+	if text == "" {
+		text = strings.Trim(q.Literal, "%")
+	}
+	scope := req.URL.Path
+	if q.Scope != "" {
+		if u, err := url.Parse(q.Scope); err == nil {
+			scope = path.Clean("/" + u.Path)
+		}
+	}
+
+	resp := searchResponse{XMLNS: "DAV:"}
+	for _, name := range searchIndex.search(text, scope, searchMaxResults) {
+		fi, err := fs.Stat(req.Context(), name)
+		if err != nil {
+			continue
+		}
+		resp.Responses = append(resp.Responses, searchResource{
+			Href:   (&url.URL{Path: name}).EscapedPath(),
+			Name:   fi.Name(),
+			Length: fi.Size(),
+			Mod:    fi.ModTime().UTC().Format(http.TimeFormat),
+			Status: "HTTP/1.1 200 OK",
+		})
+	}
+	w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+	w.WriteHeader(http.StatusMultiStatus)
+	io.WriteString(w, xml.Header)
+	xml.NewEncoder(w).Encode(resp)
+}
+
+// writeSearchResults renders the listing search box results for dir.
+func writeSearchResults(fs webdav.FileSystem, w http.ResponseWriter, req *http.Request, query string) {
+	dir := req.URL.Path
+	writeListingHead(w, "Search: "+query, listingNav(dir))
+	results := searchIndex.search(query, dir, searchMaxResults)
+	ctx := req.Context()
+	for _, name := range results {
+		fi, err := fs.Stat(ctx, name)
+		if err != nil {
+			continue
+		}
+		writeListingRow(w, name, strings.TrimPrefix(name, dir), fi)
+	}
+	if len(results) == 0 {
+		fmt.Fprintln(w, "<tr><td></td><td>No matches</td></tr>")
+	}
+	writeListingFoot(w)
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/webdav"
+)
+
+func TestUniqueTerms(t *testing.T) {
+	tests := []struct {
+		text string
+		want []string
+	}{
+		{"Hello, hello WORLD!", []string{"hello", "world"}},
+		{"a b cd", []string{"cd"}},
+		{"über-Straße 42", []string{"über", "straße", "42"}},
+		{"", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.text, func(t *testing.T) {
+			if got := uniqueTerms(tt.text); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("uniqueTerms = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestContentIndexSearch(t *testing.T) {
+	x := newContentIndex("", 1<<20)
+	x.add("/docs/a.txt", "the quick brown fox")
+	x.add("/docs/b.txt", "the lazy brown dog")
+	x.add("/other/c.txt", "quick thinking")
+	x.add("/docs/sub/d.txt", "a brown fox again")
+
+	tests := []struct {
+		name  string
+		query string
+		scope string
+		want  []string
+	}{
+		{"single word", "brown", "/", []string{"/docs/a.txt", "/docs/b.txt", "/docs/sub/d.txt"}},
+		{"all words", "brown fox", "/", []string{"/docs/a.txt", "/docs/sub/d.txt"}},
+		{"case-insensitive", "QUICK", "/", []string{"/docs/a.txt", "/other/c.txt"}},
+		{"scoped", "quick", "/other", []string{"/other/c.txt"}},
+		{"scope with slash", "fox", "/docs/sub/", []string{"/docs/sub/d.txt"}},
+		{"scope is not a prefix match", "quick", "/oth", nil},
+		{"no match", "cat", "/", nil},
+		{"empty query", "", "/", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := x.search(tt.query, tt.scope, 10); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("search = %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	x.add("/docs/a.txt", "replaced content")
+	if got := x.search("fox", "/", 10); !reflect.DeepEqual(got, []string{"/docs/sub/d.txt"}) {
+		t.Errorf("after re-add search = %q", got)
+	}
+	x.remove("/docs")
+	if got := x.search("brown", "/", 10); got != nil {
+		t.Errorf("after removing dir search = %q", got)
+	}
+	if x.len() != 1 {
+		t.Errorf("index has %d docs, want 1", x.len())
+	}
+	for term := range x.postings {
+		if term != "quick" && term != "thinking" {
+			t.Errorf("stale posting %q", term)
+		}
+	}
+}
+
+func pdfWithStream(content string, flate bool) []byte {
+	var stream bytes.Buffer
+	dict := "<< /Length %d >>"
+	if flate {
+		zw := zlib.NewWriter(&stream)
+		zw.Write([]byte(content))
+		zw.Close()
+		dict = "<< /Length %d /Filter /FlateDecode >>"
+	} else {
+		stream.WriteString(content)
+	}
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "%%PDF-1.4\n4 0 obj\n"+dict+"\nstream\n", stream.Len())
+	b.Write(stream.Bytes())
+	b.WriteString("\nendstream\nendobj\n%%EOF\n")
+	return b.Bytes()
+}
+
+func TestExtractText(t *testing.T) {
+	const page = "BT /F1 12 Tf 72 712 Td (Quarterly \\(draft\\) report) Tj ET BT [(Rev) -20 (enue)] TJ ET"
+	tests := []struct {
+		name string
+		file string
+		data []byte
+		want []string
+		not  []string
+	}{
+		{"text", "a.txt", []byte("plain words"), []string{"plain", "words"}, nil},
+		{"binary", "a.bin", []byte{0, 1, 2, 0xff, 0xfe}, nil, []string{"\x00"}},
+		{"pdf flate", "a.pdf", pdfWithStream(page, true), []string{"Quarterly", "(draft)", "Rev", "enue"}, []string{"Tf"}},
+		{"pdf plain", "b.pdf", pdfWithStream(page, false), []string{"report"}, nil},
+		{"pdf unknown filter", "c.pdf", []byte("%PDF-1.4\n<< /Filter /DCTDecode >>\nstream\n(secret) Tj\nendstream\n"), nil, []string{"secret"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := extractText(tt.file, tt.data)
+			for _, w := range tt.want {
+				if !strings.Contains(got, w) {
+					t.Errorf("text %q missing %q", got, w)
+				}
+			}
+			for _, w := range tt.not {
+				if strings.Contains(got, w) {
+					t.Errorf("text %q contains %q", got, w)
+				}
+			}
+		})
+	}
+}
+
+func TestHandleSearch(t *testing.T) {
+	root := t.TempDir()
+	os.MkdirAll(filepath.Join(root, "sub"), 0755)
+	os.WriteFile(filepath.Join(root, "top.txt"), []byte("needle"), 0644)
+	os.WriteFile(filepath.Join(root, "sub", "with space.txt"), []byte("needle haystack"), 0644)
+
+	defer func(x *contentIndex) { searchIndex = x }(searchIndex)
+	searchIndex = newContentIndex(root, 1<<20)
+	searchIndex.rebuild()
+	fs := webdav.Dir(root)
+
+	tests := []struct {
+		name   string
+		path   string
+		body   string
+		status int
+		hrefs  []string
+	}{
+		{"contains", "/", `<D:searchrequest xmlns:D="DAV:"><D:basicsearch><D:where><D:contains>needle</D:contains></D:where></D:basicsearch></D:searchrequest>`,
+			http.StatusMultiStatus, []string{"<D:href>/sub/with%20space.txt</D:href>", "<D:href>/top.txt</D:href>"}},
+		{"scope href", "/", `<D:searchrequest xmlns:D="DAV:"><D:basicsearch><D:from><D:scope><D:href>/sub</D:href></D:scope></D:from><D:where><D:contains>needle</D:contains></D:where></D:basicsearch></D:searchrequest>`,
+			http.StatusMultiStatus, []string{"<D:href>/sub/with%20space.txt</D:href>"}},
+		{"like literal", "/sub/", `<D:searchrequest xmlns:D="DAV:"><D:basicsearch><D:where><D:like><D:prop><D:displayname/></D:prop><D:literal>%haystack%</D:literal></D:like></D:where></D:basicsearch></D:searchrequest>`,
+			http.StatusMultiStatus, []string{"<D:href>/sub/with%20space.txt</D:href>"}},
+		{"bad body", "/", `<nope`, http.StatusBadRequest, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			handleSearch(fs, rec, httptest.NewRequest("SEARCH", tt.path, strings.NewReader(tt.body)))
+			if rec.Code != tt.status {
+				t.Fatalf("status = %d, want %d", rec.Code, tt.status)
+			}
+			if got := strings.Count(rec.Body.String(), "<D:href>"); got != len(tt.hrefs) {
+				t.Errorf("got %d results, want %d: %s", got, len(tt.hrefs), rec.Body)
+			}
+			for _, h := range tt.hrefs {
+				if !strings.Contains(rec.Body.String(), h) {
+					t.Errorf("response missing %s: %s", h, rec.Body)
+				}
+			}
+		})
+	}
+}
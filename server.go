@@ -0,0 +1,65 @@
+package main
+
+import (
+	"flag"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+var (
+	flagMaxHeaderBytes = flag.Int("max-header-bytes", http.DefaultMaxHeaderBytes, "largest request header, in bytes, the server accepts")
+	flagKeepAlive      = flag.Bool("keep-alive", true, "reuse client connections for further requests; disable to close each one after its response")
+	flagIdleTimeout    = flag.Duration("idle-timeout", 0, "close keep-alive connections idle for this long (0 for no limit)")
+	flagMaxIdleConns   = flag.Int("max-idle-conns", 0, "keep at most this many idle keep-alive connections open, closing the longest idle ones (0 for no limit)")
+)
+
+// newServer returns the HTTP server for handler, tuned by the flags above.
+func newServer(handler http.Handler) *http.Server {
+	srv := &http.Server{
+		Handler:        handler,
+		MaxHeaderBytes: *flagMaxHeaderBytes,
+		IdleTimeout:    *flagIdleTimeout,
+	}
+	if *flagMaxIdleConns > 0 {
+		srv.ConnState = newIdleLimiter(*flagMaxIdleConns).track
+	}
+	srv.SetKeepAlivesEnabled(*flagKeepAlive)
+	return srv
+}
+
+// idleLimiter closes the longest idle keep-alive connections once more
+// than max of them are open, so idle clients can't tie up the file
+// descriptors and memory of a small device.
+type idleLimiter struct {
+	max int
+
+	mu   sync.Mutex
+	idle map[net.Conn]time.Time
+}
+
+func newIdleLimiter(max int) *idleLimiter {
+	return &idleLimiter{max: max, idle: make(map[net.Conn]time.Time)}
+}
+
+func (l *idleLimiter) track(c net.Conn, state http.ConnState) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if state != http.StateIdle {
+		delete(l.idle, c)
+		return
+	}
+	l.idle[c] = time.Now()
+	for len(l.idle) > l.max {
+		var oldest net.Conn
+		var since time.Time
+		for conn, t := range l.idle {
+			if oldest == nil || t.Before(since) {
+				oldest, since = conn, t
+			}
+		}
+		delete(l.idle, oldest)
+		oldest.Close()
+	}
+}
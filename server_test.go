@@ -0,0 +1,52 @@
+package main
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestIdleLimiter(t *testing.T) {
+	l := newIdleLimiter(2)
+	var conns []net.Conn
+	for i := 0; i < 3; i++ {
+		c, peer := net.Pipe()
+		defer peer.Close()
+		conns = append(conns, c)
+		l.track(c, http.StateNew)
+		l.track(c, http.StateActive)
+		l.track(c, http.StateIdle)
+		time.Sleep(time.Millisecond)
+	}
+	if len(l.idle) != 2 {
+		t.Errorf("%d idle connections tracked, want 2", len(l.idle))
+	}
+	if _, err := conns[0].Write([]byte("x")); err != io.ErrClosedPipe {
+		t.Errorf("oldest idle connection is still open: %v", err)
+	}
+	l.track(conns[1], http.StateActive)
+	l.track(conns[2], http.StateClosed)
+	if len(l.idle) != 0 {
+		t.Errorf("%d idle connections tracked after they went busy or closed", len(l.idle))
+	}
+}
+
+func TestNewServerKeepAlive(t *testing.T) {
+	defer func(v bool) { *flagKeepAlive = v }(*flagKeepAlive)
+	*flagKeepAlive = false
+	srv := httptest.NewUnstartedServer(nil)
+	srv.Config = newServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}))
+	srv.Start()
+	defer srv.Close()
+	resp, err := http.Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if !resp.Close {
+		t.Error("connection kept alive with -keep-alive=false")
+	}
+}
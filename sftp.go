@@ -0,0 +1,409 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"sync"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/net/context"
+	"golang.org/x/net/webdav"
+)
+
+var (
+	flagSFTPAddr           = flag.String("sftp", "", "also serve the root over SFTP on this address, e.g. :2022 (disabled when empty)")
+	flagSFTPHostKey        = flag.String("sftp-host-key", "", "SSH host key file, generated if missing (default: ssh_host_ed25519_key in -state-dir)")
+	flagSFTPAuthorizedKeys = flag.String("sftp-authorized-keys", "", "authorized_keys file of public keys allowed to log in over SFTP")
+)
+
+// loadHostKey reads the SSH host key at p, creating an ed25519 key there on
+// first use so clients see the same host key across restarts.
+func loadHostKey(p string) (ssh.Signer, error) {
+	data, err := os.ReadFile(p)
+	if errors.Is(err, os.ErrNotExist) {
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		block, err := ssh.MarshalPrivateKey(key, "gowebdav host key")
+		if err != nil {
+			return nil, err
+		}
+		data = pem.EncodeToMemory(block)
+		if err := os.WriteFile(p, data, 0600); err != nil {
+			return nil, err
+		}
+		log.Printf("Generated SFTP host key %s", p)
+	} else if err != nil {
+		return nil, err
+	}
+	return ssh.ParsePrivateKey(data)
+}
+
+func loadAuthorizedKeys(p string) (map[string]bool, error) {
+	data, err := os.ReadFile(p)
+	if err != nil {
+		return nil, err
+	}
+	keys := make(map[string]bool)
+	for len(data) > 0 {
+		key, _, _, rest, err := ssh.ParseAuthorizedKey(data)
+		if err != nil {
+			break
+		}
+		keys[string(key.Marshal())] = true
+		data = rest
+	}
+	return keys, nil
+}
+
+// sftpConfig authenticates with the HTTP credentials or the authorized
+// keys. With neither configured, anyone may log in, as over HTTP.
+func sftpConfig(hostKey ssh.Signer, authorizedKeys map[string]bool) *ssh.ServerConfig {
+	config := &ssh.ServerConfig{}
+	if *flagUserName != "" && *flagPassword != "" {
+		config.PasswordCallback = func(c ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			if subtle.ConstantTimeCompare([]byte(c.User()), []byte(*flagUserName)) == 1 &&
+				subtle.ConstantTimeCompare(password, []byte(*flagPassword)) == 1 {
+				return nil, nil
+			}
+			log.Printf("SFTP: login failed for %q from %s", c.User(), c.RemoteAddr())
+			return nil, errors.New("login incorrect")
+		}
+	}
+	if len(authorizedKeys) > 0 {
+		config.PublicKeyCallback = func(c ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if authorizedKeys[string(key.Marshal())] {
+				return nil, nil
+			}
+			return nil, errors.New("unknown key")
+		}
+	}
+	config.NoClientAuth = config.PasswordCallback == nil && config.PublicKeyCallback == nil
+	config.AddHostKey(hostKey)
+	return config
+}
+
+func startSFTP(fs webdav.FileSystem) error {
+	keyFile := *flagSFTPHostKey
+	if keyFile == "" {
+		dir, err := stateDir()
+		if err != nil {
+			return err
+		}
+		keyFile = filepath.Join(dir, "ssh_host_ed25519_key")
+	}
+	hostKey, err := loadHostKey(keyFile)
+	if err != nil {
+		return err
+	}
+	var authorizedKeys map[string]bool
+	if *flagSFTPAuthorizedKeys != "" {
+		if authorizedKeys, err = loadAuthorizedKeys(*flagSFTPAuthorizedKeys); err != nil {
+			return err
+		}
+	}
+	ln, err := net.Listen("tcp", *flagSFTPAddr)
+	if err != nil {
+		return err
+	}
+	log.Printf("Serving SFTP on %s", ln.Addr())
+	onShutdown(func() { ln.Close() })
+	go serveSFTP(ln, sftpConfig(hostKey, authorizedKeys), fs)
+	return nil
+}
+
+func serveSFTP(ln net.Listener, config *ssh.ServerConfig, fs webdav.FileSystem) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			log.Printf("SFTP: %v", err)
+			continue
+		}
+		go handleSSHConn(conn, config, fs)
+	}
+}
+
+// handleSSHConn serves the sftp subsystem on every session channel of an
+// SSH connection, and nothing else: no shells, commands or forwarding.
+func handleSSHConn(conn net.Conn, config *ssh.ServerConfig, fs webdav.FileSystem) {
+	sconn, chans, reqs, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	defer sconn.Close()
+	go ssh.DiscardRequests(reqs)
+	for nc := range chans {
+		if nc.ChannelType() != "session" {
+			nc.Reject(ssh.UnknownChannelType, "only sftp sessions are supported")
+			continue
+		}
+		ch, requests, err := nc.Accept()
+		if err != nil {
+			continue
+		}
+		go func() {
+			defer ch.Close()
+			for req := range requests {
+				ok := req.Type == "subsystem" && len(req.Payload) > 4 && string(req.Payload[4:]) == "sftp"
+				req.Reply(ok, nil)
+				if ok {
+					h := &sftpHandler{fs: fs, user: sconn.User(), remote: sconn.RemoteAddr().String()}
+					srv := sftp.NewRequestServer(ch, sftp.Handlers{FileGet: h, FilePut: h, FileCmd: h, FileList: h})
+					if err := srv.Serve(); err != nil && err != io.EOF {
+						log.Printf("SFTP: %v", err)
+					}
+					srv.Close()
+					return
+				}
+			}
+		}()
+	}
+}
+
+// sftpHandler maps SFTP requests onto the same webdav.FileSystem the HTTP
+// side uses, so hidden probe files, -read-only and -show-hidden behave
+// alike, and logs every change.
+type sftpHandler struct {
+	fs     webdav.FileSystem
+	user   string
+	remote string
+}
+
+func (h *sftpHandler) audit(method, name string, err error) {
+	if err != nil {
+		log.Printf("SFTP: %s %s by %q from %s failed: %v", method, name, h.user, h.remote, err)
+		return
+	}
+	log.Printf("SFTP: %s %s by %q from %s", method, name, h.user, h.remote)
+}
+
+// sftpError turns the errors of SkipBrokenLink, which reports missing files
+// as filepath.SkipDir, into ones the sftp package maps to status codes.
+func sftpError(err error) error {
+	if err == filepath.SkipDir {
+		return os.ErrNotExist
+	}
+	return err
+}
+
+func (h *sftpHandler) Fileread(r *sftp.Request) (io.ReaderAt, error) {
+	f, err := h.fs.OpenFile(context.Background(), r.Filepath, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, sftpError(err)
+	}
+	return &fileAt{f: f}, nil
+}
+
+func (h *sftpHandler) Filewrite(r *sftp.Request) (io.WriterAt, error) {
+	if *flagReadonly {
+		return nil, sftp.ErrSSHFxPermissionDenied
+	}
+	pf := r.Pflags()
+	flags := os.O_WRONLY
+	if pf.Creat {
+		flags |= os.O_CREATE
+	}
+	if pf.Trunc {
+		flags |= os.O_TRUNC
+	}
+	if pf.Excl {
+		flags |= os.O_EXCL
+	}
+	if pf.Append {
+		flags |= os.O_APPEND
+	}
+	f, err := h.fs.OpenFile(context.Background(), r.Filepath, flags, 0644)
+	h.audit("write", r.Filepath, err)
+	if err != nil {
+		return nil, sftpError(err)
+	}
+	name := r.Filepath
+	return &fileAt{f: f, done: func() error {
+		return finishUpload(h.fs, name, h.user, remoteHost(h.remote))
+	}}, nil
+}
+
+func (h *sftpHandler) Filecmd(r *sftp.Request) error {
+	if *flagReadonly {
+		return sftp.ErrSSHFxPermissionDenied
+	}
+	ctx := context.Background()
+	var err error
+	switch r.Method {
+	case "Setstat":
+		// Clients set times and modes after uploads; the tree keeps its own.
+		return nil
+	case "Rename", "PosixRename":
+		err = h.fs.Rename(ctx, r.Filepath, r.Target)
+		h.audit("rename", r.Filepath+" -> "+r.Target, err)
+	case "Rmdir", "Remove":
+		var fi os.FileInfo
+		if fi, err = h.fs.Stat(ctx, r.Filepath); err == nil {
+			if fi.IsDir() != (r.Method == "Rmdir") {
+				return sftp.ErrSSHFxFailure
+			}
+			if fi.IsDir() && !h.isEmpty(r.Filepath) {
+				return sftp.ErrSSHFxFailure
+			}
+			err = h.fs.RemoveAll(ctx, r.Filepath)
+		}
+		h.audit("remove", r.Filepath, err)
+	case "Mkdir":
+		err = h.fs.Mkdir(ctx, r.Filepath, 0755)
+		h.audit("mkdir", r.Filepath, err)
+	default:
+		return sftp.ErrSSHFxOpUnsupported
+	}
+	return sftpError(err)
+}
+
+// isEmpty reports whether dir has no entries at all, hidden ones included.
+func (h *sftpHandler) isEmpty(dir string) bool {
+	f, err := h.fs.OpenFile(context.Background(), dir, os.O_RDONLY, 0)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	fis, err := f.Readdir(1)
+	return len(fis) == 0 && (err == nil || err == io.EOF)
+}
+
+func (h *sftpHandler) Filelist(r *sftp.Request) (sftp.ListerAt, error) {
+	switch r.Method {
+	case "List":
+		fi, err := h.fs.Stat(context.Background(), r.Filepath)
+		if err == nil && !fi.IsDir() {
+			err = os.ErrInvalid
+		}
+		if err != nil {
+			return nil, sftpError(err)
+		}
+		return &dirLister{fs: h.fs, name: r.Filepath}, nil
+	case "Stat", "Lstat":
+		fi, err := h.fs.Stat(context.Background(), r.Filepath)
+		if err != nil {
+			return nil, sftpError(err)
+		}
+		return listerAt{renamedInfo{fi, path.Base(r.Filepath)}}, nil
+	}
+	return nil, sftp.ErrSSHFxOpUnsupported
+}
+
+type listerAt []os.FileInfo
+
+func (l listerAt) ListAt(fis []os.FileInfo, offset int64) (int, error) {
+	if offset >= int64(len(l)) {
+		return 0, io.EOF
+	}
+	n := copy(fis, l[offset:])
+	if n+int(offset) == len(l) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// dirLister lists a directory in name order one page at a time, so a
+// directory of any size is never held whole. Clients read pages in order,
+// so each continues after the last entry of the one before; any other
+// offset is reached by reading from the start.
+type dirLister struct {
+	fs     webdav.FileSystem
+	name   string
+	offset int64
+	after  string
+}
+
+func (l *dirLister) ListAt(fis []os.FileInfo, offset int64) (int, error) {
+	if len(fis) == 0 {
+		return 0, nil
+	}
+	if offset < l.offset {
+		l.offset, l.after = 0, ""
+	}
+	for {
+		page, more, err := readdirPage(context.Background(), l.fs, l.name, l.after, len(fis), os.FileInfo.Name, visibleEntry)
+		if err != nil {
+			return 0, sftpError(err)
+		}
+		skip := int(offset - l.offset)
+		if skip >= len(page) {
+			if !more {
+				return 0, io.EOF
+			}
+			l.offset += int64(len(page))
+			l.after = page[len(page)-1].Name()
+			continue
+		}
+		n := copy(fis, page[skip:])
+		l.offset += int64(skip + n)
+		l.after = page[skip+n-1].Name()
+		if !more && skip+n == len(page) {
+			return n, io.EOF
+		}
+		return n, nil
+	}
+}
+
+// renamedInfo reports the name a file was asked for by, which for the root
+// is "/" rather than the name of the -dir folder.
+type renamedInfo struct {
+	os.FileInfo
+	name string
+}
+
+func (fi renamedInfo) Name() string { return fi.name }
+
+// fileAt gives a webdav.File, which only seeks, the positional reads and
+// writes the sftp package wants. done, if set, finishes an upload once the
+// file is closed.
+type fileAt struct {
+	mu   sync.Mutex
+	f    webdav.File
+	done func() error
+}
+
+func (f *fileAt) ReadAt(p []byte, off int64) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, err := f.f.Seek(off, io.SeekStart); err != nil {
+		return 0, err
+	}
+	n, err := io.ReadFull(f.f, p)
+	if err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	}
+	return n, err
+}
+
+func (f *fileAt) WriteAt(p []byte, off int64) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, err := f.f.Seek(off, io.SeekStart); err != nil {
+		return 0, err
+	}
+	return f.f.Write(p)
+}
+
+func (f *fileAt) Close() error {
+	err := f.f.Close()
+	if err == nil && f.done != nil {
+		err = f.done()
+	}
+	return err
+}
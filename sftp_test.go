@@ -0,0 +1,160 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/net/webdav"
+)
+
+func TestLoadHostKey(t *testing.T) {
+	p := filepath.Join(t.TempDir(), "host_key")
+	first, err := loadHostKey(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, err := loadHostKey(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(first.PublicKey().Marshal()) != string(again.PublicKey().Marshal()) {
+		t.Error("host key changed when loaded again")
+	}
+	if fi, err := os.Stat(p); err != nil || fi.Mode().Perm() != 0600 {
+		t.Errorf("host key file: %v, %v", fi, err)
+	}
+}
+
+func testSFTP(t *testing.T, root string, config *ssh.ServerConfig, auth ssh.AuthMethod) (*sftp.Client, error) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go serveSFTP(ln, config, SkipBrokenLink{webdav.Dir(root)})
+
+	conn, err := ssh.Dial("tcp", ln.Addr().String(), &ssh.ClientConfig{
+		User:            "alice",
+		Auth:            []ssh.AuthMethod{auth},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	t.Cleanup(func() { conn.Close() })
+	return sftp.NewClient(conn)
+}
+
+func TestSFTP(t *testing.T) {
+	root := t.TempDir()
+	os.WriteFile(filepath.Join(root, "hello.txt"), []byte("hello world"), 0644)
+	os.WriteFile(filepath.Join(root, ".secret"), []byte("hidden"), 0644)
+	defer func(u, p string, ro bool) { *flagUserName, *flagPassword, *flagReadonly = u, p, ro }(*flagUserName, *flagPassword, *flagReadonly)
+	*flagUserName, *flagPassword = "alice", "s3cret"
+
+	hostKey, err := loadHostKey(filepath.Join(t.TempDir(), "host_key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, clientKey, _ := ed25519.GenerateKey(rand.Reader)
+	signer, _ := ssh.NewSignerFromKey(clientKey)
+	config := sftpConfig(hostKey, map[string]bool{string(signer.PublicKey().Marshal()): true})
+
+	if _, err := testSFTP(t, root, config, ssh.Password("wrong")); err == nil {
+		t.Fatal("logged in with a wrong password")
+	}
+	if _, err := testSFTP(t, root, config, ssh.PublicKeys(signer)); err != nil {
+		t.Fatalf("public key login: %v", err)
+	}
+	c, err := testSFTP(t, root, config, ssh.Password("s3cret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.Mkdir("/docs"); err != nil {
+		t.Fatal(err)
+	}
+	f, err := c.Create("/docs/note.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(f, "some notes")
+	f.Close()
+	if err := c.Rename("/docs/note.txt", "/docs/renamed.txt"); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err = c.Open("/docs/renamed.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := io.ReadAll(f)
+	f.Close()
+	if string(data) != "some notes" {
+		t.Errorf("read back %q", data)
+	}
+
+	fis, err := c.ReadDir("/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, fi := range fis {
+		names = append(names, fi.Name())
+	}
+	sort.Strings(names)
+	if got := strings.Join(names, ","); got != "docs,hello.txt" {
+		t.Errorf("listing = %s", got)
+	}
+	if fi, err := c.Stat("/hello.txt"); err != nil || fi.Size() != 11 {
+		t.Errorf("stat = %v, %v", fi, err)
+	}
+	if _, err := c.Stat("/missing"); !os.IsNotExist(err) {
+		t.Errorf("stat of missing file: %v", err)
+	}
+	if err := c.RemoveDirectory("/docs"); err == nil {
+		t.Error("removed a non-empty directory")
+	}
+	if err := c.Remove("/docs/renamed.txt"); err != nil {
+		t.Error(err)
+	}
+	if err := c.RemoveDirectory("/docs"); err != nil {
+		t.Error(err)
+	}
+
+	// Uploads are scanned like PUTs.
+	defer func(clamd, mode, action string) {
+		*flagClamd, *flagClamdMode, *flagClamdAction = clamd, mode, action
+	}(*flagClamd, *flagClamdMode, *flagClamdAction)
+	*flagClamd, *flagClamdMode, *flagClamdAction = fakeClamd(t, ""), "inline", "reject"
+	f, err = c.Create("/eicar.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(f, "EICAR")
+	if err := f.Close(); err == nil {
+		t.Error("infected upload closed without error")
+	}
+	if _, err := os.Stat(filepath.Join(root, "eicar.com")); !os.IsNotExist(err) {
+		t.Errorf("infected upload was kept: %v", err)
+	}
+	*flagClamd = ""
+
+	*flagReadonly = true
+	if _, err := c.Create("/new.txt"); err == nil {
+		t.Error("created a file in read-only mode")
+	}
+	if err := c.Remove("/hello.txt"); err == nil {
+		t.Error("removed a file in read-only mode")
+	}
+}
@@ -0,0 +1,383 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+	"golang.org/x/net/webdav"
+)
+
+const sharesState = "shares.json"
+
+// shareLink lets anyone holding its token download one file without
+// credentials, as path?share=TOKEN. MaxDownloads, when set, invalidates the
+// token after that many GETs, range requests included; 1 makes it single
+// use. MaxRate caps the bytes per second sent through the link,
+// shared by all its downloads, and MaxBytes the bytes it may send in total.
+type shareLink struct {
+	Token        string     `json:"token"`
+	Path         string     `json:"path"`
+	Created      time.Time  `json:"created"`
+	Expires      *time.Time `json:"expires,omitempty"`
+	MaxDownloads int        `json:"max_downloads,omitempty"`
+	Downloads    int        `json:"downloads"`
+	MaxRate      int64      `json:"max_rate,omitempty"`
+	MaxBytes     int64      `json:"max_bytes,omitempty"`
+	Transferred  int64      `json:"transferred"`
+
+	limiter *rateLimiter
+}
+
+// URL returns the path and query the share is reached at.
+func (s *shareLink) URL() string {
+	return (&url.URL{Path: s.Path, RawQuery: "share=" + s.Token}).String()
+}
+
+var shares struct {
+	sync.Mutex
+	m map[string]*shareLink
+}
+
+// startShares loads the share links and registers their admin endpoint.
+func startShares(fs webdav.FileSystem) error {
+	shares.m = make(map[string]*shareLink)
+	data, err := readState(sharesState)
+	if err != nil {
+		return err
+	}
+	if data != nil {
+		var list []*shareLink
+		if err := json.Unmarshal(data, &list); err != nil {
+			return err
+		}
+		for _, s := range list {
+			shares.m[s.Token] = s
+		}
+	}
+	handleAdmin("shares", sharesAdmin(fs))
+	return nil
+}
+
+// saveShares writes the share links to the state dir. The caller holds the
+// lock.
+func saveShares() error {
+	list := make([]*shareLink, 0, len(shares.m))
+	for _, s := range shares.m {
+		list = append(list, s)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Created.Before(list[j].Created) })
+	data, err := json.MarshalIndent(list, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeState(sharesState, data)
+}
+
+var (
+	errShareNotFound = errors.New("share link not found")
+	errShareUsedUp   = errors.New("share link has been used up")
+	errShareExpired  = errors.New("share link has expired")
+	errShareBudget   = errors.New("share link has used up its transfer budget")
+)
+
+// useShare checks the token for the file at p and, for a download, counts
+// it. Tokens past their expiry or download limit stay listed but no longer
+// work.
+func useShare(token, p string, download bool) (*shareLink, error) {
+	shares.Lock()
+	defer shares.Unlock()
+	s := shares.m[token]
+	if s == nil || s.Path != p {
+		return nil, errShareNotFound
+	}
+	if s.Expires != nil && time.Now().After(*s.Expires) {
+		return nil, errShareExpired
+	}
+	if s.MaxDownloads > 0 && s.Downloads >= s.MaxDownloads {
+		return nil, errShareUsedUp
+	}
+	if s.MaxBytes > 0 && s.Transferred >= s.MaxBytes {
+		return nil, errShareBudget
+	}
+	if !download {
+		return s, nil
+	}
+	s.Downloads++
+	if err := saveShares(); err != nil {
+		// Serving without being able to count could hand out a single-use
+		// document twice.
+		s.Downloads--
+		log.Printf("Failed to save share links: %v", err)
+		return nil, err
+	}
+	if s.Downloads == s.MaxDownloads {
+		log.Printf("Share link for %s used up after %d downloads", s.Path, s.Downloads)
+	}
+	return s, nil
+}
+
+// handleShare serves requests carrying ?share=, without credentials. It
+// reports whether it answered the request.
+func handleShare(fs webdav.FileSystem, w http.ResponseWriter, req *http.Request) bool {
+	token := req.URL.Query().Get("share")
+	if token == "" || shares.m == nil {
+		return false
+	}
+	if req.Method != "GET" && req.Method != "HEAD" {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "WebDAV: share links are read only", http.StatusMethodNotAllowed)
+		return true
+	}
+	// Check the token before touching the file, and count the download
+	// only once the file is known to be there.
+	s, err := useShare(token, req.URL.Path, false)
+	var (
+		f  webdav.File
+		fi os.FileInfo
+	)
+	if err == nil {
+		if f, err = fs.OpenFile(req.Context(), s.Path, os.O_RDONLY, 0); err != nil {
+			err = errShareNotFound
+		}
+	}
+	if err == nil {
+		defer f.Close()
+		if fi, _ = f.Stat(); fi == nil || fi.IsDir() {
+			err = errShareNotFound
+		} else if req.Method == "GET" && req.Header.Get("Range") == "" && !s.budgetFor(fi.Size()) {
+			// Refuse downloads that would be cut off halfway.
+			err = errShareBudget
+		} else if req.Method == "GET" {
+			// Every GET counts, range requests too: a file can be fetched
+			// whole by ranges just as by a plain download.
+			_, err = useShare(token, req.URL.Path, true)
+		}
+	}
+	switch err {
+	case nil:
+	case errShareNotFound:
+		http.Error(w, "Not Found", http.StatusNotFound)
+		return true
+	case errShareUsedUp, errShareExpired, errShareBudget:
+		http.Error(w, "WebDAV: "+err.Error(), http.StatusGone)
+		return true
+	default:
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return true
+	}
+	// Counted downloads must reach the server every time.
+	w.Header().Set("Cache-Control", "no-store")
+	if s.MaxRate > 0 || s.MaxBytes > 0 {
+		sw := &shareWriter{ResponseWriter: w, ctx: req.Context(), s: s}
+		defer sw.save()
+		w = sw
+	}
+	http.ServeContent(w, req, fi.Name(), fi.ModTime(), f)
+	return true
+}
+
+// budgetFor reports whether the link may still send size bytes.
+func (s *shareLink) budgetFor(size int64) bool {
+	shares.Lock()
+	defer shares.Unlock()
+	return s.MaxBytes == 0 || s.MaxBytes-s.Transferred >= size
+}
+
+// take reserves up to n bytes of the link's transfer budget and returns how
+// many it may send, along with the limiter pacing them.
+func (s *shareLink) take(n int) (int, *rateLimiter, error) {
+	shares.Lock()
+	defer shares.Unlock()
+	if s.MaxBytes > 0 {
+		left := s.MaxBytes - s.Transferred
+		if left <= 0 {
+			return 0, nil, errShareBudget
+		}
+		if int64(n) > left {
+			n = int(left)
+		}
+	}
+	s.Transferred += int64(n)
+	if s.MaxRate > 0 && s.limiter == nil {
+		s.limiter = &rateLimiter{rate: s.MaxRate}
+	}
+	return n, s.limiter, nil
+}
+
+// shareChunk is the most a shareWriter sends at once, so that rate limited
+// downloads progress smoothly and budgets are not overshot.
+const shareChunk = 16 << 10
+
+// shareWriter sends a response through a share link's rate limit and
+// transfer budget. Once the budget runs out, writes fail and the response
+// is cut short.
+type shareWriter struct {
+	http.ResponseWriter
+	ctx  context.Context
+	s    *shareLink
+	sent bool
+}
+
+func (w *shareWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := len(p)
+		if n > shareChunk {
+			n = shareChunk
+		}
+		n, limiter, err := w.s.take(n)
+		if err != nil {
+			return written, err
+		}
+		w.sent = true
+		if limiter != nil {
+			if err := limiter.wait(w.ctx, n); err != nil {
+				return written, err
+			}
+		}
+		m, err := w.ResponseWriter.Write(p[:n])
+		written += m
+		if err != nil {
+			return written, err
+		}
+		p = p[m:]
+	}
+	return written, nil
+}
+
+// save records the bytes sent in the state dir.
+func (w *shareWriter) save() {
+	if !w.sent {
+		return
+	}
+	shares.Lock()
+	defer shares.Unlock()
+	if err := saveShares(); err != nil {
+		log.Printf("Failed to save share links: %v", err)
+	}
+}
+
+// rateLimiter paces writes to rate bytes per second, however many
+// goroutines share it.
+type rateLimiter struct {
+	rate int64
+	mu   sync.Mutex
+	next time.Time
+}
+
+// wait blocks until n more bytes may be sent.
+func (l *rateLimiter) wait(ctx context.Context, n int) error {
+	l.mu.Lock()
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	start := l.next
+	l.next = l.next.Add(time.Duration(int64(n) * int64(time.Second) / l.rate))
+	l.mu.Unlock()
+	d := start.Sub(now)
+	if d <= 0 {
+		return nil
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// shareRequest is the body of a POST to the shares admin endpoint.
+type shareRequest struct {
+	Path         string     `json:"path"`
+	Expires      *time.Time `json:"expires,omitempty"`
+	MaxDownloads int        `json:"max_downloads,omitempty"`
+	MaxRate      int64      `json:"max_rate,omitempty"`
+	MaxBytes     int64      `json:"max_bytes,omitempty"`
+}
+
+// sharesAdmin lists the share links on GET, creates one for a file of fs
+// from the JSON body of a POST and removes the one named by ?token= on
+// DELETE.
+func sharesAdmin(fs webdav.FileSystem) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		switch req.Method {
+		case "GET":
+			shares.Lock()
+			list := make([]*shareLink, 0, len(shares.m))
+			for _, s := range shares.m {
+				c := *s
+				list = append(list, &c)
+			}
+			shares.Unlock()
+			sort.Slice(list, func(i, j int) bool { return list[i].Created.Before(list[j].Created) })
+			writeJSON(w, http.StatusOK, list)
+		case "POST":
+			var r shareRequest
+			if err := json.NewDecoder(http.MaxBytesReader(w, req.Body, 64<<10)).Decode(&r); err != nil {
+				http.Error(w, "invalid share: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+			r.Path = path.Clean("/" + r.Path)
+			if r.MaxDownloads < 0 || r.MaxRate < 0 || r.MaxBytes < 0 {
+				http.Error(w, "max_downloads, max_rate and max_bytes must not be negative", http.StatusBadRequest)
+				return
+			}
+			fi, err := fs.Stat(req.Context(), r.Path)
+			if err != nil || !fi.Mode().IsRegular() {
+				http.Error(w, "path is not a file", http.StatusBadRequest)
+				return
+			}
+			var b [16]byte
+			if _, err := rand.Read(b[:]); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			s := &shareLink{Token: hex.EncodeToString(b[:]), Path: r.Path, Created: time.Now().UTC(), Expires: r.Expires, MaxDownloads: r.MaxDownloads, MaxRate: r.MaxRate, MaxBytes: r.MaxBytes}
+			shares.Lock()
+			shares.m[s.Token] = s
+			err = saveShares()
+			if err != nil {
+				delete(shares.m, s.Token)
+			}
+			shares.Unlock()
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Location", s.URL())
+			writeJSON(w, http.StatusCreated, s)
+		case "DELETE":
+			token := req.URL.Query().Get("token")
+			shares.Lock()
+			_, ok := shares.m[token]
+			delete(shares.m, token)
+			err := saveShares()
+			shares.Unlock()
+			switch {
+			case !ok:
+				http.Error(w, "unknown share", http.StatusNotFound)
+			case err != nil:
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+			default:
+				w.WriteHeader(http.StatusNoContent)
+			}
+		default:
+			w.Header().Set("Allow", "GET, POST, DELETE")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	}
+}
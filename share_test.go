@@ -0,0 +1,164 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+	"golang.org/x/net/webdav"
+)
+
+func TestShareLinks(t *testing.T) {
+	root := t.TempDir()
+	os.WriteFile(filepath.Join(root, "secret.pdf"), []byte("one-off document"), 0644)
+	os.Mkdir(filepath.Join(root, "dir"), 0755)
+	fs := webdav.Dir(root)
+	*flagStateDir = t.TempDir()
+	defer func() { *flagStateDir = "" }()
+	defer func() { shares.m = nil }()
+	shares.m = make(map[string]*shareLink)
+	admin := sharesAdmin(fs)
+
+	create := func(body string) (*httptest.ResponseRecorder, shareLink) {
+		w := httptest.NewRecorder()
+		admin(w, httptest.NewRequest("POST", "/shares", strings.NewReader(body)))
+		var s shareLink
+		json.NewDecoder(w.Body).Decode(&s)
+		return w, s
+	}
+	if w, _ := create(`{"path": "/dir"}`); w.Code != http.StatusBadRequest {
+		t.Errorf("sharing a folder answered %d", w.Code)
+	}
+	w, s := create(`{"path": "secret.pdf", "max_downloads": 1}`)
+	if w.Code != http.StatusCreated || w.Header().Get("Location") != "/secret.pdf?share="+s.Token {
+		t.Fatalf("create answered %d, Location %q", w.Code, w.Header().Get("Location"))
+	}
+
+	get := func(target, rng string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", target, nil)
+		if rng != "" {
+			req.Header.Set("Range", rng)
+		}
+		w := httptest.NewRecorder()
+		if !handleShare(fs, w, req) {
+			t.Fatalf("%s not handled", target)
+		}
+		return w
+	}
+	if w := get("/other.pdf?share="+s.Token, ""); w.Code != http.StatusNotFound {
+		t.Errorf("token for another path answered %d", w.Code)
+	}
+	if w := get("/secret.pdf?share="+s.Token, ""); w.Code != http.StatusOK || w.Body.String() != "one-off document" {
+		t.Errorf("download answered %d %q", w.Code, w.Body)
+	}
+	if w := get("/secret.pdf?share="+s.Token, ""); w.Code != http.StatusGone {
+		t.Errorf("second download answered %d", w.Code)
+	}
+	// Range requests use the link up too, or they could fetch the whole
+	// file again and again.
+	w, s = create(`{"path": "secret.pdf", "max_downloads": 1}`)
+	if w := get("/secret.pdf?share="+s.Token, "bytes=-999999999999"); w.Code != http.StatusPartialContent || w.Body.String() != "one-off document" {
+		t.Errorf("suffix range answered %d %q", w.Code, w.Body)
+	}
+	for _, rng := range []string{"bytes=-999999999999", "bytes=1-", ""} {
+		if w := get("/secret.pdf?share="+s.Token, rng); w.Code != http.StatusGone {
+			t.Errorf("%q after a suffix range answered %d", rng, w.Code)
+		}
+	}
+
+	req := httptest.NewRequest("PUT", "/secret.pdf?share="+s.Token, strings.NewReader("x"))
+	w = httptest.NewRecorder()
+	if !handleShare(fs, w, req) || w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("PUT answered %d", w.Code)
+	}
+
+	// Links and their counts survive a restart.
+	_, unlimited := create(`{"path": "/secret.pdf"}`)
+	defer func(m *http.ServeMux) { adminMux = m }(adminMux)
+	adminMux = http.NewServeMux()
+	if err := startShares(fs); err != nil {
+		t.Fatal(err)
+	}
+	if len(shares.m) != 3 || shares.m[s.Token].Downloads != 1 {
+		t.Errorf("reloaded shares %v", shares.m)
+	}
+	for i := 0; i < 3; i++ {
+		if w := get("/secret.pdf?share="+unlimited.Token, ""); w.Code != http.StatusOK {
+			t.Errorf("unlimited link answered %d", w.Code)
+		}
+	}
+
+	w = httptest.NewRecorder()
+	admin(w, httptest.NewRequest("DELETE", "/shares?token="+unlimited.Token, nil))
+	if w.Code != http.StatusNoContent {
+		t.Errorf("DELETE answered %d", w.Code)
+	}
+	if w := get("/secret.pdf?share="+unlimited.Token, ""); w.Code != http.StatusNotFound {
+		t.Errorf("deleted link answered %d", w.Code)
+	}
+}
+
+func TestShareLinkLimits(t *testing.T) {
+	root := t.TempDir()
+	os.WriteFile(filepath.Join(root, "big.iso"), []byte("sixteen bytes..."), 0644)
+	fs := webdav.Dir(root)
+	*flagStateDir = t.TempDir()
+	defer func() { *flagStateDir = "" }()
+	defer func() { shares.m = nil }()
+	shares.m = make(map[string]*shareLink)
+
+	w := httptest.NewRecorder()
+	sharesAdmin(fs)(w, httptest.NewRequest("POST", "/shares", strings.NewReader(`{"path": "/big.iso", "max_bytes": 20}`)))
+	var s shareLink
+	json.NewDecoder(w.Body).Decode(&s)
+	get := func(rng string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/big.iso?share="+s.Token, nil)
+		if rng != "" {
+			req.Header.Set("Range", rng)
+		}
+		w := httptest.NewRecorder()
+		handleShare(fs, w, req)
+		return w
+	}
+	if w := get(""); w.Code != http.StatusOK || w.Body.Len() != 16 {
+		t.Fatalf("download answered %d with %d bytes", w.Code, w.Body.Len())
+	}
+	// 4 bytes are left: not enough for the file, and a range gets cut short.
+	if w := get(""); w.Code != http.StatusGone {
+		t.Errorf("download past the budget answered %d", w.Code)
+	}
+	if w := get("bytes=8-"); w.Body.String() != "byte" {
+		t.Errorf("range past the budget sent %q", w.Body)
+	}
+	if w := get("bytes=0-3"); w.Code != http.StatusGone {
+		t.Errorf("range after the budget ran out answered %d", w.Code)
+	}
+	if shares.m[s.Token].Transferred != 20 {
+		t.Errorf("transferred %d bytes, want 20", shares.m[s.Token].Transferred)
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	l := &rateLimiter{rate: 10000}
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		if err := l.wait(context.Background(), 2500); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The first 2500 bytes go at once, the rest take 250ms each.
+	if d := time.Since(start); d < 450*time.Millisecond || d > 2*time.Second {
+		t.Errorf("7500 bytes at 10000/s let through after %v", d)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := l.wait(ctx, 10000); err == nil {
+		t.Error("wait ignored a canceled context")
+	}
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var flagSignedMaxAge = flag.Duration("signed-max-age", 24*time.Hour, "longest lifetime of the signed folder URLs issued by the admin API")
+
+const (
+	signingKeyState = "signing.key"
+	signedCookie    = "gowebdav_sig"
+)
+
+// signingKey signs folder access tokens. It is kept in the state dir so
+// tokens survive a restart.
+var signingKey []byte
+
+func startSigning() error {
+	key, err := readState(signingKeyState)
+	if err != nil {
+		return err
+	}
+	if len(key) < 32 {
+		key = make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			return err
+		}
+		if err := writeState(signingKeyState, key); err != nil {
+			return err
+		}
+	}
+	signingKey = key
+	handleAdmin("sign", serveSignAdmin)
+	return nil
+}
+
+// signScope returns a token granting read access below the folder scope
+// until expires. It reads scope.expiry.mac, all base64url or decimal.
+func signScope(scope string, expires time.Time) string {
+	enc := base64.RawURLEncoding
+	payload := enc.EncodeToString([]byte(scope)) + "." + strconv.FormatInt(expires.Unix(), 10)
+	m := hmac.New(sha256.New, signingKey)
+	m.Write([]byte(payload))
+	return payload + "." + enc.EncodeToString(m.Sum(nil))
+}
+
+// verifyScope returns the folder a token grants access to, and when it
+// stops doing so.
+func verifyScope(token string) (string, time.Time, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 || signingKey == nil {
+		return "", time.Time{}, errors.New("malformed token")
+	}
+	enc := base64.RawURLEncoding
+	mac, err := enc.DecodeString(parts[2])
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	m := hmac.New(sha256.New, signingKey)
+	m.Write([]byte(parts[0] + "." + parts[1]))
+	if !hmac.Equal(mac, m.Sum(nil)) {
+		return "", time.Time{}, errors.New("bad signature")
+	}
+	scope, err := enc.DecodeString(parts[0])
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	exp, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	expires := time.Unix(exp, 0)
+	if time.Now().After(expires) {
+		return "", time.Time{}, errors.New("token expired")
+	}
+	return string(scope), expires, nil
+}
+
+func inScope(p, scope string) bool {
+	return scope == "/" || p == scope || strings.HasPrefix(p, scope+"/")
+}
+
+// signedAccess reports whether req may read without credentials, because
+// it carries a valid ?sig= token or cookie for a folder above its path.
+// A valid ?sig= also sets the cookie, scoped to the folder, so the pages
+// and images loaded from there need no token of their own.
+func signedAccess(w http.ResponseWriter, req *http.Request) bool {
+	if signingKey == nil || req.Method != "GET" && req.Method != "HEAD" {
+		return false
+	}
+	if token := req.URL.Query().Get("sig"); token != "" {
+		scope, expires, err := verifyScope(token)
+		if err != nil || !inScope(req.URL.Path, scope) {
+			return false
+		}
+		cookiePath := scope
+		if cookiePath != "/" {
+			cookiePath += "/"
+		}
+		http.SetCookie(w, &http.Cookie{
+			Name:     signedCookie,
+			Value:    token,
+			Path:     cookiePath,
+			Expires:  expires,
+			HttpOnly: true,
+			Secure:   req.TLS != nil,
+			SameSite: http.SameSiteLaxMode,
+		})
+		return true
+	}
+	// Cookies for several folders may be sent; any one will do.
+	for _, c := range req.Cookies() {
+		if c.Name != signedCookie {
+			continue
+		}
+		if scope, _, err := verifyScope(c.Value); err == nil && inScope(req.URL.Path, scope) {
+			return true
+		}
+	}
+	return false
+}
+
+// serveSignAdmin issues a signed URL on POST of {"path": ..., "ttl": ...},
+// ttl being a duration such as "2h".
+func serveSignAdmin(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var r struct {
+		Path string `json:"path"`
+		TTL  string `json:"ttl"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, req.Body, 64<<10)).Decode(&r); err != nil {
+		http.Error(w, "invalid request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	ttl := time.Hour
+	if r.TTL != "" {
+		var err error
+		if ttl, err = time.ParseDuration(r.TTL); err != nil || ttl <= 0 {
+			http.Error(w, fmt.Sprintf("invalid ttl %q", r.TTL), http.StatusBadRequest)
+			return
+		}
+	}
+	if ttl > *flagSignedMaxAge {
+		http.Error(w, fmt.Sprintf("ttl is longer than -signed-max-age %s", *flagSignedMaxAge), http.StatusBadRequest)
+		return
+	}
+	scope := path.Clean("/" + r.Path)
+	expires := time.Now().Add(ttl).Truncate(time.Second)
+	token := signScope(scope, expires)
+	writeJSON(w, http.StatusCreated, map[string]interface{}{
+		"path":    scope,
+		"expires": expires.UTC(),
+		"token":   token,
+		"url":     (&url.URL{Path: scope, RawQuery: "sig=" + token}).String(),
+	})
+}
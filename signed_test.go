@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSignedAccess(t *testing.T) {
+	*flagStateDir = t.TempDir()
+	defer func() { *flagStateDir = "" }()
+	defer func(k []byte) { signingKey = k }(signingKey)
+	defer func(m *http.ServeMux) { adminMux = m }(adminMux)
+	adminMux = http.NewServeMux()
+	if err := startSigning(); err != nil {
+		t.Fatal(err)
+	}
+	key := signingKey
+
+	w := httptest.NewRecorder()
+	serveSignAdmin(w, httptest.NewRequest("POST", "/sign", strings.NewReader(`{"path": "/gallery", "ttl": "30m"}`)))
+	var issued struct {
+		URL, Token string
+		Expires    time.Time
+	}
+	json.NewDecoder(w.Body).Decode(&issued)
+	if w.Code != http.StatusCreated || !strings.HasPrefix(issued.URL, "/gallery?sig=") || time.Until(issued.Expires) > 30*time.Minute {
+		t.Fatalf("sign answered %d %+v", w.Code, issued)
+	}
+	w = httptest.NewRecorder()
+	serveSignAdmin(w, httptest.NewRequest("POST", "/sign", strings.NewReader(`{"path": "/gallery", "ttl": "48h"}`)))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("ttl past -signed-max-age answered %d", w.Code)
+	}
+
+	access := func(method, target string, cookie *http.Cookie) (bool, []*http.Cookie) {
+		req := httptest.NewRequest(method, target, nil)
+		if cookie != nil {
+			req.AddCookie(cookie)
+		}
+		w := httptest.NewRecorder()
+		ok := signedAccess(w, req)
+		return ok, w.Result().Cookies()
+	}
+	ok, cookies := access("GET", "/gallery/index.html?sig="+issued.Token, nil)
+	if !ok || len(cookies) != 1 || cookies[0].Path != "/gallery/" {
+		t.Fatalf("signed URL: access %v, cookies %v", ok, cookies)
+	}
+	for _, tt := range []struct {
+		method, target string
+		want           bool
+	}{
+		{"GET", "/gallery/img/1.jpg", true},
+		{"HEAD", "/gallery/2.jpg", true},
+		{"PUT", "/gallery/3.jpg", false},
+		{"GET", "/galleryx/1.jpg", false},
+		{"GET", "/private/1.jpg", false},
+	} {
+		if got, _ := access(tt.method, tt.target, cookies[0]); got != tt.want {
+			t.Errorf("%s %s with cookie: access %v, want %v", tt.method, tt.target, got, tt.want)
+		}
+	}
+	if ok, _ := access("GET", "/private/x.jpg?sig="+issued.Token, nil); ok {
+		t.Error("token granted access outside its folder")
+	}
+	forged := strings.Replace(issued.Token, issued.Token[:4], "Lw", 1)
+	if ok, _ := access("GET", "/x.jpg?sig="+forged, nil); ok {
+		t.Error("forged token granted access")
+	}
+	if ok, _ := access("GET", "/gallery/a.jpg?sig="+signScope("/gallery", time.Now().Add(-time.Second)), nil); ok {
+		t.Error("expired token granted access")
+	}
+
+	// The key, and so the tokens, survive a restart.
+	adminMux = http.NewServeMux()
+	startSigning()
+	if string(signingKey) != string(key) {
+		t.Error("signing key changed across restarts")
+	}
+}
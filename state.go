@@ -0,0 +1,273 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+var flagStateDir = flag.String("state-dir", "", "directory for server state that is not files, such as share links and locks (default: user config dir)")
+
+const (
+	stateManifest = "manifest.json"
+	stateVersion  = 1
+)
+
+// stateDir returns the directory features keep their persistent state in,
+// creating it if needed.
+func stateDir() (string, error) {
+	dir := *flagStateDir
+	if dir == "" {
+		base, err := os.UserConfigDir()
+		if err != nil {
+			return "", err
+		}
+		dir = filepath.Join(base, "gowebdav")
+	}
+	return dir, os.MkdirAll(dir, 0700)
+}
+
+// readState reads a state file, returning nil data if it doesn't exist yet.
+func readState(name string) ([]byte, error) {
+	dir, err := stateDir()
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(filepath.Join(dir, name))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	return data, err
+}
+
+// writeState replaces a state file atomically, so a concurrent export or a
+// crash never sees it half written.
+func writeState(name string, data []byte) error {
+	dir, err := stateDir()
+	if err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(dir, "."+name+".tmp-*")
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), filepath.Join(dir, name))
+}
+
+// stateArchive describes an export. Settings records the flags the
+// exporting server was started with, secrets left out, so the new host can
+// be started the same way.
+type stateArchive struct {
+	Version  int               `json:"version"`
+	Exported time.Time         `json:"exported"`
+	Host     string            `json:"host,omitempty"`
+	Files    []string          `json:"files"`
+	Settings map[string]string `json:"settings,omitempty"`
+}
+
+func isSecretFlag(name string) bool {
+	for _, s := range []string{"password", "secret", "token", "key"} {
+		if strings.Contains(name, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// exportState writes the state dir and the current settings to w as a
+// tar.gz archive.
+func exportState(dir string, w io.Writer) error {
+	var names []string
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() || strings.HasPrefix(d.Name(), ".") {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		names = append(names, filepath.ToSlash(rel))
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	sort.Strings(names)
+
+	m := stateArchive{Version: stateVersion, Exported: time.Now().UTC(), Files: names, Settings: make(map[string]string)}
+	m.Host, _ = os.Hostname()
+	flag.Visit(func(f *flag.Flag) {
+		if !isSecretFlag(f.Name) {
+			m.Settings[f.Name] = f.Value.String()
+		}
+	})
+	manifest, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	if err := tw.WriteHeader(&tar.Header{Name: stateManifest, Mode: 0600, Size: int64(len(manifest)), ModTime: m.Exported}); err != nil {
+		return err
+	}
+	if _, err := tw.Write(manifest); err != nil {
+		return err
+	}
+	for _, name := range names {
+		data, err := os.ReadFile(filepath.Join(dir, filepath.FromSlash(name)))
+		if err != nil {
+			return err
+		}
+		hdr := &tar.Header{Name: "state/" + name, Mode: 0600, Size: int64(len(data)), ModTime: m.Exported}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if _, err := tw.Write(data); err != nil {
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+// importState restores the state files from an archive written by
+// exportState into dir, replacing files of the same name, and returns its
+// manifest.
+func importState(dir string, r io.Reader) (*stateArchive, error) {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	tr := tar.NewReader(gz)
+	var m *stateArchive
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if hdr.Name == stateManifest {
+			m = new(stateArchive)
+			if err := json.NewDecoder(tr).Decode(m); err != nil {
+				return nil, fmt.Errorf("bad manifest: %v", err)
+			}
+			if m.Version != stateVersion {
+				return nil, fmt.Errorf("unsupported state version %d", m.Version)
+			}
+			continue
+		}
+		if m == nil {
+			return nil, errors.New("not a gowebdav state archive")
+		}
+		rel := strings.TrimPrefix(hdr.Name, "state/")
+		if rel == hdr.Name || hdr.Typeflag != tar.TypeReg || !fs.ValidPath(rel) || path.Base(rel)[0] == '.' {
+			return nil, fmt.Errorf("unexpected entry %q", hdr.Name)
+		}
+		data, err := io.ReadAll(tr)
+		if err != nil {
+			return nil, err
+		}
+		p := filepath.Join(dir, filepath.FromSlash(rel))
+		if err := os.MkdirAll(filepath.Dir(p), 0700); err != nil {
+			return nil, err
+		}
+		if err := os.WriteFile(p, data, 0600); err != nil {
+			return nil, err
+		}
+	}
+	if m == nil {
+		return nil, errors.New("not a gowebdav state archive")
+	}
+	return m, nil
+}
+
+// runStateCommand handles "export-state FILE" and "import-state FILE", with
+// "-" for stdout or stdin. It reports whether args named such a command.
+func runStateCommand(args []string) bool {
+	if len(args) == 0 || (args[0] != "export-state" && args[0] != "import-state") {
+		return false
+	}
+	if len(args) != 2 {
+		fmt.Fprintf(os.Stderr, "Usage: gowebdav [flags] %s FILE\n", args[0])
+		os.Exit(2)
+	}
+	dir, err := stateDir()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	if args[0] == "export-state" {
+		out := os.Stdout
+		if args[1] != "-" {
+			if out, err = os.Create(args[1]); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				os.Exit(1)
+			}
+		}
+		err = exportState(dir, out)
+		if cerr := out.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to export state: %v\n", err)
+			os.Exit(1)
+		}
+		return true
+	}
+
+	in := os.Stdin
+	if args[1] != "-" {
+		if in, err = os.Open(args[1]); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		defer in.Close()
+	}
+	m, err := importState(dir, in)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to import state: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Fprintf(os.Stderr, "Imported %d state files exported from %s at %s into %s\n", len(m.Files), m.Host, m.Exported.Format(time.RFC3339), dir)
+	if len(m.Settings) > 0 {
+		var names []string
+		for name := range m.Settings {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		fmt.Fprintln(os.Stderr, "It was started with:")
+		for _, name := range names {
+			fmt.Fprintf(os.Stderr, "  -%s=%s\n", name, m.Settings[name])
+		}
+	}
+	return true
+}
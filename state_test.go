@@ -0,0 +1,80 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestStateRoundTrip(t *testing.T) {
+	defer func(dir string) { *flagStateDir = dir }(*flagStateDir)
+	*flagStateDir = t.TempDir()
+	if err := writeState("shares.json", []byte(`{"abc":"/docs"}`)); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeState("locks.json", []byte(`[]`)); err != nil {
+		t.Fatal(err)
+	}
+	os.WriteFile(filepath.Join(*flagStateDir, ".shares.json.tmp-1"), []byte("partial"), 0600)
+
+	var buf bytes.Buffer
+	if err := exportState(*flagStateDir, &buf); err != nil {
+		t.Fatal(err)
+	}
+	*flagStateDir = t.TempDir()
+	m, err := importState(*flagStateDir, &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(m.Files, ","); got != "locks.json,shares.json" {
+		t.Errorf("files = %s", got)
+	}
+	data, err := readState("shares.json")
+	if err != nil || string(data) != `{"abc":"/docs"}` {
+		t.Errorf("shares.json = %q, %v", data, err)
+	}
+	if data, err := readState("missing.json"); data != nil || err != nil {
+		t.Errorf("missing state = %q, %v; want nil, nil", data, err)
+	}
+}
+
+func TestImportStateRejects(t *testing.T) {
+	archive := func(entries ...string) *bytes.Buffer {
+		var buf bytes.Buffer
+		gz := gzip.NewWriter(&buf)
+		tw := tar.NewWriter(gz)
+		for _, e := range entries {
+			name, body, _ := strings.Cut(e, "=")
+			tw.WriteHeader(&tar.Header{Name: name, Mode: 0600, Size: int64(len(body))})
+			tw.Write([]byte(body))
+		}
+		tw.Close()
+		gz.Close()
+		return &buf
+	}
+	manifest := stateManifest + `={"version":1}`
+	tests := []struct {
+		name    string
+		archive *bytes.Buffer
+		wantErr string
+	}{
+		{"no manifest", archive("state/a.json=x"), "not a gowebdav state archive"},
+		{"empty", archive(), "not a gowebdav state archive"},
+		{"future version", archive(stateManifest + `={"version":9}`), "unsupported state version"},
+		{"escape", archive(manifest, "state/../../etc/passwd=x"), "unexpected entry"},
+		{"outside state", archive(manifest, "other/a.json=x"), "unexpected entry"},
+		{"not gzip", bytes.NewBufferString("plain text, not an archive"), "gzip"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := importState(t.TempDir(), tt.archive)
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("err = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"flag"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+
+	"golang.org/x/net/webdav"
+)
+
+var (
+	flagStaticSites = flag.String("static-sites", "", "comma-separated folders to serve as static websites, with index.html, clean URLs and 404.html, e.g. /www (use / for the whole root)")
+	flagSPASites    = flag.String("spa-sites", "", "comma-separated folders to serve as single-page apps: static sites whose unknown pages get the site's index.html")
+)
+
+var (
+	// staticSites lists the roots of the folders served as websites.
+	staticSites []string
+	// spaSites holds the static sites that are single-page apps.
+	spaSites map[string]bool
+)
+
+func startStaticSites() {
+	for _, dir := range strings.Split(*flagStaticSites, ",") {
+		if dir = strings.TrimSpace(dir); dir != "" {
+			staticSites = append(staticSites, path.Clean("/"+dir))
+		}
+	}
+	for _, dir := range strings.Split(*flagSPASites, ",") {
+		if dir = strings.TrimSpace(dir); dir != "" {
+			if spaSites == nil {
+				spaSites = make(map[string]bool)
+			}
+			dir = path.Clean("/" + dir)
+			spaSites[dir] = true
+			staticSites = append(staticSites, dir)
+		}
+	}
+}
+
+// wantsPage reports whether req is a browser navigating to a page, as
+// opposed to a script fetching data or a DAV client fetching a file.
+func wantsPage(req *http.Request) bool {
+	return req.Method == "GET" && strings.Contains(req.Header.Get("Accept"), "text/html")
+}
+
+// siteFor returns the innermost static site containing name.
+func siteFor(name string) (string, bool) {
+	best, found := "", false
+	for _, site := range staticSites {
+		if name == site || site == "/" || strings.HasPrefix(name, site+"/") {
+			if !found || len(site) > len(best) {
+				best, found = site, true
+			}
+		}
+	}
+	return best, found
+}
+
+// serveStatic answers GET and HEAD below a static site the way a web server
+// would: index.html for directories, /page for /page.html, and the site's
+// 404.html for anything missing. Single-page apps get their index.html
+// instead, so the app's router can take over. It reports whether it handled
+// req.
+func serveStatic(fs webdav.FileSystem, w http.ResponseWriter, req *http.Request) bool {
+	name := path.Clean(req.URL.Path)
+	site, ok := siteFor(name)
+	if !ok {
+		return false
+	}
+	ctx := req.Context()
+	fi, err := fs.Stat(ctx, name)
+	switch {
+	case err == nil && fi.IsDir():
+		if !strings.HasSuffix(req.URL.Path, "/") {
+			http.Redirect(w, req, req.URL.Path+"/", http.StatusMovedPermanently)
+			return true
+		}
+		if serveSiteFile(fs, w, req, path.Join(name, "index.html"), http.StatusOK) {
+			return true
+		}
+	case err == nil:
+		return false
+	case path.Ext(name) == "":
+		if serveSiteFile(fs, w, req, name+".html", http.StatusOK) {
+			return true
+		}
+	}
+	if err == nil {
+		// A directory without an index page still gets its listing.
+		return false
+	}
+	if spaSites[site] && wantsPage(req) && serveSiteFile(fs, w, req, path.Join(site, "index.html"), http.StatusOK) {
+		return true
+	}
+	if serveSiteFile(fs, w, req, path.Join(site, "404.html"), http.StatusNotFound) {
+		return true
+	}
+	http.NotFound(w, req)
+	return true
+}
+
+// serveSiteFile serves the page at name with status, or reports false when
+// there is no such page.
+func serveSiteFile(fs webdav.FileSystem, w http.ResponseWriter, req *http.Request, name string, status int) bool {
+	f, err := fs.OpenFile(req.Context(), name, os.O_RDONLY, 0)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil || fi.IsDir() {
+		return false
+	}
+	if status != http.StatusOK {
+		// ServeContent would answer conditional and range requests for the
+		// error page itself with 304s and 206s.
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.WriteHeader(status)
+		if req.Method != "HEAD" {
+			io.Copy(w, f)
+		}
+		return true
+	}
+	http.ServeContent(w, req, fi.Name(), fi.ModTime(), f)
+	return true
+}
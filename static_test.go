@@ -0,0 +1,136 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/webdav"
+)
+
+func TestServeStatic(t *testing.T) {
+	root := t.TempDir()
+	for name, data := range map[string]string{
+		"www/index.html":      "home page",
+		"www/about.html":      "about page",
+		"www/404.html":        "custom not found",
+		"www/blog/index.html": "blog index",
+		"www/img/logo.png":    "png",
+		"www/docs/notes.txt":  "plain notes",
+		"www/shop/index.html": "shop",
+		"private/file.txt":    "dav only",
+	} {
+		p := filepath.Join(root, filepath.FromSlash(name))
+		os.MkdirAll(filepath.Dir(p), 0755)
+		os.WriteFile(p, []byte(data), 0644)
+	}
+	defer func(s []string) { staticSites = s }(staticSites)
+	staticSites = []string{"/www"}
+	fs := SkipBrokenLink{webdav.Dir(root)}
+
+	tests := []struct {
+		method  string
+		target  string
+		handled bool
+		status  int
+		body    string
+	}{
+		{"GET", "/www/", true, http.StatusOK, "home page"},
+		{"GET", "/www", true, http.StatusMovedPermanently, ""},
+		{"GET", "/www/about", true, http.StatusOK, "about page"},
+		{"GET", "/www/about.html", false, 0, ""},
+		{"GET", "/www/blog/", true, http.StatusOK, "blog index"},
+		{"GET", "/www/img/logo.png", false, 0, ""},
+		{"GET", "/www/docs/", false, 0, ""},
+		{"GET", "/www/missing", true, http.StatusNotFound, "custom not found"},
+		{"GET", "/www/img/missing.png", true, http.StatusNotFound, "custom not found"},
+		{"HEAD", "/www/missing", true, http.StatusNotFound, ""},
+		{"GET", "/private/file.txt", false, 0, ""},
+		{"GET", "/private/missing", false, 0, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.method+" "+tt.target, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			handled := serveStatic(fs, rec, httptest.NewRequest(tt.method, tt.target, nil))
+			if handled != tt.handled {
+				t.Fatalf("handled = %v, want %v", handled, tt.handled)
+			}
+			if !handled {
+				return
+			}
+			if rec.Code != tt.status {
+				t.Errorf("status = %d, want %d", rec.Code, tt.status)
+			}
+			if !strings.Contains(rec.Body.String(), tt.body) || tt.method == "HEAD" && rec.Body.Len() > 0 {
+				t.Errorf("body = %q, want %q", rec.Body, tt.body)
+			}
+		})
+	}
+}
+
+func TestSiteFor(t *testing.T) {
+	defer func(s []string) { staticSites = s }(staticSites)
+	staticSites = []string{"/", "/www", "/www/blog"}
+	tests := []struct{ name, want string }{
+		{"/other/file", "/"},
+		{"/www", "/www"},
+		{"/www/page", "/www"},
+		{"/wwwx/page", "/"},
+		{"/www/blog/post", "/www/blog"},
+	}
+	for _, tt := range tests {
+		if got, ok := siteFor(tt.name); !ok || got != tt.want {
+			t.Errorf("siteFor(%q) = %q, %v; want %q", tt.name, got, ok, tt.want)
+		}
+	}
+}
+
+func TestServeSPA(t *testing.T) {
+	root := t.TempDir()
+	for name, data := range map[string]string{
+		"app/index.html":     "app shell",
+		"app/assets/app.js":  "js",
+		"app/settings/x.txt": "file",
+	} {
+		p := filepath.Join(root, filepath.FromSlash(name))
+		os.MkdirAll(filepath.Dir(p), 0755)
+		os.WriteFile(p, []byte(data), 0644)
+	}
+	defer func(s []string, spa map[string]bool) { staticSites, spaSites = s, spa }(staticSites, spaSites)
+	staticSites, spaSites = []string{"/app"}, map[string]bool{"/app": true}
+	fs := SkipBrokenLink{webdav.Dir(root)}
+
+	const browser = "text/html,application/xhtml+xml,*/*;q=0.8"
+	tests := []struct {
+		method, target, accept string
+		status                 int
+		body                   string
+	}{
+		{"GET", "/app/users/42", browser, http.StatusOK, "app shell"},
+		{"GET", "/app/", browser, http.StatusOK, "app shell"},
+		// Existing files go on to the DAV handler.
+		{"GET", "/app/assets/app.js", "*/*", 0, ""},
+		{"GET", "/app/assets/missing.js", "*/*", http.StatusNotFound, ""},
+		{"GET", "/app/users/42", "application/json", http.StatusNotFound, ""},
+		{"HEAD", "/app/users/42", browser, http.StatusNotFound, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.method+" "+tt.target+" "+tt.accept, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, tt.target, nil)
+			req.Header.Set("Accept", tt.accept)
+			rec := httptest.NewRecorder()
+			if !serveStatic(fs, rec, req) {
+				if tt.status != 0 {
+					t.Errorf("not handled, want %d", tt.status)
+				}
+				return
+			}
+			if rec.Code != tt.status || !strings.Contains(rec.Body.String(), tt.body) {
+				t.Errorf("got %d %q, want %d %q", rec.Code, rec.Body, tt.status, tt.body)
+			}
+		})
+	}
+}
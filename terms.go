@@ -0,0 +1,103 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"html"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var flagTerms = flag.String("terms", "", "terms of use file (.html, or plain text) browser users must accept once per session before browsing or uploading")
+
+const termsCookie = "gowebdav_terms"
+
+// termsGate holds the terms page. Its version is a hash of the text, so
+// changing the terms asks everybody to accept them again.
+type termsGate struct {
+	body    string
+	version string
+}
+
+var terms *termsGate
+
+func startTerms() error {
+	data, err := os.ReadFile(*flagTerms)
+	if err != nil {
+		return err
+	}
+	sum := sha256.Sum256(data)
+	body := string(data)
+	if ext := strings.ToLower(filepath.Ext(*flagTerms)); ext != ".html" && ext != ".htm" {
+		body = "<pre>" + html.EscapeString(body) + "</pre>"
+	}
+	terms = &termsGate{body: body, version: hex.EncodeToString(sum[:8])}
+	return nil
+}
+
+// isBrowser tells requests from browsers, which send Sec-Fetch headers or
+// ask for HTML, from those of WebDAV clients, which the terms don't gate.
+func isBrowser(req *http.Request) bool {
+	return req.Header.Get("Sec-Fetch-Mode") != "" || strings.Contains(req.Header.Get("Accept"), "text/html")
+}
+
+// handleTerms shows the terms to browsers that have not accepted them in
+// this session, and records acceptance. It reports whether it answered the
+// request.
+func handleTerms(w http.ResponseWriter, req *http.Request) bool {
+	if terms == nil || !isBrowser(req) {
+		return false
+	}
+	if _, ok := req.URL.Query()["terms"]; ok && req.Method == "POST" {
+		user, _, _ := req.BasicAuth()
+		log.Printf("Terms: version %s accepted by %q from %s", terms.version, user, clientIP(req))
+		http.SetCookie(w, &http.Cookie{
+			Name:     termsCookie,
+			Value:    terms.version,
+			Path:     "/",
+			HttpOnly: true,
+			Secure:   req.TLS != nil,
+			SameSite: http.SameSiteLaxMode,
+		})
+		http.Redirect(w, req, req.URL.Path, http.StatusSeeOther)
+		return true
+	}
+	if c, err := req.Cookie(termsCookie); err == nil && c.Value == terms.version {
+		return false
+	}
+	if req.Method != "GET" && req.Method != "HEAD" {
+		http.Error(w, "WebDAV: accept the terms of use first", http.StatusForbidden)
+		return true
+	}
+	action := (&url.URL{Path: req.URL.Path, RawQuery: "terms"}).String()
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusForbidden)
+	fmt.Fprintf(w, `<!DOCTYPE html>
+<html>
+<head>
+	<title>Terms of use</title>
+	<meta charset="utf-8">
+	<meta name="viewport" content="width=device-width, initial-scale=1.0">
+	<style>
+	body { font-family: -apple-system, BlinkMacSystemFont, "Segoe UI", Roboto, sans-serif; max-width: 50em; margin: 3em auto; padding: 0 5%%; line-height: 1.5; }
+	pre { white-space: pre-wrap; font-family: inherit; }
+	.terms { max-height: 60vh; overflow: auto; border: 1px solid #ddd; border-radius: 5px; padding: 1em; }
+	button { margin-top: 1em; padding: 0.5em 1.5em; font-size: 1em; }
+	</style>
+</head>
+<body>
+	<h1>Terms of use</h1>
+	<div class="terms">%s</div>
+	<form method="post" action="%s"><button type="submit">Accept and continue</button></form>
+</body>
+</html>
+`, terms.body, html.EscapeString(action))
+	return true
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestTermsGate(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "terms.txt")
+	os.WriteFile(file, []byte("Be nice & <careful>."), 0644)
+	*flagTerms = file
+	defer func() { *flagTerms = "" }()
+	defer func(g *termsGate) { terms = g }(terms)
+	if err := startTerms(); err != nil {
+		t.Fatal(err)
+	}
+
+	serve := func(method, target string, browser bool, cookie *http.Cookie) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, nil)
+		if browser {
+			req.Header.Set("Accept", "text/html,application/xhtml+xml")
+			req.Header.Set("Sec-Fetch-Mode", "navigate")
+		}
+		if cookie != nil {
+			req.AddCookie(cookie)
+		}
+		w := httptest.NewRecorder()
+		if !handleTerms(w, req) {
+			w.WriteHeader(http.StatusTeapot)
+		}
+		return w
+	}
+
+	// WebDAV clients are not gated.
+	if w := serve("PROPFIND", "/docs/", false, nil); w.Code != http.StatusTeapot {
+		t.Errorf("WebDAV client got %d", w.Code)
+	}
+	w := serve("GET", "/docs/", true, nil)
+	if w.Code != http.StatusForbidden || !strings.Contains(w.Body.String(), "Be nice &amp; &lt;careful&gt;.") ||
+		!strings.Contains(w.Body.String(), `action="/docs/?terms"`) {
+		t.Errorf("terms page: %d %s", w.Code, w.Body)
+	}
+	if w := serve("PUT", "/docs/a.txt", true, nil); w.Code != http.StatusForbidden {
+		t.Errorf("upload before accepting got %d", w.Code)
+	}
+
+	w = serve("POST", "/docs/?terms", true, nil)
+	if w.Code != http.StatusSeeOther || w.Header().Get("Location") != "/docs/" {
+		t.Errorf("accepting answered %d to %q", w.Code, w.Header().Get("Location"))
+	}
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != termsCookie || cookies[0].MaxAge != 0 || cookies[0].Expires.Unix() > 0 {
+		t.Fatalf("cookies %v, want one session cookie", cookies)
+	}
+	if w := serve("GET", "/docs/", true, cookies[0]); w.Code != http.StatusTeapot {
+		t.Errorf("after accepting got %d", w.Code)
+	}
+
+	// New terms need accepting again.
+	os.WriteFile(file, []byte("Be nicer."), 0644)
+	startTerms()
+	if w := serve("GET", "/docs/", true, cookies[0]); w.Code != http.StatusForbidden {
+		t.Errorf("changed terms not shown, got %d", w.Code)
+	}
+}
@@ -0,0 +1,329 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"image"
+	"image/color"
+	_ "image/gif"
+	"image/jpeg"
+	_ "image/png"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+	"golang.org/x/net/webdav"
+)
+
+var (
+	flagThumbs         = flag.Bool("thumbs", false, "show image thumbnails in listings, served at ?thumb=1")
+	flagThumbCacheDir  = flag.String("thumb-cache-dir", "", "directory to keep generated thumbnails in (default: user cache dir)")
+	flagThumbCacheSize = flag.Int64("thumb-cache-size", 256<<20, "evict the oldest thumbnails once the cache exceeds this many bytes")
+)
+
+const (
+	thumbSize      = 256
+	thumbMaxPixels = 50 << 20
+)
+
+var thumbExts = map[string]bool{".jpg": true, ".jpeg": true, ".png": true, ".gif": true}
+
+func isThumbable(name string) bool {
+	return thumbExts[strings.ToLower(path.Ext(name))]
+}
+
+// thumbCache stores generated thumbnails on disk, named after a hash of the
+// source path, size and mtime, and evicts the least recently used ones once
+// it grows past its limit.
+type thumbCache struct {
+	dir   string
+	limit int64
+
+	mu    sync.Mutex
+	total int64
+}
+
+var thumbs *thumbCache
+
+func startThumbs() error {
+	dir := *flagThumbCacheDir
+	if dir == "" {
+		base, err := os.UserCacheDir()
+		if err != nil {
+			return err
+		}
+		dir = filepath.Join(base, "gowebdav", "thumbs")
+	}
+	c, err := newThumbCache(dir, *flagThumbCacheSize)
+	if err != nil {
+		return err
+	}
+	thumbs = c
+	handleAdmin("thumbnails", c.serveAdmin)
+	handleAdmin("thumbnails/purge", c.servePurge)
+	registerJob("thumbnail-cleanup", func(ctx context.Context) error {
+		c.evict()
+		return nil
+	})
+	return nil
+}
+
+func newThumbCache(dir string, limit int64) (*thumbCache, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	c := &thumbCache{dir: dir, limit: limit}
+	files, err := c.files()
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range files {
+		c.total += f.size
+	}
+	return c, nil
+}
+
+type cachedThumb struct {
+	path    string
+	size    int64
+	modTime time.Time
+}
+
+func (c *thumbCache) files() ([]cachedThumb, error) {
+	var files []cachedThumb
+	err := filepath.WalkDir(c.dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() || !strings.HasSuffix(p, ".jpg") {
+			return nil
+		}
+		if fi, err := d.Info(); err == nil {
+			files = append(files, cachedThumb{p, fi.Size(), fi.ModTime()})
+		}
+		return nil
+	})
+	return files, err
+}
+
+func (c *thumbCache) key(name string, fi os.FileInfo) string {
+	h := sha256.Sum256([]byte(fmt.Sprintf("%s\x00%d\x00%d", name, fi.Size(), fi.ModTime().UnixNano())))
+	k := hex.EncodeToString(h[:])
+	return filepath.Join(c.dir, k[:2], k+".jpg")
+}
+
+// get returns the thumbnail of name, generating and caching it on a miss.
+func (c *thumbCache) get(fs webdav.FileSystem, req *http.Request, name string) ([]byte, error) {
+	fi, err := fs.Stat(req.Context(), name)
+	if err != nil {
+		return nil, err
+	}
+	p := c.key(name, fi)
+	if data, err := os.ReadFile(p); err == nil {
+		now := time.Now()
+		os.Chtimes(p, now, now)
+		return data, nil
+	}
+
+	f, err := fs.OpenFile(req.Context(), name, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	data, err := makeThumb(f, thumbSize)
+	if err != nil {
+		return nil, err
+	}
+	c.put(p, data)
+	return data, nil
+}
+
+func (c *thumbCache) put(p string, data []byte) {
+	if err := os.MkdirAll(filepath.Dir(p), 0700); err != nil {
+		return
+	}
+	if err := os.WriteFile(p, data, 0600); err != nil {
+		return
+	}
+	c.mu.Lock()
+	c.total += int64(len(data))
+	over := c.total > c.limit
+	c.mu.Unlock()
+	if over {
+		c.evict()
+	}
+}
+
+// evict removes the least recently used thumbnails until the cache is at
+// 90% of its limit, leaving room for new entries.
+func (c *thumbCache) evict() {
+	files, err := c.files()
+	if err != nil {
+		return
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].modTime.Before(files[j].modTime) })
+	var total int64
+	for _, f := range files {
+		total += f.size
+	}
+	target := c.limit / 10 * 9
+	for _, f := range files {
+		if total <= target {
+			break
+		}
+		if os.Remove(f.path) == nil {
+			total -= f.size
+		}
+	}
+	c.mu.Lock()
+	c.total = total
+	c.mu.Unlock()
+}
+
+// purge deletes every cached thumbnail.
+func (c *thumbCache) purge() (int, error) {
+	files, err := c.files()
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, f := range files {
+		if os.Remove(f.path) == nil {
+			n++
+		}
+	}
+	c.evict()
+	return n, nil
+}
+
+type thumbCacheStatus struct {
+	Dir   string `json:"dir"`
+	Files int    `json:"files"`
+	Bytes int64  `json:"bytes"`
+	Limit int64  `json:"limit"`
+}
+
+func (c *thumbCache) status() (thumbCacheStatus, error) {
+	files, err := c.files()
+	s := thumbCacheStatus{Dir: c.dir, Files: len(files), Limit: c.limit}
+	for _, f := range files {
+		s.Bytes += f.size
+	}
+	return s, err
+}
+
+func (c *thumbCache) serveAdmin(w http.ResponseWriter, req *http.Request) {
+	s, err := c.status()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, s)
+}
+
+func (c *thumbCache) servePurge(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	n, err := c.purge()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]int{"purged": n})
+}
+
+func handleThumb(fs webdav.FileSystem, w http.ResponseWriter, req *http.Request) {
+	if !isThumbable(req.URL.Path) {
+		http.Error(w, "WebDAV: no thumbnail for this file type", http.StatusBadRequest)
+		return
+	}
+	data, err := thumbs.get(fs, req, req.URL.Path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			http.Error(w, "Not Found", http.StatusNotFound)
+		} else {
+			http.Error(w, "WebDAV: cannot make thumbnail", http.StatusUnprocessableEntity)
+		}
+		return
+	}
+	w.Header().Set("Content-Type", "image/jpeg")
+	w.Header().Set("Cache-Control", "private, max-age=3600")
+	w.Write(data)
+}
+
+// makeThumb decodes an image and scales it to fit in a size×size box,
+// averaging the source pixels that fall into each thumbnail pixel.
+func makeThumb(r io.Reader, size int) ([]byte, error) {
+	var buf bytes.Buffer
+	cfg, _, err := image.DecodeConfig(io.TeeReader(r, &buf))
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Width*cfg.Height > thumbMaxPixels {
+		return nil, errors.New("image too large")
+	}
+	src, _, err := image.Decode(io.MultiReader(&buf, r))
+	if err != nil {
+		return nil, err
+	}
+
+	b := src.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if w == 0 || h == 0 {
+		return nil, errors.New("empty image")
+	}
+	tw, th := w, h
+	if w > size || h > size {
+		if w >= h {
+			tw, th = size, h*size/w
+		} else {
+			tw, th = w*size/h, size
+		}
+	}
+	if tw < 1 {
+		tw = 1
+	}
+	if th < 1 {
+		th = 1
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, tw, th))
+	for y := 0; y < th; y++ {
+		y0, y1 := b.Min.Y+y*h/th, b.Min.Y+(y+1)*h/th
+		if y1 == y0 {
+			y1++
+		}
+		for x := 0; x < tw; x++ {
+			x0, x1 := b.Min.X+x*w/tw, b.Min.X+(x+1)*w/tw
+			if x1 == x0 {
+				x1++
+			}
+			var r, g, bl, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					cr, cg, cb, ca := src.At(sx, sy).RGBA()
+					r, g, bl, a, n = r+uint64(cr), g+uint64(cg), bl+uint64(cb), a+uint64(ca), n+1
+				}
+			}
+			dst.Set(x, y, color.RGBA64{uint16(r / n), uint16(g / n), uint16(bl / n), uint16(a / n)})
+		}
+	}
+
+	var out bytes.Buffer
+	if err := jpeg.Encode(&out, dst, &jpeg.Options{Quality: 80}); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/net/webdav"
+)
+
+func testPNG(t *testing.T, w, h int) []byte {
+	t.Helper()
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			img.Set(x, y, color.RGBA{uint8(x), uint8(y), 128, 255})
+		}
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestMakeThumb(t *testing.T) {
+	tests := []struct {
+		name         string
+		w, h         int
+		wantW, wantH int
+		wantErr      bool
+		data         []byte
+	}{
+		{name: "landscape", w: 1000, h: 500, wantW: 256, wantH: 128},
+		{name: "portrait", w: 300, h: 600, wantW: 128, wantH: 256},
+		{name: "small kept", w: 40, h: 30, wantW: 40, wantH: 30},
+		{name: "thin", w: 2000, h: 1, wantW: 256, wantH: 1},
+		{name: "not an image", data: []byte("hello"), wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := tt.data
+			if data == nil {
+				data = testPNG(t, tt.w, tt.h)
+			}
+			out, err := makeThumb(bytes.NewReader(data), thumbSize)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			cfg, err := jpeg.DecodeConfig(bytes.NewReader(out))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cfg.Width != tt.wantW || cfg.Height != tt.wantH {
+				t.Errorf("thumb is %dx%d, want %dx%d", cfg.Width, cfg.Height, tt.wantW, tt.wantH)
+			}
+		})
+	}
+}
+
+func TestThumbCacheEviction(t *testing.T) {
+	c, err := newThumbCache(t.TempDir(), 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().Add(-time.Hour)
+	for i, name := range []string{"a", "b", "c", "d"} {
+		p := filepath.Join(c.dir, "00", name+".jpg")
+		c.put(p, make([]byte, 300))
+		mod := old.Add(time.Duration(i) * time.Minute)
+		os.Chtimes(p, mod, mod)
+	}
+	s, _ := c.status()
+	if s.Bytes > 1000 {
+		t.Errorf("cache holds %d bytes, over its limit", s.Bytes)
+	}
+	if _, err := os.Stat(filepath.Join(c.dir, "00", "a.jpg")); err == nil {
+		t.Error("oldest entry was not evicted")
+	}
+	if _, err := os.Stat(filepath.Join(c.dir, "00", "d.jpg")); err != nil {
+		t.Error("newest entry was evicted")
+	}
+
+	rec := httptest.NewRecorder()
+	c.servePurge(rec, httptest.NewRequest("POST", "/thumbnails/purge", nil))
+	if rec.Code != http.StatusOK {
+		t.Errorf("purge status = %d", rec.Code)
+	}
+	if s, _ := c.status(); s.Files != 0 || c.total != 0 {
+		t.Errorf("after purge: %d files, total %d", s.Files, c.total)
+	}
+}
+
+func TestHandleThumb(t *testing.T) {
+	root := t.TempDir()
+	os.WriteFile(filepath.Join(root, "pic.png"), testPNG(t, 600, 400), 0644)
+	os.WriteFile(filepath.Join(root, "bad.png"), []byte("nope"), 0644)
+	os.WriteFile(filepath.Join(root, "doc.txt"), []byte("text"), 0644)
+	defer func(c *thumbCache) { thumbs = c }(thumbs)
+	var err error
+	if thumbs, err = newThumbCache(t.TempDir(), 1<<20); err != nil {
+		t.Fatal(err)
+	}
+	fs := webdav.Dir(root)
+
+	tests := []struct {
+		name   string
+		path   string
+		status int
+	}{
+		{"image", "/pic.png", http.StatusOK},
+		{"cached image", "/pic.png", http.StatusOK},
+		{"broken image", "/bad.png", http.StatusUnprocessableEntity},
+		{"not an image", "/doc.txt", http.StatusBadRequest},
+		{"missing", "/gone.png", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			handleThumb(fs, rec, httptest.NewRequest("GET", tt.path+"?thumb=1", nil))
+			if rec.Code != tt.status {
+				t.Errorf("status = %d, want %d", rec.Code, tt.status)
+			}
+		})
+	}
+	if s, _ := thumbs.status(); s.Files != 1 {
+		t.Errorf("cache has %d files, want 1", s.Files)
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"time"
+
+	"golang.org/x/net/context"
+	"golang.org/x/net/webdav"
+)
+
+var (
+	flagOpTimeout       = flag.Duration("op-timeout", 0, "abort requests other than downloads and uploads after this long, e.g. 2m (0 for no limit)")
+	flagTransferTimeout = flag.Duration("transfer-timeout", 0, "abort GET, HEAD and PUT requests after this long (0 for no limit)")
+)
+
+// operationTimeout returns the time limit for a request with method, or 0.
+// Transfers get their own limit since their duration grows with file size
+// and the client's bandwidth.
+func operationTimeout(method string) time.Duration {
+	switch method {
+	case "GET", "HEAD", "PUT":
+		return *flagTransferTimeout
+	}
+	return *flagOpTimeout
+}
+
+// ctxFile stops reading, writing and listing once the context the file was
+// opened with is done, so work for a client that went away or ran out of
+// time ends at the next chunk instead of running to completion.
+type ctxFile struct {
+	webdav.File
+	ctx context.Context
+}
+
+func (f ctxFile) Read(p []byte) (int, error) {
+	if err := f.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return f.File.Read(p)
+}
+
+func (f ctxFile) Write(p []byte) (int, error) {
+	if err := f.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return f.File.Write(p)
+}
+
+func (f ctxFile) Readdir(count int) ([]os.FileInfo, error) {
+	if err := f.ctx.Err(); err != nil {
+		return nil, err
+	}
+	return f.File.Readdir(count)
+}
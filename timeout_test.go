@@ -0,0 +1,74 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+	"golang.org/x/net/webdav"
+)
+
+func TestOperationTimeout(t *testing.T) {
+	defer func(op, transfer time.Duration) { *flagOpTimeout, *flagTransferTimeout = op, transfer }(*flagOpTimeout, *flagTransferTimeout)
+	*flagOpTimeout, *flagTransferTimeout = time.Minute, time.Hour
+	tests := []struct {
+		method string
+		want   time.Duration
+	}{
+		{"GET", time.Hour},
+		{"HEAD", time.Hour},
+		{"PUT", time.Hour},
+		{"PROPFIND", time.Minute},
+		{"COPY", time.Minute},
+		{"DELETE", time.Minute},
+	}
+	for _, tt := range tests {
+		if got := operationTimeout(tt.method); got != tt.want {
+			t.Errorf("operationTimeout(%s) = %v, want %v", tt.method, got, tt.want)
+		}
+	}
+}
+
+func TestCtxFile(t *testing.T) {
+	root := t.TempDir()
+	os.WriteFile(filepath.Join(root, "big.bin"), make([]byte, 1<<20), 0644)
+	os.Mkdir(filepath.Join(root, "dir"), 0755)
+	fs := SkipBrokenLink{webdav.Dir(root)}
+
+	// Files are only wrapped when a time limit applies.
+	ctx, cancel := context.WithTimeout(context.Background(), time.Hour)
+	f, err := fs.OpenFile(ctx, "/big.bin", os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	buf := make([]byte, 4096)
+	if _, err := f.Read(buf); err != nil {
+		t.Fatalf("read before cancel: %v", err)
+	}
+	cancel()
+	if _, err := io.ReadAll(f); err != context.Canceled {
+		t.Errorf("read after cancel: %v, want context.Canceled", err)
+	}
+
+	d, err := fs.OpenFile(ctx, "/dir", os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	if _, err := d.Readdir(-1); err != context.Canceled {
+		t.Errorf("readdir after cancel: %v, want context.Canceled", err)
+	}
+
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/dir/", nil).WithContext(ctx)
+	if !handleDirList(fs, rec, req) || rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("listing with an expired context: %d %s", rec.Code, strings.TrimSpace(rec.Body.String()))
+	}
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"flag"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+	"golang.org/x/net/webdav"
+)
+
+var flagTreeWorkers = flag.Int("tree-workers", 8, "copy and delete the files of large folders on this many goroutines (1 to work sequentially)")
+
+// treePool runs the per-file work of a recursive COPY or DELETE on a fixed
+// number of goroutines. The first failure cancels the rest.
+type treePool struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	tasks  chan func(context.Context) error
+	wg     sync.WaitGroup
+
+	mu  sync.Mutex
+	err error
+}
+
+func newTreePool(ctx context.Context, workers int) *treePool {
+	if workers < 1 {
+		workers = 1
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	p := &treePool{ctx: ctx, cancel: cancel, tasks: make(chan func(context.Context) error)}
+	for i := 0; i < workers; i++ {
+		p.wg.Add(1)
+		go func() {
+			defer p.wg.Done()
+			for task := range p.tasks {
+				if err := task(ctx); err != nil {
+					p.fail(err)
+				}
+			}
+		}()
+	}
+	return p
+}
+
+func (p *treePool) fail(err error) {
+	p.mu.Lock()
+	if p.err == nil {
+		p.err = err
+	}
+	p.mu.Unlock()
+	p.cancel()
+}
+
+// submit queues task, or returns an error once the pool has failed.
+func (p *treePool) submit(task func(context.Context) error) error {
+	select {
+	case p.tasks <- task:
+		return nil
+	case <-p.ctx.Done():
+		return p.ctx.Err()
+	}
+}
+
+// wait lets the queued tasks finish and returns the first error.
+func (p *treePool) wait() error {
+	close(p.tasks)
+	p.wg.Wait()
+	p.cancel()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.err
+}
+
+// removeTree deletes p and everything below it. Files are removed by the
+// pool while the tree is walked; the then empty directories are removed
+// deepest first.
+func removeTree(ctx context.Context, p string, workers int) error {
+	fi, err := os.Lstat(p)
+	if err != nil || !fi.IsDir() || workers <= 1 {
+		return os.RemoveAll(p)
+	}
+	pool := newTreePool(ctx, workers)
+	dirs := []string{p}
+	for i := 0; i < len(dirs); i++ {
+		f, err := os.Open(dirs[i])
+		if err != nil {
+			pool.fail(err)
+			break
+		}
+		err = readdirBatches(f, func(fis []os.FileInfo) error {
+			for _, fi := range fis {
+				name := filepath.Join(dirs[i], fi.Name())
+				if fi.IsDir() {
+					dirs = append(dirs, name)
+					continue
+				}
+				err := pool.submit(func(ctx context.Context) error {
+					err := removeIfExists(name)
+					if err == nil {
+						progressFrom(ctx).add(1, 0)
+					}
+					return err
+				})
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		f.Close()
+		if err != nil {
+			pool.fail(err)
+			break
+		}
+	}
+	if err := pool.wait(); err != nil {
+		return err
+	}
+	for i := len(dirs) - 1; i > 0; i-- {
+		if err := removeIfExists(dirs[i]); err != nil {
+			return err
+		}
+	}
+	// Catches anything created while the tree was being removed.
+	return os.RemoveAll(p)
+}
+
+func removeIfExists(name string) error {
+	if err := os.Remove(name); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (d SkipBrokenLink) RemoveAll(ctx context.Context, name string) error {
+	name = path.Clean("/" + name)
+	if name == "/" {
+		// Like webdav.Dir, refuse to remove the root.
+		return os.ErrInvalid
+	}
+	defer fileHashes.forget(name)
+	dir := string(d.Dir)
+	if dir == "" {
+		dir = "."
+	}
+	return removeTree(ctx, filepath.Join(dir, filepath.FromSlash(name)), *flagTreeWorkers)
+}
+
+// copyTree copies the directory src to dst, which must not exist yet. The
+// walk creates the directories in order and hands the files to the pool.
+func copyTree(ctx context.Context, fs webdav.FileSystem, src, dst string, workers int) error {
+	fi, err := fs.Stat(ctx, src)
+	if err != nil {
+		return err
+	}
+	if err := fs.Mkdir(ctx, dst, fi.Mode()&os.ModePerm); err != nil {
+		return err
+	}
+	pool := newTreePool(ctx, workers)
+	dirs := []string{""}
+	for i := 0; i < len(dirs); i++ {
+		f, err := fs.OpenFile(pool.ctx, path.Join(src, dirs[i]), os.O_RDONLY, 0)
+		if err != nil {
+			pool.fail(err)
+			break
+		}
+		err = readdirBatches(f, func(fis []os.FileInfo) error {
+			for _, fi := range fis {
+				rel := path.Join(dirs[i], fi.Name())
+				if fi.Mode()&os.ModeSymlink != 0 {
+					// Links are copied as what they point to, as
+					// webdav.Handler does; broken ones are skipped.
+					target, err := fs.Stat(pool.ctx, path.Join(src, rel))
+					if err != nil {
+						continue
+					}
+					fi = target
+				}
+				if fi.IsDir() {
+					if err := fs.Mkdir(pool.ctx, path.Join(dst, rel), fi.Mode()&os.ModePerm); err != nil {
+						return err
+					}
+					dirs = append(dirs, rel)
+					continue
+				}
+				perm := fi.Mode() & os.ModePerm
+				err := pool.submit(func(ctx context.Context) error {
+					return copyTreeFile(ctx, fs, path.Join(src, rel), path.Join(dst, rel), perm)
+				})
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		f.Close()
+		if err != nil {
+			pool.fail(err)
+			break
+		}
+	}
+	return pool.wait()
+}
+
+func copyTreeFile(ctx context.Context, fs webdav.FileSystem, src, dst string, perm os.FileMode) error {
+	in, err := fs.OpenFile(ctx, src, os.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := fs.OpenFile(ctx, dst, os.O_RDWR|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	n, err := io.Copy(out, in)
+	if err != nil {
+		out.Close()
+		return err
+	}
+	progressFrom(ctx).add(1, n)
+	return out.Close()
+}
+
+// handleTreeCopy serves a Depth: infinity COPY of a directory with copyTree.
+// Requests that carry lock tokens, and copies of single files, are left to
+// h, which reports them as not handled.
+func handleTreeCopy(h *webdav.Handler, w http.ResponseWriter, req *http.Request) bool {
+	if req.Method != "COPY" || *flagTreeWorkers <= 1 || req.Header.Get("If") != "" {
+		return false
+	}
+	if depth := req.Header.Get("Depth"); depth != "" && strings.ToLower(depth) != "infinity" {
+		return false
+	}
+	u, err := url.Parse(req.Header.Get("Destination"))
+	if err != nil || u.Path == "" || u.Host != "" && u.Host != req.Host {
+		return false
+	}
+	ctx := req.Context()
+	src, dst := path.Clean("/"+req.URL.Path), path.Clean("/"+u.Path)
+	if fi, err := h.FileSystem.Stat(ctx, src); err != nil || !fi.IsDir() || src == dst {
+		return false
+	}
+
+	status := func() int {
+		if dst == "/" || strings.HasPrefix(dst+"/", src+"/") {
+			// Copying a folder into itself would never end.
+			return http.StatusForbidden
+		}
+		// Like webdav.Handler, lock the destination for the duration of
+		// the copy so it cannot be changed under us.
+		now := time.Now()
+		token, err := h.LockSystem.Create(now, webdav.LockDetails{Root: dst, Duration: -1, ZeroDepth: true})
+		if err == webdav.ErrLocked {
+			return webdav.StatusLocked
+		} else if err != nil {
+			return http.StatusInternalServerError
+		}
+		defer h.LockSystem.Unlock(now, token)
+
+		status := http.StatusCreated
+		if _, err := h.FileSystem.Stat(ctx, dst); err == nil {
+			if req.Header.Get("Overwrite") == "F" {
+				return http.StatusPreconditionFailed
+			}
+			if err := h.FileSystem.RemoveAll(ctx, dst); err != nil && !os.IsNotExist(err) {
+				return http.StatusForbidden
+			}
+			status = http.StatusNoContent
+		}
+		if _, err := h.FileSystem.Stat(ctx, path.Dir(dst)); err != nil {
+			return http.StatusConflict
+		}
+		if err := copyTree(ctx, h.FileSystem, src, dst, *flagTreeWorkers); err != nil {
+			return http.StatusInternalServerError
+		}
+		return status
+	}()
+	w.WriteHeader(status)
+	if status != http.StatusNoContent {
+		w.Write([]byte(webdav.StatusText(status)))
+	}
+	return true
+}
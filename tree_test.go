@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+	"golang.org/x/net/webdav"
+)
+
+// makeTree creates a few levels of folders with files in each.
+func makeTree(t *testing.T, root string) int {
+	t.Helper()
+	n := 0
+	for _, dir := range []string{"", "a", "a/b", "a/b/c", "d"} {
+		os.MkdirAll(filepath.Join(root, dir), 0755)
+		for i := 0; i < 20; i++ {
+			os.WriteFile(filepath.Join(root, dir, fmt.Sprintf("f%d.txt", i)), []byte(dir+fmt.Sprint(i)), 0644)
+			n++
+		}
+	}
+	return n
+}
+
+func countFiles(t *testing.T, root string) int {
+	t.Helper()
+	n := 0
+	filepath.Walk(root, func(p string, fi os.FileInfo, err error) error {
+		if err == nil && !fi.IsDir() {
+			n++
+		}
+		return nil
+	})
+	return n
+}
+
+func TestRemoveTree(t *testing.T) {
+	root := t.TempDir()
+	makeTree(t, filepath.Join(root, "tree"))
+	if err := removeTree(context.Background(), filepath.Join(root, "tree"), 4); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Lstat(filepath.Join(root, "tree")); !os.IsNotExist(err) {
+		t.Errorf("tree still exists: %v", err)
+	}
+	if err := (SkipBrokenLink{webdav.Dir(root)}).RemoveAll(context.Background(), "/"); err != os.ErrInvalid {
+		t.Errorf("removing the root: %v, want os.ErrInvalid", err)
+	}
+}
+
+func TestHandleTreeCopy(t *testing.T) {
+	root := t.TempDir()
+	n := makeTree(t, filepath.Join(root, "src"))
+	os.Mkdir(filepath.Join(root, "existing"), 0755)
+	os.Symlink(filepath.Join(root, "missing"), filepath.Join(root, "src", "broken"))
+	h := &webdav.Handler{FileSystem: SkipBrokenLink{webdav.Dir(root)}, LockSystem: webdav.NewMemLS()}
+	locked, err := h.LockSystem.Create(time.Now(), webdav.LockDetails{Root: "/locked", Duration: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.LockSystem.Unlock(time.Now(), locked)
+
+	tests := []struct {
+		name      string
+		src, dst  string
+		overwrite string
+		status    int
+	}{
+		{"new", "/src", "/copy", "", http.StatusCreated},
+		{"overwrite", "/src", "/existing", "", http.StatusNoContent},
+		{"no overwrite", "/src", "/copy", "F", http.StatusPreconditionFailed},
+		{"into itself", "/src", "/src/a/inner", "", http.StatusForbidden},
+		{"missing parent", "/src", "/nowhere/copy", "", http.StatusConflict},
+		{"locked", "/src", "/locked", "", webdav.StatusLocked},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("COPY", tt.src, nil)
+			req.Header.Set("Destination", "http://example.com"+tt.dst)
+			if tt.overwrite != "" {
+				req.Header.Set("Overwrite", tt.overwrite)
+			}
+			rec := httptest.NewRecorder()
+			if !handleTreeCopy(h, rec, req) {
+				t.Fatal("not handled")
+			}
+			if rec.Code != tt.status {
+				t.Errorf("status = %d, want %d", rec.Code, tt.status)
+			}
+		})
+	}
+	for _, dst := range []string{"copy", "existing"} {
+		if got := countFiles(t, filepath.Join(root, dst)); got != n {
+			t.Errorf("%s has %d files, want %d", dst, got, n)
+		}
+	}
+	if data, _ := os.ReadFile(filepath.Join(root, "copy", "a", "b", "c", "f3.txt")); string(data) != "a/b/c3" {
+		t.Errorf("copied file holds %q", data)
+	}
+
+	req := httptest.NewRequest("COPY", "/src/f1.txt", nil)
+	req.Header.Set("Destination", "/f1.txt")
+	if handleTreeCopy(h, httptest.NewRecorder(), req) {
+		t.Error("copy of a single file was handled")
+	}
+}
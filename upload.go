@@ -0,0 +1,122 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"os"
+
+	"golang.org/x/net/context"
+	"golang.org/x/net/webdav"
+)
+
+var errQuotaExceeded = errors.New("quota exceeded")
+
+// checkQuota refuses storing size bytes at name when that would take usage
+// past -quota. Whatever name holds now is replaced, so does not count.
+func checkQuota(ctx context.Context, fs webdav.FileSystem, name string, size int64) error {
+	if quota == nil {
+		return nil
+	}
+	used, ok := dirSize("/")
+	if !ok {
+		return nil
+	}
+	quota.update(used)
+	if size < 0 {
+		size = 0
+	}
+	if fi, err := fs.Stat(ctx, name); err == nil && !fi.IsDir() {
+		size -= fi.Size()
+	}
+	if used+size > quota.limit {
+		return errQuotaExceeded
+	}
+	return nil
+}
+
+// quotaFS stops writes through the file system from taking usage past
+// -quota, so uploads over FTP, SFTP and S3, and PUTs of unknown length,
+// cannot exceed it either.
+type quotaFS struct {
+	webdav.FileSystem
+}
+
+func (fs quotaFS) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	// PROPPATCH opens its target O_RDWR and writes nothing but properties,
+	// which a wrapper would hide.
+	if flag&(os.O_WRONLY|os.O_RDWR) == 0 || flag == os.O_RDWR {
+		return fs.FileSystem.OpenFile(ctx, name, flag, perm)
+	}
+	used, ok := dirSize("/")
+	var size int64
+	if fi, err := fs.FileSystem.Stat(ctx, name); err == nil && !fi.IsDir() {
+		size = fi.Size()
+	}
+	f, err := fs.FileSystem.OpenFile(ctx, name, flag, perm)
+	if err != nil || !ok {
+		return f, err
+	}
+	if flag&os.O_TRUNC != 0 {
+		used -= size
+		size = 0
+	}
+	return &quotaFile{File: f, size: size, max: size + quota.limit - used, appending: flag&os.O_APPEND != 0}, nil
+}
+
+// quotaFile fails writes that would grow the file past max bytes.
+type quotaFile struct {
+	webdav.File
+	pos, size, max int64
+	appending      bool
+}
+
+func (f *quotaFile) Seek(offset int64, whence int) (int64, error) {
+	pos, err := f.File.Seek(offset, whence)
+	if err == nil {
+		f.pos = pos
+	}
+	return pos, err
+}
+
+func (f *quotaFile) Write(p []byte) (int, error) {
+	if f.appending {
+		f.pos = f.size
+	}
+	if end := f.pos + int64(len(p)); end > f.size && end > f.max {
+		return 0, errQuotaExceeded
+	}
+	n, err := f.File.Write(p)
+	if f.pos += int64(n); f.pos > f.size {
+		f.size = f.pos
+	}
+	return n, err
+}
+
+// virusError rejects an upload clamd found a virus in.
+type virusError struct {
+	virus string
+}
+
+func (e *virusError) Error() string { return "virus " + e.virus + " found" }
+
+// finishUpload puts a file uploaded to name other than by PUT through what
+// a PUT goes through: the -clamd scan, with its action, and the upload
+// notification. It returns a *virusError when the scan rejected the file.
+func finishUpload(fs webdav.FileSystem, name, user, client string) error {
+	if *flagClamd != "" {
+		if *flagClamdMode == "async" {
+			go func() {
+				if _, err := scanUpload(fs, name, user); err != nil {
+					log.Printf("Failed to scan upload %s: %v", name, err)
+				}
+			}()
+		} else if virus, err := scanUpload(fs, name, user); err != nil {
+			// Fail open, as for PUT.
+			log.Printf("Failed to scan upload %s: %v", name, err)
+		} else if virus != "" && *flagClamdAction != "alert" {
+			return &virusError{virus}
+		}
+	}
+	notifyUpload(name, user, client)
+	return nil
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/net/webdav"
+)
+
+func TestFinishUpload(t *testing.T) {
+	sock := fakeClamd(t, "")
+	defer func(clamd, mode, action string) {
+		*flagClamd, *flagClamdMode, *flagClamdAction = clamd, mode, action
+	}(*flagClamd, *flagClamdMode, *flagClamdAction)
+	*flagClamd, *flagClamdMode = sock, "inline"
+	f := &fakeNotifier{}
+	withNotifier(t, f)
+	root := t.TempDir()
+	fs := webdav.Dir(root)
+
+	tests := []struct {
+		name, action, data string
+		rejected           bool
+	}{
+		{"clean.txt", "reject", "hello", false},
+		{"virus.txt", "reject", "EICAR", true},
+		{"alerted.txt", "alert", "EICAR", false},
+	}
+	for _, tt := range tests {
+		*flagClamdAction = tt.action
+		os.WriteFile(filepath.Join(root, tt.name), []byte(tt.data), 0644)
+		err := finishUpload(fs, "/"+tt.name, "scanner", "192.0.2.1")
+		var virus *virusError
+		if errors.As(err, &virus) != tt.rejected {
+			t.Errorf("%s: finishUpload = %v", tt.name, err)
+		}
+		if _, err := os.Stat(filepath.Join(root, tt.name)); (err == nil) == tt.rejected {
+			t.Errorf("%s: kept = %v", tt.name, err == nil)
+		}
+	}
+	flushNotifications()
+	var notified []string
+	for _, b := range f.batches {
+		for _, ev := range b {
+			notified = append(notified, ev.Path)
+		}
+	}
+	if len(notified) != 2 || notified[0] != "/clean.txt" || notified[1] != "/alerted.txt" {
+		t.Errorf("notified %v", notified)
+	}
+}
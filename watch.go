@@ -0,0 +1,131 @@
+package main
+
+import (
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// treeEvent is a change below the root dir. Path is slash-separated and
+// rooted at "/", like WebDAV request paths.
+type treeEvent struct {
+	Path string
+	Op   fsnotify.Op
+}
+
+// treeWatcher watches a whole directory tree with fsnotify, which only
+// watches single directories, by adding every directory as it appears.
+type treeWatcher struct {
+	root    string
+	watcher *fsnotify.Watcher
+
+	mu   sync.Mutex
+	subs []func(treeEvent)
+}
+
+var (
+	rootWatcher     *treeWatcher
+	rootWatcherErr  error
+	rootWatcherOnce sync.Once
+)
+
+// watchRoot returns the process-wide watcher of the -dir tree, starting it
+// on first use.
+func watchRoot() (*treeWatcher, error) {
+	rootWatcherOnce.Do(func() {
+		rootWatcher, rootWatcherErr = newTreeWatcher(*flagRootDir)
+	})
+	return rootWatcher, rootWatcherErr
+}
+
+func newTreeWatcher(root string) (*treeWatcher, error) {
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	t := &treeWatcher{root: root, watcher: w}
+	if err := t.addTree(root, false); err != nil {
+		w.Close()
+		return nil, err
+	}
+	go t.run()
+	return t, nil
+}
+
+// subscribe registers f to be called, from the watcher goroutine, for every
+// change in the tree.
+func (t *treeWatcher) subscribe(f func(treeEvent)) {
+	t.mu.Lock()
+	t.subs = append(t.subs, f)
+	t.mu.Unlock()
+}
+
+func (t *treeWatcher) Close() error {
+	return t.watcher.Close()
+}
+
+// addTree watches dir and every directory below it. With emit set, files and
+// directories found are reported as created, since they may have appeared
+// before the watch was in place.
+func (t *treeWatcher) addTree(dir string, emit bool) error {
+	return filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if p == dir {
+				return err
+			}
+			return nil
+		}
+		if d.IsDir() {
+			if err := t.watcher.Add(p); err != nil {
+				log.Printf("Failed to watch %s: %v", p, err)
+			}
+		}
+		if emit && p != dir {
+			t.emit(treeEvent{Path: t.rel(p), Op: fsnotify.Create})
+		}
+		return nil
+	})
+}
+
+func (t *treeWatcher) run() {
+	for {
+		select {
+		case ev, ok := <-t.watcher.Events:
+			if !ok {
+				return
+			}
+			if ev.Has(fsnotify.Create) {
+				if fi, err := os.Stat(ev.Name); err == nil && fi.IsDir() {
+					t.addTree(ev.Name, true)
+				}
+			}
+			t.emit(treeEvent{Path: t.rel(ev.Name), Op: ev.Op})
+		case err, ok := <-t.watcher.Errors:
+			if !ok {
+				return
+			}
+			log.Printf("Watcher: %v", err)
+		}
+	}
+}
+
+func (t *treeWatcher) emit(ev treeEvent) {
+	t.mu.Lock()
+	subs := t.subs
+	t.mu.Unlock()
+	for _, f := range subs {
+		f(ev)
+	}
+}
+
+func (t *treeWatcher) rel(p string) string {
+	rel, err := filepath.Rel(t.root, p)
+	if err != nil || rel == "." {
+		return "/"
+	}
+	return "/" + filepath.ToSlash(rel)
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+func TestTreeWatcher(t *testing.T) {
+	root := t.TempDir()
+	if err := os.Mkdir(filepath.Join(root, "existing"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	w, err := newTreeWatcher(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	events := make(chan treeEvent, 100)
+	w.subscribe(func(ev treeEvent) { events <- ev })
+
+	expect := func(path string, op fsnotify.Op) {
+		t.Helper()
+		timeout := time.After(5 * time.Second)
+		for {
+			select {
+			case ev := <-events:
+				if ev.Path == path && ev.Op.Has(op) {
+					return
+				}
+			case <-timeout:
+				t.Fatalf("no %v event for %s", op, path)
+			}
+		}
+	}
+
+	tests := []struct {
+		name   string
+		action func() error
+		path   string
+		op     fsnotify.Op
+	}{
+		{"file in root", func() error { return os.WriteFile(filepath.Join(root, "a.txt"), []byte("x"), 0644) }, "/a.txt", fsnotify.Create},
+		{"file in existing dir", func() error { return os.WriteFile(filepath.Join(root, "existing", "b.txt"), []byte("x"), 0644) }, "/existing/b.txt", fsnotify.Create},
+		{"new nested dirs", func() error { return os.MkdirAll(filepath.Join(root, "new", "deep"), 0755) }, "/new/deep", fsnotify.Create},
+		{"file in new dir", func() error { return os.WriteFile(filepath.Join(root, "new", "deep", "c.txt"), []byte("x"), 0644) }, "/new/deep/c.txt", fsnotify.Create},
+		{"remove", func() error { return os.Remove(filepath.Join(root, "a.txt")) }, "/a.txt", fsnotify.Remove},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.action(); err != nil {
+				t.Fatal(err)
+			}
+			expect(tt.path, tt.op)
+		})
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"flag"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+
+	"golang.org/x/net/context"
+	"golang.org/x/net/webdav"
+)
+
+var (
+	flagWORMPaths = flag.String("worm-paths", "", "comma-separated folders where files may be created but never overwritten, deleted or renamed (write once, read many), e.g. /archive; empty files too, unless -worm-allow-empty")
+	flagWORMEmpty = flag.Bool("worm-allow-empty", false, "let empty files in -worm-paths folders be written over once, for clients such as the macOS Finder that create a file before uploading its contents")
+)
+
+// wormPaths lists the write-once folders.
+var wormPaths []string
+
+func startWORM() {
+	wormPaths = parseFolders(*flagWORMPaths)
+}
+
+// parseFolders splits a comma-separated list of folders.
+func parseFolders(list string) []string {
+	var dirs []string
+	for _, dir := range strings.Split(list, ",") {
+		if dir = strings.TrimSpace(dir); dir != "" {
+			dirs = append(dirs, path.Clean("/"+dir))
+		}
+	}
+	return dirs
+}
+
+// inFolders reports whether name lies in one of dirs.
+func inFolders(name string, dirs []string) bool {
+	for _, dir := range dirs {
+		if name != dir && inScope(name, dir) {
+			return true
+		}
+	}
+	return false
+}
+
+// holdsFolders reports whether name is one of dirs or a folder above one,
+// whose removal would take the files in it along.
+func holdsFolders(name string, dirs []string) bool {
+	for _, dir := range dirs {
+		if inScope(dir, name) {
+			return true
+		}
+	}
+	return false
+}
+
+func permissionError(op, name string) error {
+	return &os.PathError{Op: op, Path: name, Err: os.ErrPermission}
+}
+
+// wormRemove refuses removing name, or moving it away.
+func wormRemove(name string) error {
+	name = path.Clean("/" + name)
+	if inFolders(name, wormPaths) || holdsFolders(name, wormPaths) {
+		return permissionError("remove", name)
+	}
+	return nil
+}
+
+// wormReplace refuses writing over name, which may be a file in a
+// write-once folder or, on COPY and MOVE, a folder holding one. With
+// -worm-allow-empty, empty files can be replaced.
+func wormReplace(ctx context.Context, fs webdav.FileSystem, name string) error {
+	name = path.Clean("/" + name)
+	if !inFolders(name, wormPaths) && !holdsFolders(name, wormPaths) {
+		return nil
+	}
+	if fi, err := fs.Stat(ctx, name); err == nil && (fi.IsDir() || fi.Size() > 0 || !*flagWORMEmpty) {
+		return permissionError("write", name)
+	}
+	return nil
+}
+
+// wormFS enforces -worm-paths on every change made through the file
+// system, so FTP, SFTP and server-side copies obey it too.
+type wormFS struct {
+	webdav.FileSystem
+}
+
+func (fs wormFS) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	if flag&(os.O_WRONLY|os.O_RDWR) != 0 && inFolders(path.Clean("/"+name), wormPaths) {
+		if _, err := fs.FileSystem.Stat(ctx, name); err == nil {
+			if err := wormReplace(ctx, fs.FileSystem, name); err != nil {
+				return nil, err
+			}
+		} else if flag&os.O_CREATE != 0 {
+			// Of two uploads racing to create the file, only one wins.
+			flag |= os.O_EXCL
+		}
+	}
+	return fs.FileSystem.OpenFile(ctx, name, flag, perm)
+}
+
+func (fs wormFS) RemoveAll(ctx context.Context, name string) error {
+	if err := wormRemove(name); err != nil {
+		return err
+	}
+	return fs.FileSystem.RemoveAll(ctx, name)
+}
+
+func (fs wormFS) Rename(ctx context.Context, oldName, newName string) error {
+	if err := wormRemove(oldName); err != nil {
+		return err
+	}
+	if err := wormReplace(ctx, fs.FileSystem, newName); err != nil {
+		return err
+	}
+	return fs.FileSystem.Rename(ctx, oldName, newName)
+}
+
+// refuseWORM answers 403 to WebDAV requests that would overwrite, delete or
+// move files in a write-once folder. webdav.Handler would fail them too, by
+// way of wormFS, but with less fitting status codes.
+func refuseWORM(fs webdav.FileSystem, w http.ResponseWriter, req *http.Request) bool {
+	if wormPaths == nil {
+		return false
+	}
+	ctx := req.Context()
+	var err error
+	switch req.Method {
+	case "PUT":
+		err = wormReplace(ctx, fs, req.URL.Path)
+	case "DELETE":
+		err = wormRemove(req.URL.Path)
+	case "MOVE", "COPY":
+		if req.Method == "MOVE" {
+			err = wormRemove(req.URL.Path)
+		}
+		if u, perr := url.Parse(req.Header.Get("Destination")); err == nil && perr == nil && u.Path != "" {
+			err = wormReplace(ctx, fs, u.Path)
+		}
+	}
+	if err == nil {
+		return false
+	}
+	http.Error(w, "WebDAV: files in write-once folders may not be overwritten, deleted or moved", http.StatusForbidden)
+	return true
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/context"
+	"golang.org/x/net/webdav"
+)
+
+func TestWORM(t *testing.T) {
+	root := t.TempDir()
+	os.MkdirAll(filepath.Join(root, "archive", "2026"), 0755)
+	os.WriteFile(filepath.Join(root, "draft.txt"), []byte("draft"), 0644)
+	*flagWORMPaths = "/archive/"
+	defer func() { *flagWORMPaths, wormPaths = "", nil }()
+	startWORM()
+
+	fs := wormFS{webdav.Dir(root)}
+	h := &webdav.Handler{FileSystem: fs, LockSystem: webdav.NewMemLS()}
+	do := func(method, target, dest, body string) int {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		if dest != "" {
+			req.Header.Set("Destination", dest)
+		}
+		w := httptest.NewRecorder()
+		if !refuseWORM(fs, w, req) {
+			h.ServeHTTP(w, req)
+		}
+		return w.Code
+	}
+	for _, tt := range []struct {
+		method, target, dest string
+		want                 int
+	}{
+		{"PUT", "/archive/2026/a.log", "", http.StatusCreated},
+		{"PUT", "/archive/2026/a.log", "", http.StatusForbidden},
+		{"DELETE", "/archive/2026/a.log", "", http.StatusForbidden},
+		{"DELETE", "/archive/2026", "", http.StatusForbidden},
+		{"DELETE", "/archive", "", http.StatusForbidden},
+		{"DELETE", "/", "", http.StatusForbidden},
+		{"MOVE", "/archive/2026/a.log", "/a.log", http.StatusForbidden},
+		{"COPY", "/draft.txt", "/archive/2026/a.log", http.StatusForbidden},
+		{"COPY", "/archive/2026/a.log", "/copy.log", http.StatusCreated},
+		{"COPY", "/draft.txt", "/archive/2026/draft.txt", http.StatusCreated},
+		{"MOVE", "/copy.log", "/archive/copy.log", http.StatusCreated},
+		{"MKCOL", "/archive/2027", "", http.StatusCreated},
+		// Outside the archive everything goes.
+		{"PUT", "/draft.txt", "", http.StatusCreated},
+		{"DELETE", "/draft.txt", "", http.StatusNoContent},
+		// An empty file, as left by a client locking a new name, is
+		// written once too.
+		{"PUT", "/archive/2026/b.log", "", http.StatusForbidden},
+	} {
+		body := "entry"
+		if tt.method != "PUT" {
+			body = ""
+		}
+		if tt.target == "/archive/2026/b.log" {
+			os.WriteFile(filepath.Join(root, "archive", "2026", "b.log"), nil, 0644)
+		}
+		if got := do(tt.method, tt.target, tt.dest, body); got != tt.want {
+			t.Errorf("%s %s %s answered %d, want %d", tt.method, tt.target, tt.dest, got, tt.want)
+		}
+	}
+
+	// Unless it may get its contents afterwards.
+	*flagWORMEmpty = true
+	defer func() { *flagWORMEmpty = false }()
+	if got := do("PUT", "/archive/2026/b.log", "", "entry"); got != http.StatusCreated {
+		t.Errorf("PUT over an empty file with -worm-allow-empty answered %d", got)
+	}
+	if got := do("PUT", "/archive/2026/b.log", "", "again"); got != http.StatusForbidden {
+		t.Errorf("second PUT with -worm-allow-empty answered %d", got)
+	}
+
+	// Other protocols go through the file system, which refuses too.
+	ctx := context.Background()
+	if _, err := fs.OpenFile(ctx, "/archive/2026/a.log", os.O_WRONLY|os.O_APPEND, 0); !os.IsPermission(err) {
+		t.Errorf("appending answered %v", err)
+	}
+	if err := fs.Rename(ctx, "/archive/2026", "/old"); !os.IsPermission(err) {
+		t.Errorf("renaming the folder answered %v", err)
+	}
+	if f, err := fs.OpenFile(ctx, "/archive/2026/c.log", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644); err != nil {
+		t.Errorf("creating a file answered %v", err)
+	} else {
+		f.Close()
+	}
+	if data, _ := os.ReadFile(filepath.Join(root, "archive", "2026", "a.log")); string(data) != "entry" {
+		t.Errorf("archived file holds %q", data)
+	}
+}
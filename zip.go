@@ -0,0 +1,58 @@
+package main
+
+import (
+	"archive/zip"
+	"flag"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+
+	"golang.org/x/net/context"
+	"golang.org/x/net/webdav"
+)
+
+var flagZip = flag.Bool("zip", false, "allow downloading folders as zip archives at ?zip=1")
+
+// handleZip sends the files below dir as a zip archive. Building one for a
+// huge folder takes a while, so it runs as a queued task.
+func handleZip(fs webdav.FileSystem, w http.ResponseWriter, req *http.Request, dir string) {
+	name := path.Base(strings.TrimSuffix(dir, "/"))
+	if name == "/" || name == "." {
+		name = "files"
+	}
+	serveTaskOutput(w, req, "zip", name+".zip", "application/zip", func(ctx context.Context, w io.Writer) error {
+		return writeZip(ctx, fs, dir, w)
+	})
+}
+
+func writeZip(ctx context.Context, fs webdav.FileSystem, dir string, w io.Writer) error {
+	zw := zip.NewWriter(w)
+	err := walkFiles(ctx, fs, dir, func(name string, fi os.FileInfo) error {
+		if !fi.Mode().IsRegular() {
+			return nil
+		}
+		hdr, err := zip.FileInfoHeader(fi)
+		if err != nil {
+			return err
+		}
+		hdr.Name = strings.TrimPrefix(name, strings.TrimSuffix(dir, "/")+"/")
+		hdr.Method = zip.Deflate
+		zf, err := zw.CreateHeader(hdr)
+		if err != nil {
+			return err
+		}
+		f, err := fs.OpenFile(ctx, name, os.O_RDONLY, 0)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(zf, f)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return zw.Close()
+}